@@ -336,26 +336,22 @@ func SecurePath(c *fiber.Ctx, redis *redis.Client) (*model.UserProfile, error) {
 		c.SendStatus(responseStatus)
 		return nil, errors.New("unauthorized: You are not allowed to access this resource")
 	}
-	client := []byte(redis.Get(ctx, authHeader).Val())
-	if client == nil {
+	session, err := SessionFromAccessToken(redis, authHeader)
+	if err != nil {
 		isLogout := c.Locals("isLogout")
 		if isLogout != nil && isLogout.(bool) {
 			c.SendStatus(fiber.StatusOK)
 			return nil, errors.New("already logged out")
 		}
 		c.SendStatus(responseStatus)
-		return nil, errors.New("token not found or expired")
-	}
-	var logger model.UserProfile
-	err := json.Unmarshal(client, &logger)
-	if err != nil {
-		c.SendStatus(responseStatus)
-		// fmt.Println("authentication failed, invalid token: ", err.Error(), "Data:", client)
-		return nil, errors.New("authentication failed, invalid token")
+		if !errors.Is(err, ErrSessionNotFound) {
+			return nil, errors.New("authentication failed, invalid token")
+		}
+		return nil, err
 	}
-
-	redis.Expire(ctx, authHeader, time.Duration(SessionExpirationTime*time.Minute))
+	logger := session.User
 	logger.AccessToken = authHeader
+	logger.SessionId = session.Id
 	return &logger, nil
 }
 
@@ -565,17 +561,14 @@ func ValidateAirtelPhone(phoneNumber string, redis redis.Client) (string, error)
 	}
 }
 
-// send sms, return message_id on success and error if any
-func SendSMS(DB *pgxpool.Pool, phoneNumber string, message string, senderName string, serviceName string, messageType string, customerId *int, redis *redis.Client) (string, error) {
+// sendSMSRequest send the sms through the sms service api, return message_id on success and error if any
+func sendSMSRequest(url string, timeout time.Duration, phoneNumber string, message string, senderName string, serviceName string) (string, error) {
 	//skip this if it is test
 	if IsTestMode {
 		return "TEST_SMS_ID", nil
 	}
 	fmt.Println("sending sms to ", phoneNumber)
-	networkOperator := "MTN"
-	if strings.HasPrefix(phoneNumber, "073") || strings.HasPrefix(phoneNumber, "072") {
-		networkOperator = "AIRTEL"
-	}
+	networkOperator := SMSOperator(phoneNumber)
 	payload := map[string]interface{}{
 		"sender_id":        senderName,
 		"phone":            phoneNumber,
@@ -584,57 +577,38 @@ func SendSMS(DB *pgxpool.Pool, phoneNumber string, message string, senderName st
 	}
 	jsonData, _ := json.Marshal(payload)
 	//send http json request
-	request, err := http.NewRequest("POST", viper.GetString("sms_service_url"), bytes.NewBuffer(jsonData))
+	request, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return "", err
 	}
 	request.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
+	client := &http.Client{Timeout: timeout}
 	resp, err := client.Do(request)
-	error_message := ""
 	if err != nil {
-		error_message = err.Error()
-	}
-	if resp == nil {
-		fmt.Println("failed to send sms, no response, err:", error_message, "body:", string(jsonData))
-		LogMessage("critical", "SendSMS: ailed to send sms, no response", serviceName)
-		return "", errors.New("failed to send sms, no response")
+		return "", errors.New("failed to send sms, err: " + err.Error())
 	}
+	defer resp.Body.Close()
 	// Read the response body
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		error_message = err.Error()
+		return "", errors.New("failed to send sms, err: " + err.Error())
 	}
 	var result map[string]interface{}
 	err = json.Unmarshal(body, &result)
 	if err != nil {
-		error_message = err.Error()
+		LogMessage("critical", "SendSMS: failed to send sms, system error, body: "+string(body), serviceName)
+		return "", errors.New("failed to send sms, system error")
 	}
-	messageId := ""
 	if res, ok := result["status"].(string); ok {
 		if res != "success" {
-			error_message = "failed to send sms, err: " + result["message"].(string)
-		} else {
-			messageId = result["message_id"].(string)
-			// redis.Set(ctx, "UPDATE_SMS_BALANCE", "1", 30*time.Minute)
+			message, _ := result["message"].(string)
+			return "", errors.New("failed to send sms, err: " + message)
 		}
-	} else {
-		LogMessage("critical", "SendSMS: failed to send sms, system error, body: "+string(body), serviceName)
-		error_message = "failed to send sms, system error"
-	}
-	status := "SENT"
-	if error_message != "" {
-		status = "FAILED"
+		messageId, _ := result["message_id"].(string)
+		return messageId, nil
 	}
-	if messageType == "password" || messageType == "reset_password_otp" || messageType == "account_password" {
-		message = "Message content is hidden for security reasons"
-	}
-	_, err = DB.Exec(ctx, "INSERT INTO sms (customer_id, message, phone, type, status, message_id, credit_count, error_message) VALUES ($1, $2, $3, $4, $5, $6, 0, $7)",
-		customerId, message, phoneNumber, messageType, status, messageId, error_message)
-	if err != nil {
-		LogMessage("critical", "SendSMS: failed to save sms, err: "+err.Error(), serviceName)
-	}
-	return messageId, nil
+	LogMessage("critical", "SendSMS: failed to send sms, system error, body: "+string(body), serviceName)
+	return "", errors.New("failed to send sms, system error")
 }
 
 // send sms, return message_id on success and error if any
@@ -779,14 +753,6 @@ func GenerateHtmlTemplate(filename string, emailData any) (string, error) {
 	}
 	return body.String(), nil
 }
-func SendEmail(to string, subject string, body string, serviceName string) string {
-	//skip this if it is test
-	if IsTestMode {
-		return "Email sent"
-	}
-	//TODO: send email
-	return "Email sent"
-}
 
 // RecordActivityLog inserts an activity log into the activity_logs table
 func RecordActivityLog(db *pgxpool.Pool, log ActivityLog, serviceName string, extra *map[string]interface{}) error {
@@ -0,0 +1,247 @@
+package utils
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/spf13/viper"
+)
+
+// check digit algorithms of a code format
+const (
+	CheckDigitNone = "none"
+	CheckDigitLuhn = "luhn" // Luhn mod N over the format alphabet
+	CheckDigitDamm = "damm" // Damm over a 10 characters alphabet, catches every single typo and adjacent swap
+)
+
+// LegacyCodeLength is the length of the codes uploaded without a format (legacy batches and codes uploaded before batches)
+const LegacyCodeLength = 10
+
+// DefaultCodeAlphabet leaves out characters easily mistaken for another when printed (0/O, 1/I, 5/S, 8/B, 2/Z)
+const DefaultCodeAlphabet = "ACDEFGHJKLMNPQRTUVWXY34679"
+
+// CodeFormat describe the codes of a batch, Length includes the check character
+type CodeFormat struct {
+	Alphabet   string `json:"alphabet"`
+	Length     int    `json:"length"`
+	CheckDigit string `json:"check_digit"`
+}
+
+// Validate check the alphabet has at least 2 distinct characters and the length leaves room for the check character
+func (f CodeFormat) Validate() error {
+	if len(f.Alphabet) < 2 || len(f.Alphabet) > 64 {
+		return errors.New("alphabet should contain between 2 and 64 characters")
+	}
+	for i, r := range f.Alphabet {
+		if r > 127 || !(r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return fmt.Errorf("alphabet character %q is not an upper case letter or a digit", r)
+		}
+		if strings.IndexRune(f.Alphabet, r) != i {
+			return fmt.Errorf("alphabet character %q is repeated", r)
+		}
+	}
+	if f.CheckDigit != CheckDigitNone && f.CheckDigit != CheckDigitLuhn && f.CheckDigit != CheckDigitDamm {
+		return fmt.Errorf("unknown check digit %s", f.CheckDigit)
+	}
+	if f.CheckDigit == CheckDigitDamm && len(f.Alphabet) != 10 {
+		return errors.New("damm check digit requires an alphabet of 10 characters")
+	}
+	if f.Length < 6 || f.Length > 32 {
+		return errors.New("length should be between 6 and 32")
+	}
+	return nil
+}
+
+// payloadLength is the number of random characters of a code
+func (f CodeFormat) payloadLength() int {
+	if f.CheckDigit == CheckDigitNone {
+		return f.Length
+	}
+	return f.Length - 1
+}
+
+// EntropyBits is the number of random bits of a code, the check character adds none
+func (f CodeFormat) EntropyBits() float64 {
+	return float64(f.payloadLength()) * math.Log2(float64(len(f.Alphabet)))
+}
+
+// GuessProbability is the chance that a random guess matches one of quantity codes
+func (f CodeFormat) GuessProbability(quantity int) float64 {
+	return float64(quantity) / math.Pow(2, f.EntropyBits())
+}
+
+// GenerateCode draw the code characters with crypto/rand, every character of the alphabet has the same probability
+func (f CodeFormat) GenerateCode() (string, error) {
+	code := make([]byte, f.payloadLength(), f.Length)
+	max := big.NewInt(int64(len(f.Alphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = f.Alphabet[n.Int64()]
+	}
+	if f.CheckDigit != CheckDigitNone {
+		check, err := f.checkChar(string(code))
+		if err != nil {
+			return "", err
+		}
+		code = append(code, check)
+	}
+	return string(code), nil
+}
+
+func (f CodeFormat) checkChar(payload string) (byte, error) {
+	if f.CheckDigit == CheckDigitDamm {
+		return DammCheckChar(payload, f.Alphabet)
+	}
+	return LuhnModNCheckChar(payload, f.Alphabet)
+}
+
+// Match check the code could belong to a batch of this format: length, alphabet and check character.
+// the alphabet of legacy batches is unknown, only their length is checked
+func (f CodeFormat) Match(code string) bool {
+	if len(code) != f.Length {
+		return false
+	}
+	if f.Alphabet != "" {
+		for i := 0; i < len(code); i++ {
+			if strings.IndexByte(f.Alphabet, code[i]) < 0 {
+				return false
+			}
+		}
+	}
+	if f.CheckDigit == CheckDigitNone || f.CheckDigit == "" {
+		return true
+	}
+	if len(code) < 2 {
+		return false
+	}
+	check, err := f.checkChar(code[:len(code)-1])
+	return err == nil && check == code[len(code)-1]
+}
+
+// LuhnModNCheckChar compute the Luhn mod N check character of the payload, N is the alphabet size
+func LuhnModNCheckChar(payload string, alphabet string) (byte, error) {
+	n := len(alphabet)
+	factor := 2
+	sum := 0
+	//from the rightmost character, the check character is appended on the right
+	for i := len(payload) - 1; i >= 0; i-- {
+		codePoint := strings.IndexByte(alphabet, payload[i])
+		if codePoint < 0 {
+			return 0, fmt.Errorf("character %q is not in the alphabet", payload[i])
+		}
+		addend := factor * codePoint
+		if factor == 2 {
+			factor = 1
+		} else {
+			factor = 2
+		}
+		sum += addend/n + addend%n
+	}
+	return alphabet[(n-sum%n)%n], nil
+}
+
+// ValidLuhnModN check the last character of the code is its Luhn mod N check character
+func ValidLuhnModN(code string, alphabet string) bool {
+	if len(code) < 2 {
+		return false
+	}
+	check, err := LuhnModNCheckChar(code[:len(code)-1], alphabet)
+	return err == nil && check == code[len(code)-1]
+}
+
+// dammTable is the totally anti-symmetric quasigroup of order 10 used by the Damm algorithm
+var dammTable = [10][10]int{
+	{0, 3, 1, 7, 5, 9, 8, 6, 4, 2},
+	{7, 0, 9, 2, 1, 5, 4, 8, 6, 3},
+	{4, 2, 0, 6, 8, 7, 1, 3, 5, 9},
+	{1, 7, 5, 0, 9, 8, 3, 4, 2, 6},
+	{6, 1, 2, 3, 0, 4, 5, 9, 7, 8},
+	{3, 6, 7, 4, 2, 0, 9, 5, 8, 1},
+	{5, 8, 6, 9, 7, 2, 0, 1, 3, 4},
+	{8, 9, 4, 5, 3, 6, 2, 0, 1, 7},
+	{9, 4, 3, 8, 6, 1, 7, 2, 0, 5},
+	{2, 5, 8, 1, 4, 3, 6, 7, 9, 0},
+}
+
+// DammCheckChar compute the Damm check character of the payload, the alphabet must have 10 characters
+func DammCheckChar(payload string, alphabet string) (byte, error) {
+	if len(alphabet) != 10 {
+		return 0, errors.New("damm check digit requires an alphabet of 10 characters")
+	}
+	interim := 0
+	for i := 0; i < len(payload); i++ {
+		digit := strings.IndexByte(alphabet, payload[i])
+		if digit < 0 {
+			return 0, fmt.Errorf("character %q is not in the alphabet", payload[i])
+		}
+		interim = dammTable[interim][digit]
+	}
+	return alphabet[interim], nil
+}
+
+// formats of the ACTIVE batches, cached to validate codes without a db round trip
+var codeFormatCache struct {
+	mu        sync.Mutex
+	formats   []CodeFormat
+	expiresAt time.Time
+}
+
+// ActiveCodeFormats return the distinct formats of the ACTIVE batches, codes uploaded before batches existed count as a legacy format.
+// the list is reloaded every code_format.cache_ttl seconds (default 60)
+func ActiveCodeFormats(DB *pgxpool.Pool) ([]CodeFormat, error) {
+	codeFormatCache.mu.Lock()
+	defer codeFormatCache.mu.Unlock()
+	if time.Now().Before(codeFormatCache.expiresAt) {
+		return codeFormatCache.formats, nil
+	}
+	rows, err := DB.Query(ctx, `select distinct code_alphabet,code_length,check_digit from code_batch where status='ACTIVE'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	formats := []CodeFormat{}
+	for rows.Next() {
+		format := CodeFormat{}
+		if err = rows.Scan(&format.Alphabet, &format.Length, &format.CheckDigit); err != nil {
+			return nil, err
+		}
+		if format.Length == 0 {
+			format.Length = LegacyCodeLength
+		}
+		formats = append(formats, format)
+	}
+	var unbatched bool
+	if err = DB.QueryRow(ctx, `select exists(select 1 from codes where batch_id is null)`).Scan(&unbatched); err != nil {
+		return nil, err
+	}
+	if unbatched {
+		formats = append(formats, CodeFormat{Length: LegacyCodeLength, CheckDigit: CheckDigitNone})
+	}
+	ttl := viper.GetInt("code_format.cache_ttl")
+	if ttl <= 0 {
+		ttl = 60
+	}
+	codeFormatCache.formats = formats
+	codeFormatCache.expiresAt = time.Now().Add(time.Duration(ttl) * time.Second)
+	return formats, nil
+}
+
+// MatchAnyCodeFormat is false when the code matches no format, e.g a mistyped character caught by the check digit
+func MatchAnyCodeFormat(code string, formats []CodeFormat) bool {
+	for _, format := range formats {
+		if format.Match(code) {
+			return true
+		}
+	}
+	return false
+}
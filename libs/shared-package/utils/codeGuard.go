@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/spf13/viper"
+)
+
+// errors of the code guard, their text is the localized ussd message
+var ErrCodeLocked = errors.New("code_locked")
+var ErrCodeBlocked = errors.New("code_blocked")
+
+// CodeGuardSettings limit the invalid codes a msisdn can try, counters are sliding windows kept in redis
+type CodeGuardSettings struct {
+	Window             time.Duration // period of the attempt counters
+	MaxMSISDNAttempts  int           // invalid codes of a msisdn within the window before a lockout
+	MaxSessionAttempts int           // invalid codes of a ussd session within the window before a lockout
+	Lockout            time.Duration // first lockout, doubled on every new lockout
+	MaxLockout         time.Duration
+	LockoutMemory      time.Duration // how long lockouts are remembered to escalate the next one
+	FraudLockouts      int           // lockouts after which the msisdn is flagged as FRAUD
+}
+
+// GetCodeGuardSettings read the code_guard config, defaults apply to missing values
+func GetCodeGuardSettings() CodeGuardSettings {
+	settings := CodeGuardSettings{
+		Window:             time.Duration(viper.GetInt("code_guard.window")) * time.Second,
+		MaxMSISDNAttempts:  viper.GetInt("code_guard.msisdn_max_attempts"),
+		MaxSessionAttempts: viper.GetInt("code_guard.session_max_attempts"),
+		Lockout:            time.Duration(viper.GetInt("code_guard.lockout")) * time.Second,
+		MaxLockout:         time.Duration(viper.GetInt("code_guard.max_lockout")) * time.Second,
+		LockoutMemory:      time.Duration(viper.GetInt("code_guard.lockout_memory")) * time.Second,
+		FraudLockouts:      viper.GetInt("code_guard.fraud_lockouts"),
+	}
+	if settings.Window <= 0 {
+		settings.Window = 10 * time.Minute
+	}
+	if settings.MaxMSISDNAttempts <= 0 {
+		settings.MaxMSISDNAttempts = 5
+	}
+	if settings.MaxSessionAttempts <= 0 {
+		settings.MaxSessionAttempts = 3
+	}
+	if settings.Lockout <= 0 {
+		settings.Lockout = 15 * time.Minute
+	}
+	if settings.MaxLockout <= 0 {
+		settings.MaxLockout = 24 * time.Hour
+	}
+	if settings.LockoutMemory <= 0 {
+		settings.LockoutMemory = 7 * 24 * time.Hour
+	}
+	if settings.FraudLockouts <= 0 {
+		settings.FraudLockouts = 3
+	}
+	return settings
+}
+
+// LockoutDuration is the lockout applied for the nth lockout of a msisdn
+func (s CodeGuardSettings) LockoutDuration(lockouts int) time.Duration {
+	duration := time.Duration(float64(s.Lockout) * math.Pow(2, float64(lockouts-1)))
+	if duration > s.MaxLockout || duration <= 0 {
+		return s.MaxLockout
+	}
+	return duration
+}
+
+// CodeGuardKey is the redis key suffix of a msisdn, the phone is hashed like customer.phone_hash so the web-service can clear it from a flag
+func CodeGuardKey(phoneHash []byte) string {
+	return hex.EncodeToString(phoneHash)
+}
+
+func codeGuardPhoneKey(phone string) string {
+	hash := sha256.Sum256([]byte(phone))
+	return CodeGuardKey(hash[:])
+}
+
+// CodeGuardCheck return ErrCodeBlocked when the msisdn is flagged as FRAUD and ErrCodeLocked during a lockout
+func CodeGuardCheck(DB *pgxpool.Pool, redisClient *redis.Client, phone string) error {
+	locked, err := redisClient.Exists(ctx, "code_guard:lock:"+codeGuardPhoneKey(phone)).Result()
+	if err != nil {
+		return err
+	}
+	var blocked bool
+	err = DB.QueryRow(ctx, `select exists(select 1 from code_fraud_flag where phone_hash = digest($1,'sha256') and status in ('OPEN','CONFIRMED'))
+	or exists(select 1 from customer where phone_hash = digest($1,'sha256') and status = 'FRAUD')`, phone).Scan(&blocked)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return ErrCodeBlocked
+	}
+	if locked > 0 {
+		return ErrCodeLocked
+	}
+	return nil
+}
+
+// CodeGuardFailure count an invalid code of the msisdn and its session. it returns ErrCodeLocked when the attempt starts a lockout
+// and ErrCodeBlocked when the lockouts reach code_guard.fraud_lockouts, the msisdn is then flagged for review
+func CodeGuardFailure(DB *pgxpool.Pool, redisClient *redis.Client, phone string, sessionId string) error {
+	settings := GetCodeGuardSettings()
+	phoneKey := codeGuardPhoneKey(phone)
+	msisdnAttempts, err := slidingWindowHit(redisClient, "code_guard:msisdn:"+phoneKey, settings.Window)
+	if err != nil {
+		return err
+	}
+	sessionAttempts, err := slidingWindowHit(redisClient, "code_guard:session:"+sessionId, settings.Window)
+	if err != nil {
+		return err
+	}
+	if msisdnAttempts < int64(settings.MaxMSISDNAttempts) && sessionAttempts < int64(settings.MaxSessionAttempts) {
+		return nil
+	}
+	lockouts, err := redisClient.Incr(ctx, "code_guard:lockouts:"+phoneKey).Result()
+	if err != nil {
+		return err
+	}
+	redisClient.Expire(ctx, "code_guard:lockouts:"+phoneKey, settings.LockoutMemory)
+	duration := settings.LockoutDuration(int(lockouts))
+	if err = redisClient.Set(ctx, "code_guard:lock:"+phoneKey, lockouts, duration).Err(); err != nil {
+		return err
+	}
+	redisClient.Del(ctx, "code_guard:msisdn:"+phoneKey, "code_guard:session:"+sessionId)
+	LogMessage("warn", fmt.Sprintf("CodeGuardFailure: msisdn %s locked out for %s after %d invalid codes (lockout #%d)",
+		MaskPhone(phone), duration, msisdnAttempts, lockouts), "ussd-service")
+	if lockouts < int64(settings.FraudLockouts) {
+		return ErrCodeLocked
+	}
+	if err = flagCodeFraud(DB, phone, int(msisdnAttempts), int(lockouts)); err != nil {
+		return err
+	}
+	return ErrCodeBlocked
+}
+
+// slidingWindowHit add a hit to the sorted set of the key and return the hits within the window
+func slidingWindowHit(redisClient *redis.Client, key string, window time.Duration) (int64, error) {
+	now := time.Now()
+	pipe := redisClient.TxPipeline()
+	pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(now.Add(-window).UnixNano(), 10))
+	pipe.ZAdd(ctx, key, &redis.Z{Score: float64(now.UnixNano()), Member: strconv.FormatInt(now.UnixNano(), 10) + GenerateRandomCapitalLetter(4)})
+	count := pipe.ZCard(ctx, key)
+	pipe.Expire(ctx, key, window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return count.Val(), nil
+}
+
+// flagCodeFraud open a review flag for the msisdn and set its customer to FRAUD
+func flagCodeFraud(DB *pgxpool.Pool, phone string, attempts int, lockouts int) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, `insert into code_fraud_flag (customer_id,phone_hash,phone_masked,reason,invalid_attempts,lockouts)
+	values ((select id from customer where phone_hash = digest($1,'sha256')),digest($1,'sha256'),$2,$3,$4,$5)
+	on conflict (phone_hash) where status = 'OPEN' do update set invalid_attempts = code_fraud_flag.invalid_attempts + excluded.invalid_attempts,
+	lockouts = excluded.lockouts, updated_at = now()`,
+		phone, MaskPhone(phone), fmt.Sprintf("%d lockouts for invalid codes", lockouts), attempts, lockouts)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `update customer set status = 'FRAUD' where phone_hash = digest($1,'sha256')`, phone)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// ClearCodeGuard remove the lockout and the counters of the msisdn, e.g once its fraud flag is cleared
+func ClearCodeGuard(redisClient *redis.Client, phoneHash []byte) error {
+	key := CodeGuardKey(phoneHash)
+	return redisClient.Del(ctx, "code_guard:lock:"+key, "code_guard:lockouts:"+key, "code_guard:msisdn:"+key).Err()
+}
+
+// MaskPhone keep the first 6 and last 2 digits of the phone, e.g 250788****12
+func MaskPhone(phone string) string {
+	if len(phone) <= 8 {
+		return strings.Repeat("*", len(phone))
+	}
+	return phone[:6] + strings.Repeat("*", len(phone)-8) + phone[len(phone)-2:]
+}
@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/spf13/viper"
+)
+
+// email types whose content must not stay in db once sent
+var hiddenEmailTypes = []string{"verify_account_otp"}
+
+type queuedEmail struct {
+	Id       int
+	To       string
+	Subject  string
+	Body     string
+	Type     string
+	Attempts int
+}
+
+// QueueEmail save the email and its attachments as QUEUED in one transaction (a savepoint when db is a transaction),
+// the dispatcher will send it. return the email id
+func QueueEmail(db DBConn, message EmailMessage, messageType string) (int, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+	var emailId int
+	err = tx.QueryRow(ctx, `INSERT INTO email (recipient, subject, body, type, status, attachments, error_message, next_attempt_at)
+	VALUES ($1, left($2, 255), $3, $4, 'QUEUED', $5, '', now()) returning id`,
+		message.To, message.Subject, message.Body, messageType, len(message.Attachments)).Scan(&emailId)
+	if err != nil {
+		return 0, err
+	}
+	for _, attachment := range message.Attachments {
+		var attachmentId int
+		err = tx.QueryRow(ctx, `INSERT INTO email_attachment (email_id, file_name, content_type, content) VALUES ($1, $2, $3, $4) returning id`,
+			emailId, attachment.FileName, attachment.ContentType, attachment.Content).Scan(&attachmentId)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return emailId, tx.Commit(ctx)
+}
+
+func emailMaxAttempts() int {
+	attempts := viper.GetInt("email.max_attempts")
+	if attempts <= 0 {
+		attempts = 5
+	}
+	return attempts
+}
+
+func emailBatchSize() int {
+	size := viper.GetInt("email.batch_size")
+	if size <= 0 {
+		size = 20
+	}
+	return size
+}
+
+func emailAttachments(DB *pgxpool.Pool, emailId int) ([]EmailAttachment, error) {
+	rows, err := DB.Query(ctx, `select file_name, content_type, content from email_attachment where email_id=$1 order by id`, emailId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	attachments := []EmailAttachment{}
+	for rows.Next() {
+		attachment := EmailAttachment{}
+		if err = rows.Scan(&attachment.FileName, &attachment.ContentType, &attachment.Content); err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, attachment)
+	}
+	return attachments, rows.Err()
+}
+
+// emailLease is how long a picked email is skipped by the other dispatchers
+const emailLease = 5 * time.Minute
+
+// renewEmailLease extend the lease of the email right before it is sent, it fails when the batch lease ended and
+// another dispatcher picked the email meanwhile (its attempts moved)
+func renewEmailLease(DB *pgxpool.Pool, email queuedEmail) (bool, error) {
+	result, err := DB.Exec(ctx, `update email set next_attempt_at = now() + make_interval(secs => $1::int), updated_at = now()
+	where id=$2 and status='QUEUED' and attempts=$3`, int(emailLease.Seconds()), email.Id, email.Attempts)
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() == 1, nil
+}
+
+// DispatchEmail send a batch of due QUEUED emails, return the number of emails picked.
+// rows are leased by moving next_attempt_at like the sms and the lease of each email is renewed before it is sent,
+// the attachments are removed once the email is sent
+func DispatchEmail(DB *pgxpool.Pool, serviceName string) int {
+	rows, err := DB.Query(ctx, `update email set attempts = attempts + 1, next_attempt_at = now() + make_interval(secs => $2::int), updated_at = now()
+	where id in (select id from email where status = 'QUEUED' and next_attempt_at <= now() order by id limit $1 for update skip locked)
+	returning id, recipient, subject, body, coalesce(type,''), attempts`, emailBatchSize(), int(emailLease.Seconds()))
+	if err != nil {
+		LogMessage("critical", "DispatchEmail: failed to fetch queued emails, err: "+err.Error(), serviceName)
+		return 0
+	}
+	emails := []queuedEmail{}
+	for rows.Next() {
+		email := queuedEmail{}
+		err = rows.Scan(&email.Id, &email.To, &email.Subject, &email.Body, &email.Type, &email.Attempts)
+		if err != nil {
+			LogMessage("critical", "DispatchEmail: failed to read queued email, err: "+err.Error(), serviceName)
+			continue
+		}
+		emails = append(emails, email)
+	}
+	rows.Close()
+	if len(emails) == 0 {
+		return 0
+	}
+	provider, providerErr := NewEmailProvider()
+	providerName := viper.GetString("email.transport")
+	if providerName == "" {
+		providerName = "smtp"
+	}
+	for _, email := range emails {
+		leased, err := renewEmailLease(DB, email)
+		if err != nil {
+			LogMessage("critical", fmt.Sprintf("DispatchEmail: failed to renew lease of email #%d, err: %s", email.Id, err.Error()), serviceName)
+			continue
+		} else if !leased {
+			continue
+		}
+		message := EmailMessage{To: email.To, Subject: email.Subject, Body: email.Body}
+		var messageId string
+		sendErr := providerErr
+		if sendErr == nil {
+			message.Attachments, sendErr = emailAttachments(DB, email.Id)
+		}
+		if sendErr == nil {
+			messageId, sendErr = provider.Send(EmailSender(), message)
+		}
+		body := email.Body
+		if slices.Contains(hiddenEmailTypes, email.Type) {
+			body = "Message content is hidden for security reasons"
+		}
+		if sendErr == nil {
+			_, err = DB.Exec(ctx, `with sent as (update email set status='SENT', message_id=$1, body=$2, error_message='', provider=$3, sent_at=now(), updated_at=now()
+			where id=$4 returning id) delete from email_attachment where email_id in (select id from sent)`, messageId, body, providerName, email.Id)
+		} else if email.Attempts >= emailMaxAttempts() {
+			_, err = DB.Exec(ctx, `update email set status='FAILED', body=$1, error_message=left($2, 255), updated_at=now() where id=$3`, body, sendErr.Error(), email.Id)
+		} else {
+			//retry later, wait longer after each failure
+			backoff := email.Attempts * email.Attempts * 60
+			_, err = DB.Exec(ctx, `update email set error_message=left($1, 255), next_attempt_at = now() + make_interval(secs => $2::int), updated_at=now() where id=$3`,
+				sendErr.Error(), backoff, email.Id)
+		}
+		if err != nil {
+			LogMessage("critical", fmt.Sprintf("DispatchEmail: failed to update email #%d, err: %s", email.Id, err.Error()), serviceName)
+		}
+	}
+	return len(emails)
+}
+
+// RunEmailDispatcher keep sending queued emails, it is safe to run it on many services at once
+func RunEmailDispatcher(DB *pgxpool.Pool, serviceName string) {
+	for {
+		if DispatchEmail(DB, serviceName) == 0 {
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// EmailAttachment is a file sent with an email, e.g an excel export
+type EmailAttachment struct {
+	FileName    string
+	ContentType string
+	Content     []byte
+}
+
+// EmailMessage is an html email to a single recipient
+type EmailMessage struct {
+	To          string
+	Subject     string
+	Body        string
+	Attachments []EmailAttachment
+}
+
+// EmailProvider is a transport able to hand over an email, it returns the provider message id
+type EmailProvider interface {
+	Send(from string, message EmailMessage) (string, error)
+}
+
+// SMTPEmailProvider send emails through a smtp server, TLS is starttls (upgrade when offered), tls (implicit, port 465) or none
+type SMTPEmailProvider struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	TLS      string
+	Timeout  time.Duration
+}
+
+func (s *SMTPEmailProvider) Send(from string, message EmailMessage) (string, error) {
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return "", fmt.Errorf("invalid sender %s, %s", from, err.Error())
+	}
+	recipient, err := mail.ParseAddress(message.To)
+	if err != nil {
+		return "", fmt.Errorf("invalid recipient %s, %s", message.To, err.Error())
+	}
+	messageId, data, err := buildEmailMIME(sender, recipient, message)
+	if err != nil {
+		return "", err
+	}
+	address := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	dialer := &net.Dialer{Timeout: s.Timeout}
+	var conn net.Conn
+	if s.TLS == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, &tls.Config{ServerName: s.Host})
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return "", err
+	}
+	conn.SetDeadline(time.Now().Add(s.Timeout))
+	client, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return "", err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok && s.TLS != "tls" && s.TLS != "none" {
+		if err = client.StartTLS(&tls.Config{ServerName: s.Host}); err != nil {
+			return "", err
+		}
+	}
+	if s.Username != "" {
+		if err = client.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return "", err
+		}
+	}
+	if err = client.Mail(sender.Address); err != nil {
+		return "", err
+	}
+	if err = client.Rcpt(recipient.Address); err != nil {
+		return "", err
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return "", err
+	}
+	if _, err = writer.Write(data); err != nil {
+		return "", err
+	}
+	if err = writer.Close(); err != nil {
+		return "", err
+	}
+	client.Quit()
+	return messageId, nil
+}
+
+// HTTPEmailProvider send emails through an email service api, the email is posted as json
+// {from, to, subject, html, attachments: [{filename, content_type, content (base64)}]} with the api key as bearer token
+type HTTPEmailProvider struct {
+	Url     string
+	ApiKey  string
+	Timeout time.Duration
+}
+
+func (h *HTTPEmailProvider) Send(from string, message EmailMessage) (string, error) {
+	attachments := []map[string]string{}
+	for _, attachment := range message.Attachments {
+		attachments = append(attachments, map[string]string{"filename": attachment.FileName, "content_type": attachment.ContentType,
+			"content": base64.StdEncoding.EncodeToString(attachment.Content)})
+	}
+	payload, err := json.Marshal(map[string]any{"from": from, "to": message.To, "subject": message.Subject, "html": message.Body, "attachments": attachments})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", h.Url, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.ApiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+h.ApiKey)
+	}
+	resp, err := (&http.Client{Timeout: h.Timeout}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("email provider returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	result := struct {
+		Id        string `json:"id"`
+		MessageId string `json:"message_id"`
+	}{}
+	json.Unmarshal(body, &result)
+	if result.MessageId != "" {
+		return result.MessageId, nil
+	}
+	return result.Id, nil
+}
+
+// EmailSender is the from address of the emails, email.from in config.yml
+func EmailSender() string {
+	if from := viper.GetString("email.from"); from != "" {
+		return from
+	}
+	return "BRALIRWA <no-reply@bralirwa.co.rw>"
+}
+
+// NewEmailProvider build the provider of email.transport, smtp by default
+func NewEmailProvider() (EmailProvider, error) {
+	switch transport := strings.ToLower(viper.GetString("email.transport")); transport {
+	case "", "smtp":
+		provider := &SMTPEmailProvider{
+			Host:     viper.GetString("email.smtp.host"),
+			Port:     viper.GetInt("email.smtp.port"),
+			Username: viper.GetString("email.smtp.username"),
+			Password: viper.GetString("email.smtp.password"),
+			TLS:      strings.ToLower(viper.GetString("email.smtp.tls")),
+			Timeout:  time.Duration(viper.GetInt("email.smtp.timeout")) * time.Second,
+		}
+		if provider.Host == "" {
+			return nil, errors.New("email.smtp.host is not configured")
+		}
+		if provider.Port <= 0 {
+			provider.Port = 587
+		}
+		if provider.Timeout <= 0 {
+			provider.Timeout = 30 * time.Second
+		}
+		return provider, nil
+	case "http":
+		provider := &HTTPEmailProvider{
+			Url:     viper.GetString("email.http.url"),
+			ApiKey:  viper.GetString("email.http.api_key"),
+			Timeout: time.Duration(viper.GetInt("email.http.timeout")) * time.Second,
+		}
+		if provider.Url == "" {
+			return nil, errors.New("email.http.url is not configured")
+		}
+		if provider.Timeout <= 0 {
+			provider.Timeout = 30 * time.Second
+		}
+		return provider, nil
+	default:
+		return nil, fmt.Errorf("unknown email transport %s", transport)
+	}
+}
+
+// buildEmailMIME render the email with its attachments, it returns the generated Message-ID
+func buildEmailMIME(sender *mail.Address, recipient *mail.Address, message EmailMessage) (string, []byte, error) {
+	domain := sender.Address[strings.LastIndex(sender.Address, "@")+1:]
+	token, err := RandomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	messageId := token[:24] + "@" + domain
+	buf := new(bytes.Buffer)
+	headers := []string{
+		"From: " + sender.String(),
+		"To: " + recipient.String(),
+		"Subject: " + mime.QEncoding.Encode("utf-8", message.Subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Message-ID: <" + messageId + ">",
+		"MIME-Version: 1.0",
+	}
+	htmlHeader := textproto.MIMEHeader{"Content-Type": {"text/html; charset=UTF-8"}, "Content-Transfer-Encoding": {"quoted-printable"}}
+	if len(message.Attachments) == 0 {
+		for _, header := range append(headers, "Content-Type: text/html; charset=UTF-8", "Content-Transfer-Encoding: quoted-printable") {
+			buf.WriteString(header + "\r\n")
+		}
+		buf.WriteString("\r\n")
+		err = writeQuotedPrintable(buf, message.Body)
+		return messageId, buf.Bytes(), err
+	}
+	parts := multipart.NewWriter(buf)
+	for _, header := range append(headers, "Content-Type: multipart/mixed; boundary=\""+parts.Boundary()+"\"") {
+		buf.WriteString(header + "\r\n")
+	}
+	buf.WriteString("\r\n")
+	part, err := parts.CreatePart(htmlHeader)
+	if err == nil {
+		err = writeQuotedPrintable(part, message.Body)
+	}
+	for _, attachment := range message.Attachments {
+		if err != nil {
+			break
+		}
+		contentType := attachment.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		part, err = parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType(contentType, map[string]string{"name": attachment.FileName})},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": attachment.FileName})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err == nil {
+			err = writeBase64Lines(part, attachment.Content)
+		}
+	}
+	if err == nil {
+		err = parts.Close()
+	}
+	return messageId, buf.Bytes(), err
+}
+
+func writeQuotedPrintable(w io.Writer, text string) error {
+	writer := quotedprintable.NewWriter(w)
+	if _, err := writer.Write([]byte(text)); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// writeBase64Lines encode the content in lines of 76 characters as required by MIME
+func writeBase64Lines(w io.Writer, content []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(content)
+	for len(encoded) > 0 {
+		line := encoded[:min(76, len(encoded))]
+		encoded = encoded[len(line):]
+		if _, err := io.WriteString(w, line+"\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// fraud rules, the name is saved with the signal
+const (
+	FraudRuleVelocity   = "entry_velocity"
+	FraudRuleBatchBurst = "batch_burst"
+	FraudRuleSharedMomo = "shared_momo_name"
+	FraudRuleStaffPhone = "staff_phone"
+)
+
+// FraudSignal is a rule matched by a customer, Score is added to the customer score
+type FraudSignal struct {
+	Rule   string `json:"rule"`
+	Score  int    `json:"score"`
+	Detail string `json:"detail"`
+}
+
+// FraudRuleSettings are the thresholds and scores of the rules, read from fraud_rules
+type FraudRuleSettings struct {
+	HoldScore           int // score from which the customer is put in REVIEW
+	VelocityPerHour     int // entries of the customer within the last hour
+	VelocityScore       int
+	BatchBurstCodes     int // codes of the same batch entered by the customer within BatchBurstMinutes
+	BatchBurstMinutes   int
+	BatchBurstScore     int
+	SharedMomoCustomers int // customers registered with the same MoMo name
+	SharedMomoScore     int
+	StaffPhoneScore     int // customer phone is the phone of a staff user
+}
+
+func fraudRuleInt(key string, defaultValue int) int {
+	if value := viper.GetInt("fraud_rules." + key); value > 0 {
+		return value
+	}
+	return defaultValue
+}
+
+// GetFraudRuleSettings read the fraud_rules config, defaults apply to missing values
+func GetFraudRuleSettings() FraudRuleSettings {
+	return FraudRuleSettings{
+		HoldScore:           fraudRuleInt("hold_score", 50),
+		VelocityPerHour:     fraudRuleInt("velocity_per_hour", 20),
+		VelocityScore:       fraudRuleInt("velocity_score", 40),
+		BatchBurstCodes:     fraudRuleInt("batch_burst_codes", 10),
+		BatchBurstMinutes:   fraudRuleInt("batch_burst_minutes", 15),
+		BatchBurstScore:     fraudRuleInt("batch_burst_score", 30),
+		SharedMomoCustomers: fraudRuleInt("shared_momo_customers", 3),
+		SharedMomoScore:     fraudRuleInt("shared_momo_score", 30),
+		StaffPhoneScore:     fraudRuleInt("staff_phone_score", 100),
+	}
+}
+
+var momoNamesSpaces = regexp.MustCompile(`\s+`)
+
+// MomoNamesHash is the hash of the normalized MoMo name, names are encrypted so customers sharing a name are matched on it
+func MomoNamesHash(names string) []byte {
+	normalized := strings.ToUpper(momoNamesSpaces.ReplaceAllString(strings.TrimSpace(names), " "))
+	if normalized == "" {
+		return nil
+	}
+	hash := sha256.Sum256([]byte(normalized))
+	return hash[:]
+}
+
+// ScoreCustomer evaluate the fraud rules for the customer and return the matched signals and the total score
+func ScoreCustomer(DB DBConn, customerId int) ([]FraudSignal, int, error) {
+	settings := GetFraudRuleSettings()
+	var hourlyEntries, burstCodes, sharedMomo int
+	var staffPhone bool
+	err := DB.QueryRow(ctx, `select
+	(select count(e.id) from entries e where e.customer_id = c.id and e.created_at >= now() - interval '1 hour'),
+	(select coalesce(max(n),0) from (select count(e.id) n from entries e inner join codes cd on cd.id = e.code_id
+		where e.customer_id = c.id and cd.batch_id is not null and e.created_at >= now() - make_interval(mins => $2) group by cd.batch_id) b),
+	(select count(o.id) from customer o where c.momo_names_hash is not null and o.momo_names_hash = c.momo_names_hash),
+	exists(select 1 from users u where u.phone is not null and u.deleted_at is null
+		and digest('250' || right(regexp_replace(u.phone,'[^0-9]','','g'),9),'sha256') = c.phone_hash)
+	from customer c where c.id = $1`, customerId, settings.BatchBurstMinutes).Scan(&hourlyEntries, &burstCodes, &sharedMomo, &staffPhone)
+	if err != nil {
+		return nil, 0, err
+	}
+	signals := []FraudSignal{}
+	if hourlyEntries >= settings.VelocityPerHour {
+		signals = append(signals, FraudSignal{Rule: FraudRuleVelocity, Score: settings.VelocityScore,
+			Detail: fmt.Sprintf("%d entries within the last hour", hourlyEntries)})
+	}
+	if burstCodes >= settings.BatchBurstCodes {
+		signals = append(signals, FraudSignal{Rule: FraudRuleBatchBurst, Score: settings.BatchBurstScore,
+			Detail: fmt.Sprintf("%d codes of the same batch within %d minutes", burstCodes, settings.BatchBurstMinutes)})
+	}
+	if sharedMomo >= settings.SharedMomoCustomers {
+		signals = append(signals, FraudSignal{Rule: FraudRuleSharedMomo, Score: settings.SharedMomoScore,
+			Detail: fmt.Sprintf("MoMo name shared by %d customers", sharedMomo)})
+	}
+	if staffPhone {
+		signals = append(signals, FraudSignal{Rule: FraudRuleStaffPhone, Score: settings.StaffPhoneScore, Detail: "phone of a staff user"})
+	}
+	score := 0
+	for _, signal := range signals {
+		score += signal.Score
+	}
+	return signals, score, nil
+}
+
+// EvaluateCustomerFraud score the customer, save the score on the entry and open a fraud case when the score reaches the hold score.
+// a customer cleared by a reviewer is flagged again only when its score grows above the cleared one. it returns whether the customer is held.
+// DB can be the transaction saving the entry
+func EvaluateCustomerFraud(DB DBConn, customerId int, entryId *int) (bool, error) {
+	signals, score, err := ScoreCustomer(DB, customerId)
+	if err != nil {
+		return false, err
+	}
+	if entryId != nil {
+		if _, err = DB.Exec(ctx, `update entries set fraud_score=$2 where id=$1`, *entryId, score); err != nil {
+			return false, err
+		}
+	}
+	var status string
+	var clearedScore int
+	err = DB.QueryRow(ctx, `select c.status,coalesce((select max(f.score) from fraud_case f where f.customer_id = c.id and f.status = 'CLEARED'),0)
+	from customer c where c.id=$1`, customerId).Scan(&status, &clearedScore)
+	if err != nil {
+		return false, err
+	}
+	if status != "OKAY" {
+		return true, nil
+	}
+	if score < GetFraudRuleSettings().HoldScore || score <= clearedScore {
+		return false, nil
+	}
+	content, _ := json.Marshal(signals)
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, `insert into fraud_case (customer_id,entry_id,score,signals) values ($1,$2,$3,$4)
+	on conflict (customer_id) where status = 'OPEN' do update set score = excluded.score, signals = excluded.signals, updated_at = now()`,
+		customerId, entryId, score, content)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(ctx, `update customer set status='REVIEW' where id=$1 and status='OKAY'`, customerId)
+	if err != nil {
+		return false, err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,220 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/spf13/viper"
+)
+
+// scopes of the login guard, each has its own counters and lockout
+const (
+	LoginGuardLogin          = "login"
+	LoginGuardForgotPassword = "forgot_password"
+	LoginGuardOTP            = "otp"
+)
+
+var loginGuardScopes = []string{LoginGuardLogin, LoginGuardForgotPassword, LoginGuardOTP}
+
+// LoginGuardSettings limit the attempts on an account and from an ip, counters are sliding windows kept in redis
+type LoginGuardSettings struct {
+	Window             time.Duration // period of the attempt counters
+	MaxAccountAttempts int           // failures of an account within the window before a lockout
+	MaxIPAttempts      int           // failures from an ip within the window before a lockout
+	DelayAfter         int           // failures of an account before the next attempt is delayed
+	Delay              time.Duration // first delay, doubled on every new failure
+	MaxDelay           time.Duration
+	Lockout            time.Duration // first lockout, doubled on every new lockout
+	MaxLockout         time.Duration
+	LockoutMemory      time.Duration // how long lockouts are remembered to escalate the next one
+}
+
+// LoginGuardError is returned while an account or an ip is delayed or locked out
+type LoginGuardError struct {
+	Locked     bool
+	RetryAfter time.Duration
+}
+
+func (e *LoginGuardError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("too many attempts, try again in %s", e.RetryAfter.Round(time.Second))
+	}
+	return fmt.Sprintf("please wait %s before trying again", e.RetryAfter.Round(time.Second))
+}
+
+// LoginLockout is an account lockout started by a failure
+type LoginLockout struct {
+	Scope    string
+	Lockouts int
+	Duration time.Duration
+}
+
+// GetLoginGuardSettings read the login_guard config, defaults apply to missing values
+func GetLoginGuardSettings() LoginGuardSettings {
+	settings := LoginGuardSettings{
+		Window:             time.Duration(viper.GetInt("login_guard.window")) * time.Second,
+		MaxAccountAttempts: viper.GetInt("login_guard.account_max_attempts"),
+		MaxIPAttempts:      viper.GetInt("login_guard.ip_max_attempts"),
+		DelayAfter:         viper.GetInt("login_guard.delay_after"),
+		Delay:              time.Duration(viper.GetInt("login_guard.delay")) * time.Second,
+		MaxDelay:           time.Duration(viper.GetInt("login_guard.max_delay")) * time.Second,
+		Lockout:            time.Duration(viper.GetInt("login_guard.lockout")) * time.Second,
+		MaxLockout:         time.Duration(viper.GetInt("login_guard.max_lockout")) * time.Second,
+		LockoutMemory:      time.Duration(viper.GetInt("login_guard.lockout_memory")) * time.Second,
+	}
+	if settings.Window <= 0 {
+		settings.Window = 15 * time.Minute
+	}
+	if settings.MaxAccountAttempts <= 0 {
+		settings.MaxAccountAttempts = 5
+	}
+	if settings.MaxIPAttempts <= 0 {
+		settings.MaxIPAttempts = 20
+	}
+	if settings.DelayAfter <= 0 {
+		settings.DelayAfter = 2
+	}
+	if settings.Delay <= 0 {
+		settings.Delay = 2 * time.Second
+	}
+	if settings.MaxDelay <= 0 {
+		settings.MaxDelay = time.Minute
+	}
+	if settings.Lockout <= 0 {
+		settings.Lockout = 15 * time.Minute
+	}
+	if settings.MaxLockout <= 0 {
+		settings.MaxLockout = 24 * time.Hour
+	}
+	if settings.LockoutMemory <= 0 {
+		settings.LockoutMemory = 7 * 24 * time.Hour
+	}
+	return settings
+}
+
+// LockoutDuration is the lockout applied for the nth lockout of an account
+func (s LoginGuardSettings) LockoutDuration(lockouts int) time.Duration {
+	duration := time.Duration(float64(s.Lockout) * math.Pow(2, float64(lockouts-1)))
+	if duration > s.MaxLockout || duration <= 0 {
+		return s.MaxLockout
+	}
+	return duration
+}
+
+// DelayDuration is the wait imposed after the nth failure of an account, none before login_guard.delay_after
+func (s LoginGuardSettings) DelayDuration(failures int) time.Duration {
+	if failures < s.DelayAfter {
+		return 0
+	}
+	duration := time.Duration(float64(s.Delay) * math.Pow(2, float64(failures-s.DelayAfter)))
+	if duration > s.MaxDelay || duration <= 0 {
+		return s.MaxDelay
+	}
+	return duration
+}
+
+// LoginGuardAccount is the redis key suffix of an account, the email is hashed
+func LoginGuardAccount(email string) string {
+	return TokenHash(strings.ToLower(strings.TrimSpace(email)))
+}
+
+func loginGuardKey(kind string, scope string, key string) string {
+	return "login_guard:" + scope + ":" + kind + ":" + key
+}
+
+// LoginGuardCheck return a LoginGuardError when the account or the ip is locked out for the scope,
+// or when the account has to wait after its last failure
+func LoginGuardCheck(redisClient *redis.Client, scope string, email string, ip string) error {
+	account := LoginGuardAccount(email)
+	for _, key := range []string{loginGuardKey("lock", scope, account), loginGuardKey("ip_lock", scope, ip)} {
+		ttl, err := redisClient.PTTL(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if ttl > 0 {
+			return &LoginGuardError{Locked: true, RetryAfter: ttl}
+		}
+	}
+	ttl, err := redisClient.PTTL(ctx, loginGuardKey("delay", scope, account)).Result()
+	if err != nil {
+		return err
+	}
+	if ttl > 0 {
+		return &LoginGuardError{RetryAfter: ttl}
+	}
+	return nil
+}
+
+// LoginGuardFailure count a failed attempt of the account from the ip. it returns the lockout when the attempt locks the account,
+// an ip lockout is only logged as the owner of the ip is unknown
+func LoginGuardFailure(redisClient *redis.Client, scope string, email string, ip string) (*LoginLockout, error) {
+	settings := GetLoginGuardSettings()
+	account := LoginGuardAccount(email)
+	accountFailures, err := slidingWindowHit(redisClient, loginGuardKey("attempts", scope, account), settings.Window)
+	if err != nil {
+		return nil, err
+	}
+	ipFailures, err := slidingWindowHit(redisClient, loginGuardKey("ip_attempts", scope, ip), settings.Window)
+	if err != nil {
+		return nil, err
+	}
+	if ipFailures >= int64(settings.MaxIPAttempts) {
+		redisClient.Set(ctx, loginGuardKey("ip_lock", scope, ip), ipFailures, settings.Lockout)
+		redisClient.Del(ctx, loginGuardKey("ip_attempts", scope, ip))
+		LogMessage("warn", fmt.Sprintf("LoginGuardFailure: ip %s locked out of %s for %s after %d failures", ip, scope, settings.Lockout, ipFailures), "web-service")
+	}
+	if accountFailures < int64(settings.MaxAccountAttempts) {
+		if delay := settings.DelayDuration(int(accountFailures)); delay > 0 {
+			redisClient.Set(ctx, loginGuardKey("delay", scope, account), accountFailures, delay)
+		}
+		return nil, nil
+	}
+	lockouts, err := redisClient.Incr(ctx, loginGuardKey("lockouts", scope, account)).Result()
+	if err != nil {
+		return nil, err
+	}
+	redisClient.Expire(ctx, loginGuardKey("lockouts", scope, account), settings.LockoutMemory)
+	duration := settings.LockoutDuration(int(lockouts))
+	if err = redisClient.Set(ctx, loginGuardKey("lock", scope, account), lockouts, duration).Err(); err != nil {
+		return nil, err
+	}
+	redisClient.Del(ctx, loginGuardKey("attempts", scope, account), loginGuardKey("delay", scope, account))
+	return &LoginLockout{Scope: scope, Lockouts: int(lockouts), Duration: duration}, nil
+}
+
+// LoginGuardSuccess reset the failures of the account after a successful attempt, lockouts are still remembered for escalation
+func LoginGuardSuccess(redisClient *redis.Client, scope string, email string) error {
+	account := LoginGuardAccount(email)
+	return redisClient.Del(ctx, loginGuardKey("attempts", scope, account), loginGuardKey("delay", scope, account)).Err()
+}
+
+// LoginGuardLocked return the remaining lockout of the account per scope
+func LoginGuardLocked(redisClient *redis.Client, email string) (map[string]time.Duration, error) {
+	account := LoginGuardAccount(email)
+	locked := map[string]time.Duration{}
+	for _, scope := range loginGuardScopes {
+		ttl, err := redisClient.PTTL(ctx, loginGuardKey("lock", scope, account)).Result()
+		if err != nil {
+			return nil, err
+		}
+		if ttl > 0 {
+			locked[scope] = ttl
+		}
+	}
+	return locked, nil
+}
+
+// ClearLoginGuard remove the lockouts and the counters of the account in all scopes, e.g when an admin unlocks it
+func ClearLoginGuard(redisClient *redis.Client, email string) error {
+	account := LoginGuardAccount(email)
+	keys := []string{}
+	for _, scope := range loginGuardScopes {
+		for _, kind := range []string{"lock", "lockouts", "attempts", "delay"} {
+			keys = append(keys, loginGuardKey(kind, scope, account))
+		}
+	}
+	return redisClient.Del(ctx, keys...).Err()
+}
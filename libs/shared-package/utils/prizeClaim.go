@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/spf13/viper"
+)
+
+// max wrong code/ID tries before a claim is locked, an operator has to resend a new code (ResendPrizeClaim)
+const ClaimMaxAttempts = 5
+
+var ErrClaimNotFound = errors.New("claim_not_found")
+var ErrClaimInvalidCode = errors.New("claim_invalid_code")
+var ErrClaimIdMismatch = errors.New("claim_id_mismatch")
+var ErrClaimIdMissing = errors.New("claim_id_missing")
+var ErrClaimExpired = errors.New("claim_expired")
+var ErrClaimLocked = errors.New("claim_locked")
+var ErrClaimVerified = errors.New("claim_already_verified")
+
+// PrizeClaimRequired check if a prize of this value must be claimed before payout
+func PrizeClaimRequired(value float64) bool {
+	minAmount := viper.GetFloat64("prize_claim.min_amount")
+	return minAmount > 0 && value >= minAmount
+}
+
+// PrizeClaimDeadlineHours return how long a winner has to claim a prize
+func PrizeClaimDeadlineHours() int {
+	hours := viper.GetInt("prize_claim.deadline_hours")
+	if hours <= 0 {
+		hours = 72
+	}
+	return hours
+}
+
+// CreatePrizeClaim generate and save a claim code for the prize, the code is only returned to be sent to the winner
+func CreatePrizeClaim(tx pgx.Tx, prizeId int, customerId int, transactionId *int) (string, time.Time, error) {
+	code, err := GenerateOTP(6)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var expiresAt time.Time
+	err = tx.QueryRow(ctx, `insert into prize_claim (prize_id,customer_id,transaction_id,claim_code,status,expires_at)
+	values ($1,$2,$3,crypt($4, gen_salt('bf')),'PENDING',now() + make_interval(hours => $5)) returning expires_at`,
+		prizeId, customerId, transactionId, code, PrizeClaimDeadlineHours()).Scan(&expiresAt)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return code, expiresAt, nil
+}
+
+// ResendPrizeClaim replace the code of a PENDING claim and reset its wrong tries, the claim deadline is kept.
+// the new code is only returned to be sent to the winner
+func ResendPrizeClaim(tx pgx.Tx, claimId int) (string, time.Time, error) {
+	var status string
+	var expiresAt time.Time
+	var isExpired bool
+	err := tx.QueryRow(ctx, `select status,expires_at,expires_at < now() from prize_claim where id=$1 for update`, claimId).Scan(&status, &expiresAt, &isExpired)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", time.Time{}, ErrClaimNotFound
+		}
+		return "", time.Time{}, err
+	}
+	if status == "VERIFIED" {
+		return "", expiresAt, ErrClaimVerified
+	} else if status == "EXPIRED" || isExpired {
+		return "", expiresAt, ErrClaimExpired
+	}
+	code, err := GenerateOTP(6)
+	if err != nil {
+		return "", expiresAt, err
+	}
+	_, err = tx.Exec(ctx, `update prize_claim set claim_code=crypt($1, gen_salt('bf')),attempts=0 where id=$2`, code, claimId)
+	if err != nil {
+		return "", expiresAt, err
+	}
+	return code, expiresAt, nil
+}
+
+// VerifyPrizeClaim check the claim code and the winner national ID, wrong tries are counted.
+// registerMissingId allow an agent (who saw the ID card) to save the ID when the customer has none
+func VerifyPrizeClaim(db *pgxpool.Pool, claimId int, claimCode string, idNumber string, channel string, operatorId *int, registerMissingId bool) (int, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+	var status string
+	var attempts, customerId int
+	var storedId *string
+	var codeMatch, isExpired bool
+	err = tx.QueryRow(ctx, `select pc.status,pc.attempts,pc.expires_at < now(),pc.customer_id,c.id_number,(pc.claim_code = crypt($2, pc.claim_code))
+	from prize_claim pc inner join customer c on c.id = pc.customer_id where pc.id=$1 for update of pc`, claimId, claimCode).
+		Scan(&status, &attempts, &isExpired, &customerId, &storedId, &codeMatch)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ErrClaimNotFound
+		}
+		return 0, err
+	}
+	if status == "VERIFIED" {
+		return customerId, ErrClaimVerified
+	} else if status == "EXPIRED" || isExpired {
+		return customerId, ErrClaimExpired
+	} else if attempts >= ClaimMaxAttempts {
+		return customerId, ErrClaimLocked
+	}
+	idNumber = strings.TrimSpace(idNumber)
+	var claimErr error
+	if !codeMatch {
+		claimErr = ErrClaimInvalidCode
+	} else if storedId != nil && *storedId != "" && *storedId != idNumber {
+		claimErr = ErrClaimIdMismatch
+	} else if (storedId == nil || *storedId == "") && !registerMissingId {
+		//nothing to compare with, the winner has to visit an agent
+		return customerId, ErrClaimIdMissing
+	}
+	if claimErr != nil {
+		_, err = tx.Exec(ctx, `update prize_claim set attempts = attempts + 1 where id=$1`, claimId)
+		if err != nil {
+			return customerId, err
+		}
+		if err = tx.Commit(ctx); err != nil {
+			return customerId, err
+		}
+		return customerId, claimErr
+	}
+	if storedId == nil || *storedId == "" {
+		_, err = tx.Exec(ctx, `update customer set id_number=$1 where id=$2`, idNumber, customerId)
+		if err != nil {
+			return customerId, err
+		}
+	}
+	_, err = tx.Exec(ctx, `update prize_claim set status='VERIFIED',channel=$1,verified_by=$2,verified_at=now() where id=$3`, channel, operatorId, claimId)
+	if err != nil {
+		return customerId, err
+	}
+	return customerId, tx.Commit(ctx)
+}
@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// values an exclusion can match, they are stored hashed like customer.phone_hash
+const (
+	ExclusionPhone      = "PHONE"
+	ExclusionNationalId = "NATIONAL_ID"
+	ExclusionMomoName   = "MOMO_NAME"
+)
+
+// ExclusionHit is an exclusion matched by a winner
+type ExclusionHit struct {
+	ExclusionId   int
+	ExclusionType string
+	CustomerId    int
+	Context       string // draw or instant_win
+	PrizeTypeId   int
+	EntryId       int
+}
+
+// ExclusionValue normalize the value of an exclusion and return its hash and the masked value shown to operators
+func ExclusionValue(exclusionType string, value string) ([]byte, string, error) {
+	value = strings.TrimSpace(value)
+	var normalized, masked string
+	switch exclusionType {
+	case ExclusionPhone:
+		digits := strings.ReplaceAll(value, " ", "")
+		if !isNumeric(strings.TrimPrefix(digits, "+")) {
+			return nil, "", errors.New("phone should contain only digits")
+		}
+		normalized = NormalizePhone(digits)
+		if len(normalized) != 12 {
+			return nil, "", errors.New("phone should have 12 digits with the country code")
+		}
+		masked = MaskPhone(normalized)
+	case ExclusionNationalId:
+		normalized = strings.ToUpper(strings.Join(strings.Fields(value), ""))
+		if len(normalized) < 8 {
+			return nil, "", errors.New("national ID is too short")
+		}
+		masked = normalized[:3] + strings.Repeat("*", len(normalized)-5) + normalized[len(normalized)-2:]
+	case ExclusionMomoName:
+		hash := MomoNamesHash(value)
+		if hash == nil {
+			return nil, "", errors.New("MoMo name is empty")
+		}
+		words := strings.Fields(strings.ToUpper(value))
+		for i, word := range words {
+			words[i] = word[:1] + strings.Repeat("*", len(word)-1)
+		}
+		return hash, strings.Join(words, " "), nil
+	default:
+		return nil, "", fmt.Errorf("unknown exclusion type %s", exclusionType)
+	}
+	hash := sha256.Sum256([]byte(normalized))
+	return hash[:], masked, nil
+}
+
+// MatchPrizeExclusion return the first ACTIVE exclusion matching the phone, national ID or MoMo name of the customer, nil when none matches
+func MatchPrizeExclusion(db Querier, customerId int) (*ExclusionHit, error) {
+	hit := ExclusionHit{CustomerId: customerId}
+	err := db.QueryRow(ctx, `select x.id,x.exclusion_type from prize_exclusion x inner join customer c on c.id = $1 where x.status = 'ACTIVE' and (
+	(x.exclusion_type = 'PHONE' and x.value_hash = c.phone_hash)
+	or (x.exclusion_type = 'NATIONAL_ID' and c.id_number is not null and x.value_hash = digest(upper(regexp_replace(c.id_number,'\s','','g')),'sha256'))
+	or (x.exclusion_type = 'MOMO_NAME' and x.value_hash = c.momo_names_hash)) limit 1`, customerId).Scan(&hit.ExclusionId, &hit.ExclusionType)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &hit, nil
+}
+
+// RecordExclusionHit save the hit in the activity log, operatorId is nil for instant wins
+func RecordExclusionHit(DB *pgxpool.Pool, hit ExclusionHit, operatorId *int, ipAddress string, serviceName string) {
+	extra, _ := json.Marshal(map[string]interface{}{
+		"exclusion_id":   hit.ExclusionId,
+		"exclusion_type": hit.ExclusionType,
+		"customer_id":    hit.CustomerId,
+		"prize_type_id":  hit.PrizeTypeId,
+		"entry_id":       hit.EntryId,
+		"context":        hit.Context,
+	})
+	_, err := DB.Exec(ctx, `insert into activity_logs (user_id,activity_type,status,description,ip_address,extra) values ($1,'prize_exclusion','failure',$2,nullif($3,'')::inet,$4)`,
+		operatorId, fmt.Sprintf("customer #%d excluded from %s by %s exclusion #%d", hit.CustomerId, hit.Context, hit.ExclusionType, hit.ExclusionId), ipAddress, extra)
+	if err != nil {
+		LogMessage("critical", "RecordExclusionHit: could not insert activity log: "+err.Error(), serviceName)
+	}
+}
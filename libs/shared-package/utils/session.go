@@ -0,0 +1,279 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+	"web-service/model"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/spf13/viper"
+)
+
+// errors of the session store, their text is returned to the client
+var ErrSessionNotFound = errors.New("token not found or expired")
+var ErrRefreshTokenReused = errors.New("refresh token already used, the session has been revoked")
+
+// Session is a login of a user, the access token is short lived and renewed with the refresh token.
+// tokens are random and only their sha256 is kept in redis, the user index allows to revoke all sessions of a user
+type Session struct {
+	Id          string            `json:"id"`
+	User        model.UserProfile `json:"user"`
+	IPAddress   string            `json:"ip_address"`
+	UserAgent   string            `json:"user_agent"`
+	AccessHash  string            `json:"access_hash"`
+	RefreshHash string            `json:"refresh_hash"`
+	CreatedAt   time.Time         `json:"created_at"`
+	RefreshedAt time.Time         `json:"refreshed_at"`
+	ExpiresAt   time.Time         `json:"expires_at"`
+}
+
+// SessionTokens are returned to the client on login and refresh
+type SessionTokens struct {
+	SessionId    string `json:"-"`
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    int    `json:"expiresIn"`
+}
+
+// SessionAccessTTL is the lifetime of an access token, session.access_ttl in minutes
+func SessionAccessTTL() time.Duration {
+	if ttl := viper.GetInt("session.access_ttl"); ttl > 0 {
+		return time.Duration(ttl) * time.Minute
+	}
+	return 15 * time.Minute
+}
+
+// SessionRefreshTTL is the lifetime of a refresh token, session.refresh_ttl in minutes. a session which is not refreshed within it ends
+func SessionRefreshTTL() time.Duration {
+	if ttl := viper.GetInt("session.refresh_ttl"); ttl > 0 {
+		return time.Duration(ttl) * time.Minute
+	}
+	return SessionExpirationTime * time.Minute
+}
+
+// TokenHash is the key of a token in redis
+func TokenHash(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// RandomToken return 32 random bytes, url safe encoded
+func RandomToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+func sessionKey(sessionId string) string {
+	return "session:" + sessionId
+}
+func accessTokenKey(hash string) string {
+	return "session:access:" + hash
+}
+func refreshTokenKey(hash string) string {
+	return "session:refresh:" + hash
+}
+func usedRefreshTokenKey(hash string) string {
+	return "session:refresh_used:" + hash
+}
+func userSessionsKey(userId int) string {
+	return fmt.Sprintf("session:user:%d", userId)
+}
+
+// issueSessionTokens generate a new token pair for the session and save it, the previous pair is no longer valid
+func issueSessionTokens(rdb *redis.Client, session *Session) (*SessionTokens, error) {
+	accessToken, err := RandomToken()
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := RandomToken()
+	if err != nil {
+		return nil, err
+	}
+	previousAccess, previousRefresh := session.AccessHash, session.RefreshHash
+	session.AccessHash, session.RefreshHash = TokenHash(accessToken), TokenHash(refreshToken)
+	session.RefreshedAt = time.Now()
+	session.ExpiresAt = session.RefreshedAt.Add(SessionRefreshTTL())
+	sessionData, err := json.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if previousAccess != "" {
+			pipe.Del(ctx, accessTokenKey(previousAccess), refreshTokenKey(previousRefresh))
+			pipe.Set(ctx, usedRefreshTokenKey(previousRefresh), session.Id, SessionRefreshTTL())
+		}
+		pipe.Set(ctx, sessionKey(session.Id), sessionData, SessionRefreshTTL())
+		pipe.Set(ctx, accessTokenKey(session.AccessHash), session.Id, SessionAccessTTL())
+		pipe.Set(ctx, refreshTokenKey(session.RefreshHash), session.Id, SessionRefreshTTL())
+		pipe.SAdd(ctx, userSessionsKey(session.User.Id), session.Id)
+		pipe.Expire(ctx, userSessionsKey(session.User.Id), SessionRefreshTTL())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &SessionTokens{
+		SessionId:    session.Id,
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(SessionAccessTTL().Seconds()),
+	}, nil
+}
+
+// CreateSession start a session for the user and return its tokens
+func CreateSession(rdb *redis.Client, user model.UserProfile, ipAddress, userAgent string) (*SessionTokens, error) {
+	sessionId, err := RandomToken()
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate session id for user %d, error: %s", user.Id, err.Error())
+	}
+	user.AccessToken, user.SessionId = "", ""
+	session := &Session{
+		Id:        sessionId[:22],
+		User:      user,
+		IPAddress: ipAddress,
+		UserAgent: userAgent,
+		CreatedAt: time.Now(),
+	}
+	tokens, err := issueSessionTokens(rdb, session)
+	if err != nil {
+		return nil, fmt.Errorf("unable to save session for user %d, error: %s", user.Id, err.Error())
+	}
+	return tokens, nil
+}
+
+// GetSession return the session with the given id
+func GetSession(rdb *redis.Client, sessionId string) (*Session, error) {
+	sessionData, err := rdb.Get(ctx, sessionKey(sessionId)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	session := &Session{}
+	if err = json.Unmarshal(sessionData, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// SessionFromAccessToken return the session an access token belongs to
+func SessionFromAccessToken(rdb *redis.Client, accessToken string) (*Session, error) {
+	sessionId, err := rdb.Get(ctx, accessTokenKey(TokenHash(accessToken))).Result()
+	if err == redis.Nil {
+		return nil, ErrSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return GetSession(rdb, sessionId)
+}
+
+// UpdateSessionUser replace the user saved in the session, e.g once the password changed. its expiry is kept
+func UpdateSessionUser(rdb *redis.Client, sessionId string, user model.UserProfile) error {
+	session, err := GetSession(rdb, sessionId)
+	if err != nil {
+		return err
+	}
+	user.AccessToken, user.SessionId = "", ""
+	session.User = user
+	sessionData, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return rdb.Set(ctx, sessionKey(sessionId), sessionData, redis.KeepTTL).Err()
+}
+
+// RefreshSession exchange a refresh token for a new token pair. a refresh token can only be used once,
+// presenting it again means it leaked and the whole session is revoked
+func RefreshSession(rdb *redis.Client, refreshToken string) (*Session, *SessionTokens, error) {
+	hash := TokenHash(refreshToken)
+	sessionId, err := rdb.Get(ctx, refreshTokenKey(hash)).Result()
+	if err == redis.Nil {
+		reusedId, err := rdb.Get(ctx, usedRefreshTokenKey(hash)).Result()
+		if err == nil {
+			if session, err := GetSession(rdb, reusedId); err == nil {
+				RevokeSession(rdb, session.User.Id, session.Id)
+				return session, nil, ErrRefreshTokenReused
+			}
+		}
+		return nil, nil, ErrSessionNotFound
+	} else if err != nil {
+		return nil, nil, err
+	}
+	session, err := GetSession(rdb, sessionId)
+	if err != nil {
+		return nil, nil, err
+	}
+	tokens, err := issueSessionTokens(rdb, session)
+	if err != nil {
+		return nil, nil, err
+	}
+	return session, tokens, nil
+}
+
+// RevokeSession end a session of the user, its tokens stop working immediately
+func RevokeSession(rdb *redis.Client, userId int, sessionId string) error {
+	session, err := GetSession(rdb, sessionId)
+	if err != nil {
+		rdb.SRem(ctx, userSessionsKey(userId), sessionId)
+		return err
+	}
+	if session.User.Id != userId {
+		return ErrSessionNotFound
+	}
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, sessionKey(session.Id), accessTokenKey(session.AccessHash), refreshTokenKey(session.RefreshHash))
+		pipe.SRem(ctx, userSessionsKey(userId), session.Id)
+		return nil
+	})
+	return err
+}
+
+// RevokeUserSessions end all sessions of the user except the given one, it returns the number of revoked sessions
+func RevokeUserSessions(rdb *redis.Client, userId int, exceptSessionId string) (int, error) {
+	sessionIds, err := rdb.SMembers(ctx, userSessionsKey(userId)).Result()
+	if err != nil {
+		return 0, err
+	}
+	revoked := 0
+	for _, sessionId := range sessionIds {
+		if sessionId == exceptSessionId {
+			continue
+		}
+		err = RevokeSession(rdb, userId, sessionId)
+		if err == nil {
+			revoked++
+		} else if !errors.Is(err, ErrSessionNotFound) {
+			return revoked, err
+		}
+	}
+	return revoked, nil
+}
+
+// ListUserSessions return the active sessions of the user, the expired ones are removed from the index
+func ListUserSessions(rdb *redis.Client, userId int) ([]Session, error) {
+	sessionIds, err := rdb.SMembers(ctx, userSessionsKey(userId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	sessions := []Session{}
+	for _, sessionId := range sessionIds {
+		session, err := GetSession(rdb, sessionId)
+		if errors.Is(err, ErrSessionNotFound) {
+			rdb.SRem(ctx, userSessionsKey(userId), sessionId)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	}
+	return sessions, nil
+}
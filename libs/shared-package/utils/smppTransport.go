@@ -0,0 +1,229 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiorix/go-smpp/smpp"
+	"github.com/fiorix/go-smpp/smpp/pdu"
+	"github.com/fiorix/go-smpp/smpp/pdu/pdufield"
+	"github.com/spf13/viper"
+)
+
+var ErrSMPPNotBound = errors.New("smpp bind is not connected")
+var ErrSMPPWindowFull = errors.New("smpp window is full, no response from the smsc")
+
+// SMPPBindConfig is the transceiver bind of one mobile network operator
+type SMPPBindConfig struct {
+	Operator    string // MTN or AIRTEL, see SMSOperator
+	Address     string
+	User        string
+	Password    string
+	SystemType  string
+	WindowSize  int           // max submit_sm waiting for a response
+	Throughput  int           // max PDUs per second
+	EnquireLink time.Duration // keep alive interval
+	RespTimeout time.Duration
+}
+
+// SMPPBindConfigs read the binds configured under smpp.mtn and smpp.airtel, operators without address are skipped
+func SMPPBindConfigs() []SMPPBindConfig {
+	configs := []SMPPBindConfig{}
+	for _, mno := range []string{"mtn", "airtel"} {
+		key := "smpp." + mno + "."
+		if viper.GetString(key+"address") == "" {
+			continue
+		}
+		configs = append(configs, SMPPBindConfig{
+			Operator:    strings.ToUpper(mno),
+			Address:     viper.GetString(key + "address"),
+			User:        viper.GetString(key + "user"),
+			Password:    viper.GetString(key + "password"),
+			SystemType:  viper.GetString(key + "system_type"),
+			WindowSize:  viper.GetInt(key + "window_size"),
+			Throughput:  viper.GetInt(key + "throughput"),
+			EnquireLink: time.Duration(viper.GetInt(key+"enquire_link")) * time.Second,
+			RespTimeout: time.Duration(viper.GetInt(key+"resp_timeout")) * time.Second,
+		})
+	}
+	return configs
+}
+
+// smppThrottle space out PDUs to respect the throughput agreed with the smsc
+type smppThrottle struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func (t *smppThrottle) Wait(ctx context.Context) error {
+	t.mu.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	wait := t.next.Sub(now)
+	t.next = t.next.Add(t.interval)
+	t.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type smppBind struct {
+	config    SMPPBindConfig
+	trx       *smpp.Transceiver
+	window    chan struct{}
+	connected atomic.Bool
+}
+
+// SMPPSender keep one transceiver bind per operator, delivery receipts come back on the same bind
+type SMPPSender struct {
+	binds       map[string]*smppBind
+	serviceName string
+}
+
+// NewSMPPSender bind to every operator, the binds are re-established with an increasing delay when the connection is lost
+func NewSMPPSender(configs []SMPPBindConfig, handler func(p pdu.Body), serviceName string) *SMPPSender {
+	sender := &SMPPSender{binds: map[string]*smppBind{}, serviceName: serviceName}
+	for _, config := range configs {
+		if config.WindowSize <= 0 {
+			config.WindowSize = 10
+		}
+		if config.EnquireLink <= 0 {
+			config.EnquireLink = 30 * time.Second
+		}
+		if config.RespTimeout <= 0 {
+			config.RespTimeout = 10 * time.Second
+		}
+		bind := &smppBind{config: config, window: make(chan struct{}, config.WindowSize)}
+		bind.trx = &smpp.Transceiver{
+			Addr:        config.Address,
+			User:        config.User,
+			Passwd:      config.Password,
+			SystemType:  config.SystemType,
+			EnquireLink: config.EnquireLink,
+			RespTimeout: config.RespTimeout,
+			Handler:     handler,
+		}
+		if config.Throughput > 0 {
+			bind.trx.RateLimiter = &smppThrottle{interval: time.Second / time.Duration(config.Throughput)}
+		}
+		go sender.watch(bind, bind.trx.Bind())
+		sender.binds[config.Operator] = bind
+	}
+	return sender
+}
+
+// watch follow the connection status of the bind until it is closed
+func (s *SMPPSender) watch(bind *smppBind, status <-chan smpp.ConnStatus) {
+	for event := range status {
+		if event.Status() == smpp.Connected {
+			bind.connected.Store(true)
+			LogMessage("info", fmt.Sprintf("SMPP: %s bound to %s", bind.config.Operator, bind.config.Address), s.serviceName)
+			continue
+		}
+		bind.connected.Store(false)
+		message := fmt.Sprintf("SMPP: %s bind to %s %s", bind.config.Operator, bind.config.Address, strings.ToLower(event.Status().String()))
+		if event.Error() != nil {
+			message += ", err: " + event.Error().Error()
+		}
+		LogMessage("critical", message, s.serviceName)
+	}
+	bind.connected.Store(false)
+}
+
+// Connected check if the bind of the operator is up
+func (s *SMPPSender) Connected(operator string) bool {
+	bind, ok := s.binds[operator]
+	return ok && bind.connected.Load()
+}
+
+// Send submit the sms on the bind of the phone operator, long messages are split with a user data header.
+// the message id of each part is returned, an error keeps the sms in the outbox for a retry
+func (s *SMPPSender) Send(phoneNumber string, message string, senderName string) ([]string, error) {
+	operator := SMSOperator(phoneNumber)
+	bind, ok := s.binds[operator]
+	if !ok {
+		return nil, fmt.Errorf("no smpp bind configured for %s", operator)
+	}
+	if !bind.connected.Load() {
+		return nil, ErrSMPPNotBound
+	}
+	select {
+	case bind.window <- struct{}{}:
+	case <-time.After(bind.config.RespTimeout):
+		return nil, ErrSMPPWindowFull
+	}
+	defer func() { <-bind.window }()
+	sm := &smpp.ShortMessage{
+		Src:         senderName,
+		Dst:         smppDestination(phoneNumber),
+		Text:        SMSText(message),
+		Register:    pdufield.FinalDeliveryReceipt,
+		DestAddrTON: 1,
+		DestAddrNPI: 1,
+	}
+	if isNumeric(senderName) {
+		sm.SourceAddrTON, sm.SourceAddrNPI = 1, 1
+	} else {
+		sm.SourceAddrTON = 5 //alphanumeric sender id
+	}
+	if SMSSegments(message) > 1 {
+		parts, err := bind.trx.SubmitLongMsg(sm)
+		if err != nil {
+			return nil, err
+		}
+		messageIds := make([]string, len(parts))
+		for i := range parts {
+			messageIds[i] = parts[i].RespID()
+		}
+		return messageIds, nil
+	}
+	resp, err := bind.trx.Submit(sm)
+	if err != nil {
+		return nil, err
+	}
+	return []string{resp.RespID()}, nil
+}
+
+// Close unbind from all operators
+func (s *SMPPSender) Close() {
+	for _, bind := range s.binds {
+		bind.trx.Close()
+	}
+}
+
+// smppDestination format the phone in international format without +, e.g 250788000000
+func smppDestination(phoneNumber string) string {
+	phone := strings.TrimPrefix(strings.TrimSpace(phoneNumber), "+")
+	if strings.HasPrefix(phone, "0") {
+		phone = "250" + phone[1:]
+	} else if !strings.HasPrefix(phone, "250") {
+		phone = "250" + phone
+	}
+	return phone
+}
+
+func isNumeric(value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, r := range value {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,221 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fiorix/go-smpp/smpp/pdu"
+	"github.com/fiorix/go-smpp/smpp/pdu/pdufield"
+	"github.com/fiorix/go-smpp/smpp/pdu/pdutlv"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/spf13/viper"
+)
+
+var ErrSMSNotFound = errors.New("sms not found or already in a final state")
+
+// SMSDeliveryReport is a delivery report (DLR) received from the provider or the SMSC
+type SMSDeliveryReport struct {
+	MessageId string
+	State     string // DELIVRD, EXPIRED, UNDELIV, REJECTD, ... as sent by the SMSC
+	ErrorCode string
+	DoneAt    *time.Time
+}
+
+// message_state values of the SMPP receipted message (SMPP 3.4, 5.2.28)
+var smppMessageStates = map[byte]string{
+	1: "ENROUTE",
+	2: "DELIVRD",
+	3: "EXPIRED",
+	4: "DELETED",
+	5: "UNDELIV",
+	6: "ACCEPTD",
+	7: "UNKNOWN",
+	8: "REJECTD",
+}
+
+var receiptFieldRegex = regexp.MustCompile(`(?i)(id|stat|err|done date):(\S+)`)
+
+// SMSDeliveryStatus map the SMSC state to the sms status, an empty status means the message is not yet in a final state
+func SMSDeliveryStatus(state string) string {
+	switch strings.ToUpper(strings.TrimSpace(state)) {
+	case "DELIVRD", "DELIVERED":
+		return "DELIVERED"
+	case "EXPIRED":
+		return "EXPIRED"
+	case "UNDELIV", "UNDELIVERABLE", "REJECTD", "REJECTED", "DELETED", "UNKNOWN", "FAILED":
+		return "UNDELIVERABLE"
+	}
+	return ""
+}
+
+// ParseSMPPReceipt read the receipt text of a deliver_sm,
+// format: id:IIIIIIIIII sub:SSS dlvrd:DDD submit date:YYMMDDhhmm done date:YYMMDDhhmm stat:DDDDDDD err:E text:...
+func ParseSMPPReceipt(text string) SMSDeliveryReport {
+	report := SMSDeliveryReport{}
+	for _, match := range receiptFieldRegex.FindAllStringSubmatch(text, -1) {
+		switch strings.ToLower(match[1]) {
+		case "id":
+			report.MessageId = match[2]
+		case "stat":
+			report.State = match[2]
+		case "err":
+			report.ErrorCode = match[2]
+		case "done date":
+			report.DoneAt = parseReceiptDate(match[2])
+		}
+	}
+	return report
+}
+
+// receipt dates are in the SMSC local time
+func parseReceiptDate(value string) *time.Time {
+	location, err := time.LoadLocation(viper.GetString("timezone"))
+	if err != nil || viper.GetString("timezone") == "" {
+		location, err = time.LoadLocation("Africa/Kigali")
+		if err != nil {
+			location = time.UTC
+		}
+	}
+	for _, layout := range []string{"0601021504", "060102150405"} {
+		if len(value) != len(layout) {
+			continue
+		}
+		if date, err := time.ParseInLocation(layout, value, location); err == nil {
+			date = date.UTC()
+			return &date
+		}
+	}
+	return nil
+}
+
+// SaveSMSDeliveryReport update the sms of the report, ErrSMSNotFound is returned when no SENT sms has the message id
+func SaveSMSDeliveryReport(DB *pgxpool.Pool, report SMSDeliveryReport) (string, error) {
+	if report.MessageId == "" {
+		return "", ErrSMSNotFound
+	}
+	status := SMSDeliveryStatus(report.State)
+	//each part of a long message has its own report
+	if partStatus, err := saveSMSPartReport(DB, report, status); !errors.Is(err, ErrSMSNotFound) {
+		return partStatus, err
+	}
+	if status == "" {
+		//intermediate state, only note that the report was received
+		cmd, err := DB.Exec(ctx, `update sms set dlr_received_at=now() where message_id=$1 and status='SENT'`, report.MessageId)
+		if err == nil && cmd.RowsAffected() == 0 {
+			err = ErrSMSNotFound
+		}
+		return "SENT", err
+	}
+	cmd, err := DB.Exec(ctx, `update sms set status=$2, error_code=$3, delivered_at=coalesce($4, now()), dlr_received_at=now()
+	where message_id=$1 and status='SENT'`, report.MessageId, status, smsErrorCode(report.ErrorCode), report.DoneAt)
+	if err != nil {
+		return status, err
+	}
+	if cmd.RowsAffected() == 0 {
+		return status, ErrSMSNotFound
+	}
+	return status, nil
+}
+
+// saveSMSPartReport update the part of a long message having the message id, ErrSMSNotFound is returned when it is not a part of a SENT sms.
+// the sms is DELIVERED with its last delivered part and fails with its first failed part
+func saveSMSPartReport(DB *pgxpool.Pool, report SMSDeliveryReport, status string) (string, error) {
+	var smsId int
+	err := DB.QueryRow(ctx, `update sms_part set status=coalesce(nullif($2, ''), status), dlr_received_at=now()
+	where message_id=$1 and sms_id in (select id from sms where status='SENT') returning sms_id`, report.MessageId, status).Scan(&smsId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrSMSNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if status == "" {
+		_, err = DB.Exec(ctx, `update sms set dlr_received_at=now() where id=$1`, smsId)
+		return "SENT", err
+	}
+	//the part is saved before, so when the last parts are reported at once at least one of them sees all the parts delivered
+	cmd, err := DB.Exec(ctx, `update sms set status=$2, error_code=$3, delivered_at=coalesce($4, now()), dlr_received_at=now()
+	where id=$1 and status='SENT' and ($2 <> 'DELIVERED' or not exists (select 1 from sms_part where sms_id=$1 and status is distinct from 'DELIVERED'))`,
+		smsId, status, smsErrorCode(report.ErrorCode), report.DoneAt)
+	if err != nil {
+		return status, err
+	}
+	if cmd.RowsAffected() == 0 {
+		//other parts are not delivered yet
+		_, err = DB.Exec(ctx, `update sms set dlr_received_at=now() where id=$1`, smsId)
+		return "SENT", err
+	}
+	return status, nil
+}
+
+// smsErrorCode is the error code of the report, codes made of zeros mean no error
+func smsErrorCode(code string) *string {
+	if code == "" || strings.Trim(code, "0") == "" {
+		return nil
+	}
+	return &code
+}
+
+// IsSMPPReceipt check if a deliver_sm carries a delivery receipt (esm_class bit 2) and not a mobile originated message
+func IsSMPPReceipt(p pdu.Body) bool {
+	if p.Header().ID != pdu.DeliverSMID {
+		return false
+	}
+	if esmClass, ok := p.Fields()[pdufield.ESMClass]; ok {
+		if raw := esmClass.Bytes(); len(raw) > 0 && raw[0]&0x04 != 0 {
+			return true
+		}
+	}
+	_, hasReceiptedId := p.TLVFields()[pdutlv.TagReceiptedMessageID]
+	return hasReceiptedId
+}
+
+// SMPPDeliveryReport read the delivery report of a deliver_sm, TLVs are preferred to the receipt text when present
+func SMPPDeliveryReport(p pdu.Body) SMSDeliveryReport {
+	report := SMSDeliveryReport{}
+	if shortMessage, ok := p.Fields()[pdufield.ShortMessage]; ok {
+		report = ParseSMPPReceipt(string(shortMessage.Bytes()))
+	}
+	tlvs := p.TLVFields()
+	if receiptedId, ok := tlvs[pdutlv.TagReceiptedMessageID]; ok {
+		report.MessageId = strings.TrimRight(string(receiptedId.Bytes()), "\x00")
+	}
+	if messageState, ok := tlvs[pdutlv.TagMessageStateOption]; ok {
+		if state := messageState.Bytes(); len(state) > 0 {
+			if name, ok := smppMessageStates[state[0]]; ok {
+				report.State = name
+			}
+		}
+	}
+	if networkError, ok := tlvs[pdutlv.TagNetworkErrorCode]; ok {
+		//network type (1 byte) followed by the error code (2 bytes)
+		if code := networkError.Bytes(); len(code) == 3 {
+			report.ErrorCode = fmt.Sprintf("%d:%d", code[0], int(code[1])<<8|int(code[2]))
+		}
+	}
+	return report
+}
+
+// SMPPDeliveryHandler return the handler saving delivery receipts and mobile originated sms received on a SMPP bind
+func SMPPDeliveryHandler(DB *pgxpool.Pool, serviceName string) func(p pdu.Body) {
+	return func(p pdu.Body) {
+		if p.Header().ID != pdu.DeliverSMID {
+			return
+		}
+		if !IsSMPPReceipt(p) {
+			inbound := SMPPInboundSMS(p)
+			if _, err := HandleInboundSMS(DB, inbound); err != nil {
+				LogMessage("critical", "SMPPDeliveryHandler: failed to handle inbound sms of "+inbound.Phone+", err: "+err.Error(), serviceName)
+			}
+			return
+		}
+		report := SMPPDeliveryReport(p)
+		if _, err := SaveSMSDeliveryReport(DB, report); err != nil && !errors.Is(err, ErrSMSNotFound) {
+			LogMessage("critical", "SMPPDeliveryHandler: failed to save delivery report of "+report.MessageId+", err: "+err.Error(), serviceName)
+		}
+	}
+}
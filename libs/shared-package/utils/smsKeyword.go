@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/fiorix/go-smpp/smpp/pdu"
+	"github.com/fiorix/go-smpp/smpp/pdu/pdufield"
+	"github.com/fiorix/go-smpp/smpp/pdu/pdutext"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/spf13/viper"
+)
+
+// keywords a customer can send to the short code
+const (
+	SMSKeywordStop  = "STOP"
+	SMSKeywordStart = "START"
+	SMSKeywordHelp  = "HELP"
+)
+
+// preference sources, tell who changed the sms preference of a customer
+const (
+	SMSPreferenceKeyword = "KEYWORD"
+	SMSPreferenceAdmin   = "ADMIN"
+)
+
+// default words of each keyword, sms_keywords.stop|start|help in config replace them
+var defaultSMSKeywords = map[string][]string{
+	SMSKeywordStop:  {"STOP", "STOPALL", "UNSUBSCRIBE", "HAGARIKA"},
+	SMSKeywordStart: {"START", "SUBSCRIBE", "TANGIRA"},
+	SMSKeywordHelp:  {"HELP", "INFO", "UBUFASHA"},
+}
+
+// transactional sms are sent even to customers who opted out, the others (campaign, ...) are suppressed
+var defaultTransactionalSMSTypes = []string{"password", "reset_password_otp", "two_factor_otp", "account_locked", "account_password", "prize_won", "no_prize", "prize_claim",
+	"fulfilment", "upload_codes", "test", "keyword_reply"}
+
+// InboundSMS is a mobile originated sms received from the webhook or a SMPP bind
+type InboundSMS struct {
+	Phone     string
+	Message   string
+	MessageId string
+	Source    string // WEBHOOK or SMPP
+}
+
+// IsTransactionalSMS check if the message type is sent regardless of the customer preference, see sms.transactional_types
+func IsTransactionalSMS(messageType string) bool {
+	types := viper.GetStringSlice("sms.transactional_types")
+	if len(types) == 0 {
+		types = defaultTransactionalSMSTypes
+	}
+	return slices.Contains(types, messageType)
+}
+
+// NormalizePhone return the phone in the stored format, 250XXXXXXXXX
+func NormalizePhone(phoneNumber string) string {
+	return smppDestination(phoneNumber)
+}
+
+// SMSKeyword return the keyword of the message (first word), empty when the message is not a keyword
+func SMSKeyword(message string) string {
+	words := strings.Fields(strings.ToUpper(message))
+	if len(words) == 0 {
+		return ""
+	}
+	for _, keyword := range []string{SMSKeywordStop, SMSKeywordStart, SMSKeywordHelp} {
+		keywordWords := viper.GetStringSlice("sms_keywords." + strings.ToLower(keyword))
+		if len(keywordWords) == 0 {
+			keywordWords = defaultSMSKeywords[keyword]
+		}
+		for _, word := range keywordWords {
+			if strings.EqualFold(word, words[0]) {
+				return keyword
+			}
+		}
+	}
+	return ""
+}
+
+// SetSMSOptOut change the sms preference of the customer and keep the change in customer_preference_log
+func SetSMSOptOut(tx pgx.Tx, customerId int, optOut bool, source string, reason string, operatorId *int) error {
+	var current bool
+	err := tx.QueryRow(ctx, `select sms_opt_out from customer where id=$1 for update`, customerId).Scan(&current)
+	if err != nil {
+		return err
+	}
+	if current == optOut {
+		return nil
+	}
+	_, err = tx.Exec(ctx, `update customer set sms_opt_out=$2, sms_opt_out_at=case when $2 then now() else null end where id=$1`, customerId, optOut)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `insert into customer_preference_log (customer_id,sms_opt_out,source,reason,operator_id) values ($1,$2,$3,$4,$5)`,
+		customerId, optOut, source, reason, operatorId)
+	return err
+}
+
+// HandleInboundSMS save the inbound sms and apply its keyword: STOP opt the customer out of non transactional sms,
+// START opt them back in and HELP only replies. the reply uses the keyword_<keyword> template in the customer locale
+func HandleInboundSMS(DB *pgxpool.Pool, inbound InboundSMS) (string, error) {
+	inbound.Phone = NormalizePhone(inbound.Phone)
+	keyword := SMSKeyword(inbound.Message)
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return keyword, err
+	}
+	defer tx.Rollback(ctx)
+	var customerId *int
+	locale := SMSTemplateDefaultLang()
+	var id int
+	var customerLocale *string
+	err = tx.QueryRow(ctx, `select id,locale from customer where phone_hash = digest($1,'sha256')`, inbound.Phone).Scan(&id, &customerLocale)
+	if err == nil {
+		customerId = &id
+		if customerLocale != nil && *customerLocale != "" {
+			locale = *customerLocale
+		}
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		return keyword, err
+	}
+	_, err = tx.Exec(ctx, `insert into sms_inbound (phone,message,keyword,customer_id,message_id,source) values ($1,$2,$3,$4,$5,$6)`,
+		inbound.Phone, inbound.Message, keyword, customerId, inbound.MessageId, inbound.Source)
+	if err != nil {
+		return keyword, err
+	}
+	if keyword == "" {
+		return keyword, tx.Commit(ctx)
+	}
+	if customerId != nil && keyword != SMSKeywordHelp {
+		err = SetSMSOptOut(tx, *customerId, keyword == SMSKeywordStop, SMSPreferenceKeyword, inbound.Message, nil)
+		if err != nil {
+			return keyword, err
+		}
+	}
+	_, err = QueueTemplateSMS(tx, "keyword_"+strings.ToLower(keyword), locale, map[string]any{"AppName": viper.GetString("ap_name")},
+		inbound.Phone, viper.GetString("SENDER_ID"), "keyword_reply", customerId)
+	if err != nil && !errors.Is(err, ErrSMSTemplateNotFound) {
+		return keyword, err
+	}
+	return keyword, tx.Commit(ctx)
+}
+
+// SMPPInboundSMS read the mobile originated sms of a deliver_sm
+func SMPPInboundSMS(p pdu.Body) InboundSMS {
+	fields := p.Fields()
+	inbound := InboundSMS{Source: "SMPP"}
+	if sourceAddr, ok := fields[pdufield.SourceAddr]; ok {
+		inbound.Phone = strings.TrimRight(sourceAddr.String(), "\x00")
+	}
+	shortMessage, ok := fields[pdufield.ShortMessage]
+	if !ok {
+		return inbound
+	}
+	var dataCoding byte
+	if coding, ok := fields[pdufield.DataCoding]; ok && len(coding.Bytes()) > 0 {
+		dataCoding = coding.Bytes()[0]
+	}
+	switch pdutext.DataCoding(dataCoding) {
+	case pdutext.UCS2Type:
+		inbound.Message = string(pdutext.UCS2(shortMessage.Bytes()).Decode())
+	case pdutext.Latin1Type:
+		inbound.Message = string(pdutext.Latin1(shortMessage.Bytes()).Decode())
+	default:
+		inbound.Message = string(pdutext.GSM7(shortMessage.Bytes()).Decode())
+	}
+	return inbound
+}
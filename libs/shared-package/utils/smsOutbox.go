@@ -0,0 +1,199 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/spf13/viper"
+)
+
+// Querier is implemented by both *pgxpool.Pool and pgx.Tx, queue sms inside a transaction to save it with the business change
+type Querier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// DBConn is implemented by both *pgxpool.Pool and pgx.Tx, a Begin on a pgx.Tx starts a savepoint
+type DBConn interface {
+	Querier
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// message types whose content must not stay in db once sent, nor be shown while they wait in the queue
+var hiddenSMSTypes = []string{"password", "reset_password_otp", "account_password", "prize_claim", "two_factor_otp"}
+
+// how long a dispatcher owns a sms it is about to send, other dispatchers pick it again once the lease ends
+const smsLease = 5 * time.Minute
+
+// MaskSMSMessage hide the content of the sms carrying a secret (password, otp, claim code)
+func MaskSMSMessage(messageType string, message string) string {
+	if slices.Contains(hiddenSMSTypes, messageType) {
+		return "Message content is hidden for security reasons"
+	}
+	return message
+}
+
+type queuedSMS struct {
+	Id       int
+	Phone    string
+	Message  string
+	SenderId string
+	Type     string
+	Priority int
+	Attempts int
+}
+
+// QueueSMS save the sms as QUEUED with the priority of its type, the dispatcher will send it. return the sms id
+func QueueSMS(db Querier, phoneNumber string, message string, senderName string, messageType string, customerId *int) (int, error) {
+	var smsId int
+	//non transactional sms of customers who opted out are kept as SUPPRESSED and never sent
+	err := db.QueryRow(ctx, `INSERT INTO sms (customer_id, message, phone, type, status, sender_id, network_operator, priority, message_id, credit_count, error_message, next_attempt_at)
+	VALUES ($1, $2, $3, $4, case when not $8 and exists (select 1 from customer where sms_opt_out and (id = $1 or phone_hash = digest($3::text,'sha256')))
+	then 'SUPPRESSED' else 'QUEUED' end, $5, $6, $7, '', 0, '', now()) returning id`,
+		customerId, message, phoneNumber, messageType, senderName, SMSOperator(phoneNumber), SMSPriority(messageType), IsTransactionalSMS(messageType)).Scan(&smsId)
+	return smsId, err
+}
+
+// SMSOperator guess the mobile network operator from the phone prefix (Airtel: 072/073, MTN: 078/079)
+func SMSOperator(phoneNumber string) string {
+	phone := strings.TrimPrefix(strings.TrimPrefix(phoneNumber, "+"), "250")
+	if !strings.HasPrefix(phone, "0") {
+		phone = "0" + phone
+	}
+	if strings.HasPrefix(phone, "073") || strings.HasPrefix(phone, "072") {
+		return "AIRTEL"
+	}
+	return "MTN"
+}
+
+func smsMaxAttempts() int {
+	attempts := viper.GetInt("sms.max_attempts")
+	if attempts <= 0 {
+		attempts = 5
+	}
+	return attempts
+}
+
+func smsBatchSize() int {
+	size := viper.GetInt("sms.batch_size")
+	if size <= 0 {
+		size = 100
+	}
+	return size
+}
+
+// smsRateLimit return the number of sms per second allowed for the sender id
+func smsRateLimit(senderId string) int {
+	limit := viper.GetInt("sms.rate_limit." + strings.ToLower(senderId))
+	if limit <= 0 {
+		limit = viper.GetInt("sms.rate_limit.default")
+	}
+	if limit <= 0 {
+		limit = 20
+	}
+	return limit
+}
+
+// smsRateAllowed count sms sent by the sender id in the current second, shared by all dispatchers through redis
+func smsRateAllowed(redis *redis.Client, senderId string) bool {
+	key := fmt.Sprintf("sms_rate:%s:%d", senderId, time.Now().Unix())
+	count, err := redis.Incr(ctx, key).Result()
+	if err != nil {
+		//do not block sending when redis is down
+		return true
+	}
+	if count == 1 {
+		redis.Expire(ctx, key, 2*time.Second)
+	}
+	return count <= int64(smsRateLimit(senderId))
+}
+
+// renewSMSLease extend the lease of the sms right before it is sent, it fails when the batch lease ended and
+// another dispatcher picked the sms meanwhile (its attempts moved)
+func renewSMSLease(DB *pgxpool.Pool, sms queuedSMS) (bool, error) {
+	result, err := DB.Exec(ctx, `update sms set next_attempt_at = now() + make_interval(secs => $1::int) where id=$2 and status='QUEUED' and attempts=$3`,
+		int(smsLease.Seconds()), sms.Id, sms.Attempts)
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() == 1, nil
+}
+
+// DispatchSMS send a batch of due QUEUED sms, return the number of sms picked.
+// rows are leased by moving next_attempt_at so that other dispatchers skip them, the lease of each sms is renewed
+// before it is sent as a slow batch can outlive it. a message left QUEUED after a crash is picked again once the lease ends
+func DispatchSMS(DB *pgxpool.Pool, redis *redis.Client, serviceName string) int {
+	rows, err := DB.Query(ctx, `update sms set attempts = attempts + 1, next_attempt_at = now() + make_interval(secs => $2::int)
+	where id in (select id from sms where status = 'QUEUED' and next_attempt_at <= now() order by priority desc, id limit $1 for update skip locked)
+	returning id, phone, message, coalesce(sender_id,''), coalesce(type,''), priority, attempts`, smsBatchSize(), int(smsLease.Seconds()))
+	if err != nil {
+		LogMessage("critical", "DispatchSMS: failed to fetch queued sms, err: "+err.Error(), serviceName)
+		return 0
+	}
+	messages := []queuedSMS{}
+	for rows.Next() {
+		sms := queuedSMS{}
+		err = rows.Scan(&sms.Id, &sms.Phone, &sms.Message, &sms.SenderId, &sms.Type, &sms.Priority, &sms.Attempts)
+		if err != nil {
+			LogMessage("critical", "DispatchSMS: failed to read queued sms, err: "+err.Error(), serviceName)
+			continue
+		}
+		messages = append(messages, sms)
+	}
+	rows.Close()
+	for _, sms := range messages {
+		if sms.SenderId == "" {
+			sms.SenderId = viper.GetString("SENDER_ID")
+		}
+		leased, err := renewSMSLease(DB, sms)
+		if err != nil {
+			LogMessage("critical", fmt.Sprintf("DispatchSMS: failed to renew lease of sms #%d, err: %s", sms.Id, err.Error()), serviceName)
+			continue
+		} else if !leased {
+			continue
+		}
+		if !smsRateAllowed(redis, sms.SenderId) {
+			//rate limit reached, give back the lease and the attempt
+			_, err = DB.Exec(ctx, `update sms set attempts = attempts - 1, next_attempt_at = now() + interval '1 second' where id=$1`, sms.Id)
+			if err != nil {
+				LogMessage("critical", "DispatchSMS: failed to release sms, err: "+err.Error(), serviceName)
+			}
+			continue
+		}
+		result, sendErr := SendRoutedSMS(sms.Phone, sms.Message, sms.SenderId, sms.Type, sms.Priority, serviceName)
+		message := MaskSMSMessage(sms.Type, sms.Message)
+		if sendErr == nil {
+			_, err = DB.Exec(ctx, `with sent as (update sms set status='SENT', message_id=$1, message=$2, error_message='', provider=$3, credit_count=$4, sent_at=now()
+			where id=$5 returning id)
+			insert into sms_part (sms_id,part,message_id) select sent.id, part.number, part.message_id from sent, unnest($6::text[]) with ordinality as part(message_id, number)`,
+				result.MessageId, message, result.Provider, result.Credits, sms.Id, result.PartIds)
+		} else if sms.Attempts >= smsMaxAttempts() {
+			_, err = DB.Exec(ctx, `update sms set status='FAILED', message=$1, error_message=left($2, 255) where id=$3`, message, sendErr.Error(), sms.Id)
+		} else {
+			//retry later, wait longer after each failure
+			backoff := sms.Attempts * sms.Attempts * 30
+			_, err = DB.Exec(ctx, `update sms set error_message=left($1, 255), next_attempt_at = now() + make_interval(secs => $2::int) where id=$3`, sendErr.Error(), backoff, sms.Id)
+		}
+		if err != nil {
+			LogMessage("critical", fmt.Sprintf("DispatchSMS: failed to update sms #%d, err: %s", sms.Id, err.Error()), serviceName)
+		}
+	}
+	return len(messages)
+}
+
+// RunSMSDispatcher keep sending queued sms, it is safe to run it on many services at once
+func RunSMSDispatcher(DB *pgxpool.Pool, redis *redis.Client, serviceName string) {
+	for {
+		if DispatchSMS(DB, redis, serviceName) == 0 {
+			time.Sleep(time.Second)
+		}
+	}
+}
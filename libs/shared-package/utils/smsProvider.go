@@ -0,0 +1,262 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiorix/go-smpp/smpp/encoding"
+	"github.com/fiorix/go-smpp/smpp/pdu/pdutext"
+	"github.com/fsnotify/fsnotify"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/spf13/viper"
+)
+
+// SMSProvider is a transport able to hand over a sms, it returns the provider message id,
+// one per part when the parts of a long message are submitted separately
+type SMSProvider interface {
+	Send(phoneNumber string, message string, senderName string) ([]string, error)
+}
+
+// HTTPSMSProvider send sms through a sms service api
+type HTTPSMSProvider struct {
+	Url         string
+	Timeout     time.Duration
+	ServiceName string
+}
+
+func (s *HTTPSMSProvider) Send(phoneNumber string, message string, senderName string) ([]string, error) {
+	messageId, err := sendSMSRequest(s.Url, s.Timeout, phoneNumber, message, senderName, s.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	return []string{messageId}, nil
+}
+
+// sms priorities, the dispatcher sends higher priorities first
+const (
+	SMSPriorityLow    = 0
+	SMSPriorityNormal = 1
+	SMSPriorityHigh   = 2
+)
+
+var smsPriorityNames = map[string]int{"low": SMSPriorityLow, "normal": SMSPriorityNormal, "high": SMSPriorityHigh}
+
+// SMSRoute send the matching sms through the providers in order, the next provider is tried when one fails.
+// empty fields match every sms
+type SMSRoute struct {
+	Operator  string   `mapstructure:"operator"`
+	Types     []string `mapstructure:"types"`
+	Priority  string   `mapstructure:"priority"`
+	Providers []string `mapstructure:"providers"`
+}
+
+type smsProviderConfig struct {
+	Type    string `mapstructure:"type"` // http or smpp
+	Url     string `mapstructure:"url"`
+	Timeout int    `mapstructure:"timeout"` // seconds
+	Cost    int    `mapstructure:"cost"`    // credits per segment
+}
+
+type routedSMSProvider struct {
+	provider SMSProvider
+	cost     int
+}
+
+type smsRouting struct {
+	providers  map[string]routedSMSProvider
+	routes     []SMSRoute
+	priorities map[string]int
+}
+
+// SMSSendResult tell which provider accepted the sms and what it cost
+type SMSSendResult struct {
+	MessageId string
+	PartIds   []string // message id of each part of a long message, saved in sms_part
+	Provider  string
+	Credits   int
+}
+
+var currentSMSRouting atomic.Pointer[smsRouting]
+var smppSender *SMPPSender
+
+// InitializeSMSTransport load the sms routing from sms_routing in config.yml, the file is watched and the routing
+// is reloaded on change. smpp binds are opened once here, changing them needs a restart
+func InitializeSMSTransport(DB *pgxpool.Pool, serviceName string) {
+	if configs := SMPPBindConfigs(); len(configs) > 0 {
+		smppSender = NewSMPPSender(configs, SMPPDeliveryHandler(DB, serviceName), serviceName)
+	}
+	routingConfig := viper.New()
+	routingConfig.SetConfigFile(configFilePath("config.yml"))
+	if err := routingConfig.ReadInConfig(); err != nil {
+		LogMessage("critical", "InitializeSMSTransport: failed to read sms routing, using the main config, err: "+err.Error(), serviceName)
+		routingConfig = viper.GetViper()
+	}
+	if err := LoadSMSRouting(routingConfig, serviceName); err != nil {
+		LogMessage("critical", "InitializeSMSTransport: invalid sms routing, err: "+err.Error(), serviceName)
+	}
+	if routingConfig != viper.GetViper() {
+		routingConfig.OnConfigChange(func(e fsnotify.Event) {
+			if err := LoadSMSRouting(routingConfig, serviceName); err != nil {
+				LogMessage("critical", "InitializeSMSTransport: sms routing not reloaded, err: "+err.Error(), serviceName)
+				return
+			}
+			LogMessage("info", "InitializeSMSTransport: sms routing reloaded", serviceName)
+		})
+		routingConfig.WatchConfig()
+	}
+}
+
+// configFilePath return the path of a file next to config.yml
+func configFilePath(name string) string {
+	if IsTestMode {
+		return "../" + name
+	}
+	return "/app/" + name
+}
+
+// LoadSMSRouting build the providers and routes from sms_routing, the current routing is kept when the config is invalid.
+// without sms_routing every sms goes through the sms.transport provider
+func LoadSMSRouting(config *viper.Viper, serviceName string) error {
+	routing := &smsRouting{providers: map[string]routedSMSProvider{}, priorities: map[string]int{}}
+	providerConfigs := map[string]smsProviderConfig{}
+	if err := config.UnmarshalKey("sms_routing.providers", &providerConfigs); err != nil {
+		return err
+	}
+	if err := config.UnmarshalKey("sms_routing.routes", &routing.routes); err != nil {
+		return err
+	}
+	if len(providerConfigs) == 0 {
+		defaultProvider := smsProviderConfig{Type: config.GetString("sms.transport"), Url: config.GetString("sms_service_url"), Cost: 1}
+		providerConfigs = map[string]smsProviderConfig{"default": defaultProvider}
+		routing.routes = []SMSRoute{{Providers: []string{"default"}}}
+	}
+	for name, providerConfig := range providerConfigs {
+		if providerConfig.Cost <= 0 {
+			providerConfig.Cost = 1
+		}
+		routed := routedSMSProvider{cost: providerConfig.Cost}
+		switch strings.ToLower(providerConfig.Type) {
+		case "smpp":
+			if smppSender == nil {
+				return fmt.Errorf("provider %s: no smpp bind configured", name)
+			}
+			routed.provider = smppSender
+		case "", "http":
+			timeout := time.Duration(providerConfig.Timeout) * time.Second
+			if timeout <= 0 {
+				timeout = 30 * time.Second
+			}
+			routed.provider = &HTTPSMSProvider{Url: providerConfig.Url, Timeout: timeout, ServiceName: serviceName}
+		default:
+			return fmt.Errorf("provider %s: unknown type %s", name, providerConfig.Type)
+		}
+		routing.providers[name] = routed
+	}
+	for i, route := range routing.routes {
+		if _, ok := smsPriorityNames[strings.ToLower(route.Priority)]; route.Priority != "" && !ok {
+			return fmt.Errorf("route %d: unknown priority %s", i+1, route.Priority)
+		}
+		if len(route.Providers) == 0 {
+			return fmt.Errorf("route %d: no provider", i+1)
+		}
+		for _, name := range route.Providers {
+			if _, ok := routing.providers[name]; !ok {
+				return fmt.Errorf("route %d: unknown provider %s", i+1, name)
+			}
+		}
+	}
+	for messageType, name := range config.GetStringMapString("sms_routing.priorities") {
+		priority, ok := smsPriorityNames[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("type %s: unknown priority %s", messageType, name)
+		}
+		routing.priorities[messageType] = priority
+	}
+	currentSMSRouting.Store(routing)
+	return nil
+}
+
+// SMSPriority return the priority configured for the message type, normal by default
+func SMSPriority(messageType string) int {
+	if routing := currentSMSRouting.Load(); routing != nil {
+		if priority, ok := routing.priorities[messageType]; ok {
+			return priority
+		}
+	}
+	return SMSPriorityNormal
+}
+
+// providers of the first route matching the sms
+func (r *smsRouting) route(operator string, messageType string, priority int) []string {
+	for _, route := range r.routes {
+		if route.Operator != "" && !strings.EqualFold(route.Operator, operator) {
+			continue
+		}
+		if len(route.Types) > 0 && !slices.Contains(route.Types, messageType) {
+			continue
+		}
+		if route.Priority != "" && smsPriorityNames[strings.ToLower(route.Priority)] != priority {
+			continue
+		}
+		return route.Providers
+	}
+	return nil
+}
+
+// SendRoutedSMS send the sms through the providers of its route, failing over to the next provider on error or timeout
+func SendRoutedSMS(phoneNumber string, message string, senderName string, messageType string, priority int, serviceName string) (SMSSendResult, error) {
+	routing := currentSMSRouting.Load()
+	if routing == nil {
+		//transport not initialized, e.g in tests
+		routing = &smsRouting{
+			providers: map[string]routedSMSProvider{"default": {provider: &HTTPSMSProvider{Url: viper.GetString("sms_service_url"), Timeout: 30 * time.Second, ServiceName: serviceName}, cost: 1}},
+			routes:    []SMSRoute{{Providers: []string{"default"}}},
+		}
+	}
+	operator := SMSOperator(phoneNumber)
+	providers := routing.route(operator, messageType, priority)
+	if len(providers) == 0 {
+		return SMSSendResult{}, fmt.Errorf("no sms route for %s %s", operator, messageType)
+	}
+	failures := []string{}
+	for _, name := range providers {
+		routed := routing.providers[name]
+		messageIds, err := routed.provider.Send(phoneNumber, message, senderName)
+		if err == nil {
+			result := SMSSendResult{MessageId: messageIds[0], Provider: name, Credits: SMSSegments(message) * routed.cost}
+			if len(messageIds) > 1 {
+				result.PartIds = messageIds
+			}
+			return result, nil
+		}
+		failures = append(failures, name+": "+err.Error())
+	}
+	return SMSSendResult{}, errors.New(strings.Join(failures, "; "))
+}
+
+// SMSText encode the message in GSM 7-bit when possible, UCS-2 otherwise
+func SMSText(message string) pdutext.Codec {
+	if len(encoding.ValidateGSM7String(message)) == 0 {
+		return pdutext.GSM7(message)
+	}
+	return pdutext.UCS2(message)
+}
+
+// SMSSegments return the number of parts the message is split into,
+// a single sms holds 160 GSM 7-bit or 70 UCS-2 characters, the user data header takes room in each part of a long message
+func SMSSegments(message string) int {
+	text := SMSText(message)
+	length := len(text.Encode())
+	singleLength, partLength := 160, 152
+	if text.Type() == pdutext.UCS2Type {
+		singleLength, partLength = 140, 132
+	}
+	if length <= singleLength {
+		return 1
+	}
+	return (length-1)/partLength + 1
+}
@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/spf13/viper"
+)
+
+var ErrSMSTemplateNotFound = errors.New("sms template not found")
+
+// SMSTemplateSampleData is used to preview a template when no data is given, it lists the placeholders available to templates
+var SMSTemplateSampleData = map[string]any{
+	"Name":          "KALISA Jean",
+	"Amount":        10000,
+	"Code":          "AB12CD34",
+	"PrizeType":     "Weekly prize",
+	"ClaimDeadline": "31/12/2025 18:00",
+	"Password":      "Pass@1234",
+	"OTP":           "123456",
+	"AppName":       "BRALIRWA",
+	"Total":         1000,
+	"Duplicates":    3,
+	"Invalid":       2,
+	"Duration":      "2.5s",
+	"Error":         "invalid file",
+	"Reference":     "BTL-2025-001",
+	"Place":         "Kigali, Kicukiro",
+	"PickupDate":    "31/12/2025 10:00",
+}
+
+// prefix of the winner sms templates, see PrizeTypeTemplate
+const prizeTypeTemplatePrefix = "prize_type."
+
+// prizeTypeTemplatePlaceholders are the only placeholders the winner sms of a prize type is rendered with
+var prizeTypeTemplatePlaceholders = []string{"Name", "Amount", "Code", "PrizeType", "ClaimDeadline"}
+
+// SMSTemplateSample return the sample data of the template, limited to the placeholders it is sent with
+// so a template using a placeholder it never gets is refused instead of failing when it is sent
+func SMSTemplateSample(name string) map[string]any {
+	data := map[string]any{}
+	if strings.HasPrefix(name, prizeTypeTemplatePrefix) {
+		for _, key := range prizeTypeTemplatePlaceholders {
+			data[key] = SMSTemplateSampleData[key]
+		}
+		return data
+	}
+	for key, value := range SMSTemplateSampleData {
+		data[key] = value
+	}
+	return data
+}
+
+// SMSTemplateDefaultLang is the locale used when a template has no version in the customer locale
+func SMSTemplateDefaultLang() string {
+	lang := viper.GetString("sms_template.default_lang")
+	if lang == "" {
+		lang = "en"
+	}
+	return lang
+}
+
+// ParseSMSTemplate check the template syntax, placeholders use text/template e.g {{.Name}}
+func ParseSMSTemplate(body string) (*template.Template, error) {
+	return template.New("sms").Option("missingkey=error").Parse(body)
+}
+
+// ExecuteSMSTemplate render the template body with the data
+func ExecuteSMSTemplate(body string, data map[string]any) (string, error) {
+	tmpl, err := ParseSMSTemplate(body)
+	if err != nil {
+		return "", err
+	}
+	if data == nil {
+		data = map[string]any{}
+	}
+	message := strings.Builder{}
+	if err = tmpl.Execute(&message, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(message.String()), nil
+}
+
+// GetSMSTemplate return the active body of the template in the locale, falling back to the default locale
+func GetSMSTemplate(db Querier, name string, lang string) (string, error) {
+	var body string
+	err := db.QueryRow(ctx, `select body from sms_template where name=$1 and status='ACTIVE' and lang in ($2,$3)
+	order by (lang = $2) desc limit 1`, name, lang, SMSTemplateDefaultLang()).Scan(&body)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrSMSTemplateNotFound
+	}
+	return body, err
+}
+
+// RenderSMSTemplate render the active template in the locale
+func RenderSMSTemplate(db Querier, name string, lang string, data map[string]any) (string, error) {
+	body, err := GetSMSTemplate(db, name, lang)
+	if err != nil {
+		return "", err
+	}
+	return ExecuteSMSTemplate(body, data)
+}
+
+// QueueTemplateSMS render the template and queue the sms, see QueueSMS
+func QueueTemplateSMS(db Querier, name string, lang string, data map[string]any, phoneNumber string, senderName string, messageType string, customerId *int) (int, error) {
+	message, err := RenderSMSTemplate(db, name, lang, data)
+	if err != nil {
+		return 0, err
+	}
+	return QueueSMS(db, phoneNumber, message, senderName, messageType, customerId)
+}
+
+// SaveSMSTemplate save the body as the new active version of the template, the previous version is archived.
+// nothing changes when the body is the same as the active version, the active version is returned
+func SaveSMSTemplate(tx pgx.Tx, name string, lang string, body string, operatorId *int) (int, error) {
+	if _, err := ParseSMSTemplate(body); err != nil {
+		return 0, err
+	}
+	var activeBody string
+	var activeVersion int
+	err := tx.QueryRow(ctx, `select body,version from sms_template where name=$1 and lang=$2 and status='ACTIVE' for update`, name, lang).
+		Scan(&activeBody, &activeVersion)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return 0, err
+	}
+	if err == nil && activeBody == body {
+		return activeVersion, nil
+	}
+	_, err = tx.Exec(ctx, `update sms_template set status='ARCHIVED' where name=$1 and lang=$2 and status='ACTIVE'`, name, lang)
+	if err != nil {
+		return 0, err
+	}
+	var version int
+	err = tx.QueryRow(ctx, `insert into sms_template (name,lang,version,body,status,operator_id)
+	values ($1,$2,(select coalesce(max(version),0)+1 from sms_template where name=$1 and lang=$2),$3,'ACTIVE',$4) returning version`,
+		name, lang, body, operatorId).Scan(&version)
+	return version, err
+}
+
+// PrizeTypeTemplate is the name of the winner sms template of a prize type
+func PrizeTypeTemplate(prizeTypeId int) string {
+	return fmt.Sprintf("%s%d", prizeTypeTemplatePrefix, prizeTypeId)
+}
@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"bytes"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SinkEmail is an email received by the SMTPSink
+type SinkEmail struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// Message parse the received email
+func (e SinkEmail) Message() (*mail.Message, error) {
+	return mail.ReadMessage(bytes.NewReader(e.Data))
+}
+
+// SMTPSink is a local smtp server keeping the received emails in memory, the tests point email.smtp to it instead of a real mailbox
+type SMTPSink struct {
+	listener net.Listener
+	mu       sync.Mutex
+	emails   []SinkEmail
+}
+
+// StartSMTPSink listen on the address, e.g 127.0.0.1:0 for a random port
+func StartSMTPSink(address string) (*SMTPSink, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	sink := &SMTPSink{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go sink.serve(conn)
+		}
+	}()
+	return sink, nil
+}
+
+// Addr return the host and the port of the sink
+func (s *SMTPSink) Addr() (string, int) {
+	addr := s.listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+// Emails return the emails received so far
+func (s *SMTPSink) Emails() []SinkEmail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]SinkEmail{}, s.emails...)
+}
+
+// Close stop the sink
+func (s *SMTPSink) Close() error {
+	return s.listener.Close()
+}
+
+func (s *SMTPSink) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	reply := func(code int, message string) error {
+		return text.PrintfLine("%s %s", strconv.Itoa(code), message)
+	}
+	if reply(220, "smtp sink ready") != nil {
+		return
+	}
+	email := SinkEmail{}
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command, argument, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(command) {
+		case "EHLO":
+			err = text.PrintfLine("250-smtp sink")
+			if err == nil {
+				err = reply(250, "8BITMIME")
+			}
+		case "HELO", "NOOP":
+			err = reply(250, "OK")
+		case "RSET":
+			email = SinkEmail{}
+			err = reply(250, "OK")
+		case "MAIL":
+			email = SinkEmail{From: smtpPath(argument)}
+			err = reply(250, "OK")
+		case "RCPT":
+			email.To = append(email.To, smtpPath(argument))
+			err = reply(250, "OK")
+		case "DATA":
+			if err = reply(354, "end data with <CR><LF>.<CR><LF>"); err != nil {
+				return
+			}
+			email.Data, err = text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.emails = append(s.emails, email)
+			s.mu.Unlock()
+			email = SinkEmail{}
+			err = reply(250, "OK queued")
+		case "QUIT":
+			reply(221, "bye")
+			return
+		default:
+			err = reply(502, "command not implemented")
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// smtpPath extract the address of MAIL FROM:<address> and RCPT TO:<address>
+func smtpPath(argument string) string {
+	_, path, _ := strings.Cut(argument, ":")
+	path, _, _ = strings.Cut(strings.TrimSpace(path), " ")
+	return strings.Trim(path, "<>")
+}
@@ -350,6 +350,8 @@ func callUserFunc(functionName string, args ...interface{}) (string, error) {
 		"completeRegistration":    completeRegistration,
 		"action_completed":        action_completed,
 		"entrySaveCode":           entrySaveCode,
+		"claimSaveCode":           claimSaveCode,
+		"claimVerify":             claimVerify,
 		"end_session":             end_session,
 	}[functionName])
 	if !funcValue.IsValid() {
@@ -499,14 +501,22 @@ func appendExtraData(sessionId string, extra map[string]interface{}, key string,
 func preRegisterSaveCode(args ...interface{}) string {
 	input := args[2].(*string)
 	sessionId := args[0].(string)
+	phone := args[3].(string)
+	if msg := codeGuardCheck(phone); msg != "" {
+		return msg
+	}
 	//validate code
 	code := strings.ToUpper(*input)
+	if !plausibleCode(code) {
+		return codeGuardFailure(phone, sessionId, "fail:mistyped_code")
+	}
 	var codeId int
 	var status string
-	err := config.DB.QueryRow(ctx, `select id,status from codes where code_hash = digest($1,'sha256')`, code).Scan(&codeId, &status)
+	err := config.DB.QueryRow(ctx, `select c.id,case when coalesce(b.status,'ACTIVE') = 'ACTIVE' then c.status else 'inactive' end from codes c
+	left join code_batch b on b.id = c.batch_id where c.code_hash = digest($1,'sha256')`, code).Scan(&codeId, &status)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			return "fail:invalid_code"
+			return codeGuardFailure(phone, sessionId, "fail:invalid_code")
 		}
 		utils.LogMessage("error", "preRegisterSaveCode: fetch code id failed: err:"+err.Error(), "ussd-service")
 		return "fail:system_error"
@@ -631,35 +641,43 @@ func completeRegistration(args ...interface{}) string {
 	// name := extraData["name"]
 	name := extraData["name"]
 	momo_names := extraData["momo_names"]
+	//the customer, its entry, the prize and the sms are saved together
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		utils.LogMessage("error", "completeRegistration: start transaction failed: err:"+err.Error(), "ussd-service")
+		return "err:system_error"
+	}
+	defer tx.Rollback(ctx)
 	var customerId int
-	err := config.DB.QueryRow(ctx, `insert into customer (names,momo_names,phone,phone_hash,province,district,locale, network_operator) values
-	(pgp_sym_encrypt($1,$2),pgp_sym_encrypt($8,$2),pgp_sym_encrypt($3,$2)::bytea,digest($3,'sha256')::bytea,$4,$5,$6,$7) returning id`,
-		name, config.EncryptionKey, args[3].(string), provinceId, district["Id"], extraData["preferred_lang"], args[7].(string), momo_names).Scan(&customerId)
+	momoNames, _ := momo_names.(string)
+	err = tx.QueryRow(ctx, `insert into customer (names,momo_names,phone,phone_hash,province,district,locale, network_operator,momo_names_hash) values
+	(pgp_sym_encrypt($1,$2),pgp_sym_encrypt($8,$2),pgp_sym_encrypt($3,$2)::bytea,digest($3,'sha256')::bytea,$4,$5,$6,$7,$9) returning id`,
+		name, config.EncryptionKey, args[3].(string), provinceId, district["Id"], extraData["preferred_lang"], args[7].(string), momo_names,
+		utils.MomoNamesHash(momoNames)).Scan(&customerId)
 	if err != nil {
 		utils.LogMessage("error", "completeRegistration: insert customer failed: err:"+err.Error(), "ussd-service")
 		return "err:system_error"
 	}
 	var entryId int
 	//create entry record
-	err = config.DB.QueryRow(ctx, `insert into entries (customer_id,code_id) values ($1,$2) returning id`, customerId, extraData["code_id"]).Scan(&entryId)
+	err = tx.QueryRow(ctx, `insert into entries (customer_id,code_id) values ($1,$2) returning id`, customerId, extraData["code_id"]).Scan(&entryId)
 	if err != nil {
-		//delete customer
-		removeCustomer(customerId)
 		utils.LogMessage("error", "completeRegistration: insert entries failed: err:"+err.Error(), "ussd-service")
 		return "err:system_error"
 	}
 	//create entry record
-	_, err = config.DB.Exec(ctx, `update codes set status = 'used' where id = $1`, extraData["code_id"])
+	_, err = tx.Exec(ctx, `update codes set status = 'used' where id = $1`, extraData["code_id"])
 	if err != nil {
-		//delete customer
-		removeCustomer(customerId)
-		//delete entry
-		_, err = config.DB.Exec(ctx, `delete from entries where customer_id = $1 and code_id=$2`, customerId, extraData["code_id"])
 		utils.LogMessage("error", "completeRegistration: insert entry failed: err:"+err.Error(), "ussd-service")
 		return "err:system_error"
 	}
 	USSDdata.CustomerId = &customerId
-	sms_message, message_type, _, err := dailyPrizeWinning(entryId, extraData["code"].(string), args[1].(string))
+	held, err := utils.EvaluateCustomerFraud(tx, customerId, &entryId)
+	if err != nil {
+		utils.LogMessage("error", "completeRegistration: evaluate fraud rules failed: err:"+err.Error(), "ussd-service")
+		return "err:system_error"
+	}
+	sms_message, message_type, _, err := dailyPrizeWinning(tx, entryId, extraData["code"].(string), args[1].(string), held)
 	if err != nil {
 		return err.Error()
 	}
@@ -667,23 +685,124 @@ func completeRegistration(args ...interface{}) string {
 	// 	config.DB.Exec(ctx, "REFRESH MATERIALIZED VIEW codes_count")
 	// }()
 	fmt.Println("completeRegistration: ", args[3].(string), sms_message, message_type, customerId)
-	go utils.SendSMS(config.DB, args[3].(string), sms_message, viper.GetString("SENDER_ID"), config.ServiceName, message_type, &customerId, config.Redis)
+	_, err = utils.QueueSMS(tx, args[3].(string), sms_message, viper.GetString("SENDER_ID"), message_type, &customerId)
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		utils.LogMessage("error", "completeRegistration: save entry failed: err:"+err.Error(), "ussd-service")
+		return "err:system_error"
+	}
 	return "success_entry"
 }
-func removeCustomer(customerId int) {
-	_, err := config.DB.Exec(ctx, `delete from customer where id = $1`, customerId)
+
+// args: sessionId, lang, *input, phone, customer, lang, *USSDdata.LastInput, networkOperator
+func claimSaveCode(args ...interface{}) string {
+	input := args[2].(*string)
+	sessionId := args[0].(string)
+	var claimId int
+	err := config.DB.QueryRow(ctx, `select id from prize_claim where customer_id=$1 and status='PENDING' order by created_at desc limit 1`, USSDdata.CustomerId).Scan(&claimId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "fail:claim_not_found"
+		}
+		utils.LogMessage("error", "claimSaveCode: fetch prize claim failed: err:"+err.Error(), "ussd-service")
+		return "fail:system_error"
+	}
+	extra, _ := getUssdDataItem(sessionId, "extra")
+	if extra == nil || reflect.ValueOf(extra).IsNil() {
+		extra = make(map[string]interface{})
+	}
+	extraData := extra.(map[string]interface{})
+	appendExtraData(sessionId, extraData, "claim_id", fmt.Sprintf("%v", claimId))
+	appendExtraData(sessionId, extraData, "claim_code", strings.TrimSpace(*input))
+	return ""
+}
+
+// verify the claim code saved on previous step with the national ID
+func claimVerify(args ...interface{}) string {
+	input := args[2].(*string)
+	sessionId := args[0].(string)
+	extra, _ := getUssdDataItem(sessionId, "extra")
+	if extra == nil || reflect.ValueOf(extra).IsNil() {
+		return "fail:claim_not_found"
+	}
+	extraData := extra.(map[string]interface{})
+	claimId, err := strconv.Atoi(fmt.Sprintf("%v", extraData["claim_id"]))
+	if err != nil {
+		return "fail:claim_not_found"
+	}
+	_, err = utils.VerifyPrizeClaim(config.DB, claimId, fmt.Sprintf("%v", extraData["claim_code"]), *input, "USSD", nil, false)
+	if err != nil {
+		switch {
+		case errors.Is(err, utils.ErrClaimIdMismatch):
+			//the ID can be retyped, the session stays on this step
+			return "fail:" + err.Error()
+		case errors.Is(err, utils.ErrClaimInvalidCode):
+			//the code is asked again
+			USSDdata.StepId = "claim_code"
+			setUssdData(*USSDdata)
+			return "fail:" + err.Error()
+		case errors.Is(err, utils.ErrClaimNotFound), errors.Is(err, utils.ErrClaimIdMissing),
+			errors.Is(err, utils.ErrClaimExpired), errors.Is(err, utils.ErrClaimLocked), errors.Is(err, utils.ErrClaimVerified):
+			return "fail:" + err.Error()
+		}
+		utils.LogMessage("error", "claimVerify: verify prize claim failed: err:"+err.Error(), "ussd-service")
+		return "err:system_error"
+	}
+	//claim_ack confirms the claim
+	return ""
+}
+
+// plausibleCode reject a code matching the format of no active batch before the db lookup, codes are looked up when formats can not be loaded
+func plausibleCode(code string) bool {
+	formats, err := utils.ActiveCodeFormats(config.DB)
+	if err != nil {
+		utils.LogMessage("error", "plausibleCode: fetch code formats failed: err:"+err.Error(), "ussd-service")
+		return true
+	}
+	return utils.MatchAnyCodeFormat(code, formats)
+}
+
+// codeGuardCheck reject the codes of a msisdn locked out or flagged as FRAUD, codes are accepted when the guard is unavailable
+func codeGuardCheck(phone string) string {
+	err := utils.CodeGuardCheck(config.DB, config.Redis, phone)
+	if errors.Is(err, utils.ErrCodeLocked) || errors.Is(err, utils.ErrCodeBlocked) {
+		return "fail:" + err.Error()
+	}
+	if err != nil {
+		utils.LogMessage("error", "codeGuardCheck: check msisdn failed: err:"+err.Error(), "ussd-service")
+	}
+	return ""
+}
+
+// codeGuardFailure count an invalid code, the lockout message replaces failMsg once the msisdn is locked out
+func codeGuardFailure(phone string, sessionId string, failMsg string) string {
+	err := utils.CodeGuardFailure(config.DB, config.Redis, phone, sessionId)
+	if errors.Is(err, utils.ErrCodeLocked) || errors.Is(err, utils.ErrCodeBlocked) {
+		return "fail:" + err.Error()
+	}
 	if err != nil {
-		utils.LogMessage("error", "removeCustomer: delete customer failed: err:"+err.Error(), "ussd-service")
+		utils.LogMessage("error", "codeGuardFailure: count invalid code failed: err:"+err.Error(), "ussd-service")
 	}
+	return failMsg
 }
 func entrySaveCode(args ...interface{}) string {
 	code := strings.ToUpper(*args[2].(*string))
+	phone := args[3].(string)
+	if msg := codeGuardCheck(phone); msg != "" {
+		return msg
+	}
+	if !plausibleCode(code) {
+		return codeGuardFailure(phone, args[0].(string), "fail:mistyped_code")
+	}
 	var codeId int
 	var status string
-	err := config.DB.QueryRow(ctx, `select id,status from codes where code_hash = digest($1,'sha256')`, code).Scan(&codeId, &status)
+	err := config.DB.QueryRow(ctx, `select c.id,case when coalesce(b.status,'ACTIVE') = 'ACTIVE' then c.status else 'inactive' end from codes c
+	left join code_batch b on b.id = c.batch_id where c.code_hash = digest($1,'sha256')`, code).Scan(&codeId, &status)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			return "fail:invalid_code"
+			return codeGuardFailure(phone, args[0].(string), "fail:invalid_code")
 		}
 		utils.LogMessage("error", "preRegisterSaveCode: fetch code id failed: err:"+err.Error(), "ussd-service")
 		return "fail:system_error"
@@ -697,22 +816,32 @@ func entrySaveCode(args ...interface{}) string {
 		utils.LogMessage("error", "entrySaveCode: invalid codeId: err:"+err.Error(), "ussd-service")
 		return "err:system_error"
 	}
+	//the entry, the prize and the sms are saved together
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		utils.LogMessage("error", "entrySaveCode: start transaction failed: err:"+err.Error(), "ussd-service")
+		return "err:system_error"
+	}
+	defer tx.Rollback(ctx)
 	//create entry record
-	err = config.DB.QueryRow(ctx, `insert into entries (customer_id,code_id) values ($1,$2) returning id`, USSDdata.CustomerId, codeId).Scan(&entryId)
+	err = tx.QueryRow(ctx, `insert into entries (customer_id,code_id) values ($1,$2) returning id`, USSDdata.CustomerId, codeId).Scan(&entryId)
 	if err != nil {
-		//delete customerY
 		utils.LogMessage("error", "entrySaveCode: insert entries failed: err:"+err.Error(), "ussd-service")
 		return "err:system_error"
 	}
 	//create entry record
-	_, err = config.DB.Exec(ctx, `update codes set status = 'used' where id = $1`, codeId)
+	_, err = tx.Exec(ctx, `update codes set status = 'used' where id = $1`, codeId)
 	if err != nil {
-		//delete entry
-		_, err = config.DB.Exec(ctx, `delete from entries where customer_id = $1 and code_id=$2`, USSDdata.CustomerId, codeId)
 		utils.LogMessage("error", "entrySaveCode: insert entry failed: err:"+err.Error(), "ussd-service")
 		return "err:system_error"
 	}
-	sms_message, message_type, _, err := dailyPrizeWinning(entryId, code, args[1].(string))
+	//customers reaching the fraud hold score are put in review, their instant win payouts wait for approval
+	held, err := utils.EvaluateCustomerFraud(tx, *USSDdata.CustomerId, &entryId)
+	if err != nil {
+		utils.LogMessage("error", "entrySaveCode: evaluate fraud rules failed: err:"+err.Error(), "ussd-service")
+		return "err:system_error"
+	}
+	sms_message, message_type, _, err := dailyPrizeWinning(tx, entryId, code, args[1].(string), held)
 	if err != nil {
 		return err.Error()
 	}
@@ -720,14 +849,22 @@ func entrySaveCode(args ...interface{}) string {
 	// 	config.DB.Exec(ctx, "REFRESH MATERIALIZED VIEW codes_count")
 	// }()
 	fmt.Println("entrySaveCode: ", args[3].(string), sms_message, message_type, USSDdata.CustomerId)
-	go utils.SendSMS(config.DB, args[3].(string), sms_message, viper.GetString("SENDER_ID"), config.ServiceName, message_type, USSDdata.CustomerId, config.Redis)
+	_, err = utils.QueueSMS(tx, args[3].(string), sms_message, viper.GetString("SENDER_ID"), message_type, USSDdata.CustomerId)
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		utils.LogMessage("error", "entrySaveCode: save entry failed: err:"+err.Error(), "ussd-service")
+		return "err:system_error"
+	}
 	return ""
 }
 func end_session(args ...interface{}) string {
 	return "success_entry"
 }
 
-func dailyPrizeWinning(entryId int, code string, lang string) (string, string, bool, error) {
+// dailyPrizeWinning draw an instant prize for the entry within its transaction, the momo payout of a held customer waits for approval
+func dailyPrizeWinning(tx pgx.Tx, entryId int, code string, lang string, held bool) (string, string, bool, error) {
 	// Create a new rand instance with a secure seed
 	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
 	result := utils.GenerateBoolWithOdds(rng)
@@ -745,7 +882,7 @@ func dailyPrizeWinning(entryId int, code string, lang string) (string, string, b
 	if result {
 		//try to get daily prize and check if there is a remaining room (based on elligibility and distributed prizes)
 		//get daily prize typey
-		err := config.DB.QueryRow(ctx, `select pt.id, pt.name,(pt.elligibility - count(p.id)) as remaining_place,pt.value,pt.status,pt.distribution_type from prize_type pt
+		err := tx.QueryRow(ctx, `select pt.id, pt.name,(pt.elligibility - count(p.id)) as remaining_place,pt.value,pt.status,pt.distribution_type from prize_type pt
 		LEFT JOIN prize p on p.prize_type_id = pt.id and DATE(p. created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali') = CURRENT_DATE where pt.period = 'DAILY' and pt.trigger_by_system = true and pt.status='OKAY' group by pt.id, p.prize_type_id order by random() limit 1`).
 			Scan(&prizeType.Id, &prizeType.Name, &prizeType.RemainingPlace, &prizeType.Value, &prizeType.Status, &prizeType.DistrutionType)
 		if err != nil {
@@ -756,14 +893,35 @@ func dailyPrizeWinning(entryId int, code string, lang string) (string, string, b
 			return "", "", false, errors.New("err:system_error")
 		}
 		if prizeType.RemainingPlace > 0 {
-			//fetch prize_message
-			err = config.DB.QueryRow(ctx, `select message from prize_message where prize_type_id = $1 and lang = $2`, prizeType.Id, lang).Scan(&prizeType.Message)
+			//excluded customers (staff, relatives, blacklist) can not win
+			hit, err := utils.MatchPrizeExclusion(tx, *USSDdata.CustomerId)
 			if err != nil {
-				utils.LogMessage("error", "entrySaveCode: fetch prize message failed: err:"+err.Error(), "ussd-service")
+				utils.LogMessage("error", "entrySaveCode: match prize exclusion failed: err:"+err.Error(), "ussd-service")
 				return "", "", false, errors.New("err:system_error")
 			}
+			if hit != nil {
+				hit.Context, hit.PrizeTypeId, hit.EntryId = "instant_win", prizeType.Id, entryId
+				utils.RecordExclusionHit(config.DB, *hit, nil, "", "ussd-service")
+				prizeType.RemainingPlace = 0
+			}
+		}
+		if prizeType.RemainingPlace > 0 {
+			//render the prize message template in the customer language
+			var customerName string
+			err = tx.QueryRow(ctx, `select pgp_sym_decrypt(names::bytea,$2) from customer where id = $1`, USSDdata.CustomerId, config.EncryptionKey).Scan(&customerName)
+			if err != nil {
+				utils.LogMessage("error", "entrySaveCode: fetch customer name failed: err:"+err.Error(), "ussd-service")
+				return "", "", false, errors.New("err:system_error")
+			}
+			prizeType.Message, err = utils.RenderSMSTemplate(tx, utils.PrizeTypeTemplate(prizeType.Id), lang,
+				map[string]any{"Name": customerName, "Amount": prizeType.Value, "Code": code, "PrizeType": prizeType.Name, "ClaimDeadline": ""})
+			if err != nil {
+				//a broken template does not cost the customer the prize, the default message is sent instead
+				utils.LogMessage("critical", fmt.Sprintf("entrySaveCode: render prize message of prize type %d failed: err:%s", prizeType.Id, err.Error()), "ussd-service")
+				prizeType.Message = utils.Localize(localizer, "register_sms_instant", map[string]interface{}{"Amount": prizeType.Value})
+			}
 			//create prize record
-			err = config.DB.QueryRow(ctx, `insert into prize (entry_id, prize_type_id, prize_value,code,rewarded) values ($1, $2, $3,$4, false) returning id`,
+			err = tx.QueryRow(ctx, `insert into prize (entry_id, prize_type_id, prize_value,code,rewarded) values ($1, $2, $3,$4, false) returning id`,
 				entryId, prizeType.Id, prizeType.Value, code).Scan(&prizeId)
 			if err != nil {
 				utils.LogMessage("error", "entrySaveCode: insert prize failed: err:"+err.Error(), "ussd-service")
@@ -780,21 +938,39 @@ func dailyPrizeWinning(entryId int, code string, lang string) (string, string, b
 		if prizeType.DistrutionType == "momo" {
 			//fetch	customer phone and network operator
 			var mno string
-			err := config.DB.QueryRow(ctx, `select network_operator from customer where id = $1`,
+			err := tx.QueryRow(ctx, `select network_operator from customer where id = $1`,
 				USSDdata.CustomerId).Scan(&mno)
 			if err != nil {
 				utils.LogMessage("error", "entrySaveCode: #distribute_prize fetch customer MNO failed: err:"+err.Error(), "ussd-service")
-			} else {
-				_, err = config.DB.Exec(ctx, `insert into transaction (prize_id, amount, phone, mno, customer_id, transaction_type, initiated_by,status) values ($1, $2, $3, $4, $5,'CREDIT','SYSTEM','PENDING')`,
-					prizeId, prizeType.Value, USSDdata.MSISDN, mno, USSDdata.CustomerId)
-				if err != nil {
-					utils.LogMessage("error", "entrySaveCode: #distribute_prize insert transaction failed: err:"+err.Error(), "ussd-service")
-				}
+				return "", "", false, errors.New("err:system_error")
+			}
+			status := "PENDING"
+			if held {
+				status = "WAITING"
+			}
+			_, err = tx.Exec(ctx, `insert into transaction (prize_id, amount, phone, mno, customer_id, transaction_type, initiated_by,status) values ($1, $2, $3, $4, $5,'CREDIT','SYSTEM',$6)`,
+				prizeId, prizeType.Value, USSDdata.MSISDN, mno, USSDdata.CustomerId, status)
+			if err != nil {
+				//the prize is not saved without its payout
+				utils.LogMessage("error", "entrySaveCode: #distribute_prize insert transaction failed: err:"+err.Error(), "ussd-service")
+				return "", "", false, errors.New("err:system_error")
+			}
+		} else {
+			//non-cash prize, fulfilment is handled by operators
+			_, err := tx.Exec(ctx, `insert into fulfilment (prize_id, customer_id, status) values ($1, $2, 'WAITING_CLAIM')`, prizeId, USSDdata.CustomerId)
+			if err != nil {
+				utils.LogMessage("error", "entrySaveCode: #distribute_prize insert fulfilment failed: err:"+err.Error(), "ussd-service")
+				return "", "", false, errors.New("err:system_error")
 			}
 		}
 	} else {
-		sms_message = utils.Localize(localizer, "register_sms", nil)
 		message_type = "no_prize"
+		message, err := utils.RenderSMSTemplate(tx, "no_prize", lang, nil)
+		if err != nil {
+			utils.LogMessage("critical", "entrySaveCode: render no prize message failed: err:"+err.Error(), "ussd-service")
+			message = utils.Localize(localizer, "register_sms", nil)
+		}
+		sms_message = message
 	}
 	return sms_message, message_type, isPrizeWon, nil
 }
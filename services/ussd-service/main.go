@@ -25,6 +25,8 @@ func main() {
 	// fmt.Println(viper.Get("steps"))
 	// fmt.Println(viper.Get("steps.action_ack.inputs"))
 	config.ConnectDb()
+	utils.InitializeSMSTransport(config.DB, config.ServiceName)
+	go utils.RunSMSDispatcher(config.DB, config.Redis, config.ServiceName)
 	defer config.DB.Close()
 	server := routes.InitRoutes()
 	server.Listen("0.0.0.0:9000")
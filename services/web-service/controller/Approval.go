@@ -0,0 +1,200 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"shared-package/utils"
+	"strings"
+	"web-service/config"
+	"web-service/model"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/spf13/viper"
+)
+
+var errTransactionNotWaiting = errors.New("transaction status is already confirmed, refresh your page")
+var errAlreadyApproved = errors.New("you have already approved this transaction, another approver is required")
+var errFinanceApprovalOnly = errors.New("only finance department can approve this transaction")
+var errClaimNotVerified = errors.New("the winner has not yet claimed this prize, payout is allowed after claim verification")
+var errCustomerInReview = errors.New("the winner is held by a fraud review, payout is allowed once the fraud case is cleared")
+
+// payoutApprovalTier returns the number of distinct approvers required for the amount
+// and whether those approvers must belong to the finance department
+func payoutApprovalTier(amount float64) (int, bool) {
+	singleLimit := viper.GetFloat64("payout_approval.single_limit")
+	financeLimit := viper.GetFloat64("payout_approval.finance_limit")
+	required := 1
+	if singleLimit > 0 && amount > singleLimit {
+		required = 2
+	}
+	financeOnly := financeLimit > 0 && amount > financeLimit
+	if financeOnly {
+		required = 2
+	}
+	return required, financeOnly
+}
+
+func financeDepartment() string {
+	department := viper.GetString("payout_approval.finance_department")
+	if department == "" {
+		department = "FINANCE"
+	}
+	return department
+}
+
+// approveTransaction records an approval step of a WAITING transaction and moves it to PENDING
+// once the number of distinct approvers required by its tier is reached
+func approveTransaction(tx pgx.Tx, transactionId int, userId int, department model.Department, ipAddress string, userAgent string) (bool, int, int, error) {
+	var status string
+	var amount float64
+	var claimStatus, customerStatus *string
+	err := tx.QueryRow(ctx, `select t.status,t.amount,pc.status,c.status from transaction t left join prize_claim pc on pc.prize_id = t.prize_id
+	left join customer c on c.id = t.customer_id where t.id=$1 for update of t`, transactionId).Scan(&status, &amount, &claimStatus, &customerStatus)
+	if err != nil {
+		return false, 0, 0, err
+	}
+	if status != "WAITING" {
+		return false, 0, 0, errTransactionNotWaiting
+	}
+	if claimStatus != nil && *claimStatus != "VERIFIED" {
+		return false, 0, 0, errClaimNotVerified
+	}
+	if customerStatus != nil && *customerStatus != "OKAY" {
+		return false, 0, 0, errCustomerInReview
+	}
+	required, financeOnly := payoutApprovalTier(amount)
+	if financeOnly && !strings.EqualFold(department.Title, financeDepartment()) {
+		return false, 0, required, errFinanceApprovalOnly
+	}
+	_, err = tx.Exec(ctx, `insert into transaction_approval (transaction_id,user_id,department_id,required_approvals,ip_address,user_agent)
+	values ($1,$2,$3,$4,$5,$6)`, transactionId, userId, department.Id, required, ipAddress, userAgent)
+	if err != nil {
+		if isDuplicate, _ := utils.IsErrDuplicate(err); isDuplicate {
+			return false, 0, required, errAlreadyApproved
+		}
+		return false, 0, required, err
+	}
+	//on finance tier, only approvals from finance are counted
+	approvals := 0
+	err = tx.QueryRow(ctx, `select count(a.id) from transaction_approval a left join departments d on d.id = a.department_id
+	where a.transaction_id=$1 and ($2 = false or upper(d.title) = upper($3))`, transactionId, financeOnly, financeDepartment()).Scan(&approvals)
+	if err != nil {
+		return false, approvals, required, err
+	}
+	if approvals < required {
+		return false, approvals, required, nil
+	}
+	_, err = tx.Exec(ctx, `update transaction set status=$1 where id=$2`, "PENDING", transactionId)
+	if err != nil {
+		return false, approvals, required, err
+	}
+	return true, approvals, required, nil
+}
+
+// get the approver department from db, session data may be outdated
+func getApproverDepartment(userId int) (model.Department, error) {
+	department := model.Department{}
+	err := config.DB.QueryRow(ctx, `select d.id,d.title from users u inner join departments d on d.id = u.department_id where u.id=$1`, userId).
+		Scan(&department.Id, &department.Title)
+	return department, err
+}
+
+// GetPendingApprovals list WAITING transactions with their approval steps
+func GetPendingApprovals(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 20)
+	if page < 1 {
+		page = 1
+	}
+	offSet := (page - 1) * limit
+	department, err := getApproverDepartment(userPayload.Id)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get pending approvals failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetPendingApprovals: Unable to get user department, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	pendingApprovals := []model.PendingApproval{}
+	transactionIds := []int{}
+	rows, err := config.DB.Query(ctx,
+		`select t.id,t.amount,t.phone,t.mno,t.trx_id,t.transaction_type,t.status,t.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',
+		p.entry_id,p.code,t.customer_id,t.initiated_by,t.updated_at,p.id as prize_id,pt.name from transaction t
+		inner join prize p on p.id = t.prize_id LEFT JOIN prize_type pt ON p.prize_type_id=pt.id
+		where t.status = 'WAITING' order by t.created_at asc limit $1 offset $2`, limit, offSet)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get pending approvals failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetPendingApprovals: Unable to get transactions, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer rows.Close()
+	for rows.Next() {
+		pendingApproval := model.PendingApproval{Approvals: []model.TransactionApproval{}}
+		err = rows.Scan(&pendingApproval.Id, &pendingApproval.Amount, &pendingApproval.Phone, &pendingApproval.Mno, &pendingApproval.TrxId,
+			&pendingApproval.TransactionType, &pendingApproval.Status, &pendingApproval.CreatedAt, &pendingApproval.EntryId, &pendingApproval.Code,
+			&pendingApproval.CustomerId, &pendingApproval.InitiatedBy, &pendingApproval.UpdatedAt, &pendingApproval.PrizeId, &pendingApproval.PrizeType)
+		if err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get pending approvals failed", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "GetPendingApprovals: Unable to read transaction data, error: " + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+		pendingApproval.RequiredApprovals, pendingApproval.FinanceOnly = payoutApprovalTier(float64(pendingApproval.Amount))
+		pendingApproval.CanApprove = !pendingApproval.FinanceOnly || strings.EqualFold(department.Title, financeDepartment())
+		pendingApprovals = append(pendingApprovals, pendingApproval)
+		transactionIds = append(transactionIds, pendingApproval.Id)
+	}
+	rows.Close()
+	//attach approval steps
+	approvalRows, err := config.DB.Query(ctx,
+		`select a.id,a.transaction_id,a.user_id,concat(u.fname,' ',u.lname),coalesce(d.title,''),coalesce(host(a.ip_address),''),
+		a.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali' from transaction_approval a inner join users u on u.id = a.user_id
+		left join departments d on d.id = a.department_id where a.transaction_id = any($1) order by a.created_at asc`, transactionIds)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get pending approvals failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetPendingApprovals: Unable to get approval steps, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer approvalRows.Close()
+	approvalsByTransaction := map[int][]model.TransactionApproval{}
+	for approvalRows.Next() {
+		approval := model.TransactionApproval{}
+		err = approvalRows.Scan(&approval.Id, &approval.TransactionId, &approval.UserId, &approval.Names, &approval.Department, &approval.IPAddress, &approval.CreatedAt)
+		if err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get pending approvals failed", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "GetPendingApprovals: Unable to read approval steps, error: " + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+		approvalsByTransaction[approval.TransactionId] = append(approvalsByTransaction[approval.TransactionId], approval)
+	}
+	for i := range pendingApprovals {
+		if approvals, ok := approvalsByTransaction[pendingApprovals[i].Id]; ok {
+			pendingApprovals[i].Approvals = approvals
+		}
+		for _, approval := range pendingApprovals[i].Approvals {
+			if approval.UserId == userPayload.Id {
+				pendingApprovals[i].CanApprove = false
+			}
+		}
+	}
+	totalPending := 0
+	err = config.DB.QueryRow(ctx, `select count(id) from transaction where status = 'WAITING'`).Scan(&totalPending)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get pending approvals failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     fmt.Sprintf("GetPendingApprovals: Unable to count pending approvals, error: %s", err.Error()),
+			ServiceName: config.ServiceName,
+		})
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": pendingApprovals,
+		"pagination": fiber.Map{"page": page, "limit": limit, "total": totalPending}})
+}
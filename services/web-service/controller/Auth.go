@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"shared-package/utils"
+	"web-service/config"
+	"web-service/model"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// locals key of the authenticated user
+const userLocalsKey = "user"
+
+// Authenticate load the user of the session into the locals, it is used on the route groups and protects every route registered after it
+func Authenticate(c *fiber.Ctx) error {
+	userPayload, err := utils.SecurePath(c, config.Redis)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
+	}
+	c.Locals(userLocalsKey, userPayload)
+	return c.Next()
+}
+
+// CurrentUser return the user loaded by Authenticate
+func CurrentUser(c *fiber.Ctx) *model.UserProfile {
+	userPayload, _ := c.Locals(userLocalsKey).(*model.UserProfile)
+	return userPayload
+}
+
+// RequirePermission reject the request unless one of the roles of the user grants the permission, it is declared on the route
+func RequirePermission(permission string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userPayload := CurrentUser(c)
+		if userPayload == nil {
+			return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, "unauthorized: You are not allowed to access this resource")
+		}
+		if !userPayload.HasPermission(permission) {
+			return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, "You don't have permission to access this resource")
+		}
+		return c.Next()
+	}
+}
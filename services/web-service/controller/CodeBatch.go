@@ -0,0 +1,231 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"shared-package/utils"
+	"strconv"
+	"web-service/config"
+	"web-service/model"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+// allowed status changes of a code batch, VOIDED is final
+var codeBatchTransitions = map[string][]string{
+	"ACTIVE":    {"SUSPENDED", "VOIDED"},
+	"SUSPENDED": {"ACTIVE", "VOIDED"},
+}
+
+type codeBatchInput struct {
+	Reference      string
+	Product        string
+	BottlingLine   string
+	Region         string
+	ProductionDate string
+	FileName       string
+	FileHash       string
+	Format         *utils.CodeFormat // nil for uploaded files without a check digit, saved as the legacy format
+	UserId         int
+	IPAddress      string
+}
+
+// createCodeBatch save the batch as UPLOADING, the batch is activated once its codes are inserted
+func createCodeBatch(batch codeBatchInput) (int, error) {
+	var date *string
+	if batch.ProductionDate != "" {
+		date = &batch.ProductionDate
+	}
+	format := utils.CodeFormat{Length: utils.LegacyCodeLength, CheckDigit: utils.CheckDigitNone}
+	if batch.Format != nil {
+		format = *batch.Format
+	}
+	var batchId int
+	err := config.DB.QueryRow(ctx, `insert into code_batch (reference,product,bottling_line,region,production_date,file_name,file_hash,uploaded_by,upload_ip,
+	code_alphabet,code_length,check_digit) values ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12) returning id`, batch.Reference, batch.Product, batch.BottlingLine, batch.Region,
+		date, batch.FileName, batch.FileHash, batch.UserId, batch.IPAddress, format.Alphabet, format.Length, format.CheckDigit).
+		Scan(&batchId)
+	return batchId, err
+}
+
+// fileSHA256 return the hex sha256 of the file content
+func fileSHA256(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func failCodeBatch(batchId int, reason string) {
+	_, err := config.DB.Exec(ctx, `update code_batch set status='FAILED', status_reason=left($2,255), updated_at=now() where id=$1 and status='UPLOADING'`, batchId, reason)
+	if err != nil {
+		utils.LogMessage("error", "failCodeBatch: Unable to update code batch, error: "+err.Error(), config.ServiceName)
+	}
+}
+
+// codeBatchFilter return the condition selecting the codes (alias cd) of the batch and product query params, values are appended to args
+func codeBatchFilter(c *fiber.Ctx, args *[]interface{}) (string, error) {
+	condition := ""
+	if batchId := c.Query("batch_id"); batchId != "" {
+		if _, err := strconv.Atoi(batchId); err != nil {
+			return "", errors.New("Invalid batch id provided")
+		}
+		*args = append(*args, batchId)
+		condition = fmt.Sprintf("cd.batch_id = $%d", len(*args))
+	}
+	if product := c.Query("product"); product != "" {
+		if condition != "" {
+			condition += " and "
+		}
+		*args = append(*args, product)
+		condition += fmt.Sprintf("cd.batch_id in (select id from code_batch where product = $%d)", len(*args))
+	}
+	return condition, nil
+}
+
+func GetCodeBatches(c *fiber.Ctx) error {
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 20)
+	if page < 1 {
+		page = 1
+	}
+	offSet := (page - 1) * limit
+	args := []interface{}{}
+	filter, ii := utils.BuildQueryFilter(
+		map[string]interface{}{
+			"cb.status":  c.Query("status"),
+			"cb.product": c.Query("product"),
+			"cb.region":  c.Query("region"),
+		},
+		&args,
+	)
+	globalArgs := args
+	batches := []model.CodeBatch{}
+	rows, err := config.DB.Query(ctx, fmt.Sprintf(`select cb.id,cb.reference,cb.product,cb.bottling_line,cb.region,cb.production_date,cb.status,cb.status_reason,
+	cb.file_name,cb.file_hash,cb.code_alphabet,cb.code_length,cb.check_digit,nullif(concat(u.fname,' ',u.lname),' '),
+	cb.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',cb.uploaded_count,
+	(select count(cd.id) from codes cd where cd.batch_id = cb.id and cd.status = 'used'),
+	(select count(p.id) from prize p inner join entries e on e.id = p.entry_id inner join codes cd on cd.id = e.code_id where cd.batch_id = cb.id)
+	from code_batch cb left join users u on u.id = cb.uploaded_by %s order by cb.id desc limit $%d offset $%d`, filter, ii, ii+1),
+		append(args, limit, offSet)...)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get code batches failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetCodeBatches: Unable to get code batches, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer rows.Close()
+	for rows.Next() {
+		batch := model.CodeBatch{Counts: &model.CodeBatchCounts{}}
+		err = rows.Scan(&batch.Id, &batch.Reference, &batch.Product, &batch.BottlingLine, &batch.Region, &batch.ProductionDate, &batch.Status, &batch.StatusReason,
+			&batch.FileName, &batch.FileHash, &batch.CodeAlphabet, &batch.CodeLength, &batch.CheckDigit, &batch.UploadedBy, &batch.CreatedAt, &batch.Counts.Uploaded, &batch.Counts.Used, &batch.Counts.Won)
+		if err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get code batches failed", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "GetCodeBatches: Unable to read code batch, error: " + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+		batches = append(batches, batch)
+	}
+	total := 0
+	err = config.DB.QueryRow(ctx, `select count(cb.id) from code_batch cb `+filter, globalArgs...).Scan(&total)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get code batches failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetCodeBatches: Unable to count code batches, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": batches,
+		"pagination": fiber.Map{"page": page, "limit": limit, "total": total}})
+}
+
+// ChangeCodeBatchStatus activate, suspend or void a batch, codes of a batch which is not ACTIVE are rejected on USSD
+func ChangeCodeBatchStatus(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	batchId, err := c.ParamsInt("batch_id")
+	if err != nil || batchId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid batch id provided")
+	}
+	type FormData struct {
+		Status string `json:"status" binding:"required" validate:"required,oneof=ACTIVE SUSPENDED VOIDED"`
+		Reason string `json:"reason" binding:"required" validate:"required,min=3,max=255"`
+	}
+	formData := FormData{}
+	if err := c.BodyParser(&formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to change batch status, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ChangeCodeBatchStatus: Unable to start transaction, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer tx.Rollback(ctx)
+	var status, reference string
+	err = tx.QueryRow(ctx, `select status,reference from code_batch where id=$1 for update`, batchId).Scan(&status, &reference)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotFound, "Code batch not found")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to change batch status, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ChangeCodeBatchStatus: Unable to get code batch, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	allowed := false
+	for _, next := range codeBatchTransitions[status] {
+		if next == formData.Status {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, fmt.Sprintf("A %s batch can not be set to %s", status, formData.Status))
+	}
+	_, err = tx.Exec(ctx, `update code_batch set status=$2, status_reason=$3, updated_at=now() where id=$1`, batchId, formData.Status, formData.Reason)
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to change batch status, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ChangeCodeBatchStatus: Unable to update code batch, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "code_batch",
+			Description:  fmt.Sprintf("changed code batch %s from %s to %s", reference, status, formData.Status),
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"batch_id": batchId,
+			"reason":   formData.Reason,
+		},
+	)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Code batch status changed to " + formData.Status})
+}
@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"shared-package/utils"
+	"slices"
+	"web-service/config"
+	"web-service/model"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+// allowed reviews of a fraud flag, a CONFIRMED msisdn can still be cleared later
+var codeFraudFlagTransitions = map[string][]string{
+	"OPEN":      {"CLEARED", "CONFIRMED"},
+	"CONFIRMED": {"CLEARED"},
+}
+
+// GetCodeFraudFlags list the msisdns flagged by the USSD code guard
+func GetCodeFraudFlags(c *fiber.Ctx) error {
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 20)
+	if page < 1 {
+		page = 1
+	}
+	offSet := (page - 1) * limit
+	args := []interface{}{}
+	filter, ii := utils.BuildQueryFilter(
+		map[string]interface{}{
+			"f.status":      c.Query("status"),
+			"f.customer_id": c.Query("customer_id"),
+		},
+		&args,
+	)
+	globalArgs := args
+	flags := []model.CodeFraudFlag{}
+	rows, err := config.DB.Query(ctx, fmt.Sprintf(`select f.id,f.customer_id,f.phone_masked,f.reason,f.invalid_attempts,f.lockouts,f.status,f.review_note,
+	nullif(concat(u.fname,' ',u.lname),' '),f.reviewed_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',f.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali'
+	from code_fraud_flag f left join users u on u.id = f.reviewed_by %s order by f.id desc limit $%d offset $%d`, filter, ii, ii+1), append(args, limit, offSet)...)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get fraud flags failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetCodeFraudFlags: Unable to get fraud flags, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer rows.Close()
+	for rows.Next() {
+		flag := model.CodeFraudFlag{}
+		err = rows.Scan(&flag.Id, &flag.CustomerId, &flag.Phone, &flag.Reason, &flag.InvalidAttempts, &flag.Lockouts, &flag.Status, &flag.ReviewNote,
+			&flag.ReviewedBy, &flag.ReviewedAt, &flag.CreatedAt)
+		if err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get fraud flags failed", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "GetCodeFraudFlags: Unable to read fraud flag, error: " + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+		flags = append(flags, flag)
+	}
+	total := 0
+	err = config.DB.QueryRow(ctx, `select count(f.id) from code_fraud_flag f `+filter, globalArgs...).Scan(&total)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get fraud flags failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetCodeFraudFlags: Unable to count fraud flags, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": flags,
+		"pagination": fiber.Map{"page": page, "limit": limit, "total": total}})
+}
+
+// ReviewCodeFraudFlag clear a flag to unblock the msisdn and its customer, or confirm it to keep them blocked
+func ReviewCodeFraudFlag(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	flagId, err := c.ParamsInt("flag_id")
+	if err != nil || flagId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid flag id provided")
+	}
+	type FormData struct {
+		Status string `json:"status" binding:"required" validate:"required,oneof=CLEARED CONFIRMED"`
+		Note   string `json:"note" binding:"required" validate:"required,min=3,max=255"`
+	}
+	formData := FormData{}
+	if err := c.BodyParser(&formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to review fraud flag, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ReviewCodeFraudFlag: Unable to start transaction, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer tx.Rollback(ctx)
+	var status, phoneMasked string
+	var phoneHash []byte
+	var customerId *int
+	err = tx.QueryRow(ctx, `select status,phone_hash,phone_masked,customer_id from code_fraud_flag where id=$1 for update`, flagId).
+		Scan(&status, &phoneHash, &phoneMasked, &customerId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotFound, "Fraud flag not found")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to review fraud flag, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ReviewCodeFraudFlag: Unable to get fraud flag, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	if !slices.Contains(codeFraudFlagTransitions[status], formData.Status) {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, fmt.Sprintf("A %s flag can not be set to %s", status, formData.Status))
+	}
+	_, err = tx.Exec(ctx, `update code_fraud_flag set status=$2, review_note=$3, reviewed_by=$4, reviewed_at=now(), updated_at=now() where id=$1`,
+		flagId, formData.Status, formData.Note, userPayload.Id)
+	if err == nil && formData.Status == "CLEARED" {
+		//a customer with a fraud case stays held by it
+		_, err = tx.Exec(ctx, `update customer c set status = case when exists (select 1 from fraud_case f where f.customer_id = c.id and f.status = 'OPEN')
+		then 'REVIEW' else 'OKAY' end where c.phone_hash=$1 and not exists (select 1 from fraud_case f where f.customer_id = c.id and f.status = 'CONFIRMED')`, phoneHash)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to review fraud flag, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ReviewCodeFraudFlag: Unable to update fraud flag, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	if formData.Status == "CLEARED" {
+		//the msisdn starts again without lockout history
+		if err = utils.ClearCodeGuard(config.Redis, phoneHash); err != nil {
+			utils.LogMessage(string(utils.CRITICAL), "ReviewCodeFraudFlag: Unable to clear code guard, error: "+err.Error(), config.ServiceName)
+		}
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "code_fraud_flag",
+			Description:  fmt.Sprintf("set fraud flag of %s from %s to %s", phoneMasked, status, formData.Status),
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"flag_id":     flagId,
+			"customer_id": customerId,
+			"note":        formData.Note,
+		},
+	)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Fraud flag set to " + formData.Status})
+}
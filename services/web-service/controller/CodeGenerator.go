@@ -0,0 +1,593 @@
+package controller
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"shared-package/utils"
+	"strconv"
+	"time"
+	"web-service/config"
+	"web-service/model"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/spf13/viper"
+	"github.com/xuri/excelize/v2"
+)
+
+// advisory lock namespace of generation jobs, see codeImportLockKey
+const codeGenerationLockKey = 7002
+
+// rows per sheet of a xlsx printer file, excel sheets hold at most 1048576 rows
+const codeExportSheetRows = 1000000
+
+func codeExportDir() string {
+	dir := viper.GetString("code_generator.export_dir")
+	if dir == "" {
+		dir = "/app/exports"
+	}
+	return dir
+}
+
+// codeExportTTL is how long a printer file which was not downloaded is kept
+func codeExportTTL() int {
+	ttl := viper.GetInt("code_generator.export_ttl")
+	if ttl <= 0 {
+		ttl = 72
+	}
+	return ttl
+}
+
+// signCodeManifest return the HMAC-SHA256 of the manifest with code_generator.signing_key, the supplier checks the file with it
+func signCodeManifest(manifest model.CodeExportManifest) (string, error) {
+	key := viper.GetString("code_generator.signing_key")
+	if key == "" {
+		return "", errors.New("code_generator.signing_key is not configured")
+	}
+	manifest.Signature = ""
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(content)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// GenerateCodes create a batch and the job generating its codes, the printer file is exported once the codes are saved
+func GenerateCodes(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	type FormData struct {
+		BatchReference string `json:"batch_reference" binding:"required" validate:"required,max=100"`
+		Product        string `json:"product" binding:"required" validate:"required,max=50"`
+		BottlingLine   string `json:"bottling_line" validate:"max=50"`
+		Region         string `json:"region" validate:"max=100"`
+		ProductionDate string `json:"production_date" validate:"omitempty,datetime=2006-01-02"`
+		Quantity       int    `json:"quantity" binding:"required" validate:"required,min=1,max=50000000"`
+		Alphabet       string `json:"alphabet"`
+		Length         int    `json:"length"`
+		CheckDigit     string `json:"check_digit"`
+		ExportFormat   string `json:"export_format" validate:"omitempty,oneof=csv xlsx"`
+	}
+	formData := FormData{}
+	if err := c.BodyParser(&formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+	format := utils.CodeFormat{Alphabet: formData.Alphabet, Length: formData.Length, CheckDigit: formData.CheckDigit}
+	if format.Alphabet == "" {
+		format.Alphabet = viper.GetString("code_generator.alphabet")
+		if format.Alphabet == "" {
+			format.Alphabet = utils.DefaultCodeAlphabet
+		}
+	}
+	if format.Length == 0 {
+		format.Length = viper.GetInt("code_generator.length")
+		if format.Length == 0 {
+			format.Length = 10
+		}
+	}
+	if format.CheckDigit == "" {
+		format.CheckDigit = utils.CheckDigitLuhn
+	}
+	if formData.ExportFormat == "" {
+		formData.ExportFormat = "csv"
+	}
+	if err := format.Validate(); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, err.Error())
+	}
+	//codes must not be guessable: enough random bits and a sparse code space
+	minEntropy := viper.GetFloat64("code_generator.min_entropy_bits")
+	if minEntropy <= 0 {
+		minEntropy = 40
+	}
+	maxGuessProbability := viper.GetFloat64("code_generator.max_guess_probability")
+	if maxGuessProbability <= 0 {
+		maxGuessProbability = 0.000001
+	}
+	if format.EntropyBits() < minEntropy {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, fmt.Sprintf("Codes have %.1f random bits, at least %.0f are required, use a longer code or a larger alphabet", format.EntropyBits(), minEntropy))
+	}
+	if format.GuessProbability(formData.Quantity) > maxGuessProbability {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Too many codes for the code space, a random guess would match too often, use a longer code or a larger alphabet")
+	}
+	if _, err := signCodeManifest(model.CodeExportManifest{}); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusExpectationFailed, "Printer file signing key is not configured")
+	}
+	batchId, err := createCodeBatch(codeBatchInput{
+		Reference:      formData.BatchReference,
+		Product:        formData.Product,
+		BottlingLine:   formData.BottlingLine,
+		Region:         formData.Region,
+		ProductionDate: formData.ProductionDate,
+		Format:         &format,
+		UserId:         userPayload.Id,
+		IPAddress:      c.IP(),
+	})
+	if err != nil {
+		if ok, _ := utils.IsErrDuplicate(err); ok {
+			return utils.JsonErrorResponse(c, fiber.StatusConflict, "A batch with the same reference already exists")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to create code batch", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GenerateCodes: Unable to create code batch, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	var jobId int
+	err = config.DB.QueryRow(ctx, `insert into code_generation_job (batch_id,quantity,export_format,operator_id) values ($1,$2,$3,$4) returning id`,
+		batchId, formData.Quantity, formData.ExportFormat, userPayload.Id).Scan(&jobId)
+	if err != nil {
+		failCodeBatch(batchId, "Unable to create generation job")
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to create generation job", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GenerateCodes: Unable to create generation job, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "generateCodes",
+			Description:  fmt.Sprintf("Generate %d codes for batch %s", formData.Quantity, formData.BatchReference),
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"batch_id": batchId,
+			"job_id":   jobId,
+			"format":   format,
+		},
+	)
+	go runCodeGenerationJob(jobId)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Codes will be generated in background and we will send you an SMS",
+		"batch_id": batchId, "job_id": jobId, "entropy_bits": format.EntropyBits(), "guess_probability": format.GuessProbability(formData.Quantity)})
+}
+
+// RunCodeGenerationJobs resume the jobs left unfinished, e.g after a restart
+func RunCodeGenerationJobs() {
+	rows, err := config.DB.Query(ctx, `select id from code_generation_job where status in ('PENDING','RUNNING','EXPORTING') order by id`)
+	if err != nil {
+		utils.LogMessage(string(utils.CRITICAL), "RunCodeGenerationJobs: Unable to fetch generation jobs, error: "+err.Error(), config.ServiceName)
+	} else {
+		jobIds := []int{}
+		for rows.Next() {
+			var jobId int
+			if err = rows.Scan(&jobId); err == nil {
+				jobIds = append(jobIds, jobId)
+			}
+		}
+		rows.Close()
+		for _, jobId := range jobIds {
+			runCodeGenerationJob(jobId)
+		}
+	}
+	expireCodeExports()
+	time.Sleep(time.Minute)
+	RunCodeGenerationJobs()
+}
+
+// expireCodeExports delete the printer files not downloaded within code_generator.export_ttl hours
+func expireCodeExports() {
+	rows, err := config.DB.Query(ctx, `update code_generation_job set status='EXPIRED', export_path='', updated_at=now()
+	where status='COMPLETED' and completed_at < now() - make_interval(hours => $1) returning id,export_path`, codeExportTTL())
+	if err != nil {
+		utils.LogMessage(string(utils.CRITICAL), "expireCodeExports: Unable to expire printer files, error: "+err.Error(), config.ServiceName)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var jobId int
+		var exportPath string
+		if err = rows.Scan(&jobId, &exportPath); err != nil {
+			continue
+		}
+		if err = os.Remove(exportPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			utils.LogMessage(string(utils.CRITICAL), fmt.Sprintf("expireCodeExports: Unable to delete printer file of job #%d, error: %s", jobId, err.Error()), config.ServiceName)
+		}
+	}
+}
+
+func runCodeGenerationJob(jobId int) {
+	conn, err := config.DB.Acquire(ctx)
+	if err != nil {
+		utils.LogMessage(string(utils.CRITICAL), "runCodeGenerationJob: Unable to acquire connection, error: "+err.Error(), config.ServiceName)
+		return
+	}
+	defer conn.Release()
+	var locked bool
+	if err = conn.QueryRow(ctx, `select pg_try_advisory_lock($1,$2)`, codeGenerationLockKey, jobId).Scan(&locked); err != nil || !locked {
+		return
+	}
+	defer conn.Exec(ctx, `select pg_advisory_unlock($1,$2)`, codeGenerationLockKey, jobId)
+
+	job := model.CodeGenerationJob{}
+	manifest := model.CodeExportManifest{JobId: jobId}
+	var operatorPhone *string
+	err = config.DB.QueryRow(ctx, `select j.batch_id,b.reference,b.product,j.quantity,j.export_format,j.status,b.code_alphabet,b.code_length,b.check_digit,u.phone
+	from code_generation_job j inner join code_batch b on b.id = j.batch_id left join users u on u.id = j.operator_id where j.id=$1`, jobId).
+		Scan(&job.BatchId, &job.BatchReference, &manifest.Product, &job.Quantity, &job.ExportFormat, &job.Status, &manifest.Alphabet, &manifest.Length,
+			&manifest.CheckDigit, &operatorPhone)
+	if err != nil || (job.Status != "PENDING" && job.Status != "RUNNING" && job.Status != "EXPORTING") {
+		return
+	}
+	job.Id = jobId
+	startTime := time.Now()
+	format := utils.CodeFormat{Alphabet: manifest.Alphabet, Length: manifest.Length, CheckDigit: manifest.CheckDigit}
+	err = generateBatchCodes(&job, format)
+	if err == nil {
+		err = exportBatchCodes(&job, manifest)
+	}
+	if err != nil {
+		traceId := utils.LogMessage("error", fmt.Sprintf("runCodeGenerationJob: generation job #%d failed, error: %s", jobId, err.Error()), config.ServiceName)
+		_, dbErr := config.DB.Exec(ctx, `update code_generation_job set status='FAILED', error_message=left($2,255), updated_at=now() where id=$1`, jobId, err.Error())
+		if dbErr != nil {
+			utils.LogMessage("error", "runCodeGenerationJob: Unable to save job failure, error: "+dbErr.Error(), config.ServiceName)
+		}
+		failCodeBatch(job.BatchId, err.Error())
+		if operatorPhone != nil {
+			utils.QueueTemplateSMS(config.DB, "upload_codes_failed", utils.SMSTemplateDefaultLang(), map[string]any{"Error": "code generation failed, error code: " + traceId},
+				*operatorPhone, viper.GetString("SENDER_ID"), "upload_codes", nil)
+		}
+		return
+	}
+	_, err = config.DB.Exec(ctx, "REFRESH MATERIALIZED VIEW codes_count;")
+	if err != nil {
+		utils.LogMessage("error", "runCodeGenerationJob: Unable to refresh codes_count, error: "+err.Error(), config.ServiceName)
+	}
+	if operatorPhone != nil {
+		_, err = utils.QueueTemplateSMS(config.DB, "codes_generated", utils.SMSTemplateDefaultLang(),
+			map[string]any{"Total": job.GeneratedCount, "Reference": job.BatchReference, "Duration": time.Since(startTime).Round(time.Second).String()},
+			*operatorPhone, viper.GetString("SENDER_ID"), "upload_codes", nil)
+		if err != nil {
+			utils.LogMessage("error", "runCodeGenerationJob: Unable to queue sms notification, error: "+err.Error(), config.ServiceName)
+		}
+	}
+}
+
+// generateBatchCodes insert random codes into the batch until it holds the job quantity, codes colliding with an existing code are drawn again
+func generateBatchCodes(job *model.CodeGenerationJob, format utils.CodeFormat) error {
+	if job.Status == "EXPORTING" {
+		return nil
+	}
+	_, err := config.DB.Exec(ctx, `update code_generation_job set status='RUNNING', started_at=coalesce(started_at, now()), error_message='', updated_at=now() where id=$1`, job.Id)
+	if err != nil {
+		return err
+	}
+	//codes saved before an interruption are kept
+	err = config.DB.QueryRow(ctx, `select count(id) from codes where batch_id=$1`, job.BatchId).Scan(&job.GeneratedCount)
+	if err != nil {
+		return err
+	}
+	chunkSize := codeImportChunkSize()
+	for job.GeneratedCount < job.Quantity {
+		size := min(chunkSize, job.Quantity-job.GeneratedCount)
+		codes := make([]string, 0, size)
+		drawn := make(map[string]struct{}, size)
+		for len(codes) < size {
+			code, err := format.GenerateCode()
+			if err != nil {
+				return err
+			}
+			if _, ok := drawn[code]; ok {
+				job.CollisionCount++
+				continue
+			}
+			drawn[code] = struct{}{}
+			codes = append(codes, code)
+		}
+		tx, err := config.DB.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		cmd, err := tx.Exec(ctx, `insert into codes (code,code_hash,status,batch_id)
+		select pgp_sym_encrypt(c,$2),digest(c,'sha256'),'unused',$3 from unnest($1::text[]) c on conflict (code_hash) do nothing`, codes, config.EncryptionKey, job.BatchId)
+		if err != nil {
+			tx.Rollback(ctx)
+			return err
+		}
+		inserted := int(cmd.RowsAffected())
+		job.CollisionCount += len(codes) - inserted
+		_, err = tx.Exec(ctx, `update code_generation_job set generated_count=$2, collision_count=$3, updated_at=now() where id=$1`,
+			job.Id, job.GeneratedCount+inserted, job.CollisionCount)
+		if err == nil {
+			err = tx.Commit(ctx)
+		}
+		if err != nil {
+			tx.Rollback(ctx)
+			return err
+		}
+		job.GeneratedCount += inserted
+	}
+	_, err = config.DB.Exec(ctx, `update code_generation_job set status='EXPORTING', updated_at=now() where id=$1`, job.Id)
+	return err
+}
+
+// exportBatchCodes write the printer file of the batch and save its signed manifest, the codes are streamed from the db
+func exportBatchCodes(job *model.CodeGenerationJob, manifest model.CodeExportManifest) error {
+	if err := os.MkdirAll(codeExportDir(), 0700); err != nil {
+		return err
+	}
+	manifest.FileName = fmt.Sprintf("batch_%d_codes.%s", job.BatchId, job.ExportFormat)
+	exportPath := filepath.Join(codeExportDir(), manifest.FileName)
+	rows, err := config.DB.Query(ctx, `select pgp_sym_decrypt(code::bytea,$2) from codes where batch_id=$1 order by id`, job.BatchId, config.EncryptionKey)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	count := 0
+	if job.ExportFormat == "xlsx" {
+		count, err = writeCodesXlsx(exportPath, rows)
+	} else {
+		count, err = writeCodesCsv(exportPath, rows)
+	}
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(exportPath)
+	if err != nil {
+		return err
+	}
+	manifest.SHA256, err = fileSHA256(exportPath)
+	if err != nil {
+		return err
+	}
+	manifest.BatchId = job.BatchId
+	manifest.BatchReference = job.BatchReference
+	manifest.Quantity = count
+	manifest.FileSize = info.Size()
+	manifest.GeneratedAt = time.Now().UTC()
+	manifest.Signature, err = signCodeManifest(manifest)
+	if err != nil {
+		return err
+	}
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, `update code_generation_job set status='COMPLETED', export_path=$2, manifest=$3, completed_at=now(), updated_at=now() where id=$1`,
+		job.Id, exportPath, manifest)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `update code_batch set status='ACTIVE', uploaded_count=$2, file_name=$3, file_hash=$4, updated_at=now() where id=$1 and status='UPLOADING'`,
+		job.BatchId, count, manifest.FileName, manifest.SHA256)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func writeCodesCsv(exportPath string, rows pgx.Rows) (int, error) {
+	file, err := os.OpenFile(exportPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	buffer := bufio.NewWriterSize(file, 1024*1024)
+	writer := csv.NewWriter(buffer)
+	writer.Write([]string{"serial", "code"})
+	count := 0
+	for rows.Next() {
+		var code string
+		if err = rows.Scan(&code); err != nil {
+			return count, err
+		}
+		count++
+		writer.Write([]string{strconv.Itoa(count), code})
+	}
+	if err = rows.Err(); err != nil {
+		return count, err
+	}
+	writer.Flush()
+	if err = writer.Error(); err != nil {
+		return count, err
+	}
+	return count, buffer.Flush()
+}
+
+func writeCodesXlsx(exportPath string, rows pgx.Rows) (int, error) {
+	file := excelize.NewFile()
+	defer file.Close()
+	var stream *excelize.StreamWriter
+	count := 0
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			return count, err
+		}
+		sheetRow := count%codeExportSheetRows + 2
+		if count%codeExportSheetRows == 0 {
+			//a new sheet every codeExportSheetRows codes
+			if stream != nil {
+				if err := stream.Flush(); err != nil {
+					return count, err
+				}
+			}
+			sheet := fmt.Sprintf("Sheet%d", count/codeExportSheetRows+1)
+			if _, err := file.NewSheet(sheet); err != nil {
+				return count, err
+			}
+			var err error
+			if stream, err = file.NewStreamWriter(sheet); err != nil {
+				return count, err
+			}
+			if err = stream.SetRow("A1", []interface{}{"serial", "code"}); err != nil {
+				return count, err
+			}
+		}
+		count++
+		if err := stream.SetRow(fmt.Sprintf("A%d", sheetRow), []interface{}{count, code}); err != nil {
+			return count, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+	if stream != nil {
+		if err := stream.Flush(); err != nil {
+			return count, err
+		}
+	}
+	return count, file.SaveAs(exportPath)
+}
+
+func GetCodeGenerationJob(c *fiber.Ctx) error {
+	jobId, err := c.ParamsInt("job_id")
+	if err != nil || jobId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid job id provided")
+	}
+	job, _, err := getCodeGenerationJob(jobId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotFound, "Generation job not found")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get generation job failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetCodeGenerationJob: Unable to get generation job, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": job})
+}
+
+func getCodeGenerationJob(jobId int) (model.CodeGenerationJob, string, error) {
+	job := model.CodeGenerationJob{}
+	var exportPath string
+	err := config.DB.QueryRow(ctx, `select j.id,j.batch_id,b.reference,j.quantity,j.export_format,j.status,j.generated_count,j.collision_count,j.manifest,j.error_message,
+	j.started_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',j.completed_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',
+	j.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',j.downloaded_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',j.export_path
+	from code_generation_job j inner join code_batch b on b.id = j.batch_id where j.id=$1`, jobId).
+		Scan(&job.Id, &job.BatchId, &job.BatchReference, &job.Quantity, &job.ExportFormat, &job.Status, &job.GeneratedCount, &job.CollisionCount, &job.Manifest,
+			&job.ErrorMessage, &job.StartedAt, &job.CompletedAt, &job.CreatedAt, &job.DownloadedAt, &exportPath)
+	if err != nil {
+		return job, "", err
+	}
+	job.Progress = float64(job.GeneratedCount*10000/job.Quantity) / 100
+	return job, exportPath, nil
+}
+
+// DownloadCodeExport download the printer file (or its manifest with ?manifest=true) of a completed generation job.
+// the printer file holds the codes in clear, it can be downloaded once and is deleted from the disk when the download starts
+func DownloadCodeExport(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	jobId, err := c.ParamsInt("job_id")
+	if err != nil || jobId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid job id provided")
+	}
+	job, exportPath, err := getCodeGenerationJob(jobId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotFound, "Generation job not found")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Download printer file failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "DownloadCodeExport: Unable to get generation job, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	if job.Manifest == nil {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "The printer file is not ready")
+	}
+	fileName := job.Manifest.FileName
+	if c.QueryBool("manifest") {
+		fileName += ".manifest.json"
+		recordCodeExportDownload(c, userPayload.Id, job, fileName)
+		content, _ := json.MarshalIndent(job.Manifest, "", "  ")
+		c.Attachment(fileName)
+		return c.Send(content)
+	}
+	switch job.Status {
+	case "DOWNLOADED":
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "The printer file was already downloaded, please generate a new batch")
+	case "EXPIRED":
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "The printer file has expired, please generate a new batch")
+	}
+	//the file stays readable through the open descriptor once it is removed
+	file, err := os.Open(exportPath)
+	var info os.FileInfo
+	if err == nil {
+		info, err = file.Stat()
+	}
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Download printer file failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     fmt.Sprintf("DownloadCodeExport: Unable to open printer file of job #%d, error: %s", jobId, err.Error()),
+			ServiceName: config.ServiceName,
+		})
+	}
+	result, err := config.DB.Exec(ctx, `update code_generation_job set status='DOWNLOADED', export_path='', downloaded_at=now(), downloaded_by=$2, updated_at=now()
+	where id=$1 and status='COMPLETED'`, jobId, userPayload.Id)
+	if err != nil || result.RowsAffected() != 1 {
+		file.Close()
+		if err == nil {
+			//downloaded or expired meanwhile
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "The printer file is no longer available")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Download printer file failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "DownloadCodeExport: Unable to save the download, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	if err = os.Remove(exportPath); err != nil {
+		utils.LogMessage(string(utils.CRITICAL), fmt.Sprintf("DownloadCodeExport: Unable to delete printer file of job #%d, error: %s", jobId, err.Error()), config.ServiceName)
+	}
+	recordCodeExportDownload(c, userPayload.Id, job, fileName)
+	c.Attachment(fileName)
+	return c.SendStream(file, int(info.Size()))
+}
+
+func recordCodeExportDownload(c *fiber.Ctx, userId int, job model.CodeGenerationJob, fileName string) {
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userId,
+			ActivityType: "downloadCodes",
+			Description:  "Download printer file " + fileName + " of batch " + job.BatchReference,
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"job_id":   job.Id,
+			"batch_id": job.BatchId,
+		},
+	)
+}
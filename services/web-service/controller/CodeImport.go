@@ -0,0 +1,487 @@
+package controller
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"shared-package/utils"
+	"strconv"
+	"strings"
+	"time"
+	"web-service/config"
+	"web-service/model"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/spf13/viper"
+	"github.com/xuri/excelize/v2"
+)
+
+// advisory lock namespace of import jobs, the lock is held by the instance running the job and released if it dies
+const codeImportLockKey = 7001
+
+// CodeImportMaxFileSize is the largest codes file accepted, code_import.max_file_size in MB
+func CodeImportMaxFileSize() int64 {
+	size := viper.GetInt64("code_import.max_file_size")
+	if size <= 0 {
+		size = 1024
+	}
+	return size * 1024 * 1024
+}
+
+// LimitBody reject bodies larger than limit on every path but the ones given, the server streams bodies past its
+// BodyLimit instead of refusing them so the codes upload can go up to CodeImportMaxFileSize
+func LimitBody(limit int, largeBodyPaths ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		for _, path := range largeBodyPaths {
+			if c.Path() == path {
+				return c.Next()
+			}
+		}
+		//-1 is a chunked body whose size is only known once it is read
+		if length := c.Request().Header.ContentLength(); length > limit || length == -1 {
+			return utils.JsonErrorResponse(c, fiber.StatusRequestEntityTooLarge, fmt.Sprintf("Request body should not exceed %dMB", limit/1024/1024))
+		}
+		return c.Next()
+	}
+}
+
+func codeImportChunkSize() int {
+	size := viper.GetInt("code_import.chunk_size")
+	if size <= 0 {
+		size = 50000
+	}
+	return size
+}
+
+// codeRowReader stream the rows of a codes file, line is the line (txt) or row (xlsx) number starting from 1
+type codeRowReader interface {
+	Next() (line int, columns []string, err error)
+	Close() error
+}
+
+type txtCodeReader struct {
+	file    *os.File
+	scanner *bufio.Scanner
+	line    int
+}
+
+func (r *txtCodeReader) Next() (int, []string, error) {
+	if !r.scanner.Scan() {
+		if err := r.scanner.Err(); err != nil {
+			return r.line, nil, err
+		}
+		return r.line, nil, io.EOF
+	}
+	r.line++
+	return r.line, []string{r.scanner.Text()}, nil
+}
+
+func (r *txtCodeReader) Close() error {
+	return r.file.Close()
+}
+
+type xlsxCodeReader struct {
+	file *excelize.File
+	rows *excelize.Rows
+	line int
+}
+
+func (r *xlsxCodeReader) Next() (int, []string, error) {
+	if !r.rows.Next() {
+		if err := r.rows.Error(); err != nil {
+			return r.line, nil, err
+		}
+		return r.line, nil, io.EOF
+	}
+	r.line++
+	columns, err := r.rows.Columns()
+	return r.line, columns, err
+}
+
+func (r *xlsxCodeReader) Close() error {
+	r.rows.Close()
+	return r.file.Close()
+}
+
+func openCodeFile(filePath string) (codeRowReader, error) {
+	if strings.ToLower(filepath.Ext(filePath)) == ".xlsx" {
+		file, err := excelize.OpenFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+		rows, err := file.Rows("Sheet1")
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &xlsxCodeReader{file: file, rows: rows}, nil
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return &txtCodeReader{file: file, scanner: scanner}, nil
+}
+
+type codeImportError struct {
+	line   int
+	value  string
+	detail string
+}
+
+// readImportCode return the code of the row, detail is set when the row is not valid and empty is true for blank rows.
+// legacy batches (no check digit) only check the code length
+func readImportCode(line int, columns []string, xlsx bool, format utils.CodeFormat) (code string, detail string, empty bool) {
+	values := []string{}
+	for _, column := range columns {
+		if value := strings.TrimSpace(column); value != "" {
+			values = append(values, value)
+		}
+	}
+	if len(values) == 0 || (xlsx && line == 1) {
+		//blank row or excel header
+		return "", "", true
+	}
+	if len(values) > 1 {
+		return strings.Join(values, ","), "each row should contain only one code", false
+	}
+	code = strings.ToUpper(values[0])
+	if len(code) != format.Length {
+		return code, fmt.Sprintf("invalid code length, code should be %d characters", format.Length), false
+	}
+	if !format.Match(code) {
+		return code, "invalid code, a character is not in the alphabet or the check character is wrong", false
+	}
+	return code, "", false
+}
+
+// RunCodeImportJobs resume the jobs left PENDING or RUNNING, e.g after a restart
+func RunCodeImportJobs() {
+	rows, err := config.DB.Query(ctx, `select id from code_import_job where status in ('PENDING','RUNNING') order by id`)
+	if err != nil {
+		utils.LogMessage(string(utils.CRITICAL), "RunCodeImportJobs: Unable to fetch import jobs, error: "+err.Error(), config.ServiceName)
+	} else {
+		jobIds := []int{}
+		for rows.Next() {
+			var jobId int
+			if err = rows.Scan(&jobId); err == nil {
+				jobIds = append(jobIds, jobId)
+			}
+		}
+		rows.Close()
+		for _, jobId := range jobIds {
+			runCodeImportJob(jobId)
+		}
+	}
+	time.Sleep(time.Minute)
+	RunCodeImportJobs()
+}
+
+// runCodeImportJob import the file of the job chunk by chunk, nothing is done when another instance runs the job
+func runCodeImportJob(jobId int) {
+	conn, err := config.DB.Acquire(ctx)
+	if err != nil {
+		utils.LogMessage(string(utils.CRITICAL), "runCodeImportJob: Unable to acquire connection, error: "+err.Error(), config.ServiceName)
+		return
+	}
+	defer conn.Release()
+	var locked bool
+	if err = conn.QueryRow(ctx, `select pg_try_advisory_lock($1,$2)`, codeImportLockKey, jobId).Scan(&locked); err != nil || !locked {
+		return
+	}
+	defer conn.Exec(ctx, `select pg_advisory_unlock($1,$2)`, codeImportLockKey, jobId)
+
+	job := model.CodeImportJob{}
+	var filePath string
+	var operatorPhone *string
+	format := utils.CodeFormat{}
+	err = config.DB.QueryRow(ctx, `select j.id,j.batch_id,j.file_path,j.status,j.total_rows,j.processed_rows,j.imported_count,j.duplicate_count,j.invalid_count,u.phone,
+	b.code_alphabet,b.code_length,b.check_digit from code_import_job j inner join code_batch b on b.id = j.batch_id left join users u on u.id = j.operator_id where j.id=$1`, jobId).
+		Scan(&job.Id, &job.BatchId, &filePath, &job.Status, &job.TotalRows, &job.ProcessedRows, &job.ImportedCount, &job.DuplicateCount, &job.InvalidCount, &operatorPhone,
+			&format.Alphabet, &format.Length, &format.CheckDigit)
+	if err != nil || (job.Status != "PENDING" && job.Status != "RUNNING") {
+		return
+	}
+	if format.Length == 0 {
+		format.Length = utils.LegacyCodeLength
+	}
+	startTime := time.Now()
+	err = importCodeFile(&job, filePath, format)
+	if err != nil {
+		traceId := utils.LogMessage("error", fmt.Sprintf("runCodeImportJob: import job #%d failed, error: %s", jobId, err.Error()), config.ServiceName)
+		_, dbErr := config.DB.Exec(ctx, `update code_import_job set status='FAILED', error_message=left($2,255), updated_at=now() where id=$1`, jobId, err.Error())
+		if dbErr != nil {
+			utils.LogMessage("error", "runCodeImportJob: Unable to save job failure, error: "+dbErr.Error(), config.ServiceName)
+		}
+		failCodeBatch(job.BatchId, err.Error())
+		if operatorPhone != nil {
+			utils.QueueTemplateSMS(config.DB, "upload_codes_failed", utils.SMSTemplateDefaultLang(), map[string]any{"Error": "import failed, error code: " + traceId},
+				*operatorPhone, viper.GetString("SENDER_ID"), "upload_codes", nil)
+		}
+		return
+	}
+	_, err = config.DB.Exec(ctx, "REFRESH MATERIALIZED VIEW codes_count;")
+	if err != nil {
+		utils.LogMessage("error", "runCodeImportJob: Unable to refresh codes_count, error: "+err.Error(), config.ServiceName)
+	}
+	if operatorPhone != nil {
+		_, err = utils.QueueTemplateSMS(config.DB, "upload_codes_success", utils.SMSTemplateDefaultLang(),
+			map[string]any{"Total": job.ImportedCount, "Duplicates": job.DuplicateCount, "Invalid": job.InvalidCount, "Duration": time.Since(startTime).Round(time.Second).String()},
+			*operatorPhone, viper.GetString("SENDER_ID"), "upload_codes", nil)
+		if err != nil {
+			utils.LogMessage("error", "runCodeImportJob: Unable to queue sms notification, error: "+err.Error(), config.ServiceName)
+		}
+	}
+	go os.Remove(filePath)
+}
+
+func importCodeFile(job *model.CodeImportJob, filePath string, format utils.CodeFormat) error {
+	_, err := config.DB.Exec(ctx, `update code_import_job set status='RUNNING', started_at=coalesce(started_at, now()), error_message='', updated_at=now() where id=$1`, job.Id)
+	if err != nil {
+		return err
+	}
+	//rows of an interrupted chunk
+	if _, err = config.DB.Exec(ctx, `delete from code_import_staging where job_id=$1`, job.Id); err != nil {
+		return err
+	}
+	xlsx := strings.ToLower(filepath.Ext(filePath)) == ".xlsx"
+	if job.TotalRows == 0 {
+		//first pass to report the progress, the file is streamed and never loaded in memory
+		reader, err := openCodeFile(filePath)
+		if err != nil {
+			return err
+		}
+		total := 0
+		for {
+			line, columns, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				reader.Close()
+				return err
+			}
+			if _, _, empty := readImportCode(line, columns, xlsx, format); !empty {
+				total++
+			}
+		}
+		reader.Close()
+		job.TotalRows = total
+		if _, err = config.DB.Exec(ctx, `update code_import_job set total_rows=$2 where id=$1`, job.Id, total); err != nil {
+			return err
+		}
+	}
+	reader, err := openCodeFile(filePath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	chunkSize := codeImportChunkSize()
+	codes := make([][]interface{}, 0, chunkSize)
+	invalid := []codeImportError{}
+	lastLine := job.ProcessedRows
+	for {
+		line, columns, err := reader.Next()
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if err == nil && line > job.ProcessedRows {
+			lastLine = line
+			code, detail, empty := readImportCode(line, columns, xlsx, format)
+			if !empty && detail == "" {
+				codes = append(codes, []interface{}{job.Id, line, code})
+			} else if !empty {
+				invalid = append(invalid, codeImportError{line: line, value: code, detail: detail})
+			}
+		}
+		if len(codes)+len(invalid) >= chunkSize || (err == io.EOF && lastLine > job.ProcessedRows) {
+			if err := importCodeChunk(job, codes, invalid, lastLine); err != nil {
+				return err
+			}
+			codes = codes[:0]
+			invalid = invalid[:0]
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, `update code_import_job set status='COMPLETED', completed_at=now(), updated_at=now() where id=$1`, job.Id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `update code_batch set status='ACTIVE', uploaded_count=$2, updated_at=now() where id=$1 and status='UPLOADING'`, job.BatchId, job.ImportedCount)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// importCodeChunk copy the chunk into the staging table and merge it into codes, codes already known or repeated in the file
+// are recorded as DUPLICATE. the progress is saved in the same transaction so a chunk is never imported twice
+func importCodeChunk(job *model.CodeImportJob, codes [][]interface{}, invalid []codeImportError, lastLine int) error {
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"code_import_staging"}, []string{"job_id", "line_number", "code"}, pgx.CopyFromRows(codes))
+	if err != nil {
+		return err
+	}
+	errorRows := make([][]interface{}, 0, len(invalid))
+	for _, row := range invalid {
+		value := row.value
+		if len(value) > 100 {
+			value = value[:100]
+		}
+		errorRows = append(errorRows, []interface{}{job.Id, row.line, "INVALID", strings.ToValidUTF8(value, ""), row.detail})
+	}
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"code_import_error"}, []string{"job_id", "line_number", "reason", "value", "detail"}, pgx.CopyFromRows(errorRows))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `insert into code_import_error (job_id,line_number,reason,value,detail)
+	select s.job_id,s.line_number,'DUPLICATE',left(s.code,3)||repeat('*',greatest(length(s.code)-3,0)),
+	case when s.rn > 1 then 'code repeated in the file' else 'code already exists' end
+	from (select job_id,line_number,code,row_number() over (partition by code order by line_number) rn from code_import_staging where job_id=$1) s
+	where s.rn > 1 or exists (select 1 from codes cd where cd.code_hash = digest(s.code,'sha256'))`, job.Id)
+	if err != nil {
+		return err
+	}
+	cmd, err := tx.Exec(ctx, `insert into codes (code,code_hash,status,batch_id)
+	select pgp_sym_encrypt(s.code,$2),digest(s.code,'sha256'),'unused',$3 from (select distinct code from code_import_staging where job_id=$1) s
+	on conflict (code_hash) do nothing`, job.Id, config.EncryptionKey, job.BatchId)
+	if err != nil {
+		return err
+	}
+	imported := int(cmd.RowsAffected())
+	if _, err = tx.Exec(ctx, `delete from code_import_staging where job_id=$1`, job.Id); err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `update code_import_job set processed_rows=$2, imported_count=imported_count+$3, duplicate_count=duplicate_count+$4,
+	invalid_count=invalid_count+$5, updated_at=now() where id=$1`, job.Id, lastLine, imported, len(codes)-imported, len(invalid))
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+	job.ProcessedRows = lastLine
+	job.ImportedCount += imported
+	job.DuplicateCount += len(codes) - imported
+	job.InvalidCount += len(invalid)
+	return nil
+}
+
+func GetCodeImportJob(c *fiber.Ctx) error {
+	jobId, err := c.ParamsInt("job_id")
+	if err != nil || jobId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid job id provided")
+	}
+	job := model.CodeImportJob{}
+	err = config.DB.QueryRow(ctx, `select j.id,j.batch_id,b.reference,j.file_name,j.status,j.total_rows,j.processed_rows,j.imported_count,j.duplicate_count,
+	j.invalid_count,j.error_message,j.started_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',j.completed_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',
+	j.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali' from code_import_job j inner join code_batch b on b.id = j.batch_id where j.id=$1`, jobId).
+		Scan(&job.Id, &job.BatchId, &job.BatchReference, &job.FileName, &job.Status, &job.TotalRows, &job.ProcessedRows, &job.ImportedCount, &job.DuplicateCount,
+			&job.InvalidCount, &job.ErrorMessage, &job.StartedAt, &job.CompletedAt, &job.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotFound, "Import job not found")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get import job failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetCodeImportJob: Unable to get import job, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	rowsDone := job.ImportedCount + job.DuplicateCount + job.InvalidCount
+	if job.Status == "COMPLETED" {
+		job.Progress = 100
+	} else if job.TotalRows > 0 {
+		job.Progress = float64(rowsDone*10000/job.TotalRows) / 100
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": job})
+}
+
+// GetCodeImportErrors download the rejected rows of the job as csv
+func GetCodeImportErrors(c *fiber.Ctx) error {
+	jobId, err := c.ParamsInt("job_id")
+	if err != nil || jobId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid job id provided")
+	}
+	rows, err := config.DB.Query(ctx, `select line_number,reason,value,detail from code_import_error where job_id=$1 order by line_number`, jobId)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get import errors failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetCodeImportErrors: Unable to get import errors, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	c.Set(fiber.HeaderContentType, "text/csv")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="code_import_%d_errors.csv"`, jobId))
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer rows.Close()
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"line", "reason", "value", "detail"})
+		for rows.Next() {
+			var line int
+			var reason, value, detail string
+			if err := rows.Scan(&line, &reason, &value, &detail); err != nil {
+				utils.LogMessage("error", "GetCodeImportErrors: Unable to read import error, error: "+err.Error(), config.ServiceName)
+				break
+			}
+			writer.Write([]string{strconv.Itoa(line), reason, value, detail})
+		}
+		writer.Flush()
+	})
+	return nil
+}
+
+// ResumeCodeImportJob restart a FAILED job from its last imported chunk
+func ResumeCodeImportJob(c *fiber.Ctx) error {
+	jobId, err := c.ParamsInt("job_id")
+	if err != nil || jobId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid job id provided")
+	}
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to resume import job, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ResumeCodeImportJob: Unable to start transaction, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer tx.Rollback(ctx)
+	var batchId int
+	err = tx.QueryRow(ctx, `update code_import_job set status='PENDING', updated_at=now() where id=$1 and status='FAILED' returning batch_id`, jobId).Scan(&batchId)
+	if err == nil {
+		_, err = tx.Exec(ctx, `update code_batch set status='UPLOADING', status_reason='', updated_at=now() where id=$1 and status='FAILED'`, batchId)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Only a failed import job can be resumed")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to resume import job, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ResumeCodeImportJob: Unable to update import job, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	go runCodeImportJob(jobId)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Import job resumed"})
+}
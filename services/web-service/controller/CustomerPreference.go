@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"shared-package/utils"
+	"web-service/config"
+	"web-service/model"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+// GetCustomerPreferences return the sms preference of the customer and its history
+func GetCustomerPreferences(c *fiber.Ctx) error {
+	customerId, err := c.ParamsInt("customerId")
+	if err != nil || customerId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid customer id provided")
+	}
+	customer := model.Customer{Id: customerId}
+	err = config.DB.QueryRow(ctx, `select sms_opt_out,sms_opt_out_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali' from customer where id=$1`, customerId).
+		Scan(&customer.SMSOptOut, &customer.SMSOptOutAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotFound, "customer id provided is not valid")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get customer preferences failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetCustomerPreferences: Unable to get customer preference, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	history := []model.CustomerPreferenceLog{}
+	rows, err := config.DB.Query(ctx, `select l.id,l.sms_opt_out,l.source,l.reason,nullif(concat(u.fname,' ',u.lname),' '),
+	l.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali' from customer_preference_log l left join users u on u.id = l.operator_id
+	where l.customer_id=$1 order by l.id desc`, customerId)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get customer preferences failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetCustomerPreferences: Unable to get preference history, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer rows.Close()
+	for rows.Next() {
+		log := model.CustomerPreferenceLog{}
+		if err = rows.Scan(&log.Id, &log.SMSOptOut, &log.Source, &log.Reason, &log.Operator, &log.CreatedAt); err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get customer preferences failed", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "GetCustomerPreferences: Unable to read preference history, error: " + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+		history = append(history, log)
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": fiber.Map{
+		"customer_id":    customer.Id,
+		"sms_opt_out":    customer.SMSOptOut,
+		"sms_opt_out_at": customer.SMSOptOutAt,
+		"history":        history,
+	}})
+}
+
+// UpdateCustomerPreferences override the sms preference of the customer, e.g on a request received by the call center
+func UpdateCustomerPreferences(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	customerId, err := c.ParamsInt("customerId")
+	if err != nil || customerId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid customer id provided")
+	}
+	type FormData struct {
+		SMSOptOut *bool  `json:"sms_opt_out" binding:"required" validate:"required"`
+		Reason    string `json:"reason" binding:"required" validate:"required,min=3,max=255"`
+	}
+	formData := FormData{}
+	if err := c.BodyParser(&formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to update preference, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "UpdateCustomerPreferences: Unable to start transaction, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer tx.Rollback(ctx)
+	err = utils.SetSMSOptOut(tx, customerId, *formData.SMSOptOut, utils.SMSPreferenceAdmin, formData.Reason, &userPayload.Id)
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotFound, "customer id provided is not valid")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to update preference, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "UpdateCustomerPreferences: Unable to save preference, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "customer_preference",
+			Description:  fmt.Sprintf("set sms opt out of customer #%d to %t", customerId, *formData.SMSOptOut),
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"customer_id": customerId,
+			"reason":      formData.Reason,
+		},
+	)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Customer preference updated"})
+}
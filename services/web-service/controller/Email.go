@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"shared-package/utils"
+	"time"
+	"web-service/config"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+// emailExport queue an export as an attachment to the current user instead of downloading it, used with ?send_email=true
+func emailExport(c *fiber.Ctx, title string, fileName string, contentType string, content []byte) error {
+	userPayload := CurrentUser(c)
+	body, err := utils.GenerateHtmlTemplate("export.html", map[string]any{"Name": userPayload.Fname, "Title": title, "FileName": fileName})
+	if err == nil {
+		_, err = utils.QueueEmail(config.DB, utils.EmailMessage{To: userPayload.Email, Subject: title, Body: body,
+			Attachments: []utils.EmailAttachment{{FileName: fileName, ContentType: contentType, Content: content}}}, "export")
+	}
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to email the export", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     fmt.Sprintf("emailExport: Unable to queue %s for user %d, error: %s", fileName, userPayload.Id, err.Error()),
+			ServiceName: config.ServiceName,
+		})
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "The export will be sent to " + userPayload.Email})
+}
+
+func GetEmails(c *fiber.Ctx) error {
+	type EmailData struct {
+		Id           int        `json:"id"`
+		Recipient    string     `json:"recipient"`
+		Subject      string     `json:"subject"`
+		MessageType  string     `json:"message_type"`
+		Status       string     `json:"status"`
+		Attachments  int        `json:"attachments"`
+		Attempts     int        `json:"attempts"`
+		ErrorMessage string     `json:"error_message"`
+		Provider     *string    `json:"provider"`
+		SentAt       *time.Time `json:"sent_at"`
+		CreatedAt    time.Time  `json:"created_at"`
+	}
+	startDateStr := c.Query("start_date")
+	endDateStr := c.Query("end_date")
+	messageType := c.Query("message_type")
+	status := c.Query("status")
+	recipient := c.Query("recipient")
+	//add pagination
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 20)
+	if page < 1 {
+		page = 1
+	}
+	offSet := (page - 1) * limit
+	err := utils.ValidateDateRanges(startDateStr, &endDateStr)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, err.Error())
+	}
+	args1 := []interface{}{}
+	logsFilter, ii := utils.BuildQueryFilter(
+		map[string]interface{}{
+			"email.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali' >= ": startDateStr,
+			"email.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali' <= ": endDateStr,
+			"email.type":      messageType,
+			"email.status":    status,
+			"email.recipient": recipient,
+		},
+		&args1,
+	)
+	limitStr := fmt.Sprintf(" limit $%d offset $%d", ii, ii+1)
+	globalArgs := args1
+	args1 = append(args1, limit, offSet)
+	emails := []EmailData{}
+	rows, err := config.DB.Query(ctx,
+		`select id,recipient,subject,coalesce(type,''),status,attachments,attempts,coalesce(error_message,''),provider,sent_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',
+		created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali' from email`+logsFilter+` order by id desc`+limitStr, args1...)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get email data failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetEmails: Unable to get email data, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer rows.Close()
+	for rows.Next() {
+		email := EmailData{}
+		err = rows.Scan(&email.Id, &email.Recipient, &email.Subject, &email.MessageType, &email.Status, &email.Attachments, &email.Attempts, &email.ErrorMessage,
+			&email.Provider, &email.SentAt, &email.CreatedAt)
+		if err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get email data failed", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "GetEmails: Unable to read email data, error: " + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+		emails = append(emails, email)
+	}
+	totalEmails := 0
+	err = config.DB.QueryRow(ctx, `select count(id) from email `+logsFilter, globalArgs...).Scan(&totalEmails)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get email data failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetEmails: Unable to get total emails, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": emails,
+		"pagination": fiber.Map{"page": page, "limit": limit, "total": totalEmails}})
+}
+
+// ResendEmail queue a FAILED email again, the emails whose content was hidden can not be resent
+func ResendEmail(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	emailId, err := c.ParamsInt("email_id")
+	if err != nil || emailId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Invalid email id provided")
+	}
+	var status, recipient, messageType string
+	err = config.DB.QueryRow(ctx, `select status,recipient,coalesce(type,'') from email where id=$1`, emailId).Scan(&status, &recipient, &messageType)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotFound, "Email not found")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to resend email", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ResendEmail: Unable to get email, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	if status != "FAILED" {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Only failed emails can be resent")
+	} else if messageType == "verify_account_otp" {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "This email contains a one time code, please request a new one")
+	}
+	_, err = config.DB.Exec(ctx, `update email set status='QUEUED',attempts=0,error_message='',next_attempt_at=now(),updated_at=now() where id=$1 and status='FAILED'`, emailId)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to resend email", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ResendEmail: Unable to queue email, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "resendEmail",
+			Description:  "resent email to " + recipient,
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"email_id": emailId,
+		},
+	)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Email queued successfully"})
+}
@@ -0,0 +1,248 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"shared-package/utils"
+	"slices"
+	"time"
+	"web-service/config"
+	"web-service/model"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/spf13/viper"
+)
+
+// allowed reviews of a fraud case, a CONFIRMED customer can still be cleared later
+var fraudCaseTransitions = map[string][]string{
+	"OPEN":      {"CLEARED", "CONFIRMED"},
+	"CONFIRMED": {"CLEARED"},
+}
+
+// RunFraudScoring score the customers with recent entries and the recent winners, rules depending on other customers
+// (shared MoMo names, staff phones) can match after the entry was saved
+func RunFraudScoring() {
+	if err := backfillMomoNamesHash(); err != nil {
+		utils.LogMessage(string(utils.CRITICAL), "RunFraudScoring: Unable to hash momo names, error: "+err.Error(), config.ServiceName)
+	}
+	interval := viper.GetInt("fraud_rules.scan_interval")
+	if interval <= 0 {
+		interval = 5
+	}
+	rows, err := config.DB.Query(ctx, `select distinct c.id from customer c where c.status = 'OKAY' and (
+	exists (select 1 from entries e where e.customer_id = c.id and e.created_at >= now() - make_interval(mins => $1))
+	or exists (select 1 from prize p inner join entries e on e.id = p.entry_id where e.customer_id = c.id and p.created_at >= now() - interval '1 day'))`,
+		interval*2)
+	if err != nil {
+		utils.LogMessage(string(utils.CRITICAL), "RunFraudScoring: Unable to fetch customers, error: "+err.Error(), config.ServiceName)
+	} else {
+		customerIds := []int{}
+		for rows.Next() {
+			var customerId int
+			if err = rows.Scan(&customerId); err == nil {
+				customerIds = append(customerIds, customerId)
+			}
+		}
+		rows.Close()
+		for _, customerId := range customerIds {
+			if _, err = utils.EvaluateCustomerFraud(config.DB, customerId, nil); err != nil {
+				utils.LogMessage(string(utils.CRITICAL), fmt.Sprintf("RunFraudScoring: Unable to score customer #%d, error: %s", customerId, err.Error()), config.ServiceName)
+			}
+		}
+	}
+	time.Sleep(time.Duration(interval) * time.Minute)
+	RunFraudScoring()
+}
+
+// momoNamesHashed is set once the customers registered before the fraud rules are hashed
+var momoNamesHashed bool
+
+// backfillMomoNamesHash hash the momo names of customers registered before the fraud rules with utils.MomoNamesHash,
+// customers are paged by id so the blank names left without a hash are not read again
+func backfillMomoNamesHash() error {
+	if momoNamesHashed {
+		return nil
+	}
+	lastId := 0
+	for {
+		rows, err := config.DB.Query(ctx, `select id,pgp_sym_decrypt(momo_names::bytea,$1) from customer where momo_names is not null and momo_names_hash is null
+		and id > $2 order by id limit 1000`, config.EncryptionKey, lastId)
+		if err != nil {
+			return err
+		}
+		read := 0
+		ids := []int{}
+		hashes := [][]byte{}
+		for rows.Next() {
+			var id int
+			var names string
+			if err = rows.Scan(&id, &names); err != nil {
+				rows.Close()
+				return err
+			}
+			read++
+			lastId = id
+			hash := utils.MomoNamesHash(names)
+			if hash == nil {
+				//blank name, nothing to compare with
+				continue
+			}
+			ids = append(ids, id)
+			hashes = append(hashes, hash)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		if len(ids) > 0 {
+			_, err = config.DB.Exec(ctx, `update customer c set momo_names_hash = v.hash from unnest($1::int[],$2::bytea[]) v(id,hash)
+			where c.id = v.id`, ids, hashes)
+			if err != nil {
+				return err
+			}
+		}
+		if read < 1000 {
+			momoNamesHashed = true
+			return nil
+		}
+	}
+}
+
+// GetFraudCases list the customers held by the fraud rules with the signals which matched
+func GetFraudCases(c *fiber.Ctx) error {
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 20)
+	if page < 1 {
+		page = 1
+	}
+	offSet := (page - 1) * limit
+	args := []interface{}{}
+	filter, ii := utils.BuildQueryFilter(
+		map[string]interface{}{
+			"f.status":      c.Query("status"),
+			"f.customer_id": c.Query("customer_id"),
+		},
+		&args,
+	)
+	globalArgs := args
+	cases := []model.FraudCase{}
+	rows, err := config.DB.Query(ctx, fmt.Sprintf(`select f.id,f.customer_id,f.entry_id,f.score,f.signals,f.status,f.review_note,nullif(concat(u.fname,' ',u.lname),' '),
+	f.reviewed_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',f.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali'
+	from fraud_case f left join users u on u.id = f.reviewed_by %s order by f.score desc, f.id desc limit $%d offset $%d`, filter, ii, ii+1), append(args, limit, offSet)...)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get fraud cases failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetFraudCases: Unable to get fraud cases, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer rows.Close()
+	for rows.Next() {
+		fraudCase := model.FraudCase{}
+		err = rows.Scan(&fraudCase.Id, &fraudCase.CustomerId, &fraudCase.EntryId, &fraudCase.Score, &fraudCase.Signals, &fraudCase.Status, &fraudCase.ReviewNote,
+			&fraudCase.ReviewedBy, &fraudCase.ReviewedAt, &fraudCase.CreatedAt)
+		if err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get fraud cases failed", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "GetFraudCases: Unable to read fraud case, error: " + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+		cases = append(cases, fraudCase)
+	}
+	total := 0
+	err = config.DB.QueryRow(ctx, `select count(f.id) from fraud_case f `+filter, globalArgs...).Scan(&total)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get fraud cases failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetFraudCases: Unable to count fraud cases, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": cases,
+		"pagination": fiber.Map{"page": page, "limit": limit, "total": total}})
+}
+
+// ReviewFraudCase clear a case to release the customer (draws and held payouts) or confirm it to set the customer to FRAUD
+func ReviewFraudCase(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	caseId, err := c.ParamsInt("case_id")
+	if err != nil || caseId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid case id provided")
+	}
+	type FormData struct {
+		Status string `json:"status" binding:"required" validate:"required,oneof=CLEARED CONFIRMED"`
+		Note   string `json:"note" binding:"required" validate:"required,min=3,max=255"`
+	}
+	formData := FormData{}
+	if err := c.BodyParser(&formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to review fraud case, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ReviewFraudCase: Unable to start transaction, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer tx.Rollback(ctx)
+	var status string
+	var customerId, score int
+	err = tx.QueryRow(ctx, `select status,customer_id,score from fraud_case where id=$1 for update`, caseId).Scan(&status, &customerId, &score)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotFound, "Fraud case not found")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to review fraud case, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ReviewFraudCase: Unable to get fraud case, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	if !slices.Contains(fraudCaseTransitions[status], formData.Status) {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, fmt.Sprintf("A %s case can not be set to %s", status, formData.Status))
+	}
+	_, err = tx.Exec(ctx, `update fraud_case set status=$2, review_note=$3, reviewed_by=$4, reviewed_at=now(), updated_at=now() where id=$1`,
+		caseId, formData.Status, formData.Note, userPayload.Id)
+	if err == nil {
+		customerStatus := "FRAUD"
+		if formData.Status == "CLEARED" {
+			customerStatus = "OKAY"
+		}
+		//a msisdn blocked by the code guard stays FRAUD until its flag is cleared
+		_, err = tx.Exec(ctx, `update customer c set status=$2 where c.id=$1 and not exists
+		(select 1 from code_fraud_flag f where f.phone_hash = c.phone_hash and f.status in ('OPEN','CONFIRMED'))`, customerId, customerStatus)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to review fraud case, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ReviewFraudCase: Unable to update fraud case, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "fraud_case",
+			Description:  fmt.Sprintf("set fraud case of customer #%d from %s to %s", customerId, status, formData.Status),
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"case_id": caseId,
+			"score":   score,
+			"note":    formData.Note,
+		},
+	)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Fraud case set to " + formData.Status})
+}
@@ -0,0 +1,573 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"shared-package/utils"
+	"slices"
+	"strings"
+	"time"
+	"web-service/config"
+	"web-service/model"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/spf13/viper"
+)
+
+var fulfilmentProofPath = "/app/uploads/fulfilment"
+var errFulfilmentStage = errors.New("fulfilment is not at the expected stage")
+var errFulfilmentIdMismatch = errors.New("national ID does not match the winner registered ID")
+
+// fulfilmentStages maps each stage to the stage it must come from
+var fulfilmentStages = map[string][]string{
+	"CLAIMED":          {"WAITING_CLAIM"},
+	"ID_VERIFIED":      {"CLAIMED"},
+	"PICKUP_SCHEDULED": {"ID_VERIFIED", "PICKUP_SCHEDULED"},
+	"DELIVERED":        {"PICKUP_SCHEDULED"},
+}
+
+type fulfilmentWinner struct {
+	CustomerId int
+	Names      string
+	Phone      string
+	IdNumber   *string
+	PrizeType  string
+	Locale     string
+	Status     string
+}
+
+// moveFulfilment move a fulfilment to the next stage, updates contains the extra columns to set.
+// prepare runs in the transaction once the stage is checked, it can reject the move or change the history note.
+// the sms template named by notify is rendered in the winner locale and queued with the stage change
+func moveFulfilment(fulfilmentId int, status string, note string, operatorId int, updates map[string]interface{},
+	prepare func(tx pgx.Tx, winner *fulfilmentWinner, note *string) error, notify func(winner *fulfilmentWinner) (string, map[string]any)) (*fulfilmentWinner, error) {
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			tx.Commit(ctx)
+		}
+	}()
+	winner := fulfilmentWinner{}
+	err = tx.QueryRow(ctx, `select f.status,f.customer_id,pgp_sym_decrypt(c.names::bytea,$2),pgp_sym_decrypt(c.phone::bytea,$2),c.id_number,pt.name,coalesce(c.locale,'')
+	from fulfilment f inner join customer c on c.id = f.customer_id inner join prize p on p.id = f.prize_id inner join prize_type pt on pt.id = p.prize_type_id
+	where f.id=$1 for update of f`, fulfilmentId, config.EncryptionKey).
+		Scan(&winner.Status, &winner.CustomerId, &winner.Names, &winner.Phone, &winner.IdNumber, &winner.PrizeType, &winner.Locale)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(fulfilmentStages[status], winner.Status) {
+		err = errFulfilmentStage
+		return &winner, err
+	}
+	if prepare != nil {
+		if err = prepare(tx, &winner, &note); err != nil {
+			return &winner, err
+		}
+	}
+	query := "update fulfilment set status=$1"
+	args := []interface{}{status}
+	for column, value := range updates {
+		args = append(args, value)
+		query += fmt.Sprintf(",%s=$%d", column, len(args))
+	}
+	args = append(args, fulfilmentId)
+	query += fmt.Sprintf(" where id=$%d", len(args))
+	_, err = tx.Exec(ctx, query, args...)
+	if err != nil {
+		return &winner, err
+	}
+	var historyNote *string
+	if note != "" {
+		historyNote = &note
+	}
+	_, err = tx.Exec(ctx, `insert into fulfilment_history (fulfilment_id,status,note,operator_id) values ($1,$2,$3,$4)`, fulfilmentId, status, historyNote, operatorId)
+	if err != nil {
+		return &winner, err
+	}
+	if notify != nil {
+		templateName, data := notify(&winner)
+		data["Name"], data["PrizeType"] = winner.Names, winner.PrizeType
+		_, err = utils.QueueTemplateSMS(tx, templateName, winner.Locale, data, winner.Phone, viper.GetString("SENDER_ID"), "fulfilment", &winner.CustomerId)
+		if err != nil {
+			return &winner, err
+		}
+	}
+	return &winner, nil
+}
+
+// fulfilmentStageError convert moveFulfilment error to a response
+func fulfilmentStageError(c *fiber.Ctx, funcName string, winner *fulfilmentWinner, err error) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return utils.JsonErrorResponse(c, fiber.StatusNotFound, "Fulfilment not found")
+	}
+	if errors.Is(err, errFulfilmentStage) {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, fmt.Sprintf("Fulfilment is at %s stage, refresh your page", winner.Status))
+	}
+	return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to update fulfilment", utils.Logger{
+		LogLevel:    utils.CRITICAL,
+		Message:     funcName + ": Unable to update fulfilment, error: " + err.Error(),
+		ServiceName: config.ServiceName,
+	})
+}
+
+func recordFulfilmentActivity(c *fiber.Ctx, userId int, fulfilmentId int, status string, winner *fulfilmentWinner) {
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userId,
+			ActivityType: "fulfilment",
+			Description:  fmt.Sprintf("fulfilment of %s moved to %s, winner: %s", winner.PrizeType, status, winner.Names),
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"fulfilment_id":   fulfilmentId,
+			"customer_id":     winner.CustomerId,
+			"previous_status": winner.Status,
+			"status":          status,
+		},
+	)
+}
+
+func GetFulfilments(c *fiber.Ctx) error {
+	status := c.Query("status")
+	district := c.Query("district")
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 20)
+	if page < 1 {
+		page = 1
+	}
+	offSet := (page - 1) * limit
+	args := []interface{}{}
+	filter, ii := utils.BuildQueryFilter(
+		map[string]interface{}{
+			"f.status":         status,
+			"c.district::text": district,
+		},
+		&args,
+	)
+	globalArgs := args
+	fulfilments := []model.Fulfilment{}
+	rows, err := config.DB.Query(ctx,
+		fmt.Sprintf(`select f.id,f.prize_id,pt.name,p.code,c.id,pgp_sym_decrypt(c.names::bytea,$%[2]d),pgp_sym_decrypt(c.phone::bytea,$%[2]d),coalesce(d.id,0),coalesce(d.name,''),
+		f.status,f.pickup_date AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',f.proof_path is not null,f.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',f.updated_at
+		from fulfilment f inner join prize p on p.id = f.prize_id inner join prize_type pt on pt.id = p.prize_type_id
+		inner join customer c on c.id = f.customer_id left join district d on d.id = c.district %[1]s order by f.created_at desc limit $%[3]d offset $%[4]d`, filter, ii, ii+1, ii+2),
+		append(args, config.EncryptionKey, limit, offSet)...)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get fulfilments failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetFulfilments: Unable to get fulfilments, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer rows.Close()
+	for rows.Next() {
+		fulfilment := model.Fulfilment{}
+		err = rows.Scan(&fulfilment.Id, &fulfilment.PrizeId, &fulfilment.PrizeType, &fulfilment.Code, &fulfilment.Customer.Id, &fulfilment.Customer.Names,
+			&fulfilment.Customer.Phone, &fulfilment.Customer.District.Id, &fulfilment.Customer.District.Name, &fulfilment.Status, &fulfilment.PickupDate,
+			&fulfilment.HasProof, &fulfilment.CreatedAt, &fulfilment.UpdatedAt)
+		if err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get fulfilments failed", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "GetFulfilments: Unable to read fulfilment data, error: " + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+		fulfilments = append(fulfilments, fulfilment)
+	}
+	total := 0
+	err = config.DB.QueryRow(ctx, `select count(f.id) from fulfilment f inner join customer c on c.id = f.customer_id `+filter, globalArgs...).Scan(&total)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get fulfilments failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetFulfilments: Unable to count fulfilments, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": fulfilments,
+		"pagination": fiber.Map{"page": page, "limit": limit, "total": total}})
+}
+
+func GetFulfilment(c *fiber.Ctx) error {
+	fulfilmentId, err := c.ParamsInt("fulfilment_id")
+	if err != nil || fulfilmentId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid fulfilment id provided")
+	}
+	fulfilment := model.Fulfilment{History: []model.FulfilmentHistory{}}
+	var locationId *int
+	var locationName, districtName *string
+	err = config.DB.QueryRow(ctx, `select f.id,f.prize_id,pt.name,p.code,c.id,pgp_sym_decrypt(c.names::bytea,$2),pgp_sym_decrypt(c.phone::bytea,$2),c.id_number,
+	f.status,f.pickup_date AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',f.proof_path is not null,f.claimed_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',
+	f.verified_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',f.delivered_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',
+	f.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',f.updated_at,pl.id,pl.name,d.name
+	from fulfilment f inner join prize p on p.id = f.prize_id inner join prize_type pt on pt.id = p.prize_type_id inner join customer c on c.id = f.customer_id
+	left join pickup_location pl on pl.id = f.pickup_location_id left join district d on d.id = pl.district_id where f.id=$1`, fulfilmentId, config.EncryptionKey).
+		Scan(&fulfilment.Id, &fulfilment.PrizeId, &fulfilment.PrizeType, &fulfilment.Code, &fulfilment.Customer.Id, &fulfilment.Customer.Names, &fulfilment.Customer.Phone,
+			&fulfilment.Customer.IdNumber, &fulfilment.Status, &fulfilment.PickupDate, &fulfilment.HasProof, &fulfilment.ClaimedAt, &fulfilment.VerifiedAt,
+			&fulfilment.DeliveredAt, &fulfilment.CreatedAt, &fulfilment.UpdatedAt, &locationId, &locationName, &districtName)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotFound, "Fulfilment not found")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get fulfilment failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetFulfilment: Unable to get fulfilment, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	if locationId != nil {
+		fulfilment.PickupLocation = &model.PickupLocation{Id: *locationId, Name: *locationName}
+		if districtName != nil {
+			fulfilment.PickupLocation.District.Name = *districtName
+		}
+	}
+	rows, err := config.DB.Query(ctx, `select h.id,h.status,h.note,concat(u.fname,' ',u.lname),h.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali'
+	from fulfilment_history h left join users u on u.id = h.operator_id where h.fulfilment_id=$1 order by h.id asc`, fulfilmentId)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get fulfilment failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetFulfilment: Unable to get fulfilment history, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer rows.Close()
+	for rows.Next() {
+		history := model.FulfilmentHistory{}
+		err = rows.Scan(&history.Id, &history.Status, &history.Note, &history.Operator, &history.CreatedAt)
+		if err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get fulfilment failed", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "GetFulfilment: Unable to read fulfilment history, error: " + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+		fulfilment.History = append(fulfilment.History, history)
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": fulfilment})
+}
+
+// ClaimFulfilment record that the winner claimed the prize
+func ClaimFulfilment(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	fulfilmentId, err := c.ParamsInt("fulfilment_id")
+	if err != nil || fulfilmentId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid fulfilment id provided")
+	}
+	type FormData struct {
+		Note string `json:"note" validate:"max=500"`
+	}
+	formData := new(FormData)
+	c.BodyParser(formData)
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Provided data are not valid")
+	}
+	winner, err := moveFulfilment(fulfilmentId, "CLAIMED", formData.Note, userPayload.Id, map[string]interface{}{"claimed_at": time.Now().UTC()}, nil,
+		func(winner *fulfilmentWinner) (string, map[string]any) {
+			return "fulfilment_claimed", map[string]any{}
+		})
+	if err != nil {
+		return fulfilmentStageError(c, "ClaimFulfilment", winner, err)
+	}
+	recordFulfilmentActivity(c, userPayload.Id, fulfilmentId, "CLAIMED", winner)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Prize claim recorded successfully"})
+}
+
+// VerifyFulfilmentId check the winner national ID against the registered one
+func VerifyFulfilmentId(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	fulfilmentId, err := c.ParamsInt("fulfilment_id")
+	if err != nil || fulfilmentId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid fulfilment id provided")
+	}
+	type FormData struct {
+		IdNumber string `json:"id_number" binding:"required" validate:"required,numeric,len=16"`
+		Note     string `json:"note" validate:"max=500"`
+	}
+	formData := new(FormData)
+	if err := c.BodyParser(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Please provide all required data")
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Provided national ID is not valid")
+	}
+	winner, err := moveFulfilment(fulfilmentId, "ID_VERIFIED", formData.Note, userPayload.Id, map[string]interface{}{"verified_at": time.Now().UTC()},
+		func(tx pgx.Tx, winner *fulfilmentWinner, note *string) error {
+			if winner.IdNumber != nil && *winner.IdNumber != "" {
+				if *winner.IdNumber != formData.IdNumber {
+					return errFulfilmentIdMismatch
+				}
+				return nil
+			}
+			//first time the winner provides an ID, keep it for later checks
+			_, err := tx.Exec(ctx, `update customer set id_number=$1 where id=$2`, formData.IdNumber, winner.CustomerId)
+			*note = strings.TrimSpace("national ID registered at verification. " + *note)
+			return err
+		},
+		func(winner *fulfilmentWinner) (string, map[string]any) {
+			return "fulfilment_id_verified", map[string]any{}
+		})
+	if errors.Is(err, errFulfilmentIdMismatch) {
+		utils.RecordActivityLog(config.DB,
+			utils.ActivityLog{
+				UserID:       userPayload.Id,
+				ActivityType: "fulfilment",
+				Description:  "national ID mismatch on fulfilment verification",
+				Status:       "failure",
+				IPAddress:    c.IP(),
+				UserAgent:    c.Get("User-Agent"),
+			},
+			config.ServiceName,
+			&map[string]interface{}{
+				"fulfilment_id": fulfilmentId,
+				"customer_id":   winner.CustomerId,
+			},
+		)
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "National ID does not match the winner registered ID")
+	}
+	if err != nil {
+		return fulfilmentStageError(c, "VerifyFulfilmentId", winner, err)
+	}
+	recordFulfilmentActivity(c, userPayload.Id, fulfilmentId, "ID_VERIFIED", winner)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Winner ID verified successfully"})
+}
+
+// ScheduleFulfilmentPickup set (or change) the pickup location and date
+func ScheduleFulfilmentPickup(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	fulfilmentId, err := c.ParamsInt("fulfilment_id")
+	if err != nil || fulfilmentId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid fulfilment id provided")
+	}
+	type FormData struct {
+		PickupLocationId int    `json:"pickup_location_id" binding:"required" validate:"required,number,min=1"`
+		PickupDate       string `json:"pickup_date" binding:"required" validate:"required"`
+		Note             string `json:"note" validate:"max=500"`
+	}
+	formData := new(FormData)
+	if err := c.BodyParser(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Please provide all required data")
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Provided data are not valid")
+	}
+	location, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	pickupDate, err := time.ParseInLocation("2006-01-02 15:04", formData.PickupDate, location)
+	if err != nil || pickupDate.Before(time.Now()) {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Invalid pickup date, format: 2006-01-02 15:04 and should be in the future")
+	}
+	var locationName, locationStatus string
+	var address *string
+	err = config.DB.QueryRow(ctx, `select name,address,status from pickup_location where id=$1`, formData.PickupLocationId).Scan(&locationName, &address, &locationStatus)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Pickup location is invalid")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to schedule pickup", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ScheduleFulfilmentPickup: Unable to get pickup location, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	if locationStatus != "OKAY" {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Pickup location is not active")
+	}
+	place := locationName
+	if address != nil && *address != "" {
+		place = fmt.Sprintf("%s (%s)", locationName, *address)
+	}
+	winner, err := moveFulfilment(fulfilmentId, "PICKUP_SCHEDULED", formData.Note, userPayload.Id, map[string]interface{}{
+		"pickup_location_id": formData.PickupLocationId,
+		"pickup_date":        pickupDate.UTC(),
+	}, nil, func(winner *fulfilmentWinner) (string, map[string]any) {
+		return "fulfilment_pickup", map[string]any{"Place": place, "PickupDate": pickupDate.Format("02/01/2006 15:04")}
+	})
+	if err != nil {
+		return fulfilmentStageError(c, "ScheduleFulfilmentPickup", winner, err)
+	}
+	recordFulfilmentActivity(c, userPayload.Id, fulfilmentId, "PICKUP_SCHEDULED", winner)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Pickup scheduled successfully"})
+}
+
+// DeliverFulfilment close the fulfilment with a proof of delivery
+func DeliverFulfilment(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	fulfilmentId, err := c.ParamsInt("fulfilment_id")
+	if err != nil || fulfilmentId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid fulfilment id provided")
+	}
+	file, err := c.FormFile("proof")
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Please provide the proof of delivery")
+	}
+	ext := strings.ToLower(filepath.Ext(file.Filename))
+	if !slices.Contains([]string{".pdf", ".jpg", ".jpeg", ".png"}, ext) {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Proof of delivery should be a pdf or an image")
+	}
+	if file.Size > 1024*1024*10 {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Proof of delivery size should not exceed 10MB")
+	}
+	proofPath := fmt.Sprintf("%s/%d_%d%s", fulfilmentProofPath, fulfilmentId, time.Now().UnixMilli(), ext)
+	err = os.MkdirAll(fulfilmentProofPath, 0755)
+	if err == nil {
+		err = c.SaveFile(file, proofPath)
+	}
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to save proof of delivery", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "DeliverFulfilment: Unable to save proof file, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	winner, err := moveFulfilment(fulfilmentId, "DELIVERED", c.FormValue("note"), userPayload.Id, map[string]interface{}{
+		"proof_path":   proofPath,
+		"delivered_at": time.Now().UTC(),
+	}, nil, func(winner *fulfilmentWinner) (string, map[string]any) {
+		return "fulfilment_delivered", map[string]any{}
+	})
+	if err != nil {
+		os.Remove(proofPath)
+		return fulfilmentStageError(c, "DeliverFulfilment", winner, err)
+	}
+	//mark the prize as rewarded
+	_, err = config.DB.Exec(ctx, `update prize set rewarded=true where id=(select prize_id from fulfilment where id=$1)`, fulfilmentId)
+	if err != nil {
+		utils.LogMessage(string(utils.CRITICAL), "DeliverFulfilment: Unable to mark prize as rewarded, error: "+err.Error(), config.ServiceName)
+	}
+	recordFulfilmentActivity(c, userPayload.Id, fulfilmentId, "DELIVERED", winner)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Prize delivered successfully"})
+}
+
+func GetFulfilmentProof(c *fiber.Ctx) error {
+	fulfilmentId, err := c.ParamsInt("fulfilment_id")
+	if err != nil || fulfilmentId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid fulfilment id provided")
+	}
+	var proofPath *string
+	err = config.DB.QueryRow(ctx, `select proof_path from fulfilment where id=$1`, fulfilmentId).Scan(&proofPath)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotFound, "Fulfilment not found")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to get proof of delivery", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetFulfilmentProof: Unable to get fulfilment, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	if proofPath == nil {
+		return utils.JsonErrorResponse(c, fiber.StatusNotFound, "Fulfilment has no proof of delivery")
+	}
+	return c.Download(*proofPath)
+}
+
+func GetPickupLocations(c *fiber.Ctx) error {
+	args := []interface{}{}
+	filter, _ := utils.BuildQueryFilter(
+		map[string]interface{}{
+			"pl.district_id::text": c.Query("district_id"),
+			"pl.status":            c.Query("status"),
+		},
+		&args,
+	)
+	locations := []model.PickupLocation{}
+	rows, err := config.DB.Query(ctx, `select pl.id,pl.name,pl.address,pl.contact_phone,pl.status,d.id,d.name,pl.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali'
+	from pickup_location pl inner join district d on d.id = pl.district_id `+filter+` order by d.name,pl.name`, args...)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get pickup locations failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetPickupLocations: Unable to get pickup locations, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer rows.Close()
+	for rows.Next() {
+		location := model.PickupLocation{}
+		err = rows.Scan(&location.Id, &location.Name, &location.Address, &location.ContactPhone, &location.Status, &location.District.Id, &location.District.Name, &location.CreatedAt)
+		if err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get pickup locations failed", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "GetPickupLocations: Unable to read pickup location, error: " + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+		locations = append(locations, location)
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": locations})
+}
+
+// SavePickupLocation create a pickup location, or update it when id is provided
+func SavePickupLocation(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	var err error
+	type FormData struct {
+		Id           int    `json:"id"`
+		DistrictId   int    `json:"district_id" binding:"required" validate:"required,number,min=1"`
+		Name         string `json:"name" binding:"required" validate:"required,min=3,max=255"`
+		Address      string `json:"address" validate:"max=500"`
+		ContactPhone string `json:"contact_phone" validate:"omitempty,regex=^2507[2389]\\d{7}$"`
+		Status       string `json:"status" validate:"omitempty,oneof=OKAY DISABLED"`
+	}
+	formData := new(FormData)
+	if err := c.BodyParser(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Please provide all required data")
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Provided data are not valid")
+	}
+	if formData.Status == "" {
+		formData.Status = "OKAY"
+	}
+	locationId := formData.Id
+	if formData.Id == 0 {
+		err = config.DB.QueryRow(ctx, `insert into pickup_location (district_id,name,address,contact_phone,status,operator_id) values ($1,$2,$3,$4,$5,$6) returning id`,
+			formData.DistrictId, formData.Name, formData.Address, formData.ContactPhone, formData.Status, userPayload.Id).Scan(&locationId)
+	} else {
+		err = config.DB.QueryRow(ctx, `update pickup_location set district_id=$1,name=$2,address=$3,contact_phone=$4,status=$5,operator_id=$6 where id=$7 returning id`,
+			formData.DistrictId, formData.Name, formData.Address, formData.ContactPhone, formData.Status, userPayload.Id, formData.Id).Scan(&locationId)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotFound, "Pickup location not found")
+		}
+	}
+	if err != nil {
+		if ok, _ := utils.IsErrDuplicate(err); ok {
+			return utils.JsonErrorResponse(c, fiber.StatusConflict, "Pickup location with the same name already exists in the district")
+		}
+		if ok, _ := utils.IsForeignKeyErr(err); ok {
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Provided district is invalid")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to save pickup location", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "SavePickupLocation: Unable to save pickup location, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "savePickupLocation",
+			Description:  "saved pickup location " + formData.Name,
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"pickup_location_id": locationId,
+			"district_id":        formData.DistrictId,
+		},
+	)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Pickup location saved successfully", "id": locationId})
+}
@@ -1,16 +1,16 @@
 package controller
 
 import (
-	"bufio"
 	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"logger-service/helper"
+	"math"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -26,7 +26,6 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/jackc/pgx/v5"
 	"github.com/spf13/viper"
-	"github.com/xuri/excelize/v2"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -106,21 +105,26 @@ func LoginWithEmail(c *fiber.Ctx) error {
 		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, *errorMessage)
 	}
 	userData.Email = strings.ToLower(userData.Email)
+	if err := utils.LoginGuardCheck(config.Redis, utils.LoginGuardLogin, userData.Email, c.IP()); err != nil {
+		return loginGuardResponse(c, err, "LoginWithEmail")
+	}
 	//check user data
 	UserProfile := model.UserProfile{}
 	err := config.DB.QueryRow(ctx,
 		`select u.id,u.fname,u.lname,u.department_id,d.title as department_title, u.email_verified,u.phone_verified,u.avatar_url,u.status,
-	u.can_add_codes,u.can_trigger_draw,u.can_add_user,u.can_view_logs,phone,force_change_password from users u inner join departments d on u.department_id = d.id where email = $1 and password = crypt($2, password)`, userData.Email, userData.Password).
+	phone,force_change_password from users u inner join departments d on u.department_id = d.id where email = $1 and password = crypt($2, password)`, userData.Email, userData.Password).
 		Scan(&UserProfile.Id, &UserProfile.Fname, &UserProfile.Lname, &UserProfile.Department.Id, &UserProfile.Department.Title, &UserProfile.EmailVerified, &UserProfile.PhoneVerified, &UserProfile.AvatarUrl, &UserProfile.Status,
-			&UserProfile.CanAddCodes, &UserProfile.CanTriggerDraw, &UserProfile.CanAddUser, &UserProfile.CanViewLogs, &UserProfile.Phone, &UserProfile.ForceChangePassword)
+			&UserProfile.Phone, &UserProfile.ForceChangePassword)
 	if err != nil {
 		if !errors.Is(err, pgx.ErrNoRows) {
 			utils.LogMessage("critical", fmt.Sprintf("LoginWithEmail: Unable to get user data, Email:%s, err:%v", userData.Email, err), "web-service")
+		} else if err = loginGuardFailure(c, utils.LoginGuardLogin, userData.Email); err != nil {
+			return loginGuardResponse(c, err, "LoginWithEmail")
 		}
 		responseStatus = 403
 		c.SendStatus(responseStatus)
 		return c.JSON(fiber.Map{"status": responseStatus, "message": "Invalid credentials"})
-	} else if UserProfile.Status == "inactive" {
+	} else if UserProfile.Status != "OKAY" {
 		utils.RecordActivityLog(config.DB,
 			utils.ActivityLog{
 				UserID:       UserProfile.Id,
@@ -140,12 +144,63 @@ func LoginWithEmail(c *fiber.Ctx) error {
 		return c.JSON(fiber.Map{"status": responseStatus, "message": "Your account has been deactivated"})
 	}
 	UserProfile.Email = userData.Email
-	//Generate and save access token
-	token, err := generateAccesstoken(UserProfile)
+	if err = loadUserAccess(&UserProfile); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Login failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "LoginWithEmail: Unable to get user roles, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	secret, enabled, required, err := userTwoFactor(UserProfile.Id)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Login failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "LoginWithEmail: Unable to get two factor data, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	if enabled || required {
+		//the session is opened once the second factor is verified
+		challenge, err := startTwoFactorChallenge(UserProfile, !enabled)
+		if err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Login failed", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "LoginWithEmail: Unable to save two factor challenge, error: " + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+		methods := []string{TwoFactorTOTP}
+		if enabled && secret != "" {
+			methods = append(methods, TwoFactorRecovery, TwoFactorSMS)
+		}
+		return c.JSON(fiber.Map{"status": responseStatus, "message": "Two-factor authentication required", "two_factor_required": true,
+			"enrollment_required": !enabled, "challenge": challenge, "methods": methods})
+	}
+	return completeLogin(c, UserProfile, nil)
+}
+
+// loadLoginProfile return the profile saved in the session of the user
+func loadLoginProfile(userId int) (model.UserProfile, error) {
+	UserProfile := model.UserProfile{}
+	err := config.DB.QueryRow(ctx,
+		`select u.id,u.fname,u.lname,u.email,u.department_id,d.title as department_title, u.email_verified,u.phone_verified,u.avatar_url,u.status,
+	phone,force_change_password from users u inner join departments d on u.department_id = d.id where u.id = $1`, userId).
+		Scan(&UserProfile.Id, &UserProfile.Fname, &UserProfile.Lname, &UserProfile.Email, &UserProfile.Department.Id, &UserProfile.Department.Title, &UserProfile.EmailVerified, &UserProfile.PhoneVerified, &UserProfile.AvatarUrl, &UserProfile.Status,
+			&UserProfile.Phone, &UserProfile.ForceChangePassword)
+	if err == nil {
+		err = loadUserAccess(&UserProfile)
+	}
+	return UserProfile, err
+}
+
+// completeLogin open the session of the authenticated user, extra is added to the response
+func completeLogin(c *fiber.Ctx, UserProfile model.UserProfile, extra fiber.Map) error {
+	//start a session, the access token is renewed with the refresh token
+	tokens, err := utils.CreateSession(config.Redis, UserProfile, c.IP(), c.Get("User-Agent"))
 	if err != nil {
 		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Login failed", utils.Logger{
 			LogLevel:    utils.CRITICAL,
-			Message:     err.Error(),
+			Message:     "LoginWithEmail: " + err.Error(),
 			ServiceName: config.ServiceName,
 		})
 	}
@@ -160,35 +215,29 @@ func LoginWithEmail(c *fiber.Ctx) error {
 		},
 		config.ServiceName,
 		&map[string]interface{}{
-			"email": userData.Email,
+			"email":      UserProfile.Email,
+			"session_id": tokens.SessionId,
 		},
 	)
-	c.SendStatus(responseStatus)
-	return c.JSON(fiber.Map{"status": responseStatus, "message": "Login completed", "data": UserProfile, "accessToken": token})
-}
-
-func generateAccesstoken(userData model.UserProfile) (string, error) {
-	payloadData, err := json.Marshal(userData)
-	if err != nil {
-		return "", fmt.Errorf("unable to marshal payload data for user %d , error: %s", userData.Id, err.Error())
+	if err = utils.LoginGuardSuccess(config.Redis, utils.LoginGuardLogin, UserProfile.Email); err != nil {
+		utils.LogMessage("critical", "LoginWithEmail: Unable to reset failed logins, error: "+err.Error(), config.ServiceName)
 	}
-	token := base64.RawStdEncoding.EncodeToString([]byte(fmt.Sprintf("token_%v_%v", userData.Id, time.Now().UnixMilli())))
-	if err := config.Redis.Set(ctx, token, payloadData, time.Duration(helper.SessionExpirationTime*time.Minute)).Err(); err != nil {
-		return "", fmt.Errorf("unable to save user access token for user %d , error: %s", userData.Id, err.Error())
+	response := fiber.Map{"status": fiber.StatusOK, "message": "Login completed", "data": UserProfile, "accessToken": tokens.AccessToken,
+		"refreshToken": tokens.RefreshToken, "expiresIn": tokens.ExpiresIn}
+	for key, value := range extra {
+		response[key] = value
 	}
-	return token, nil
+	return c.JSON(response)
 }
+
 func GetUserProfile(c *fiber.Ctx) error {
-	userPayload, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
+	userPayload := CurrentUser(c)
 	UserProfile := model.UserProfile{}
-	err = config.DB.QueryRow(ctx,
+	err := config.DB.QueryRow(ctx,
 		`select u.id,u.fname,u.lname,u.department_id,d.title as department_title, u.email_verified,u.phone_verified,u.avatar_url,u.status,
-	u.can_add_codes,u.can_trigger_draw,u.can_add_user,u.can_view_logs,u.phone,u.force_change_password from users u inner join departments d on u.department_id = d.id where u.id = $1`, userPayload.Id).
+	u.phone,u.force_change_password from users u inner join departments d on u.department_id = d.id where u.id = $1`, userPayload.Id).
 		Scan(&UserProfile.Id, &UserProfile.Fname, &UserProfile.Lname, &UserProfile.Department.Id, &UserProfile.Department.Title, &UserProfile.EmailVerified, &UserProfile.PhoneVerified, &UserProfile.AvatarUrl, &UserProfile.Status,
-			&UserProfile.CanAddCodes, &UserProfile.CanTriggerDraw, &UserProfile.CanAddUser, &UserProfile.CanViewLogs, &UserProfile.Phone, &UserProfile.ForceChangePassword)
+			&UserProfile.Phone, &UserProfile.ForceChangePassword)
 	if err != nil {
 		if !errors.Is(err, pgx.ErrNoRows) {
 			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get user profile failed", utils.Logger{
@@ -201,14 +250,17 @@ func GetUserProfile(c *fiber.Ctx) error {
 	} else if UserProfile.Status != "OKAY" {
 		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, "Your account is not active")
 	}
+	if err = loadUserAccess(&UserProfile); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get user profile failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetUserProfile: Unable to get user roles, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
 	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": UserProfile})
 }
 
 func GetPrizeCategory(c *fiber.Ctx) error {
-	_, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
 	categories := []model.PrizeCategory{}
 	rows, err := config.DB.Query(ctx,
 		`select id,name,status,created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali' from prize_category`)
@@ -237,21 +289,20 @@ func GetPrizeCategory(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": categories})
 }
 func GetPrizeType(c *fiber.Ctx) error {
-	_, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
+	var err error
 	prizeCategory := c.Params("prize_category")
 	prizes := []model.PrizeType{}
 	var rows pgx.Rows
 	if prizeCategory == "" {
 		rows, err = config.DB.Query(ctx,
 			`select p.id,p.name,p.status,p.value,p.elligibility,pc.name as category_name,pc.id as category_id,pc.status as category_status,pc.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',p.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',
-			p.period,p.distribution_type,p.expiry_date,STRING_AGG(pm.lang, ', ') as langs,STRING_AGG(pm.message, ', ') as messages,trigger_by_system from prize_type p join prize_category pc on p.prize_category_id = pc.id join prize_message pm on pm.prize_type_id=p.id group by p.id,pc.id`)
+			p.period,p.distribution_type,p.expiry_date,array_agg(st.lang order by st.lang) as langs,array_agg(st.body order by st.lang) as messages,array_agg(st.version order by st.lang) as versions,trigger_by_system
+			from prize_type p join prize_category pc on p.prize_category_id = pc.id join sms_template st on st.name='prize_type.'||p.id and st.status='ACTIVE' group by p.id,pc.id`)
 	} else {
 		rows, err = config.DB.Query(ctx,
 			`select p.id,p.name,p.status,p.value,p.elligibility,pc.name as category_name,pc.id as category_id,pc.status as category_status,pc.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',p.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',
-			p.period,p.distribution_type,p.expiry_date,STRING_AGG(pm.lang, ', ') as langs,STRING_AGG(pm.message, ', ') as messages,trigger_by_system from prize_type p join prize_category pc on p.prize_category_id = pc.id join prize_message pm on pm.prize_type_id=p.id where p.prize_category_id=$1 group by p.id,pc.id`, prizeCategory)
+			p.period,p.distribution_type,p.expiry_date,array_agg(st.lang order by st.lang) as langs,array_agg(st.body order by st.lang) as messages,array_agg(st.version order by st.lang) as versions,trigger_by_system
+			from prize_type p join prize_category pc on p.prize_category_id = pc.id join sms_template st on st.name='prize_type.'||p.id and st.status='ACTIVE' where p.prize_category_id=$1 group by p.id,pc.id`, prizeCategory)
 	}
 	if err != nil {
 		if !errors.Is(err, pgx.ErrNoRows) {
@@ -264,15 +315,16 @@ func GetPrizeType(c *fiber.Ctx) error {
 		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "prize type data is not valid")
 	}
 	for rows.Next() {
-		var langs, messages string
+		var langs, messages []string
+		var versions []int
 		prize := model.PrizeType{}
 		err = rows.Scan(&prize.Id, &prize.Name, &prize.Status, &prize.Value, &prize.Elligibility, &prize.PrizeCategory.Name,
 			&prize.PrizeCategory.Id, &prize.PrizeCategory.Status, &prize.PrizeCategory.CreatedAt, &prize.CreatedAt, &prize.Period,
-			&prize.Distribution, &prize.ExpiryDate, &langs, &messages, &prize.TriggerBySystem)
-		//extract messages and langs and populate to []prize.Message
+			&prize.Distribution, &prize.ExpiryDate, &langs, &messages, &versions, &prize.TriggerBySystem)
+		//populate the active message template of each locale
 		prize.PrizeMessage = []model.PrizeMessage{}
-		for i, lang := range strings.Split(langs, ", ") {
-			prize.PrizeMessage = append(prize.PrizeMessage, model.PrizeMessage{Lang: lang, Message: strings.Split(messages, ", ")[i]})
+		for i, lang := range langs {
+			prize.PrizeMessage = append(prize.PrizeMessage, model.PrizeMessage{Lang: lang, Message: messages[i], Version: versions[i]})
 		}
 		if err != nil {
 			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get prize type data failed", utils.Logger{
@@ -286,10 +338,6 @@ func GetPrizeType(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": prizes})
 }
 func GetPrizeTypeSpace(c *fiber.Ctx) error {
-	_, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
 	prizeTypeId, err := c.ParamsInt("type_id")
 	if err != nil {
 		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Provide type id is not valid")
@@ -322,7 +370,7 @@ func GetPrizeTypeSpace(c *fiber.Ctx) error {
 	}
 	occupiedSpace := 0
 	err = config.DB.QueryRow(ctx,
-		`select count(*) from prize where prize_type_id=$1`+prizeFilter, prizeTypeId).
+		`select count(*) from prize where prize_type_id=$1 and status <> 'EXPIRED'`+prizeFilter, prizeTypeId).
 		Scan(&occupiedSpace)
 	if err != nil {
 		if !errors.Is(err, pgx.ErrNoRows) {
@@ -337,10 +385,6 @@ func GetPrizeTypeSpace(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "name": prizeType.Name, "elligibility": prizeType.Elligibility, "occupied": occupiedSpace, "remaining": remaining})
 }
 func GetEntries(c *fiber.Ctx) error {
-	_, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
 	startDateStr := c.Query("start_date")
 	endDateStr := c.Query("end_date")
 	provinceId := c.Query("province_id")
@@ -353,7 +397,7 @@ func GetEntries(c *fiber.Ctx) error {
 	}
 	offSet := (page - 1) * limit
 
-	err = utils.ValidateDateRanges(startDateStr, &endDateStr)
+	err := utils.ValidateDateRanges(startDateStr, &endDateStr)
 	if err != nil {
 		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, err.Error())
 	}
@@ -376,17 +420,31 @@ func GetEntries(c *fiber.Ctx) error {
 		},
 		&args1,
 	)
+	batchFilter, err := codeBatchFilter(c, &args1)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, err.Error())
+	}
+	if batchFilter != "" {
+		if logsFilter == "" {
+			logsFilter = " where " + batchFilter
+		} else {
+			logsFilter += " and " + batchFilter
+		}
+		ii = len(args1) + 1
+	}
 	limitStr := fmt.Sprintf(" limit $%d offset $%d", ii, ii+1)
 	globalArgs := args1
 	args1 = append(args1, limit, offSet)
 	entries := []model.Entries{}
 	rows, err := config.DB.Query(ctx,
 		`select e.id,e.code_id,e.customer_id,e.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',p.id as province_id,p.name as province_name,d.id as district_id,d.name as district_name,
-		c.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',pt.name as prize_type_name,pt.id as prize_type_id,pt.value as prize_type_value,cd.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',c.network_operator,c.locale from entries e
+		c.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',pt.name as prize_type_name,pt.id as prize_type_id,pt.value as prize_type_value,cd.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',c.network_operator,c.locale,
+		cb.id,cb.reference,cb.product from entries e
 		inner join customer c on e.customer_id = c.id
 		inner join codes cd on e.code_id = cd.id
 		inner join province p on c.province = p.id
 		inner join district d on c.district = d.id
+		LEFT JOIN code_batch cb on cd.batch_id = cb.id
 		LEFT JOIN prize_type pt on cd.prize_type_id = pt.id `+logsFilter+` order by e.id desc`+limitStr, args1...)
 	if err != nil {
 		if !errors.Is(err, pgx.ErrNoRows) {
@@ -402,9 +460,14 @@ func GetEntries(c *fiber.Ctx) error {
 		entry := model.Entries{}
 		var prizeTypeName *string
 		var prizeTypeId, prizeTypeValue *int
+		var batchId *int
+		var batchReference, batchProduct *string
 		err = rows.Scan(&entry.Id, &entry.Code.Id, &entry.Customer.Id, &entry.CreatedAt, &entry.Customer.Province.Id, &entry.Customer.Province.Name,
 			&entry.Customer.District.Id, &entry.Customer.District.Name, &entry.Customer.CreatedAt, &prizeTypeName, &prizeTypeId, &prizeTypeValue,
-			&entry.Code.CreatedAt, &entry.Customer.NetworkOperator, &entry.Customer.Locale)
+			&entry.Code.CreatedAt, &entry.Customer.NetworkOperator, &entry.Customer.Locale, &batchId, &batchReference, &batchProduct)
+		if batchId != nil {
+			entry.Code.Batch = &model.CodeBatch{Id: *batchId, Reference: *batchReference, Product: *batchProduct}
+		}
 		entry.Customer.Phone = "**********"
 		entry.Customer.Names = "**********"
 		entry.Code.Code = "**********"
@@ -425,7 +488,7 @@ func GetEntries(c *fiber.Ctx) error {
 	}
 	totalEntries := 0
 	err = config.DB.QueryRow(ctx,
-		`select count(e.id) from entries e inner join customer c on e.customer_id = c.id `+logsFilter, globalArgs...).Scan(&totalEntries)
+		`select count(e.id) from entries e inner join customer c on e.customer_id = c.id inner join codes cd on e.code_id = cd.id `+logsFilter, globalArgs...).Scan(&totalEntries)
 	if err != nil {
 		if !errors.Is(err, pgx.ErrNoRows) {
 			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get entries data failed", utils.Logger{
@@ -440,10 +503,6 @@ func GetEntries(c *fiber.Ctx) error {
 }
 
 func GetPrizes(c *fiber.Ctx) error {
-	_, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
 	startDateStr := c.Query("start_date")
 	endDateStr := c.Query("end_date")
 	typeId := c.Query("type_id")
@@ -456,7 +515,7 @@ func GetPrizes(c *fiber.Ctx) error {
 	}
 	offSet := (page - 1) * limit
 
-	err = utils.ValidateDateRanges(startDateStr, &endDateStr)
+	err := utils.ValidateDateRanges(startDateStr, &endDateStr)
 	if err != nil {
 		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, err.Error())
 	}
@@ -531,10 +590,7 @@ func GetPrizes(c *fiber.Ctx) error {
 }
 
 func CreatePrizeCategory(c *fiber.Ctx) error {
-	userPayload, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
+	userPayload := CurrentUser(c)
 	type FormData struct {
 		Name string `json:"name" binding:"required" validate:"required,regex=^[a-zA-Z0-9\\-_ ]*$"`
 	}
@@ -553,7 +609,7 @@ func CreatePrizeCategory(c *fiber.Ctx) error {
 	if errorMessage != nil {
 		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, *errorMessage)
 	}
-	_, err = config.DB.Exec(ctx,
+	_, err := config.DB.Exec(ctx,
 		`insert into prize_category (name,status,operator_id) values ($1,'OKAY',$2)`, formData.Name, userPayload.Id)
 	if err != nil {
 		if ok, key := utils.IsErrDuplicate(err); ok {
@@ -606,10 +662,7 @@ func CreatePrizeCategory(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"status": responseStatus, "message": "Prize category added successfully"})
 }
 func CreatePrizeType(c *fiber.Ctx) error {
-	userPayload, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
+	userPayload := CurrentUser(c)
 
 	type FormData struct {
 		Id              int                  `json:"id" binding:"required" validate:"number"`
@@ -717,16 +770,14 @@ func CreatePrizeType(c *fiber.Ctx) error {
 			})
 		}
 	}
-	//save message
+	//save message templates, a changed message becomes a new version.
+	//they are rendered with the placeholders the winner sms is sent with, so a template that can not be sent is refused
+	sampleData := utils.SMSTemplateSample(utils.PrizeTypeTemplate(prizeTypeId))
 	for _, message := range formData.Messages {
-		//change to insert or update
-		_, err = tx.Exec(ctx,
-			`insert into prize_message (lang, prize_type_id, message, operator_id)
-			values ($1, $2, $3, $4)
-			on conflict (lang, prize_type_id) do update
-			set message = $3,
-				operator_id = $4`,
-			message.Lang, prizeTypeId, message.Message, userPayload.Id)
+		if _, err = utils.ExecuteSMSTemplate(message.Message, sampleData); err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, fmt.Sprintf("Message (%s) is not a valid template, %v", message.Lang, err))
+		}
+		_, err = utils.SaveSMSTemplate(tx, utils.PrizeTypeTemplate(prizeTypeId), message.Lang, message.Message, &userPayload.Id)
 		if err != nil {
 			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to save data, system error. please try again later", utils.Logger{
 				LogLevel:    utils.CRITICAL,
@@ -779,10 +830,6 @@ func CreatePrizeType(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"status": responseStatus, "message": returnMessage})
 }
 func GetDraws(c *fiber.Ctx) error {
-	_, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
 	startDateStr := c.Query("start_date")
 	endDateStr := c.Query("end_date")
 	code := c.Query("code")
@@ -794,7 +841,7 @@ func GetDraws(c *fiber.Ctx) error {
 	}
 	offSet := (page - 1) * limit
 
-	err = utils.ValidateDateRanges(startDateStr, &endDateStr)
+	err := utils.ValidateDateRanges(startDateStr, &endDateStr)
 	if err != nil {
 		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, err.Error())
 	}
@@ -869,23 +916,15 @@ func GetDraws(c *fiber.Ctx) error {
 		"pagination": fiber.Map{"page": page, "limit": limit, "total": totalDraws}})
 }
 func AddUser(c *fiber.Ctx) error {
-	userPayload, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
-	if !userPayload.CanAddUser {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, "You don't have permission to add a user")
-	}
+	userPayload := CurrentUser(c)
+	var err error
 	type FormData struct {
-		Fname          string `json:"fname" binding:"required" validate:"required,regex=^[a-zA-Z0-9 ]*$"`
-		Lname          string `json:"lname" binding:"required" validate:"required,regex=^[a-zA-Z0-9 ]*$"`
-		Phone          string `json:"phone" binding:"required" validate:"required,regex=^2507[2389]\\d{7}$"`
-		Email          string `json:"email" binding:"required" validate:"required,email"`
-		Department     int    `json:"department" binding:"required" validate:"required,number"`
-		CanAddCode     bool   `json:"can_add_codes" binding:"required" validate:"boolean"`
-		CanTriggerDraw bool   `json:"can_trigger_draw" binding:"required" validate:"boolean"`
-		CanViewLogs    bool   `json:"can_view_logs" binding:"required" validate:"boolean"`
-		CanAddUser     bool   `json:"can_add_user" binding:"required" validate:"boolean"`
+		Fname      string `json:"fname" binding:"required" validate:"required,regex=^[a-zA-Z0-9 ]*$"`
+		Lname      string `json:"lname" binding:"required" validate:"required,regex=^[a-zA-Z0-9 ]*$"`
+		Phone      string `json:"phone" binding:"required" validate:"required,regex=^2507[2389]\\d{7}$"`
+		Email      string `json:"email" binding:"required" validate:"required,email"`
+		Department int    `json:"department" binding:"required" validate:"required,number"`
+		Roles      []int  `json:"roles" binding:"required" validate:"required,min=1,dive,min=1"`
 	}
 	responseStatus := 200
 	formData := new(FormData)
@@ -902,6 +941,18 @@ func AddUser(c *fiber.Ctx) error {
 	if errorMessage != nil {
 		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, *errorMessage)
 	}
+	slices.Sort(formData.Roles)
+	formData.Roles = slices.Compact(formData.Roles)
+	if err = checkAssignableRoles(userPayload, formData.Roles); err != nil {
+		if errors.Is(err, errRoleNotAssignable) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, err.Error())
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to save data, system error. please try again later", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "AddUser: Unable to check roles, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
 	n := utils.GenerateRandomNumber(89)
 	avatarUrl := fmt.Sprintf("%s/api/v1/avatar/svg/av/%d", viper.GetString("BACKEND_URL"), n)
 	//insert user data, and will have to change password for the first time with a verification using phone
@@ -914,10 +965,25 @@ func AddUser(c *fiber.Ctx) error {
 			ServiceName: config.ServiceName,
 		})
 	}
-	_, err = config.DB.Exec(ctx,
-		`insert into users (fname,lname, email,phone, department_id, password, can_add_codes, can_trigger_draw, can_view_logs, can_add_user, status,force_change_password, operator, avatar_url) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, 'OKAY', true, $11, $12)`,
-		formData.Fname, formData.Lname, formData.Email, formData.Phone, formData.Department, password, formData.CanAddCode, formData.CanTriggerDraw, formData.CanViewLogs, formData.CanAddUser, userPayload.Id, avatarUrl)
-
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to save data, system error. please try again later", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "AddUser: Unable to start transaction, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer tx.Rollback(ctx)
+	var userId int
+	err = tx.QueryRow(ctx,
+		`insert into users (fname,lname, email,phone, department_id, password, status,force_change_password, operator, avatar_url) values ($1, $2, $3, $4, $5, $6, 'OKAY', true, $7, $8) returning id`,
+		formData.Fname, formData.Lname, formData.Email, formData.Phone, formData.Department, password, userPayload.Id, avatarUrl).Scan(&userId)
+	if err == nil {
+		err = setUserRoles(tx, userId, formData.Roles, userPayload.Id)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
 	if err != nil {
 		if ok, key := utils.IsErrDuplicate(err); ok {
 			return utils.JsonErrorResponse(c, fiber.StatusConflict, fmt.Sprintf("Unable to save data, %s already exists", key))
@@ -933,7 +999,11 @@ func AddUser(c *fiber.Ctx) error {
 		})
 	}
 	//send password to user phone (sms)
-	go utils.SendSMS(config.DB, formData.Phone, fmt.Sprintf("Your password is %s, please change it after login\n\n%s", rawPassword, viper.GetString("ap_name")), viper.GetString("SENDER_ID"), config.ServiceName, "account_password", nil, config.Redis)
+	_, err = utils.QueueTemplateSMS(config.DB, "account_password", utils.SMSTemplateDefaultLang(), map[string]any{"Password": rawPassword, "AppName": viper.GetString("ap_name")},
+		formData.Phone, viper.GetString("SENDER_ID"), "account_password", nil)
+	if err != nil {
+		utils.LogMessage(string(utils.CRITICAL), "AddUser: Unable to queue password sms, error: "+err.Error(), config.ServiceName)
+	}
 	utils.RecordActivityLog(config.DB,
 		utils.ActivityLog{
 			UserID:       userPayload.Id,
@@ -944,21 +1014,21 @@ func AddUser(c *fiber.Ctx) error {
 			UserAgent:    c.Get("User-Agent"),
 		},
 		config.ServiceName,
-		nil,
+		&map[string]interface{}{
+			"user_id": userId,
+			"roles":   formData.Roles,
+		},
 	)
 	return c.JSON(fiber.Map{"status": responseStatus, "message": "User added successfully"})
 }
 
 func GetUsers(c *fiber.Ctx) error {
-	_, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
 	users := []model.UserProfile{}
 	//fetch users
 	rows, err := config.DB.Query(ctx,
 		`select u.id,u.fname,u.lname,u.email,u.phone,u.department_id,d.title as department_title, u.email_verified,u.phone_verified,u.avatar_url,u.status,
-			u.can_add_codes,u.can_trigger_draw,u.can_view_logs,u.can_add_user,force_change_password from users u inner join departments d on u.department_id = d.id`)
+			coalesce((select json_agg(json_build_object('id',r.id,'name',r.name) order by r.name) from user_roles ur inner join roles r on r.id = ur.role_id where ur.user_id = u.id),'[]'),
+			force_change_password from users u inner join departments d on u.department_id = d.id`)
 	if err != nil {
 		if !errors.Is(err, pgx.ErrNoRows) {
 			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get users data failed", utils.Logger{
@@ -973,7 +1043,7 @@ func GetUsers(c *fiber.Ctx) error {
 		user := model.UserProfile{}
 		//scan user data
 		err = rows.Scan(&user.Id, &user.Fname, &user.Lname, &user.Email, &user.Phone, &user.Department.Id, &user.Department.Title, &user.EmailVerified, &user.PhoneVerified,
-			&user.AvatarUrl, &user.Status, &user.CanAddCodes, &user.CanTriggerDraw, &user.CanViewLogs, &user.CanAddUser, &user.ForceChangePassword)
+			&user.AvatarUrl, &user.Status, &user.Roles, &user.ForceChangePassword)
 
 		if err != nil {
 			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get users data failed", utils.Logger{
@@ -988,19 +1058,17 @@ func GetUsers(c *fiber.Ctx) error {
 }
 
 func GetCustomer(c *fiber.Ctx) error {
-	userPayload, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
+	userPayload := CurrentUser(c)
 	customerId := c.Params("customerId")
 	customer := model.Customer{}
-	err = config.DB.QueryRow(ctx,
+	err := config.DB.QueryRow(ctx,
 		`select p.id as province_id,p.name as province_name,d.id as district_id,d.name as district_name,
-		c.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',c.network_operator,c.locale,pgp_sym_decrypt(c.names::bytea,$1) as names,pgp_sym_decrypt(c.phone::bytea,$1) as phone,c.id from customer c
+		c.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',c.network_operator,c.locale,pgp_sym_decrypt(c.names::bytea,$1) as names,pgp_sym_decrypt(c.phone::bytea,$1) as phone,c.id,
+		c.sms_opt_out,c.sms_opt_out_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',c.status from customer c
 		inner join province p on c.province = p.id
 		inner join district d on c.district = d.id where c.id=$2`, config.EncryptionKey, customerId).
 		Scan(&customer.Province.Id, &customer.Province.Name, &customer.District.Id, &customer.District.Name, &customer.CreatedAt, &customer.NetworkOperator,
-			&customer.Locale, &customer.Names, &customer.Phone, &customer.Id)
+			&customer.Locale, &customer.Names, &customer.Phone, &customer.Id, &customer.SMSOptOut, &customer.SMSOptOutAt, &customer.Status)
 	if err != nil {
 		if !errors.Is(err, pgx.ErrNoRows) {
 			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get customer data failed", utils.Logger{
@@ -1029,17 +1097,14 @@ func GetCustomer(c *fiber.Ctx) error {
 }
 
 func GetEntryData(c *fiber.Ctx) error {
-	userPayload, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
+	userPayload := CurrentUser(c)
 	entryId := c.Params("entryId")
 	entry := model.Entries{}
 	var prizeTypeName *string
 	var prizeTypeId, prizeTypeValue *int
 	var PrizeDate *time.Time
 	var prizeId *int
-	err = config.DB.QueryRow(ctx,
+	err := config.DB.QueryRow(ctx,
 		`select e.id,e.code_id,e.customer_id,e.created_at,p.id as province_id,p.name as province_name,d.id as district_id,d.name as district_name,
 		c.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',pt.name as prize_type_name,pt.id as prize_type_id,pt.value as prize_type_value,cd.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',c.network_operator,c.locale,
 		pgp_sym_decrypt(c.names::bytea,$1) as names,pgp_sym_decrypt(c.momo_names::bytea,$1) as momo_names,pgp_sym_decrypt(c.phone::bytea,$1) as phone,
@@ -1095,10 +1160,7 @@ func GetEntryData(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": entry})
 }
 func ChangePassword(c *fiber.Ctx) error {
-	userPayload, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
+	userPayload := CurrentUser(c)
 	type FormData struct {
 		OldPassword string `json:"current_password" validate:"required"`
 		NewPassword string `json:"new_password" validate:"required,min=8,max=50,strong_password"`
@@ -1108,7 +1170,7 @@ func ChangePassword(c *fiber.Ctx) error {
 		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Please provide all required data")
 	}
 	// Register the custom validation function for strong password
-	err = Validate.RegisterValidation("strong_password", utils.IsStrongPassword)
+	err := Validate.RegisterValidation("strong_password", utils.IsStrongPassword)
 	if err != nil {
 		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Create project failed", utils.Logger{
 			LogLevel:    utils.CRITICAL,
@@ -1139,7 +1201,17 @@ func ChangePassword(c *fiber.Ctx) error {
 	} else if err := bcrypt.CompareHashAndPassword([]byte(password), []byte(formData.NewPassword)); err == nil {
 		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "New Password is the same as current one, no action made")
 	}
-	_, err = config.DB.Exec(ctx, "update users set password=crypt($1, gen_salt('bf')),force_change_password=false where id=$2", formData.NewPassword, userPayload.Id)
+	refused, err := checkPasswordPolicy(userPayload.Id, formData.NewPassword)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Change password failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     fmt.Sprintf("ChangePassword: Unable to check password policy for %d! Err: %s", userPayload.Id, err.Error()),
+			ServiceName: config.ServiceName,
+		})
+	} else if refused != "" {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, refused)
+	}
+	err = savePassword(userPayload.Id, formData.NewPassword)
 	if err != nil {
 		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Change password failed", utils.Logger{
 			LogLevel:    utils.CRITICAL,
@@ -1159,6 +1231,16 @@ func ChangePassword(c *fiber.Ctx) error {
 		config.ServiceName,
 		nil,
 	)
+	//the other sessions may have been opened with the old password
+	utils.RevokeUserSessions(config.Redis, userPayload.Id, userPayload.SessionId)
+	//the current session is no longer blocked by RequirePasswordChange
+	userPayload.ForceChangePassword = false
+	if err = loadPasswordExpiry(userPayload); err == nil {
+		err = utils.UpdateSessionUser(config.Redis, userPayload.SessionId, *userPayload)
+	}
+	if err != nil {
+		utils.LogMessage("critical", fmt.Sprintf("ChangePassword: Unable to update session of %d, error: %s", userPayload.Id, err.Error()), config.ServiceName)
+	}
 	c.SendStatus(200)
 	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": fmt.Sprintf("Dear %s, you password changed successful", userPayload.Fname)})
 }
@@ -1178,6 +1260,13 @@ func ForgotPassword(c *fiber.Ctx) error {
 	if errorMessage != nil {
 		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, *errorMessage)
 	}
+	if err := utils.LoginGuardCheck(config.Redis, utils.LoginGuardForgotPassword, formData.Email, c.IP()); err != nil {
+		return loginGuardResponse(c, err, "ForgotPassword")
+	}
+	//every request counts, a reset is only expected once in a while
+	if err := loginGuardFailure(c, utils.LoginGuardForgotPassword, formData.Email); err != nil {
+		return loginGuardResponse(c, err, "ForgotPassword")
+	}
 	uniqueResetTokenKey := base64.RawStdEncoding.EncodeToString([]byte(formData.Email + utils.RandString(20)))
 	successResponse := c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "You will receive an email if we found an account match with this email",
 		"reset_key": uniqueResetTokenKey, "email": formData.Email})
@@ -1248,7 +1337,15 @@ func ForgotPassword(c *fiber.Ctx) error {
 		nil,
 	)
 	//send email containing otp
-	go utils.SendSMS(config.DB, phone, fmt.Sprintf("Dear %s, %s is the OTP for reseting your password. don't share it with anyone.", fname, otp), viper.GetString("SENDER_ID"), config.ServiceName, "reset_password_otp", nil, config.Redis)
+	_, err = utils.QueueTemplateSMS(config.DB, "reset_password_otp", utils.SMSTemplateDefaultLang(), map[string]any{"Name": fname, "OTP": otp},
+		phone, viper.GetString("SENDER_ID"), "reset_password_otp", nil)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Reset password failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     fmt.Sprintf("ForgotPassword: unable to queue otp sms for email %s, error:%s ", formData.Email, err.Error()),
+			ServiceName: config.ServiceName,
+		})
+	}
 	return successResponse
 }
 func ValidateOTP(c *fiber.Ctx) error {
@@ -1287,9 +1384,19 @@ func ValidateOTP(c *fiber.Ctx) error {
 			ServiceName: config.ServiceName,
 		})
 	}
+	email, _ := otpData["email"].(string)
+	if err = utils.LoginGuardCheck(config.Redis, utils.LoginGuardOTP, email, c.IP()); err != nil {
+		return loginGuardResponse(c, err, "ValidateOTP")
+	}
 	if otpData["otp"].(string) != formData.Otp {
+		if err = loginGuardFailure(c, utils.LoginGuardOTP, email); err != nil {
+			//the otp can no longer be guessed, a new one has to be requested after the lockout
+			config.Redis.Del(c.Context(), formData.ResetKey)
+			return loginGuardResponse(c, err, "ValidateOTP")
+		}
 		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Invalid OTP provided")
 	}
+	utils.LoginGuardSuccess(config.Redis, utils.LoginGuardOTP, email)
 	if strings.Contains(c.Route().Path, "/verify_otp") {
 		//mark phone as verified
 		_, err := config.DB.Exec(ctx, "update users set phone_verified=true where id=$1", otpData["userId"])
@@ -1405,8 +1512,19 @@ func SetNewPassword(c *fiber.Ctx) error {
 			ServiceName: config.ServiceName,
 		})
 	}
+	userId := int(resetData["userId"].(float64))
+	refused, err := checkPasswordPolicy(userId, formData.Password)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Reset password failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     fmt.Sprintf("SetNewPassword: unable to check password policy, userId: %d, error:%s ", userId, err.Error()),
+			ServiceName: config.ServiceName,
+		})
+	} else if refused != "" {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, refused)
+	}
 	//update password
-	_, err = config.DB.Exec(ctx, "update users set password=crypt($1, gen_salt('bf')),force_change_password=false where id=$2", formData.Password, resetData["userId"])
+	err = savePassword(userId, formData.Password)
 	if err != nil {
 		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Reset password failed", utils.Logger{
 			LogLevel:    utils.CRITICAL,
@@ -1425,7 +1543,7 @@ func SetNewPassword(c *fiber.Ctx) error {
 	}
 	utils.RecordActivityLog(config.DB,
 		utils.ActivityLog{
-			UserID:       int(resetData["userId"].(float64)),
+			UserID:       userId,
 			ActivityType: "setNewPassword",
 			Description:  "Self: Set new password",
 			Status:       "success",
@@ -1435,6 +1553,7 @@ func SetNewPassword(c *fiber.Ctx) error {
 		config.ServiceName,
 		nil,
 	)
+	revokeSessions(c, userId, "password reset")
 	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Password reset completed", "email": resetData["email"]})
 }
 func SendVerificationEmail(c *fiber.Ctx) error {
@@ -1539,18 +1658,19 @@ func SendVerificationEmail(c *fiber.Ctx) error {
 		nil,
 	)
 	//send email containing otp
-	utils.SendEmail(formData.Email, "Verify your account", body, config.ServiceName)
+	_, err = utils.QueueEmail(config.DB, utils.EmailMessage{To: formData.Email, Subject: "Verify your account", Body: body}, "verify_account_otp")
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Sending verification otp failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     fmt.Sprintf("SendVerificationEmail: unable to queue email for %s, error:%s ", formData.Email, err.Error()),
+			ServiceName: config.ServiceName,
+		})
+	}
 	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "You will receive an email contains the OTP for verification, it will be expired in 20 minutes",
 		"reset_key": uniqueResetTokenKey, "email": formData.Email})
 }
 func StartPrizeDraw(c *fiber.Ctx) error {
-	userPayload, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
-	if !userPayload.CanTriggerDraw {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, "You don't have permission to start a draw")
-	}
+	userPayload := CurrentUser(c)
 	type FormData struct {
 		PrizeType uint `json:"prize_type" validate:"required,number"`
 	}
@@ -1566,7 +1686,7 @@ func StartPrizeDraw(c *fiber.Ctx) error {
 	var value float64
 	var expiryDate *time.Time
 	var triggerBySystem bool
-	err = config.DB.QueryRow(ctx, "select id,name,status,expiry_date,trigger_by_system,period,value,distribution_type from prize_type where id=$1", formData.PrizeType).
+	err := config.DB.QueryRow(ctx, "select id,name,status,expiry_date,trigger_by_system,period,value,distribution_type from prize_type where id=$1", formData.PrizeType).
 		Scan(&id, &name, &status, &expiryDate, &triggerBySystem, &period, &value, &distributionType)
 	if err != nil {
 		if !errors.Is(err, pgx.ErrNoRows) {
@@ -1653,6 +1773,13 @@ func StartPrizeDraw(c *fiber.Ctx) error {
 		}
 		entryFilter += fmt.Sprintf("e.customer_id not in ('%s')", strings.Join(excludeCustomers, "','"))
 	}
+	//entries of voided or suspended code batches can not win
+	if len(entryFilter) != 0 {
+		entryFilter += " and "
+	}
+	entryFilter += "not exists (select 1 from codes cd inner join code_batch cb on cb.id = cd.batch_id where cd.id = e.code_id and cb.status in ('VOIDED','SUSPENDED'))"
+	//customers in fraud review or confirmed as fraud are skipped
+	entryFilter += " and e.customer_id in (select id from customer where status = 'OKAY')"
 	finalFilter := ""
 	if len(entryFilter) != 0 {
 		finalFilter = " where " + entryFilter
@@ -1686,9 +1813,35 @@ func StartPrizeDraw(c *fiber.Ctx) error {
 	if len(entries) == 0 {
 		return utils.JsonErrorResponse(c, fiber.StatusExpectationFailed, "No elligible entries found for the selected prize type")
 	}
-	//select a random entry
+	//select a random entry, the entries of an excluded customer (staff, relatives, blacklist) are removed and another is drawn
 	randomGen := rand.New(rand.NewSource(time.Now().UnixNano()))
-	selectedEntry := entries[randomGen.Intn(len(entries))]
+	var selectedEntry model.Entries
+	for {
+		if len(entries) == 0 {
+			return utils.JsonErrorResponse(c, fiber.StatusExpectationFailed, "No elligible entries found for the selected prize type")
+		}
+		selectedEntry = entries[randomGen.Intn(len(entries))]
+		hit, err := utils.MatchPrizeExclusion(config.DB, selectedEntry.Customer.Id)
+		if err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to start a new draw, system error", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "StartPrizeDraw: Unable to match prize exclusions, error: " + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+		if hit == nil {
+			break
+		}
+		hit.Context, hit.PrizeTypeId, hit.EntryId = "draw", int(formData.PrizeType), selectedEntry.Id
+		utils.RecordExclusionHit(config.DB, *hit, &userPayload.Id, c.IP(), config.ServiceName)
+		remaining := []model.Entries{}
+		for _, entry := range entries {
+			if entry.Customer.Id != selectedEntry.Customer.Id {
+				remaining = append(remaining, entry)
+			}
+		}
+		entries = remaining
+	}
 	//get customer data
 	var customerPhone, customerName, customerLocale, mno string
 	err = config.DB.QueryRow(ctx, "select pgp_sym_decrypt(phone::bytea,$1), pgp_sym_decrypt(names::bytea,$1),locale,network_operator from customer where id=$2",
@@ -1701,12 +1854,10 @@ func StartPrizeDraw(c *fiber.Ctx) error {
 			ServiceName: config.ServiceName,
 		})
 	}
-	//get prize message based on customer locale
-	prizeMessage := ""
-	err = config.DB.QueryRow(ctx, "select message from prize_message where prize_type_id=$1 and lang=$2", id, customerLocale).
-		Scan(&prizeMessage)
+	//get prize message template based on customer locale
+	prizeTemplate, err := utils.GetSMSTemplate(config.DB, utils.PrizeTypeTemplate(id), customerLocale)
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
+		if errors.Is(err, utils.ErrSMSTemplateNotFound) {
 			return utils.JsonErrorResponse(c, fiber.StatusExpectationFailed, "Unable to start a new draw, no prize sms available for the selected prize type")
 		}
 		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to start a new draw, system error", utils.Logger{
@@ -1770,9 +1921,12 @@ func StartPrizeDraw(c *fiber.Ctx) error {
 		})
 	}
 	//distribute prize
+	claimCode := ""
+	var claimExpiresAt time.Time
 	if distributionType == "momo" {
-		_, err = tx.Exec(ctx, `insert into transaction (prize_id, amount, phone, mno, customer_id, transaction_type, initiated_by,status) values ($1, $2, $3, $4, $5,'CREDIT','SYSTEM','WAITING')`,
-			prizeId, value, customerPhone, mno, selectedEntry.Customer.Id)
+		var transactionId int
+		err = tx.QueryRow(ctx, `insert into transaction (prize_id, amount, phone, mno, customer_id, transaction_type, initiated_by,status) values ($1, $2, $3, $4, $5,'CREDIT','SYSTEM','WAITING') returning id`,
+			prizeId, value, customerPhone, mno, selectedEntry.Customer.Id).Scan(&transactionId)
 		if err != nil {
 			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to start a new draw, system error", utils.Logger{
 				LogLevel:    utils.CRITICAL,
@@ -1780,6 +1934,51 @@ func StartPrizeDraw(c *fiber.Ctx) error {
 				ServiceName: config.ServiceName,
 			})
 		}
+		//high value prizes are paid only after the winner claims it (claim code + national ID)
+		if utils.PrizeClaimRequired(value) {
+			claimCode, claimExpiresAt, err = utils.CreatePrizeClaim(tx, prizeId, selectedEntry.Customer.Id, &transactionId)
+			if err != nil {
+				return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to start a new draw, system error", utils.Logger{
+					LogLevel:    utils.CRITICAL,
+					Message:     "StartPrizeDraw: #distribute_prize create prize claim failed: err:" + err.Error(),
+					ServiceName: config.ServiceName,
+				})
+			}
+		}
+	} else {
+		//non-cash prize, track its fulfilment
+		_, err = tx.Exec(ctx, `insert into fulfilment (prize_id, customer_id, status) values ($1, $2, 'WAITING_CLAIM')`, prizeId, selectedEntry.Customer.Id)
+		if err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to start a new draw, system error", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "StartPrizeDraw: #distribute_prize insert fulfilment failed: err:" + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+	}
+	//queue winner sms with the draw
+	smsData := map[string]any{"Name": customerName, "Amount": int(value), "Code": rawCode, "PrizeType": name, "ClaimDeadline": ""}
+	if claimCode != "" {
+		location, locationErr := time.LoadLocation(config.Timezone)
+		if locationErr != nil {
+			location = time.UTC
+		}
+		smsData["ClaimDeadline"] = claimExpiresAt.In(location).Format("02/01/2006 15:04")
+	}
+	prizeMessage, err := utils.ExecuteSMSTemplate(prizeTemplate, smsData)
+	if err == nil {
+		_, err = utils.QueueSMS(tx, customerPhone, prizeMessage, viper.GetString("SENDER_ID"), "prize_won", &selectedEntry.Customer.Id)
+	}
+	if err == nil && claimCode != "" {
+		smsData["Code"] = claimCode
+		_, err = utils.QueueTemplateSMS(tx, "prize_claim", customerLocale, smsData, customerPhone, viper.GetString("SENDER_ID"), "prize_claim", &selectedEntry.Customer.Id)
+	}
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to start a new draw, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "StartPrizeDraw: Unable to queue winner sms, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
 	}
 	tx.Commit(ctx)
 	utils.RecordActivityLog(config.DB,
@@ -1798,8 +1997,6 @@ func StartPrizeDraw(c *fiber.Ctx) error {
 			"customer_id": selectedEntry.Customer.Id,
 		},
 	)
-	//send sms
-	go utils.SendSMS(config.DB, customerPhone, prizeMessage, viper.GetString("SENDER_ID"), config.ServiceName, "prize_won", &selectedEntry.Customer.Id, config.Redis)
 	c.SendStatus(200)
 	arrayCode := strings.Split(rawCode, "")
 	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Draw ended successfully",
@@ -1808,10 +2005,6 @@ func StartPrizeDraw(c *fiber.Ctx) error {
 }
 
 func GetDistributionType(c *fiber.Ctx) error {
-	_, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
 	types := strings.Split(viper.GetString("DISTRIBUTION_TYPES"), ",")
 	distributions := []map[string]string{}
 	for _, t := range types {
@@ -1820,10 +2013,6 @@ func GetDistributionType(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": distributions})
 }
 func GetDepartments(c *fiber.Ctx) error {
-	_, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
 	departments := []model.Department{}
 	rows, err := config.DB.Query(ctx,
 		`select id,title,created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali' from departments`)
@@ -1852,22 +2041,41 @@ func GetDepartments(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": departments})
 }
 func GetSMSSent(c *fiber.Ctx) error {
-	_, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
 	type SmsData struct {
-		Id           string    `json:"id"`
-		Message      string    `json:"message"`
-		MessageType  string    `json:"message_type"`
-		Phone        *string   `json:"phone"`
-		Status       string    `json:"status"`
-		ErrorMessage string    `json:"error_message"`
-		CreatedAt    time.Time `json:"created_at"`
+		Id           string     `json:"id"`
+		Message      string     `json:"message"`
+		MessageType  string     `json:"message_type"`
+		Phone        *string    `json:"phone"`
+		Status       string     `json:"status"`
+		ErrorMessage string     `json:"error_message"`
+		ErrorCode    *string    `json:"error_code"`
+		Operator     *string    `json:"network_operator"`
+		Provider     *string    `json:"provider"`
+		CreditCount  int        `json:"credit_count"`
+		DeliveredAt  *time.Time `json:"delivered_at"`
+		CreatedAt    time.Time  `json:"created_at"`
+	}
+	type ProviderCost struct {
+		Provider string `json:"provider"`
+		Sent     int    `json:"sent"`
+		Credits  int    `json:"credits"`
+	}
+	type DeliveryRate struct {
+		MessageType   string  `json:"message_type"`
+		Operator      string  `json:"network_operator"`
+		Sent          int     `json:"sent"`
+		Delivered     int     `json:"delivered"`
+		Expired       int     `json:"expired"`
+		Undeliverable int     `json:"undeliverable"`
+		Failed        int     `json:"failed"`
+		DeliveryRate  float64 `json:"delivery_rate"`
 	}
 	startDateStr := c.Query("start_date")
 	endDateStr := c.Query("end_date")
 	messageType := c.Query("message_type")
+	status := c.Query("status")
+	operator := c.Query("network_operator")
+	provider := c.Query("provider")
 	//add pagination
 	page := c.QueryInt("page", 1)
 	limit := c.QueryInt("limit", 20)
@@ -1876,7 +2084,7 @@ func GetSMSSent(c *fiber.Ctx) error {
 	}
 	offSet := (page - 1) * limit
 
-	err = utils.ValidateDateRanges(startDateStr, &endDateStr)
+	err := utils.ValidateDateRanges(startDateStr, &endDateStr)
 	if err != nil {
 		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, err.Error())
 	}
@@ -1887,7 +2095,10 @@ func GetSMSSent(c *fiber.Ctx) error {
 		map[string]interface{}{
 			"sms.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali' >= ": startDateStr,
 			"sms.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali' <= ": endDateStr,
-			"sms.type": messageType,
+			"sms.type":             messageType,
+			"sms.status":           status,
+			"sms.network_operator": operator,
+			"sms.provider":         provider,
 		},
 		&args1,
 	)
@@ -1896,7 +2107,8 @@ func GetSMSSent(c *fiber.Ctx) error {
 	args1 = append(args1, limit, offSet)
 	smsData := []SmsData{}
 	rows, err := config.DB.Query(ctx,
-		`select message_id,message,phone,type,status,error_message,created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali' from sms`+logsFilter+` order by id desc`+limitStr, args1...)
+		`select coalesce(message_id,''),message,phone,type,status,coalesce(error_message,''),error_code,network_operator,provider,coalesce(credit_count,0),delivered_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',
+		created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali' from sms`+logsFilter+` order by id desc`+limitStr, args1...)
 	if err != nil {
 		if !errors.Is(err, pgx.ErrNoRows) {
 			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get sms data failed", utils.Logger{
@@ -1909,7 +2121,7 @@ func GetSMSSent(c *fiber.Ctx) error {
 	}
 	for rows.Next() {
 		sms := SmsData{}
-		err = rows.Scan(&sms.Id, &sms.Message, &sms.Phone, &sms.MessageType, &sms.Status, &sms.ErrorMessage, &sms.CreatedAt)
+		err = rows.Scan(&sms.Id, &sms.Message, &sms.Phone, &sms.MessageType, &sms.Status, &sms.ErrorMessage, &sms.ErrorCode, &sms.Operator, &sms.Provider, &sms.CreditCount, &sms.DeliveredAt, &sms.CreatedAt)
 		if err != nil {
 			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get sms data failed", utils.Logger{
 				LogLevel:    utils.CRITICAL,
@@ -1917,6 +2129,8 @@ func GetSMSSent(c *fiber.Ctx) error {
 				ServiceName: config.ServiceName,
 			})
 		}
+		//secrets are kept until the sms is sent, they are never shown
+		sms.Message = utils.MaskSMSMessage(sms.MessageType, sms.Message)
 		smsData = append(smsData, sms)
 	}
 	totalSms := 0
@@ -1931,14 +2145,68 @@ func GetSMSSent(c *fiber.Ctx) error {
 			})
 		}
 	}
-	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": smsData,
+	//delivery rates per message type and operator, over sms which left the platform
+	deliveryRates := []DeliveryRate{}
+	rateRows, err := config.DB.Query(ctx,
+		`select coalesce(type,''),coalesce(network_operator,''),count(id) filter (where status in ('SENT','DELIVERED','EXPIRED','UNDELIVERABLE')),
+		count(id) filter (where status='DELIVERED'),count(id) filter (where status='EXPIRED'),count(id) filter (where status='UNDELIVERABLE'),
+		count(id) filter (where status='FAILED') from sms`+logsFilter+` group by 1,2 order by 1,2`, globalArgs...)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get sms sent data failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetSMSSent: Unable to get sms delivery rates, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer rateRows.Close()
+	for rateRows.Next() {
+		rate := DeliveryRate{}
+		err = rateRows.Scan(&rate.MessageType, &rate.Operator, &rate.Sent, &rate.Delivered, &rate.Expired, &rate.Undeliverable, &rate.Failed)
+		if err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get sms sent data failed", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "GetSMSSent: Unable to read sms delivery rates, error: " + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+		if rate.Sent > 0 {
+			rate.DeliveryRate = math.Round(float64(rate.Delivered)*10000/float64(rate.Sent)) / 100
+		}
+		deliveryRates = append(deliveryRates, rate)
+	}
+	//credits used per provider
+	providerFilter := " where provider is not null"
+	if logsFilter != "" {
+		providerFilter = logsFilter + " and provider is not null"
+	}
+	providerCosts := []ProviderCost{}
+	costRows, err := config.DB.Query(ctx,
+		`select provider,count(id),coalesce(sum(credit_count),0) from sms`+providerFilter+` group by 1 order by 1`, globalArgs...)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get sms sent data failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetSMSSent: Unable to get sms provider costs, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer costRows.Close()
+	for costRows.Next() {
+		cost := ProviderCost{}
+		err = costRows.Scan(&cost.Provider, &cost.Sent, &cost.Credits)
+		if err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get sms sent data failed", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "GetSMSSent: Unable to read sms provider costs, error: " + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+		providerCosts = append(providerCosts, cost)
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": smsData, "delivery_rates": deliveryRates, "provider_costs": providerCosts,
 		"pagination": fiber.Map{"page": page, "limit": limit, "total": totalSms}})
 }
 func GetPrizeOverview(c *fiber.Ctx) error {
-	_, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
+	var err error
 	type PrizeOverview struct {
 		TotalPrize      float64 `json:"total_prize"`
 		PrizeCount      int     `json:"prize_count"`
@@ -1991,6 +2259,19 @@ func GetPrizeOverview(c *fiber.Ctx) error {
 		dateFilter += "p.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali' <= " + argName
 		dateFilterEntry += "e.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali' <= " + argName
 	}
+	batchFilter, err := codeBatchFilter(c, &args)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, err.Error())
+	}
+	if batchFilter != "" {
+		if len(dateFilter) != 0 {
+			dateFilter += " and "
+			dateFilterEntry += " and "
+		}
+		batchFilter = "exists (select 1 from codes cd where cd.id = e.code_id and " + batchFilter + ")"
+		dateFilter += "p.entry_id in (select e.id from entries e where " + batchFilter + ")"
+		dateFilterEntry += batchFilter
+	}
 	if len(dateFilter) != 0 {
 		dateFilter = " where " + dateFilter
 		dateFilterEntry = " where " + dateFilterEntry
@@ -2038,18 +2319,25 @@ func GetPrizeOverview(c *fiber.Ctx) error {
 }
 
 func GetCodeOverview(c *fiber.Ctx) error {
-	_, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
 	type CodeOverview struct {
 		TotalCode  int `json:"totalCode"`
 		UsedCode   int `json:"usedCode"`
 		RemainCode int `json:"remainCode"`
 	}
 	codeOverview := CodeOverview{}
-	//pending_count
-	err = config.DB.QueryRow(ctx, `SELECT total,used_count FROM codes_count;`).Scan(&codeOverview.TotalCode, &codeOverview.UsedCode)
+	args := []interface{}{}
+	batchFilter, err := codeBatchFilter(c, &args)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, err.Error())
+	}
+	if batchFilter == "" {
+		//pending_count
+		err = config.DB.QueryRow(ctx, `SELECT total,used_count FROM codes_count;`).Scan(&codeOverview.TotalCode, &codeOverview.UsedCode)
+	} else {
+		//the materialized view has no batch, count the codes of the batch
+		err = config.DB.QueryRow(ctx, `SELECT count(cd.id),count(cd.id) FILTER (WHERE cd.status = 'used') FROM codes cd WHERE `+batchFilter, args...).
+			Scan(&codeOverview.TotalCode, &codeOverview.UsedCode)
+	}
 	if err != nil {
 		if !errors.Is(err, pgx.ErrNoRows) {
 			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get codeOverview data failed", utils.Logger{
@@ -2068,27 +2356,59 @@ func GetCodeOverview(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": codeOverview})
 }
 
-// function to upload excel file and insert into codes table after validation, and use transaction to rollback if any error occurs
+// UploadCodes save the file of a code batch and start its import job, see RunCodeImportJobs.
+// codes are imported in the background, the job status endpoint reports the progress and the rejected rows
 func UploadCodes(c *fiber.Ctx) error {
-	userPayload, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
+	userPayload := CurrentUser(c)
+	//codes are uploaded into a production batch
+	type FormData struct {
+		BatchReference string `form:"batch_reference" validate:"required,max=100"`
+		Product        string `form:"product" validate:"required,max=50"`
+		BottlingLine   string `form:"bottling_line" validate:"max=50"`
+		Region         string `form:"region" validate:"max=100"`
+		ProductionDate string `form:"production_date" validate:"omitempty,datetime=2006-01-02"`
+		CheckDigit     string `form:"check_digit" validate:"omitempty,oneof=none luhn damm"`
+		Alphabet       string `form:"alphabet"`
+		Length         int    `form:"length"`
+	}
+	//the body is streamed, refuse it before it is read when it is bigger than the file can be
+	if length := c.Request().Header.ContentLength(); int64(length) > CodeImportMaxFileSize()+1024*1024 || length == -1 {
+		return utils.JsonErrorResponse(c, fiber.StatusRequestEntityTooLarge, fmt.Sprintf("File size should not exceed %dMB", CodeImportMaxFileSize()/1024/1024))
+	}
+	formData := FormData{}
+	if err := c.BodyParser(&formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
 	}
-	if !userPayload.CanAddCodes {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, "You don't have permission to upload codes")
+	//codes printed with a check digit are validated on import and on USSD, files without one are legacy batches
+	var format *utils.CodeFormat
+	if formData.CheckDigit != "" && formData.CheckDigit != utils.CheckDigitNone {
+		format = &utils.CodeFormat{Alphabet: formData.Alphabet, Length: formData.Length, CheckDigit: formData.CheckDigit}
+		if format.Alphabet == "" {
+			format.Alphabet = utils.DefaultCodeAlphabet
+		}
+		if format.Length == 0 {
+			format.Length = 10
+		}
+		if err := format.Validate(); err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, err.Error())
+		}
 	}
-	startTime := time.Now()
-	fmt.Println("Upload started at:", startTime.Format("2006-01-02 15:04:05"))
-	//TODO: check if user has right to upload code
 	file, err := c.FormFile("file")
 	if err != nil {
 		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Please provide a valid file")
 	}
-	if file.Size > 1024*1024*100 {
-		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "File size should not exceed 100MB")
+	if file.Size > CodeImportMaxFileSize() {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, fmt.Sprintf("File size should not exceed %dMB", CodeImportMaxFileSize()/1024/1024))
+	}
+	ext := strings.ToLower(filepath.Ext(file.Filename))
+	if ext != ".txt" && ext != ".xlsx" {
+		return c.Status(fiber.StatusUnsupportedMediaType).SendString("Unsupported file type")
 	}
-	//save file
-	fileName := fmt.Sprintf("/app/uploads/%s", file.Filename)
+	//save file, the import job reads it from disk
+	fileName := fmt.Sprintf("/app/uploads/%d_%s%s", time.Now().UnixNano(), utils.GenerateRandomCapitalLetter(8), ext)
 	err = c.SaveFile(file, fileName)
 	if err != nil {
 		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to save file", utils.Logger{
@@ -2097,222 +2417,66 @@ func UploadCodes(c *fiber.Ctx) error {
 			ServiceName: config.ServiceName,
 		})
 	}
-	var codes []model.Code
-	//postgres limit max value to 65535, make sure to split the data into batches
-	var batches [][]model.Code
-	ext := filepath.Ext(file.Filename)
-	bCount := 0
-	skippedLines := 0
-	if ext == ".txt" {
-		//read file content and split by new line
-		// content, err := os.ReadFile(fileName)
-		// if err != nil {
-		// 	return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to read file", utils.Logger{
-		// 		LogLevel:    utils.CRITICAL,
-		// 		Message:     "UploadCodes: Unable to read file, error: " + err.Error(),
-		// 		ServiceName: config.ServiceName,
-		// 	})
-		// }
-		// lines := strings.Split(string(content), "\n")
-		// for _, line := range lines {
-		// 	//limit batch to 20000 because each value contains 3 params
-		// 	if bCount%20000 == 0 && bCount != 0 {
-		// 		batches = append(batches, codes)
-		// 		codes = []model.Code{}
-		// 	}
-		// 	bCount++
-		// 	//prevent reading more than 3 empty lines
-		// 	skippedLines++
-		// 	if skippedLines > 3 {
-		// 		break
-		// 	}
-		// 	line = strings.TrimSpace(line)
-		// 	if len(line) == 10 {
-		// 		codes = append(codes, model.Code{Code: line})
-		// 	} else {
-		// 		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Invalid code length, code should be 10 digits. code: "+line)
-		// 	}
-		// }
-
-		nFile, err := os.Open(fileName)
-		if err != nil {
-			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to read file", utils.Logger{
-				LogLevel:    utils.CRITICAL,
-				Message:     "UploadCodes: Unable to read file, error: " + err.Error(),
-				ServiceName: config.ServiceName,
-			})
-		}
-		defer nFile.Close()
-		scanner := bufio.NewScanner(nFile)
-		for scanner.Scan() {
-			//limit batch to 20000 because each value contains 3 params
-			if bCount%20000 == 0 && bCount != 0 {
-				batches = append(batches, codes)
-				codes = []model.Code{}
-			}
-			//prevent reading more than 3 empty lines
-			if skippedLines > 3 {
-				break
-			}
-			line := scanner.Text()
-			line = strings.TrimSpace(line)
-			if line == "" {
-				skippedLines++
-				continue // skip empty lines
-			}
-			bCount++
-			if len(line) == 10 {
-				codes = append(codes, model.Code{Code: line})
-			} else {
-				return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Invalid code length, code should be 10 digits. code: "+line)
-			}
-		}
-		if len(codes) > 0 {
-			batches = append(batches, codes)
+	ipAddress := c.IP()
+	var batchId int
+	fileHash, err := fileSHA256(fileName)
+	if err == nil {
+		batchId, err = createCodeBatch(codeBatchInput{
+			Reference:      formData.BatchReference,
+			Product:        formData.Product,
+			BottlingLine:   formData.BottlingLine,
+			Region:         formData.Region,
+			ProductionDate: formData.ProductionDate,
+			FileName:       file.Filename,
+			FileHash:       fileHash,
+			Format:         format,
+			UserId:         userPayload.Id,
+			IPAddress:      ipAddress,
+		})
+	}
+	if err != nil {
+		go os.Remove(fileName)
+		if ok, _ := utils.IsErrDuplicate(err); ok {
+			return utils.JsonErrorResponse(c, fiber.StatusConflict, "A batch with the same reference already exists")
 		}
-		fmt.Println("Batch preparing completed:", bCount, ", at: ", time.Now().Format("2006-01-02 15:04:05"), ", Took time:", time.Since(startTime))
-	} else if ext == ".xlsx" || ext == ".xls" {
-		//open file
-		xlFile, err := excelize.OpenFile(fileName)
-		if err != nil {
-			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to open file", utils.Logger{
-				LogLevel:    utils.CRITICAL,
-				Message:     "UploadCodes: Unable to open file, error: " + err.Error(),
-				ServiceName: config.ServiceName,
-			})
-		}
-		rows, err := xlFile.GetRows("Sheet1")
-		if err != nil {
-			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to read file", utils.Logger{
-				LogLevel:    utils.CRITICAL,
-				Message:     "UploadCodes: Unable to read file, error: " + err.Error(),
-				ServiceName: config.ServiceName,
-			})
-		}
-		//validate file data
-
-		for i, row := range rows {
-			if i == 0 {
-				continue
-			}
-			if len(row) != 1 {
-				return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Invalid file format, each row should contain only one code")
-			}
-			if bCount%20000 == 0 && bCount != 0 {
-				batches = append(batches, codes)
-				codes = []model.Code{}
-			}
-			if len(row[0]) == 0 {
-				skippedLines++
-				continue
-			}
-			bCount++
-			if skippedLines > 3 {
-				break
-			}
-			line := strings.TrimSpace(row[0])
-			if len(line) == 10 {
-				codes = append(codes, model.Code{Code: line})
-			} else {
-				return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Invalid code length, code should be 10 digits. code: "+line)
-			}
-		}
-		if len(codes) > 0 {
-			batches = append(batches, codes)
-		}
-		fmt.Println("Batch preparing using excel file completed:", bCount, ", at: ", time.Now().Format("2006-01-02 15:04:05"), ", Took time:", time.Since(startTime))
-	} else {
-		return c.Status(fiber.StatusUnsupportedMediaType).SendString("Unsupported file type")
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to create code batch", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "UploadCodes: Unable to create code batch, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
 	}
-	//run upload process in background and notify user via SMS
-	ipAddress := c.IP()
-	webAgent := c.Get("User-Agent")
-	go func() {
-		//insert codes
-		tx, err := config.DB.Begin(ctx)
-		if err != nil {
-			//send sms notification on error
-			traceId := utils.LogMessage("error", "UploadCodes: Unable to start transaction, error: "+err.Error(), config.ServiceName)
-			go utils.SendSMS(config.DB, userPayload.Phone, "Codes uploaded failed, Unable to start transaction, error code: "+traceId,
-				viper.GetString("SENDER_ID"), config.ServiceName, "upload_codes", nil, config.Redis)
-			return
-		}
-		defer func() {
-			if err != nil {
-				tx.Rollback(ctx)
-			} else {
-				tx.Commit(ctx)
-			}
-		}()
-		rowsAffected := 0
-		for _, batch := range batches {
-			// Prepare the values and placeholders
-			valueStrings := make([]string, 0, len(batch))
-			valueArgs := make([]interface{}, 0, len(batch)*3)
-			for _, code := range batch {
-				code.Code = strings.ToUpper(code.Code)
-				valueStrings = append(valueStrings, fmt.Sprintf("(pgp_sym_encrypt($%d, $%d), digest($%d, 'sha256'), 'unused')",
-					len(valueArgs)+1,
-					len(valueArgs)+2,
-					len(valueArgs)+1))
-
-				valueArgs = append(valueArgs, code.Code, config.EncryptionKey)
-			}
-			// Construct the full SQL query
-			query := fmt.Sprintf("INSERT INTO codes (code, code_hash, status) VALUES %s",
-				strings.Join(valueStrings, ", "))
-			// Execute the multi-value insert
-			cmdTag, err := tx.Exec(context.Background(), query, valueArgs...)
-			if err != nil {
-				if ok, _ := utils.IsErrDuplicate(err); ok {
-					err = errors.New("some codes already exist")
-				} else {
-					traceId := utils.LogMessage("error", "UploadCodes: Unable to insert codes, error: "+err.Error(), config.ServiceName)
-					err = errors.New("Unable to insert codes, error code: " + traceId)
-				}
-			}
-			if err != nil {
-				//send sms notification on error
-				go utils.SendSMS(config.DB, userPayload.Phone, fmt.Sprintf("Codes uploaded failed, %s", err.Error()),
-					viper.GetString("SENDER_ID"), config.ServiceName, "upload_codes", nil, config.Redis)
-				return
-			}
-			rowsAffected += int(cmdTag.RowsAffected())
-			fmt.Println("Batch item completed affected rows:", rowsAffected, ", at: ", time.Now().Format("2006-01-02 15:04:05"))
-		}
-		_, err = config.DB.Exec(ctx, "REFRESH MATERIALIZED VIEW codes_count;")
-		if err != nil {
-			utils.LogMessage("error", "UploadCodes: Unable to refresh codes_count, error: "+err.Error(), config.ServiceName)
-			err = nil
-		}
-		fmt.Println("Upload completed, ", "Total rows:", bCount, "affected rows:", rowsAffected, ", at: ", time.Now().Format("2006-01-02 15:04:05"), ", Took time:", time.Since(startTime))
-		//send sms notification
-		go utils.SendSMS(config.DB, userPayload.Phone, fmt.Sprintf("Codes uploaded successfully, total: %d, time taken: %v", rowsAffected, time.Since(startTime)), viper.GetString("SENDER_ID"), config.ServiceName, "upload_codes", nil, config.Redis)
-		utils.RecordActivityLog(config.DB,
-			utils.ActivityLog{
-				UserID:       userPayload.Id,
-				ActivityType: "uploadCodes",
-				Description:  "Upload codes, total: " + fmt.Sprintf("%v", rowsAffected),
-				Status:       "success",
-				IPAddress:    ipAddress,
-				UserAgent:    webAgent,
-			},
-			config.ServiceName,
-			nil,
-		)
-		//remove file
-		go os.Remove(fileName)
-	}()
-	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": fmt.Sprintf("%v Codes will be uploaded in background and we will send you an SMS", bCount), "count": bCount})
-}
-func GetLogs(c *fiber.Ctx) error {
-	userPayload, err := utils.SecurePath(c, config.Redis)
+	var jobId int
+	err = config.DB.QueryRow(ctx, `insert into code_import_job (batch_id,file_path,file_name,operator_id) values ($1,$2,$3,$4) returning id`,
+		batchId, fileName, file.Filename, userPayload.Id).Scan(&jobId)
 	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
-	if !userPayload.CanViewLogs {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, "You don't have permission to view logs")
+		failCodeBatch(batchId, "Unable to create import job")
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to create import job", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "UploadCodes: Unable to create import job, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
 	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "uploadCodes",
+			Description:  "Upload codes file " + file.Filename,
+			Status:       "success",
+			IPAddress:    ipAddress,
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"batch_id":  batchId,
+			"job_id":    jobId,
+			"reference": formData.BatchReference,
+			"product":   formData.Product,
+		},
+	)
+	go runCodeImportJob(jobId)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Codes will be imported in background and we will send you an SMS", "batch_id": batchId, "job_id": jobId})
+}
+func GetLogs(c *fiber.Ctx) error {
 	startDateStr := c.Query("start_date")
 	endDateStr := c.Query("end_date")
 	userId := c.Query("user_id")
@@ -2325,7 +2489,7 @@ func GetLogs(c *fiber.Ctx) error {
 	}
 	offSet := (page - 1) * limit
 
-	err = utils.ValidateDateRanges(startDateStr, &endDateStr)
+	err := utils.ValidateDateRanges(startDateStr, &endDateStr)
 	if err != nil {
 		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, err.Error())
 	}
@@ -2436,91 +2600,23 @@ func DistributeMomoPrize() {
 			utils.LogMessage(string(utils.CRITICAL), "DistributeMomoPrize: Unable to scan pending momo transactions, error: "+err.Error(), config.ServiceName)
 			continue
 		}
-		//check first if there is no transaction_records with status=SUCCESS
-		var trxRecordId int
-		err = config.DB.QueryRow(ctx, `select id from transaction_records where transaction_id=$1 and status='SUCCESS'`, transaction.Id).Scan(&trxRecordId)
-		if err == nil {
-			//update transaction status to FAILED
-			_, err = config.DB.Exec(ctx, `UPDATE transaction SET status = 'SUCCESS', error_message = 'Duplicate transaction' WHERE id = $1;`, transaction.Id)
-			if err != nil {
-				utils.LogMessage(string(utils.CRITICAL), "DistributeMomoPrize: Unable to update momo transaction status, error: "+err.Error(), config.ServiceName)
-			}
-			continue
-		}
-		refNo := ""
-		//create new transaction_record
-		var trxRecordCount int
-		newTrxid := transaction.TrxId
-		err = config.DB.QueryRow(ctx, `select count(id) from transaction_records where transaction_id=$1`, transaction.Id).Scan(&trxRecordCount)
+		//the row stays locked while it is paid so it can not be settled manually at the same time, rows being settled are skipped
+		tx, err := config.DB.Begin(ctx)
 		if err != nil {
-			utils.LogMessage(string(utils.CRITICAL), "DistributeMomoPrize: Unable to fetch transaction_records count, error: "+err.Error(), config.ServiceName)
-		}
-		previousTrxId := newTrxid
-		if trxRecordCount == 1 {
-			newTrxid = newTrxid + "R1"
-		} else if trxRecordCount > 1 {
-			// previousTrxId = fmt.Sprintf("%s%d", newTrxid[:len(newTrxid)-1], (trxRecordCount - 1))
-			previousTrxId = fmt.Sprintf("%sR%d", newTrxid, (trxRecordCount - 1))
-			newTrxid = fmt.Sprintf("%sR%d", newTrxid, trxRecordCount)
-		}
-		fmt.Println("New trxId: ", newTrxid)
-		fmt.Println("Previous trxId: ", previousTrxId)
-		//check  status for previous transaction
-		var statusErr error
-		var statusRefNo string
-		if transaction.Mno == "MTN" {
-			statusRefNo, statusErr = utils.MoMoCheckStatus(previousTrxId)
-
-		} else if transaction.Mno == "AIRTEL" {
-			statusRefNo, statusErr = utils.AirtelCheckStatus(previousTrxId, *config.Redis)
-		}
-		if statusErr == nil {
-			//transaction already completed
-			_, err = config.DB.Exec(ctx, `UPDATE transaction SET status = 'SUCCESS', ref_no = $1 WHERE id = $2;`, statusRefNo, transaction.Id)
-			if err != nil {
-				utils.LogMessage(string(utils.CRITICAL), "DistributeMomoPrize: Unable to update momo transaction status, error: "+err.Error(), config.ServiceName)
-			}
-			utils.LogMessage(string(utils.CRITICAL), "DistributeMomoPrize: Unable to check  transaction status already success, newTrxid: "+newTrxid+", previousTrxId:"+previousTrxId, config.ServiceName)
+			utils.LogMessage(string(utils.CRITICAL), "DistributeMomoPrize: Unable to start transaction, error: "+err.Error(), config.ServiceName)
 			continue
-		} else {
-			utils.LogMessage(string(utils.CRITICAL), "DistributeMomoPrize: Unable to check momo transaction status, error: "+statusErr.Error(), config.ServiceName)
 		}
-		var newTrxRecordId int
-		err := config.DB.QueryRow(ctx, `insert into transaction_records (transaction_id, trx_id,amount,phone,transaction_type,mno,status) values ($1, $2, $3, $4, $5, $6, 'PENDING') returning id`,
-			transaction.Id, newTrxid, transaction.Amount, transaction.Phone, "CREDIT", transaction.Mno).Scan(&newTrxRecordId)
+		err = tx.QueryRow(ctx, `select id from transaction where id=$1 and status='PENDING' for no key update skip locked`, transaction.Id).Scan(&transaction.Id)
 		if err != nil {
-			utils.LogMessage(string(utils.CRITICAL), "DistributeMomoPrize: Unable to create new transaction_record, error: "+err.Error(), config.ServiceName)
+			if !errors.Is(err, pgx.ErrNoRows) {
+				utils.LogMessage(string(utils.CRITICAL), "DistributeMomoPrize: Unable to lock pending momo transaction, error: "+err.Error(), config.ServiceName)
+			}
+			tx.Rollback(ctx)
 			continue
 		}
-		if transaction.Mno == "MTN" {
-			refNo, err = utils.MoMoCredit(transaction.Amount, transaction.Phone, newTrxid, transaction.Code)
-		} else if transaction.Mno == "AIRTEL" {
-			refNo, err = utils.AirtelCredit(transaction.Amount, transaction.Phone, newTrxid, transaction.Code, *config.Redis)
-		} else {
-			err = errors.New("invalid network operator")
-		}
-		//TODO: add other network operators (Airtel)
-		if err != nil {
-			//update transaction status and error_message
-			err1 := err.Error()
-			_, err = config.DB.Exec(ctx, `UPDATE transaction SET status = 'FAILED', error_message = $1 WHERE id = $2;`, err1, transaction.Id)
-			if err != nil {
-				utils.LogMessage(string(utils.CRITICAL), "DistributeMomoPrize: Unable to update momo transaction status, error: "+err.Error(), config.ServiceName)
-			}
-			_, err = config.DB.Exec(ctx, `UPDATE transaction_records SET status = 'FAILED', error_message = $1 WHERE id = $2;`, err1, newTrxRecordId)
-			if err != nil {
-				utils.LogMessage(string(utils.CRITICAL), "DistributeMomoPrize: Unable to update FAILED momo transaction_records status, error: "+err.Error(), config.ServiceName)
-			}
-		} else {
-			//update transaction status and ref_no
-			_, err = config.DB.Exec(ctx, `UPDATE transaction SET status = 'SUCCESS', ref_no = $1 WHERE id = $2;`, refNo, transaction.Id)
-			if err != nil {
-				utils.LogMessage(string(utils.CRITICAL), "DistributeMomoPrize: Unable to update momo transaction status, error: "+err.Error(), config.ServiceName)
-			}
-			_, err = config.DB.Exec(ctx, `UPDATE transaction_records SET status = 'SUCCESS', ref_no = $1 WHERE id = $2;`, refNo, newTrxRecordId)
-			if err != nil {
-				utils.LogMessage(string(utils.CRITICAL), "DistributeMomoPrize: Unable to update SUCCESS momo transaction_records status, error: "+err.Error(), config.ServiceName)
-			}
+		payMomoTransaction(tx, transaction)
+		if err = tx.Commit(ctx); err != nil {
+			utils.LogMessage(string(utils.CRITICAL), "DistributeMomoPrize: Unable to save momo transaction status, error: "+err.Error(), config.ServiceName)
 		}
 	}
 	// fmt.Println("Distributing momo prize end, rows affected: ", a)
@@ -2528,11 +2624,97 @@ func DistributeMomoPrize() {
 	time.Sleep(60 * time.Second)
 	DistributeMomoPrize()
 }
-func GetSMSBalance(c *fiber.Ctx) error {
-	_, err := utils.SecurePath(c, config.Redis)
+
+// payMomoTransaction send the prize of a pending transaction locked by tx, the transaction status is saved in tx
+func payMomoTransaction(tx pgx.Tx, transaction model.Transactions) {
+	//check first if there is no transaction_records with status=SUCCESS
+	var trxRecordId int
+	err := config.DB.QueryRow(ctx, `select id from transaction_records where transaction_id=$1 and status='SUCCESS' and transaction_type='CREDIT'`, transaction.Id).Scan(&trxRecordId)
+	if err == nil {
+		//update transaction status to FAILED
+		_, err = tx.Exec(ctx, `UPDATE transaction SET status = 'SUCCESS', error_message = 'Duplicate transaction' WHERE id = $1;`, transaction.Id)
+		if err != nil {
+			utils.LogMessage(string(utils.CRITICAL), "DistributeMomoPrize: Unable to update momo transaction status, error: "+err.Error(), config.ServiceName)
+		}
+		return
+	}
+	refNo := ""
+	//create new transaction_record
+	var trxRecordCount int
+	newTrxid := transaction.TrxId
+	err = config.DB.QueryRow(ctx, `select count(id) from transaction_records where transaction_id=$1 and transaction_type='CREDIT'`, transaction.Id).Scan(&trxRecordCount)
+	if err != nil {
+		utils.LogMessage(string(utils.CRITICAL), "DistributeMomoPrize: Unable to fetch transaction_records count, error: "+err.Error(), config.ServiceName)
+	}
+	previousTrxId := newTrxid
+	if trxRecordCount == 1 {
+		newTrxid = newTrxid + "R1"
+	} else if trxRecordCount > 1 {
+		// previousTrxId = fmt.Sprintf("%s%d", newTrxid[:len(newTrxid)-1], (trxRecordCount - 1))
+		previousTrxId = fmt.Sprintf("%sR%d", newTrxid, (trxRecordCount - 1))
+		newTrxid = fmt.Sprintf("%sR%d", newTrxid, trxRecordCount)
+	}
+	fmt.Println("New trxId: ", newTrxid)
+	fmt.Println("Previous trxId: ", previousTrxId)
+	//check  status for previous transaction
+	var statusErr error
+	var statusRefNo string
+	if transaction.Mno == "MTN" {
+		statusRefNo, statusErr = utils.MoMoCheckStatus(previousTrxId)
+
+	} else if transaction.Mno == "AIRTEL" {
+		statusRefNo, statusErr = utils.AirtelCheckStatus(previousTrxId, *config.Redis)
+	}
+	if statusErr == nil {
+		//transaction already completed
+		_, err = tx.Exec(ctx, `UPDATE transaction SET status = 'SUCCESS', ref_no = $1 WHERE id = $2;`, statusRefNo, transaction.Id)
+		if err != nil {
+			utils.LogMessage(string(utils.CRITICAL), "DistributeMomoPrize: Unable to update momo transaction status, error: "+err.Error(), config.ServiceName)
+		}
+		utils.LogMessage(string(utils.CRITICAL), "DistributeMomoPrize: Unable to check  transaction status already success, newTrxid: "+newTrxid+", previousTrxId:"+previousTrxId, config.ServiceName)
+		return
+	} else {
+		utils.LogMessage(string(utils.CRITICAL), "DistributeMomoPrize: Unable to check momo transaction status, error: "+statusErr.Error(), config.ServiceName)
+	}
+	var newTrxRecordId int
+	err = config.DB.QueryRow(ctx, `insert into transaction_records (transaction_id, trx_id,amount,phone,transaction_type,mno,status) values ($1, $2, $3, $4, $5, $6, 'PENDING') returning id`,
+		transaction.Id, newTrxid, transaction.Amount, transaction.Phone, "CREDIT", transaction.Mno).Scan(&newTrxRecordId)
 	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
+		utils.LogMessage(string(utils.CRITICAL), "DistributeMomoPrize: Unable to create new transaction_record, error: "+err.Error(), config.ServiceName)
+		return
+	}
+	if transaction.Mno == "MTN" {
+		refNo, err = utils.MoMoCredit(transaction.Amount, transaction.Phone, newTrxid, transaction.Code)
+	} else if transaction.Mno == "AIRTEL" {
+		refNo, err = utils.AirtelCredit(transaction.Amount, transaction.Phone, newTrxid, transaction.Code, *config.Redis)
+	} else {
+		err = errors.New("invalid network operator")
 	}
+	//TODO: add other network operators (Airtel)
+	if err != nil {
+		//update transaction status and error_message
+		err1 := err.Error()
+		_, err = tx.Exec(ctx, `UPDATE transaction SET status = 'FAILED', error_message = $1 WHERE id = $2;`, err1, transaction.Id)
+		if err != nil {
+			utils.LogMessage(string(utils.CRITICAL), "DistributeMomoPrize: Unable to update momo transaction status, error: "+err.Error(), config.ServiceName)
+		}
+		_, err = config.DB.Exec(ctx, `UPDATE transaction_records SET status = 'FAILED', error_message = $1 WHERE id = $2;`, err1, newTrxRecordId)
+		if err != nil {
+			utils.LogMessage(string(utils.CRITICAL), "DistributeMomoPrize: Unable to update FAILED momo transaction_records status, error: "+err.Error(), config.ServiceName)
+		}
+	} else {
+		//update transaction status and ref_no
+		_, err = tx.Exec(ctx, `UPDATE transaction SET status = 'SUCCESS', ref_no = $1 WHERE id = $2;`, refNo, transaction.Id)
+		if err != nil {
+			utils.LogMessage(string(utils.CRITICAL), "DistributeMomoPrize: Unable to update momo transaction status, error: "+err.Error(), config.ServiceName)
+		}
+		_, err = config.DB.Exec(ctx, `UPDATE transaction_records SET status = 'SUCCESS', ref_no = $1 WHERE id = $2;`, refNo, newTrxRecordId)
+		if err != nil {
+			utils.LogMessage(string(utils.CRITICAL), "DistributeMomoPrize: Unable to update SUCCESS momo transaction_records status, error: "+err.Error(), config.ServiceName)
+		}
+	}
+}
+func GetSMSBalance(c *fiber.Ctx) error {
 	smsBalance, err := utils.SMSBalance(config.DB, config.ServiceName, config.Redis)
 	if err != nil {
 		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to get sms balance", utils.Logger{
@@ -2544,13 +2726,7 @@ func GetSMSBalance(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "balance": smsBalance})
 }
 func ChangeUserStatus(c *fiber.Ctx) error {
-	userPayload, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
-	if !userPayload.CanAddUser {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, "You don't have permission to update user info")
-	}
+	userPayload := CurrentUser(c)
 	userId, err := c.ParamsInt("userId")
 	if err != nil {
 		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Invalid user id provided")
@@ -2611,13 +2787,12 @@ func ChangeUserStatus(c *fiber.Ctx) error {
 			"status":  formData.Status,
 		},
 	)
+	if formData.Status == "DISABLED" {
+		revokeSessions(c, userId, "user account disabled")
+	}
 	return c.JSON(fiber.Map{"status": responseStatus, "message": "Account of " + fname + " " + action + "d successfully"})
 }
 func GetProvinces(c *fiber.Ctx) error {
-	_, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
 	provinces := []model.Province{}
 	rows, err := config.DB.Query(ctx,
 		`select id,name,created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali' from province`)
@@ -2646,10 +2821,6 @@ func GetProvinces(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": provinces})
 }
 func GetTransactions(c *fiber.Ctx) error {
-	_, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
 	startDateStr := c.Query("start_date")
 	endDateStr := c.Query("end_date")
 	phone := c.Query("phone")
@@ -2658,6 +2829,8 @@ func GetTransactions(c *fiber.Ctx) error {
 	status := c.Query("status")
 	//(optional), excel/pdf. if it is set system will not implement pagination
 	export := c.Query("export")
+	//(optional), the excel export is emailed to the user instead of downloaded
+	sendEmail := c.QueryBool("send_email")
 	//add pagination
 	page := c.QueryInt("page", 1)
 	limit := c.QueryInt("limit", 20)
@@ -2668,7 +2841,7 @@ func GetTransactions(c *fiber.Ctx) error {
 	if status == "COMPLETED" {
 		status = "SUCCESS"
 	}
-	err = utils.ValidateDateRanges(startDateStr, &endDateStr)
+	err := utils.ValidateDateRanges(startDateStr, &endDateStr)
 	if err != nil {
 		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, err.Error())
 	}
@@ -2701,8 +2874,12 @@ func GetTransactions(c *fiber.Ctx) error {
 	transactions := []model.Transactions{}
 	rows, err := config.DB.Query(ctx,
 		`select t.id,t.amount,t.phone,t.mno,coalesce(tr.trx_id,t.trx_id) as trx_id,t.ref_no,t.transaction_type,t.status,CASE WHEN t.status='SUCCESS' THEN '' ELSE t.error_message END as error_message,
-		t.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',p.entry_id,p.code,t.customer_id,t.initiated_by,t.updated_at,p.id as prize_id,pt.name from transaction t
-		inner join prize p on p.id = t.prize_id LEFT JOIN prize_type pt ON p.prize_type_id=pt.id LEFT JOIN (select max(id) as id,max(trx_id) as trx_id,transaction_id from transaction_records group by transaction_id) tr ON tr.transaction_id = t.id `+logsFilter+` order by t.created_at desc`+limitStr, args1...)
+		t.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',p.entry_id,p.code,t.customer_id,t.initiated_by,t.updated_at,p.id as prize_id,pt.name,
+		ts.settlement_type,ts.reference,rv.trx_id from transaction t
+		inner join prize p on p.id = t.prize_id LEFT JOIN prize_type pt ON p.prize_type_id=pt.id
+		LEFT JOIN (select max(id) as id,max(trx_id) as trx_id,transaction_id from transaction_records where transaction_type='CREDIT' group by transaction_id) tr ON tr.transaction_id = t.id
+		LEFT JOIN LATERAL (select settlement_type,reference,transaction_record_id from transaction_settlement s where s.transaction_id = t.id order by s.id desc limit 1) ts ON true
+		LEFT JOIN transaction_records rv ON rv.id = ts.transaction_record_id `+logsFilter+` order by t.created_at desc`+limitStr, args1...)
 	if err != nil {
 		if !errors.Is(err, pgx.ErrNoRows) {
 			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get transaction data failed", utils.Logger{
@@ -2717,7 +2894,8 @@ func GetTransactions(c *fiber.Ctx) error {
 		transaction := model.Transactions{}
 		err = rows.Scan(&transaction.Id, &transaction.Amount, &transaction.Phone, &transaction.Mno, &transaction.TrxId, &transaction.RefNo, &transaction.TransactionType,
 			&transaction.Status, &transaction.ErrorMessage, &transaction.CreatedAt, &transaction.EntryId, &transaction.Code, &transaction.CustomerId,
-			&transaction.InitiatedBy, &transaction.UpdatedAt, &transaction.PrizeId, &transaction.PrizeType)
+			&transaction.InitiatedBy, &transaction.UpdatedAt, &transaction.PrizeId, &transaction.PrizeType,
+			&transaction.SettlementType, &transaction.SettlementRef, &transaction.ReversalTrxId)
 		if err != nil {
 			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get transaction data failed", utils.Logger{
 				LogLevel:    utils.CRITICAL,
@@ -2753,6 +2931,9 @@ func GetTransactions(c *fiber.Ctx) error {
 				ServiceName: config.ServiceName,
 			})
 		}
+		if sendEmail {
+			return emailExport(c, "Transactions export", fileName, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", rawData)
+		}
 		c.Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
 		c.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, fileName))
 		return c.Send(rawData)
@@ -2761,44 +2942,12 @@ func GetTransactions(c *fiber.Ctx) error {
 		"pagination": fiber.Map{"page": page, "limit": limit, "total": totalTransaction}})
 }
 func ConfirmTransaction(c *fiber.Ctx) error {
-	userPayload, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
+	userPayload := CurrentUser(c)
 	transactionId, err := c.ParamsInt("transaction_id")
 	if err != nil || transactionId < 1 {
 		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid transaction id provided")
 	}
 	responseStatus := 200
-	type FormData struct {
-		Password string `json:"password" binding:"required" validate:"required"`
-	}
-	formData := new(FormData)
-	if err := c.BodyParser(formData); err != nil {
-		responseStatus = 400
-		c.SendStatus(responseStatus)
-		return c.JSON(fiber.Map{"status": responseStatus, "message": "Please provide all required data", "details": err})
-	}
-	if err := Validate.Struct(formData); err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Provided data are not valid")
-	}
-	//check if password is correct
-	var fname, lname, userStatus string
-	err = config.DB.QueryRow(ctx,
-		`select u.fname,u.lname,u.status from users u  where id = $1 and password = crypt($2, password)`, userPayload.Id, formData.Password).
-		Scan(&fname, &lname, &userStatus)
-	if err != nil {
-		if !errors.Is(err, pgx.ErrNoRows) {
-			utils.LogMessage("critical", fmt.Sprintf("ConfirmTransaction: Unable to get user data for password verify, Email:%s, err:%v", userPayload.Email, err), "web-service")
-		}
-		responseStatus = 401
-		c.SendStatus(responseStatus)
-		return c.JSON(fiber.Map{"status": responseStatus, "message": "Invalid credentials"})
-	} else if userStatus != "OKAY" {
-		responseStatus = 401
-		c.SendStatus(responseStatus)
-		return c.JSON(fiber.Map{"status": responseStatus, "message": "Your account has been deactivated"})
-	}
 	//get existing status
 	var status, phone, trxId, prizeCode string
 	var refNo *string
@@ -2818,41 +2967,73 @@ func ConfirmTransaction(c *fiber.Ctx) error {
 	if status != "WAITING" {
 		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Transaction status is already confirmed, refresh your page")
 	}
-	_, err = config.DB.Exec(ctx, `update transaction set status=$1 where id=$2`, "PENDING", transactionId)
+	department, err := getApproverDepartment(userPayload.Id)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to confirm transaction", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ConfirmTransaction: Unable to get approver department, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to confirm transaction", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ConfirmTransaction: Unable to start transaction confirmation, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			tx.Commit(ctx)
+		}
+	}()
+	confirmed, approvals, requiredApprovals, err := approveTransaction(tx, transactionId, userPayload.Id, department, c.IP(), c.Get("User-Agent"))
 	if err != nil {
+		if errors.Is(err, errTransactionNotWaiting) || errors.Is(err, errAlreadyApproved) || errors.Is(err, errFinanceApprovalOnly) ||
+			errors.Is(err, errClaimNotVerified) || errors.Is(err, errCustomerInReview) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, err.Error())
+		}
 		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to confirm transaction", utils.Logger{
 			LogLevel:    utils.CRITICAL,
 			Message:     "ConfirmTransaction: Unable to confirm transaction, error: " + err.Error(),
 			ServiceName: config.ServiceName,
 		})
 	}
+	newStatus := "WAITING"
+	if confirmed {
+		newStatus = "PENDING"
+	}
 	utils.RecordActivityLog(config.DB,
 		utils.ActivityLog{
 			UserID:       userPayload.Id,
 			ActivityType: "confirmTransaction",
-			Description:  "confirm transaction of" + phone + ", TrxId: " + trxId + ", Prize: " + prizeCode,
+			Description:  fmt.Sprintf("approve transaction of %s, TrxId: %s, Prize: %s, Approval: %d/%d", phone, trxId, prizeCode, approvals, requiredApprovals),
 			Status:       "success",
 			IPAddress:    c.IP(),
 			UserAgent:    c.Get("User-Agent"),
 		},
 		config.ServiceName,
 		&map[string]interface{}{
-			"transaction_id": transactionId,
-			"status":         "WAITING",
+			"transaction_id":     transactionId,
+			"status":             newStatus,
+			"approvals":          approvals,
+			"required_approvals": requiredApprovals,
 		},
 	)
+	if !confirmed {
+		return c.JSON(fiber.Map{"status": responseStatus, "message": fmt.Sprintf("Transaction of %s approved (%d/%d), waiting for another approver", prizeCode, approvals, requiredApprovals)})
+	}
 	return c.JSON(fiber.Map{"status": responseStatus, "message": fmt.Sprintf("Transaction of %s confirmed successfully", prizeCode)})
 }
 
 // confirmBulkTransaction which has WAITING status to PENDING
 func ConfirmBulkTransaction(c *fiber.Ctx) error {
-	userPayload, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
+	userPayload := CurrentUser(c)
 	type FormData struct {
-		TransactionIds []int  `json:"transaction_ids" binding:"required" validate:"required"`
-		Password       string `json:"password" binding:"required" validate:"required"`
+		TransactionIds []int `json:"transaction_ids" binding:"required" validate:"required"`
 	}
 	responseStatus := 200
 	formData := new(FormData)
@@ -2864,23 +3045,7 @@ func ConfirmBulkTransaction(c *fiber.Ctx) error {
 	if err := Validate.Struct(formData); err != nil {
 		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Provided data are not valid")
 	}
-	//check if password is correct
-	var fname, lname, userStatus string
-	err = config.DB.QueryRow(ctx,
-		`select u.fname,u.lname,u.status from users u  where id = $1 and password = crypt($2, password)`, userPayload.Id, formData.Password).
-		Scan(&fname, &lname, &userStatus)
-	if err != nil {
-		if !errors.Is(err, pgx.ErrNoRows) {
-			utils.LogMessage("critical", fmt.Sprintf("ConfirmBulkTransaction: Unable to get user data for password verify, Email:%s, err:%v", userPayload.Email, err), "web-service")
-		}
-		responseStatus = 401
-		c.SendStatus(responseStatus)
-		return c.JSON(fiber.Map{"status": responseStatus, "message": "Invalid credentials"})
-	} else if userStatus != "OKAY" {
-		responseStatus = 401
-		c.SendStatus(responseStatus)
-		return c.JSON(fiber.Map{"status": responseStatus, "message": "Your account has been deactivated"})
-	}
+	var err error
 	//get existing status
 	prizeCodes := []string{}
 	var status, phone, trxId, prizeCode string
@@ -2904,6 +3069,14 @@ func ConfirmBulkTransaction(c *fiber.Ctx) error {
 			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "One of the transaction status is already confirmed, refresh your page #"+prizeCode)
 		}
 	}
+	department, err := getApproverDepartment(userPayload.Id)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to confirm transaction", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ConfirmBulkTransaction: Unable to get approver department, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
 	tx, err := config.DB.Begin(ctx)
 	if err != nil {
 		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to start transactions confirmation", utils.Logger{
@@ -2919,86 +3092,73 @@ func ConfirmBulkTransaction(c *fiber.Ctx) error {
 			tx.Commit(ctx)
 		}
 	}()
-	for _, transaction := range formData.TransactionIds {
-		_, err = tx.Exec(ctx, `update transaction set status=$1 where id=$2`, "PENDING", transaction)
+	confirmedIds := []int{}
+	awaitingIds := []int{}
+	for i, transaction := range formData.TransactionIds {
+		var confirmed bool
+		confirmed, _, _, err = approveTransaction(tx, transaction, userPayload.Id, department, c.IP(), c.Get("User-Agent"))
 		if err != nil {
+			if errors.Is(err, errTransactionNotWaiting) || errors.Is(err, errAlreadyApproved) || errors.Is(err, errFinanceApprovalOnly) ||
+				errors.Is(err, errClaimNotVerified) || errors.Is(err, errCustomerInReview) {
+				return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, fmt.Sprintf("%s #%s", err.Error(), prizeCodes[i]))
+			}
 			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to confirm transaction", utils.Logger{
 				LogLevel:    utils.CRITICAL,
 				Message:     "ConfirmBulkTransaction: Unable to confirm transaction, error: " + err.Error(),
 				ServiceName: config.ServiceName,
 			})
 		}
+		if confirmed {
+			confirmedIds = append(confirmedIds, transaction)
+		} else {
+			awaitingIds = append(awaitingIds, transaction)
+		}
 	}
 	utils.RecordActivityLog(config.DB,
 		utils.ActivityLog{
 			UserID:       userPayload.Id,
 			ActivityType: "confirmBulkTransaction",
-			Description:  fmt.Sprintf("confirm bulk transaction, Count:%d, Codes: %s", len(prizeCodes), strings.Join(prizeCodes, ",")),
+			Description:  fmt.Sprintf("approve bulk transaction, Count:%d, Confirmed:%d, Codes: %s", len(prizeCodes), len(confirmedIds), strings.Join(prizeCodes, ",")),
 			Status:       "success",
 			IPAddress:    c.IP(),
 			UserAgent:    c.Get("User-Agent"),
 		},
 		config.ServiceName,
 		&map[string]interface{}{
-			"transaction_ids": formData.TransactionIds,
-			"status":          "PENDING",
+			"transaction_ids":   formData.TransactionIds,
+			"confirmed_ids":     confirmedIds,
+			"awaiting_approval": awaitingIds,
+			"status":            "PENDING",
 		},
 	)
+	if len(awaitingIds) != 0 {
+		return c.JSON(fiber.Map{"status": responseStatus, "message": fmt.Sprintf("%d transaction(s) confirmed, %d waiting for another approver", len(confirmedIds), len(awaitingIds)),
+			"data": fiber.Map{"confirmed": confirmedIds, "awaiting_approval": awaitingIds}})
+	}
 	return c.JSON(fiber.Map{"status": responseStatus, "message": fmt.Sprintf("Transaction of %s confirmed successfully", prizeCode)})
 }
 
 func TestSMS(c *fiber.Ctx) error {
 	//get all sms
 	phone := c.Params("phone")
-	messageId, err := utils.SendSMS(config.DB, phone, "Hey, this is a test message from SMPP MTN", viper.GetString("SENDER_ID"), config.ServiceName, "test_sms", nil, config.Redis)
+	smsId, err := utils.QueueTemplateSMS(config.DB, "test_sms", utils.SMSTemplateDefaultLang(), map[string]any{"AppName": viper.GetString("ap_name")},
+		phone, viper.GetString("SENDER_ID"), "test_sms", nil)
 	if err != nil {
 		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to send sms", utils.Logger{
 			LogLevel:    utils.CRITICAL,
-			Message:     "TestSMS: Unable to send sms, error: " + err.Error(),
+			Message:     "TestSMS: Unable to queue sms, error: " + err.Error(),
 			ServiceName: config.ServiceName,
 		})
 	}
-	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "SMS sent", "message_id": messageId})
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "SMS queued", "sms_id": smsId})
 }
 func ResendTransaction(c *fiber.Ctx) error {
-	userPayload, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
+	userPayload := CurrentUser(c)
 	transactionId, err := c.ParamsInt("transaction_id")
 	if err != nil || transactionId < 1 {
 		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid transaction id provided")
 	}
 	responseStatus := 200
-	type FormData struct {
-		Password string `json:"password" binding:"required" validate:"required"`
-	}
-	formData := new(FormData)
-	if err := c.BodyParser(formData); err != nil {
-		responseStatus = 400
-		c.SendStatus(responseStatus)
-		return c.JSON(fiber.Map{"status": responseStatus, "message": "Please provide all required data", "details": err})
-	}
-	if err := Validate.Struct(formData); err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Provided data are not valid")
-	}
-	//check if password is correct
-	var fname, lname, userStatus string
-	err = config.DB.QueryRow(ctx,
-		`select u.fname,u.lname,u.status from users u  where id = $1 and password = crypt($2, password)`, userPayload.Id, formData.Password).
-		Scan(&fname, &lname, &userStatus)
-	if err != nil {
-		if !errors.Is(err, pgx.ErrNoRows) {
-			utils.LogMessage("critical", fmt.Sprintf("ConfirmTransaction: Unable to get user data for password verify, Email:%s, err:%v", userPayload.Email, err), "web-service")
-		}
-		responseStatus = 401
-		c.SendStatus(responseStatus)
-		return c.JSON(fiber.Map{"status": responseStatus, "message": "Invalid credentials"})
-	} else if userStatus != "OKAY" {
-		responseStatus = 401
-		c.SendStatus(responseStatus)
-		return c.JSON(fiber.Map{"status": responseStatus, "message": "Your account has been deactivated"})
-	}
 	//get existing status
 	var status, phone, trxId, prizeCode string
 	var refNo *string
@@ -3044,13 +3204,9 @@ func ResendTransaction(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"status": responseStatus, "message": fmt.Sprintf("Transaction of %s confirmed successfully", prizeCode)})
 }
 func ResendBulkTransaction(c *fiber.Ctx) error {
-	userPayload, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
+	userPayload := CurrentUser(c)
 	type FormData struct {
-		TransactionIds []int  `json:"transaction_ids" binding:"required" validate:"required"`
-		Password       string `json:"password" binding:"required" validate:"required"`
+		TransactionIds []int `json:"transaction_ids" binding:"required" validate:"required"`
 	}
 	responseStatus := 200
 	formData := new(FormData)
@@ -3062,23 +3218,7 @@ func ResendBulkTransaction(c *fiber.Ctx) error {
 	if err := Validate.Struct(formData); err != nil {
 		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Provided data are not valid")
 	}
-	//check if password is correct
-	var fname, lname, userStatus string
-	err = config.DB.QueryRow(ctx,
-		`select u.fname,u.lname,u.status from users u  where id = $1 and password = crypt($2, password)`, userPayload.Id, formData.Password).
-		Scan(&fname, &lname, &userStatus)
-	if err != nil {
-		if !errors.Is(err, pgx.ErrNoRows) {
-			utils.LogMessage("critical", fmt.Sprintf("ConfirmBulkTransaction: Unable to get user data for password verify, Email:%s, err:%v", userPayload.Email, err), "web-service")
-		}
-		responseStatus = 401
-		c.SendStatus(responseStatus)
-		return c.JSON(fiber.Map{"status": responseStatus, "message": "Invalid credentials"})
-	} else if userStatus != "OKAY" {
-		responseStatus = 401
-		c.SendStatus(responseStatus)
-		return c.JSON(fiber.Map{"status": responseStatus, "message": "Your account has been deactivated"})
-	}
+	var err error
 	//get existing status
 	prizeCodes := []string{}
 	var status, phone, trxId, prizeCode string
@@ -3145,27 +3285,18 @@ func ResendBulkTransaction(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"status": responseStatus, "message": fmt.Sprintf("Transaction of %s confirmed successfully", prizeCode)})
 }
 func EditUser(c *fiber.Ctx) error {
-	userPayload, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
-	if !userPayload.CanAddUser {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, "You don't have permission to update a user")
-	}
+	userPayload := CurrentUser(c)
 	userId, err := c.ParamsInt("userId")
 	if err != nil {
 		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Invalid user id provided")
 	}
 	type FormData struct {
-		Fname          string `json:"fname" binding:"required" validate:"required,regex=^[a-zA-Z0-9 ]*$"`
-		Lname          string `json:"lname" binding:"required" validate:"required,regex=^[a-zA-Z0-9 ]*$"`
-		Phone          string `json:"phone" binding:"required" validate:"required,regex=^2507[2389]\\d{7}$"`
-		Email          string `json:"email" binding:"required" validate:"required,email"`
-		Department     int    `json:"department" binding:"required" validate:"required,number"`
-		CanAddCode     bool   `json:"can_add_codes" binding:"required" validate:"boolean"`
-		CanTriggerDraw bool   `json:"can_trigger_draw" binding:"required" validate:"boolean"`
-		CanViewLogs    bool   `json:"can_view_logs" binding:"required" validate:"boolean"`
-		CanAddUser     bool   `json:"can_add_user" binding:"required" validate:"boolean"`
+		Fname      string `json:"fname" binding:"required" validate:"required,regex=^[a-zA-Z0-9 ]*$"`
+		Lname      string `json:"lname" binding:"required" validate:"required,regex=^[a-zA-Z0-9 ]*$"`
+		Phone      string `json:"phone" binding:"required" validate:"required,regex=^2507[2389]\\d{7}$"`
+		Email      string `json:"email" binding:"required" validate:"required,email"`
+		Department int    `json:"department" binding:"required" validate:"required,number"`
+		Roles      []int  `json:"roles" binding:"required" validate:"required,min=1,dive,min=1"`
 	}
 	responseStatus := 200
 	formData := new(FormData)
@@ -3187,10 +3318,12 @@ func EditUser(c *fiber.Ctx) error {
 	//fetch users
 	err = config.DB.QueryRow(ctx,
 		`select u.id,u.fname,u.lname,u.email,u.phone,u.department_id,d.title as department_title, u.email_verified,u.phone_verified,u.avatar_url,u.status,
-			u.can_add_codes,u.can_trigger_draw,u.can_view_logs,u.can_add_user,force_change_password from users u inner join departments d on u.department_id = d.id where u.id=$1`, userId).
+			force_change_password from users u inner join departments d on u.department_id = d.id where u.id=$1`, userId).
 		Scan(&userData.Id, &userData.Fname, &userData.Lname, &userData.Email, &userData.Phone, &userData.Department.Id, &userData.Department.Title,
-			&userData.EmailVerified, &userData.PhoneVerified, &userData.AvatarUrl, &userData.Status, &userData.CanAddCodes, &userData.CanTriggerDraw, &userData.CanViewLogs,
-			&userData.CanAddUser, &userData.ForceChangePassword)
+			&userData.EmailVerified, &userData.PhoneVerified, &userData.AvatarUrl, &userData.Status, &userData.ForceChangePassword)
+	if err == nil {
+		err = loadUserAccess(&userData)
+	}
 	if err != nil {
 		if !errors.Is(err, pgx.ErrNoRows) {
 			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get users data failed", utils.Logger{
@@ -3201,6 +3334,11 @@ func EditUser(c *fiber.Ctx) error {
 		}
 		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "users data is not valid")
 	}
+	for _, permission := range userData.Permissions {
+		if !userPayload.HasPermission(permission) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, fmt.Sprintf("%s, the user has %s which you don't have", errUserNotManageable, permission))
+		}
+	}
 	logsChange := ""
 	if userData.Fname != formData.Fname {
 		logsChange += fmt.Sprintf("fname: %s -> %s, ", userData.Fname, formData.Fname)
@@ -3217,24 +3355,56 @@ func EditUser(c *fiber.Ctx) error {
 	if userData.Department.Id != formData.Department {
 		logsChange += fmt.Sprintf("department: %d -> %d, ", userData.Department.Id, formData.Department)
 	}
-	if userData.CanAddCodes != formData.CanAddCode {
-		logsChange += fmt.Sprintf("can_add_codes: %t -> %t, ", userData.CanAddCodes, formData.CanAddCode)
+	slices.Sort(formData.Roles)
+	formData.Roles = slices.Compact(formData.Roles)
+	currentRoles := []int{}
+	for _, role := range userData.Roles {
+		currentRoles = append(currentRoles, role.Id)
+	}
+	slices.Sort(currentRoles)
+	if !slices.Equal(currentRoles, formData.Roles) {
+		//only the added roles are checked, an operator can remove a role it could not grant
+		addedRoles := []int{}
+		for _, roleId := range formData.Roles {
+			if !slices.Contains(currentRoles, roleId) {
+				addedRoles = append(addedRoles, roleId)
+			}
+		}
+		if len(addedRoles) > 0 {
+			if err = checkAssignableRoles(userPayload, addedRoles); err != nil {
+				if errors.Is(err, errRoleNotAssignable) {
+					return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, err.Error())
+				}
+				return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to update data, system error. please try again later", utils.Logger{
+					LogLevel:    utils.CRITICAL,
+					Message:     "EditUser: Unable to check roles, error: " + err.Error(),
+					ServiceName: config.ServiceName,
+				})
+			}
+		}
+		logsChange += fmt.Sprintf("roles: %v -> %v, ", currentRoles, formData.Roles)
 	}
-	if userData.CanTriggerDraw != formData.CanTriggerDraw {
-		logsChange += fmt.Sprintf("can_trigger_draw: %t -> %t, ", userData.CanTriggerDraw, formData.CanTriggerDraw)
+	if logsChange == "" {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "No changes made")
 	}
-	if userData.CanViewLogs != formData.CanViewLogs {
-		logsChange += fmt.Sprintf("can_view_logs: %t -> %t, ", userData.CanViewLogs, formData.CanViewLogs)
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to update data, system error. please try again later", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "EditUser: Unable to start transaction, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
 	}
-	if userData.CanAddUser != formData.CanAddUser {
-		logsChange += fmt.Sprintf("can_add_user: %t -> %t, ", userData.CanAddUser, formData.CanAddUser)
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx,
+		`update users set fname=$1,lname=$2,email=$3,phone=$4,department_id=$5 where id=$6`,
+		formData.Fname, formData.Lname, formData.Email, formData.Phone, formData.Department, userId)
+	if err == nil {
+		err = setUserRoles(tx, userId, formData.Roles, userPayload.Id)
 	}
-	if logsChange == "" {
-		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "No changes made")
+	if err == nil {
+		err = tx.Commit(ctx)
 	}
-	_, err = config.DB.Exec(ctx,
-		`update users set fname=$1,lname=$2,email=$3,phone=$4,department_id=$5,can_add_codes=$6,can_trigger_draw=$7,can_view_logs=$8,can_add_user=$9 where id=$10`,
-		formData.Fname, formData.Lname, formData.Email, formData.Phone, formData.Department, formData.CanAddCode, formData.CanTriggerDraw, formData.CanViewLogs, formData.CanAddUser, userId)
 
 	if err != nil {
 		if ok, key := utils.IsErrDuplicate(err); ok {
@@ -3263,13 +3433,13 @@ func EditUser(c *fiber.Ctx) error {
 		config.ServiceName,
 		nil,
 	)
+	if !slices.Equal(currentRoles, formData.Roles) {
+		revokeSessions(c, userId, "roles of the user changed")
+	}
 	return c.JSON(fiber.Map{"status": responseStatus, "message": formData.Fname + " updated successfully"})
 }
 func PlayerMetrics(c *fiber.Ctx) error {
-	_, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
+	var err error
 	type PrizeOverview struct {
 		Province string `json:"province"`
 		Mno      string `json:"mno"`
@@ -3388,10 +3558,7 @@ func PlayerMetrics(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": metrics})
 }
 func WinnerMetrics(c *fiber.Ctx) error {
-	_, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
+	var err error
 	type PrizeOverview struct {
 		Province string `json:"province"`
 		Mno      string `json:"mno"`
@@ -3512,10 +3679,7 @@ func WinnerMetrics(c *fiber.Ctx) error {
 }
 
 func GetPrizeOverviewV2(c *fiber.Ctx) error {
-	_, err := utils.SecurePath(c, config.Redis)
-	if err != nil {
-		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
-	}
+	var err error
 	type PrizeOverview struct {
 		TotalPrize      float64 `json:"total_prize"`
 		PrizeCount      int     `json:"prize_count"`
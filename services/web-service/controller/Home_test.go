@@ -6,12 +6,17 @@ import (
 	"fmt"
 	"io"
 	"net/http/httptest"
+	"regexp"
 	"shared-package/utils"
+	"strings"
 	"testing"
 	"time"
 	"web-service/config"
 	"web-service/model"
 
+	"github.com/fiorix/go-smpp/smpp/pdu"
+	"github.com/fiorix/go-smpp/smpp/pdu/pdufield"
+	"github.com/fiorix/go-smpp/smpp/smpptest"
 	"github.com/go-redis/redis/v8"
 	"github.com/gofiber/fiber/v2"
 	"github.com/spf13/viper"
@@ -34,10 +39,16 @@ func init() {
 		Password: viper.GetString("redis_test.password"),
 		DB:       viper.GetInt("redis_test.database"),
 	})
+	//the password history of previous runs must not refuse the test passwords
+	config.DB.Exec(ctx, `delete from user_password_history where user_id=2`)
+	//failed logins of previous runs must not lock the test users
+	if keys, err := config.Redis.Keys(ctx, "login_guard:*").Result(); err == nil && len(keys) > 0 {
+		config.Redis.Del(ctx, keys...)
+	}
 	//Create dummy users for testing
-	_, err := config.DB.Exec(ctx, `INSERT INTO users (id,fname, lname, phone, email, can_add_codes,can_trigger_draw,can_add_user,can_view_logs, department_id, email_verified, phone_verified, locale, avatar_url, password, status, address, operator)
+	_, err := config.DB.Exec(ctx, `INSERT INTO users (id,fname, lname, phone, email, department_id, email_verified, phone_verified, locale, avatar_url, password, status, address, operator)
 VALUES
-(2, 'Admin', 'User test', '078234234232', 'test@qonics.com', true, true, true, true, 1, FALSE, FALSE, 'en', 'NOT_AVAILABLE',
+(2, 'Admin', 'User test', '078234234232', 'test@qonics.com', 1, FALSE, FALSE, 'en', 'NOT_AVAILABLE',
  '$2a$06$Q3Omh4QCXB7f2a5mTqlrAunZgm3c4K1MZYraLh/OXgK43j8CoHyPa', 'OKAY', 'NOT_AVAILABLE', NULL);`)
 	if err != nil {
 		fmt.Println("Error inserting user data", err)
@@ -47,13 +58,23 @@ VALUES
 			fmt.Println("Error updating user password", err)
 		}
 	}
-	_, err = config.DB.Exec(ctx, `INSERT INTO users (fname, lname, phone, email, can_add_codes,can_trigger_draw,can_add_user,can_view_logs, department_id, email_verified, phone_verified, locale, avatar_url, password, status, address, operator)
+	_, err = config.DB.Exec(ctx, `INSERT INTO users (fname, lname, phone, email, department_id, email_verified, phone_verified, locale, avatar_url, password, status, address, operator)
 VALUES
-('Admin', 'User test 2', '078234234231', 'test2@qonics.com', false, false, false, true, 1, true, true, 'en', 'NOT_AVAILABLE',
+('Admin', 'User test 2', '078234234231', 'test2@qonics.com', 1, true, true, 'en', 'NOT_AVAILABLE',
  '$2a$06$GeEpPxbKoTn3tAkyufWilumzne1MvF4uw0Vl7/X/VsZ4DM.r3zWRi', 'OKAY', 'NOT_AVAILABLE', NULL);`)
 	if err != nil {
 		fmt.Println("Error inserting user data", err)
 	}
+	//the admin test user has all the roles, the second one has the roles of its former flags (can_view_logs)
+	_, err = config.DB.Exec(ctx, `INSERT INTO user_roles (user_id, role_id) SELECT 2, id FROM roles ON CONFLICT DO NOTHING`)
+	if err != nil {
+		fmt.Println("Error inserting user_roles data", err)
+	}
+	_, err = config.DB.Exec(ctx, `INSERT INTO user_roles (user_id, role_id) SELECT u.id, r.id FROM users u, roles r
+	WHERE u.email = 'test2@qonics.com' AND r.name IN ('Back office', 'Auditor') ON CONFLICT DO NOTHING`)
+	if err != nil {
+		fmt.Println("Error inserting user_roles data", err)
+	}
 	// save prize category
 	_, err = config.DB.Exec(ctx, `INSERT INTO prize_category (id,name, status) VALUES (1,'Test Category 1', 'OKAY');`)
 	if err != nil {
@@ -76,11 +97,11 @@ VALUES
 	if err != nil {
 		fmt.Println("Error inserting prize_type data", err)
 	}
-	_, err = config.DB.Exec(ctx, `INSERT INTO prize_message (id, message, lang, prize_type_id,operator_id)
-	VALUES (1, 'Congratulation, you won a prize','en',1, 1);
+	_, err = config.DB.Exec(ctx, `INSERT INTO sms_template (name, lang, version, body, status)
+	VALUES ('prize_type.1', 'en', 1, 'Congratulation {{.Name}}, you won a prize', 'ACTIVE');
 `)
 	if err != nil {
-		fmt.Println("Error inserting prize_message data", err)
+		fmt.Println("Error inserting sms_template data", err)
 	}
 	_, err = config.DB.Exec(ctx, `INSERT INTO customer (id, names,phone,phone_hash,province,district,locale,network_operator)
 	VALUES (1, pgp_sym_encrypt('KALISA Doe', 'secret'),pgp_sym_encrypt('250785753712', 'secret')::bytea,digest('250785753712', 'sha256')::bytea,5,3,'en','MTN');
@@ -120,25 +141,38 @@ VALUES
 
 func createTestAccessToken() string {
 	userData := model.UserProfile{
-		Id:             2,
-		Fname:          "Test",
-		Lname:          "user",
-		Email:          "test@qonics.com",
-		CanAddCodes:    true,
-		CanTriggerDraw: true,
-		CanAddUser:     true,
-		CanViewLogs:    true,
-		Status:         "OKAY",
-	}
-	payloadData, err := json.Marshal(userData)
+		Id:     2,
+		Fname:  "Test",
+		Lname:  "user",
+		Email:  "test@qonics.com",
+		Status: "OKAY",
+	}
+	//the test user has every permission
+	if err := config.DB.QueryRow(ctx, `select array_agg(name) from permissions`).Scan(&userData.Permissions); err != nil {
+		panic("Unable to get permissions, error: " + err.Error())
+	}
+	tokens, err := utils.CreateSession(config.Redis, userData, "0.0.0.0", "test")
 	if err != nil {
-		panic("Unable to marshal struct into json")
+		panic("Unable to create test session, error: " + err.Error())
+	}
+	return tokens.AccessToken
+}
+
+// sendTestRequest send a json request to the test app, the Authorization header is set when a token is given
+func sendTestRequest(t *testing.T, app *fiber.App, method, route, token string, payload any) (int, map[string]interface{}) {
+	body, _ := json.Marshal(payload)
+	req := httptest.NewRequest(method, route, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
 	}
-	token := "dG9rZW5fYzM5MThmNjItMWM0Ny0xMWVmLWE5NjUtMDI0MjBhMTQwMDA2XzE3MTY5NjU4NTY5NjS"
-	if err := config.Redis.Set(ctx, token, payloadData, time.Duration(10*time.Minute)).Err(); err != nil {
-		panic(fmt.Sprintf("unable to save user access token for user %d , error: %s", userData.Id, err.Error()))
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal("Error sending request", err)
 	}
-	return token
+	data := map[string]interface{}{}
+	json.NewDecoder(resp.Body).Decode(&data)
+	return resp.StatusCode, data
 }
 func TestLoginWithEmail(t *testing.T) {
 	// Setup Fiber app
@@ -167,11 +201,10 @@ func TestLoginWithEmail(t *testing.T) {
 				"status":  200,
 				"message": "Login completed",
 				"data": map[string]interface{}{
-					"can_add_codes": true,
-					"email":         "test@qonics.com",
-					"firstname":     "Admin",
-					"lastname":      "User test",
-					"status":        "OKAY", // JSON unmarshalling converts numbers to floats
+					"email":     "test@qonics.com",
+					"firstname": "Admin",
+					"lastname":  "User test",
+					"status":    "OKAY", // JSON unmarshalling converts numbers to floats
 				},
 			},
 		},
@@ -219,7 +252,7 @@ func TestLoginWithEmail(t *testing.T) {
 				a.True(ok, "data should be a map")
 
 				// Check each field
-				a.Equal(test.expectedData["data"].(map[string]interface{})["can_add_codes"], userData["can_add_codes"])
+				a.Contains(userData["permissions"], "draws.trigger")
 				a.Equal(test.expectedData["data"].(map[string]interface{})["email"], userData["email"])
 				a.Equal(test.expectedData["data"].(map[string]interface{})["firstname"], userData["firstname"])
 				a.Equal(test.expectedData["data"].(map[string]interface{})["status"], userData["status"])
@@ -232,6 +265,7 @@ func TestGetPrizeCategory(t *testing.T) {
 	access_token := createTestAccessToken()
 	// Setup Fiber app
 	app := fiber.New()
+	app.Use(Authenticate)
 	// Define the route
 	app.Get("/prize_categories", GetPrizeCategory)
 
@@ -269,6 +303,7 @@ func TestGetPrizeType(t *testing.T) {
 	access_token := createTestAccessToken()
 	// Setup Fiber app
 	app := fiber.New()
+	app.Use(Authenticate)
 	// Define the route
 	app.Get("/prize_type/:prize_category?", GetPrizeType)
 
@@ -311,6 +346,7 @@ func TestGetPrizeTypeByCategory(t *testing.T) {
 	access_token := createTestAccessToken()
 	// Setup Fiber app
 	app := fiber.New()
+	app.Use(Authenticate)
 	// Define the route
 	app.Get("/prize_type/:prize_category?", GetPrizeType)
 
@@ -355,6 +391,7 @@ func TestGetEntries(t *testing.T) {
 	access_token := createTestAccessToken()
 	// Setup Fiber app
 	app := fiber.New()
+	app.Use(Authenticate)
 	// Define the route
 	app.Get("/entries", GetEntries)
 
@@ -393,6 +430,7 @@ func TestGetDraws(t *testing.T) {
 	access_token := createTestAccessToken()
 	// Setup Fiber app
 	app := fiber.New()
+	app.Use(Authenticate)
 	// Define the route
 	app.Get("/draws", GetDraws)
 
@@ -432,6 +470,7 @@ func TestGetPrizes(t *testing.T) {
 	access_token := createTestAccessToken()
 	// Setup Fiber app
 	app := fiber.New()
+	app.Use(Authenticate)
 	// Define the route
 	app.Get("/prizes", GetPrizes)
 
@@ -471,6 +510,7 @@ func TestCreatePrizeCategory(t *testing.T) {
 	access_token := createTestAccessToken()
 	// Setup Fiber app
 	app := fiber.New()
+	app.Use(Authenticate)
 	// Define the route
 	app.Post("/prize_category", CreatePrizeCategory)
 	uniqueName := fmt.Sprintf("CASH-%d", time.Now().Unix())
@@ -539,6 +579,7 @@ func TestCreatePrizeType(t *testing.T) {
 	access_token := createTestAccessToken()
 	// Setup Fiber app
 	app := fiber.New()
+	app.Use(Authenticate)
 	// Define the route
 	app.Post("/prize_type", CreatePrizeType)
 	uniqueName := fmt.Sprintf("CASH-%d", time.Now().Unix())
@@ -676,6 +717,7 @@ func TestAddUser(t *testing.T) {
 	access_token := createTestAccessToken()
 	// Setup Fiber app
 	app := fiber.New()
+	app.Use(Authenticate)
 	// Define the route
 	app.Post("/user", AddUser)
 	uniqueName := fmt.Sprintf("User %d", time.Now().Unix())
@@ -691,15 +733,12 @@ func TestAddUser(t *testing.T) {
 		{
 			description: "Success",
 			payload: map[string]any{
-				"fname":            "Test",
-				"lname":            uniqueName,
-				"email":            uniqueEmail,
-				"phone":            uniquePhone,
-				"department":       1,
-				"can_add_codes":    true,
-				"can_trigger_draw": true,
-				"can_add_user":     true,
-				"can_view_logs":    true,
+				"fname":      "Test",
+				"lname":      uniqueName,
+				"email":      uniqueEmail,
+				"phone":      uniquePhone,
+				"department": 1,
+				"roles":      []int{1},
 			},
 			expectedCode: 200,
 			expectedData: map[string]interface{}{
@@ -710,15 +749,12 @@ func TestAddUser(t *testing.T) {
 		{
 			description: "Duplicate email",
 			payload: map[string]any{
-				"fname":            "Test",
-				"lname":            uniqueName,
-				"email":            uniqueEmail,
-				"phone":            "250782394234",
-				"department":       1,
-				"can_add_codes":    true,
-				"can_trigger_draw": true,
-				"can_add_user":     true,
-				"can_view_logs":    true,
+				"fname":      "Test",
+				"lname":      uniqueName,
+				"email":      uniqueEmail,
+				"phone":      "250782394234",
+				"department": 1,
+				"roles":      []int{1},
 			},
 			expectedCode: 409,
 			expectedData: map[string]interface{}{
@@ -729,15 +765,12 @@ func TestAddUser(t *testing.T) {
 		{
 			description: "Duplicate phone",
 			payload: map[string]any{
-				"fname":            "Test",
-				"lname":            uniqueName,
-				"email":            "erfsad@asdfd.com",
-				"phone":            uniquePhone,
-				"department":       1,
-				"can_add_codes":    true,
-				"can_trigger_draw": true,
-				"can_add_user":     true,
-				"can_view_logs":    true,
+				"fname":      "Test",
+				"lname":      uniqueName,
+				"email":      "erfsad@asdfd.com",
+				"phone":      uniquePhone,
+				"department": 1,
+				"roles":      []int{1},
 			},
 			expectedCode: 409,
 			expectedData: map[string]interface{}{
@@ -748,30 +781,24 @@ func TestAddUser(t *testing.T) {
 		{
 			description: "Invalid name",
 			payload: map[string]any{
-				"fname":            "Test*sda",
-				"lname":            "asd",
-				"email":            "erfsad@asdfd.com",
-				"phone":            "250788888121",
-				"department":       1,
-				"can_add_codes":    true,
-				"can_trigger_draw": true,
-				"can_add_user":     true,
-				"can_view_logs":    true,
+				"fname":      "Test*sda",
+				"lname":      "asd",
+				"email":      "erfsad@asdfd.com",
+				"phone":      "250788888121",
+				"department": 1,
+				"roles":      []int{1},
 			},
 			expectedCode: 406,
 		},
 		{
 			description: "Invalid department id",
 			payload: map[string]any{
-				"fname":            "Test*sda",
-				"lname":            "asd",
-				"email":            "erfsad@asdfd.com",
-				"phone":            "250788888121",
-				"department":       -1,
-				"can_add_codes":    true,
-				"can_trigger_draw": true,
-				"can_add_user":     true,
-				"can_view_logs":    true,
+				"fname":      "Test*sda",
+				"lname":      "asd",
+				"email":      "erfsad@asdfd.com",
+				"phone":      "250788888121",
+				"department": -1,
+				"roles":      []int{1},
 			},
 			expectedCode: 406,
 		},
@@ -803,6 +830,7 @@ func TestGetUsers(t *testing.T) {
 	access_token := createTestAccessToken()
 	// Setup Fiber app
 	app := fiber.New()
+	app.Use(Authenticate)
 	// Define the route
 	app.Get("/users", GetUsers)
 
@@ -837,7 +865,7 @@ func TestGetUsers(t *testing.T) {
 			a.NotEmpty(dataRecord["phone"], "phone")
 			a.NotEmpty(dataRecord["department"], "department")
 			a.NotEmpty(dataRecord["avatar_url"], "avatar_url")
-			a.NotNil(dataRecord["can_add_codes"], "can_add_codes")
+			a.NotNil(dataRecord["roles"], "roles")
 			a.NotEmpty(dataRecord["created_at"], "created_at")
 		}
 	}
@@ -846,6 +874,7 @@ func TestGetCustomer(t *testing.T) {
 	access_token := createTestAccessToken()
 	// Setup Fiber app
 	app := fiber.New()
+	app.Use(Authenticate)
 	// Define the route
 	app.Get("/customer/:customerId", GetCustomer)
 
@@ -883,6 +912,7 @@ func TestGetEntryData(t *testing.T) {
 	access_token := createTestAccessToken()
 	// Setup Fiber app
 	app := fiber.New()
+	app.Use(Authenticate)
 	// Define the route
 	app.Get("/entry/:entryId", GetEntryData)
 
@@ -917,6 +947,7 @@ func TestChangePassword(t *testing.T) {
 	token := createTestAccessToken()
 	// Setup Fiber app
 	app := fiber.New()
+	app.Use(Authenticate)
 	// Define the route
 	app.Post("/change_password", ChangePassword)
 	// Test cases
@@ -1353,6 +1384,7 @@ func TestStartPrizeDraw(t *testing.T) {
 	token := createTestAccessToken()
 	// Setup Fiber app
 	app := fiber.New()
+	app.Use(Authenticate)
 	// Define the route
 	app.Post("/draw", StartPrizeDraw)
 	// Test cases
@@ -1436,6 +1468,7 @@ func TestChangeUserStatus(t *testing.T) {
 	token := createTestAccessToken()
 	// Setup Fiber app
 	app := fiber.New()
+	app.Use(Authenticate)
 	// Define the route
 	app.Post("/change_user_status/:userId", ChangeUserStatus)
 	// Test cases
@@ -1525,6 +1558,7 @@ func TestGetTransactions(t *testing.T) {
 	access_token := createTestAccessToken()
 	// Setup Fiber app
 	app := fiber.New()
+	app.Use(Authenticate)
 	// Define the route
 	app.Get("/transactions", GetTransactions)
 
@@ -1567,6 +1601,7 @@ func TestConfirmTransaction(t *testing.T) {
 	token := createTestAccessToken()
 	// Setup Fiber app
 	app := fiber.New()
+	app.Use(Authenticate)
 	// Define the route
 	app.Post("/confirm-trx/:transaction_id", ConfirmTransaction)
 	// Test cases
@@ -1581,34 +1616,17 @@ func TestConfirmTransaction(t *testing.T) {
 		{
 			description:    "success",
 			transaction_id: transaction_id,
-			payload: map[string]any{
-				"password": "P@as12.W0d2",
-			},
-			expectedCode: fiber.StatusOK,
+			expectedCode:   fiber.StatusOK,
 		},
 		{
 			description:    "Already confirmed",
 			transaction_id: transaction_id,
-			payload: map[string]any{
-				"password": "P@as12.W0d2",
-			},
-			expectedCode: fiber.StatusNotAcceptable,
+			expectedCode:   fiber.StatusNotAcceptable,
 		},
 		{
 			description:    "invalid transaction",
 			transaction_id: -1,
-			payload: map[string]any{
-				"password": "P@as12.W0d",
-			},
-			expectedCode: fiber.StatusForbidden,
-		},
-		{
-			description:    "invalid password",
-			transaction_id: transaction_id,
-			payload: map[string]any{
-				"password": "P@as12.W0s",
-			},
-			expectedCode: fiber.StatusUnauthorized,
+			expectedCode:   fiber.StatusForbidden,
 		},
 		{
 			description:    "Transaction data is invalid",
@@ -1651,6 +1669,7 @@ func TestConfirmBulkTransaction(t *testing.T) {
 	}
 	// Setup Fiber app
 	app := fiber.New()
+	app.Use(Authenticate)
 	// Define the route
 	app.Post("/confirm-bulk-trx", ConfirmBulkTransaction)
 	// Test cases
@@ -1665,7 +1684,6 @@ func TestConfirmBulkTransaction(t *testing.T) {
 			description: "success",
 			payload: map[string]any{
 				"transaction_ids": []int{transaction_id},
-				"password":        "P@as12.W0d2",
 			},
 			expectedCode: fiber.StatusOK,
 		},
@@ -1673,7 +1691,6 @@ func TestConfirmBulkTransaction(t *testing.T) {
 			description: "Already confirmed",
 			payload: map[string]any{
 				"transaction_ids": []int{transaction_id},
-				"password":        "P@as12.W0d2",
 			},
 			expectedCode: fiber.StatusNotAcceptable,
 		},
@@ -1681,18 +1698,9 @@ func TestConfirmBulkTransaction(t *testing.T) {
 			description: "Provided data are not valid",
 			payload: map[string]any{
 				"transaction_ids": []int{1, 0},
-				"password":        "P@as12.W0d2",
 			},
 			expectedCode: fiber.StatusNotAcceptable,
 		},
-		{
-			description: "invalid password",
-			payload: map[string]any{
-				"transaction_ids": []int{transaction_id},
-				"password":        "P@as12.W0s",
-			},
-			expectedCode: fiber.StatusUnauthorized,
-		},
 		{
 			description:  "Provided data are not valid",
 			payload:      nil,
@@ -1724,3 +1732,1651 @@ func TestConfirmBulkTransaction(t *testing.T) {
 		a.NotEmpty(result["message"], test.description, "Message")
 	}
 }
+
+// test GetPendingApprovals
+func TestGetPendingApprovals(t *testing.T) {
+	token := createTestAccessToken()
+	// Setup Fiber app
+	app := fiber.New()
+	app.Use(Authenticate)
+	// Define the route
+	app.Get("/pending-approvals", GetPendingApprovals)
+
+	// Initialize the assert object
+	a := assert.New(t)
+
+	req := httptest.NewRequest("GET", "/pending-approvals", nil)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", token)
+
+	resp, _ := app.Test(req, -1)
+	a.Equal(fiber.StatusOK, resp.StatusCode)
+
+	body, _ := io.ReadAll(resp.Body)
+	var result map[string]interface{}
+	json.Unmarshal(body, &result)
+	_, ok := result["data"].([]interface{})
+	a.True(ok, "data should be an array")
+	a.NotEmpty(result["pagination"], "pagination")
+}
+
+func TestPayoutApprovalTier(t *testing.T) {
+	a := assert.New(t)
+	viper.Set("payout_approval.single_limit", 500000)
+	viper.Set("payout_approval.finance_limit", 2000000)
+	defer viper.Set("payout_approval.single_limit", 0)
+	defer viper.Set("payout_approval.finance_limit", 0)
+	tests := []struct {
+		amount      float64
+		required    int
+		financeOnly bool
+	}{
+		{amount: 1000, required: 1, financeOnly: false},
+		{amount: 500000, required: 1, financeOnly: false},
+		{amount: 500001, required: 2, financeOnly: false},
+		{amount: 2000001, required: 2, financeOnly: true},
+	}
+	for _, test := range tests {
+		required, financeOnly := payoutApprovalTier(test.amount)
+		a.Equal(test.required, required, fmt.Sprintf("amount %v", test.amount))
+		a.Equal(test.financeOnly, financeOnly, fmt.Sprintf("amount %v", test.amount))
+	}
+}
+
+// test ReverseTransaction
+func TestReverseTransaction(t *testing.T) {
+	token := createTestAccessToken()
+	// Setup Fiber app
+	app := fiber.New()
+	app.Use(Authenticate)
+	// Define the route
+	app.Post("/reverse-trx/:transaction_id", ReverseTransaction)
+	tests := []struct {
+		description    string
+		transaction_id int
+		payload        map[string]any
+		expectedCode   int
+	}{
+		{
+			description:    "invalid transaction",
+			transaction_id: -1,
+			payload:        map[string]any{"reason": "fraud"},
+			expectedCode:   fiber.StatusForbidden,
+		},
+		{
+			description:    "missing reason",
+			transaction_id: transaction_id,
+			payload:        map[string]any{},
+			expectedCode:   fiber.StatusNotAcceptable,
+		},
+		{
+			description:    "transaction not paid",
+			transaction_id: transaction_id,
+			payload:        map[string]any{"reason": "fraud"},
+			expectedCode:   fiber.StatusNotAcceptable,
+		},
+	}
+	// Initialize the assert object
+	a := assert.New(t)
+	for _, test := range tests {
+		reqBody, _ := json.Marshal(test.payload)
+		req := httptest.NewRequest("POST", fmt.Sprintf("/reverse-trx/%d", test.transaction_id), bytes.NewReader(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", token)
+
+		resp, _ := app.Test(req, -1)
+		a.Equal(test.expectedCode, resp.StatusCode, test.description)
+
+		body, _ := io.ReadAll(resp.Body)
+		var result map[string]interface{}
+		json.Unmarshal(body, &result)
+		a.NotEmpty(result["message"], test.description, "Message")
+	}
+}
+
+// test SavePickupLocation and GetPickupLocations
+func TestPickupLocations(t *testing.T) {
+	token := createTestAccessToken()
+	// Setup Fiber app
+	app := fiber.New()
+	app.Use(Authenticate)
+	// Define the route
+	app.Post("/pickup-location", SavePickupLocation)
+	app.Get("/pickup-locations", GetPickupLocations)
+	tests := []struct {
+		description  string
+		payload      map[string]any
+		expectedCode int
+	}{
+		{
+			description:  "success",
+			payload:      map[string]any{"district_id": 3, "name": fmt.Sprintf("Test depot %d", time.Now().UnixMilli()), "contact_phone": "250785753712"},
+			expectedCode: fiber.StatusOK,
+		},
+		{
+			description:  "invalid district",
+			payload:      map[string]any{"district_id": 99999, "name": "Test depot"},
+			expectedCode: fiber.StatusNotAcceptable,
+		},
+		{
+			description:  "invalid phone",
+			payload:      map[string]any{"district_id": 3, "name": "Test depot", "contact_phone": "0785753712"},
+			expectedCode: fiber.StatusNotAcceptable,
+		},
+	}
+	// Initialize the assert object
+	a := assert.New(t)
+	for _, test := range tests {
+		reqBody, _ := json.Marshal(test.payload)
+		req := httptest.NewRequest("POST", "/pickup-location", bytes.NewReader(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", token)
+
+		resp, _ := app.Test(req, -1)
+		a.Equal(test.expectedCode, resp.StatusCode, test.description)
+	}
+	req := httptest.NewRequest("GET", "/pickup-locations?district_id=3", nil)
+	req.Header.Set("Authorization", token)
+	resp, _ := app.Test(req, -1)
+	a.Equal(fiber.StatusOK, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	var result map[string]interface{}
+	json.Unmarshal(body, &result)
+	data, ok := result["data"].([]interface{})
+	a.True(ok, "data should be an array")
+	a.NotEmpty(data, "pickup locations")
+}
+
+func TestVerifyPrizeClaim(t *testing.T) {
+	token := createTestAccessToken()
+	// Setup Fiber app
+	app := fiber.New()
+	app.Use(Authenticate)
+	// Define the route
+	app.Post("/prize-claim/:claim_id/verify", VerifyPrizeClaim)
+	tests := []struct {
+		description  string
+		claimId      string
+		payload      map[string]any
+		expectedCode int
+	}{
+		{
+			description:  "invalid claim id",
+			claimId:      "abc",
+			payload:      map[string]any{"claim_code": "123456", "id_number": "1199080012345678"},
+			expectedCode: fiber.StatusForbidden,
+		},
+		{
+			description:  "invalid national id",
+			claimId:      "1",
+			payload:      map[string]any{"claim_code": "123456", "id_number": "11990800"},
+			expectedCode: fiber.StatusBadRequest,
+		},
+		{
+			description:  "claim not found",
+			claimId:      "99999999",
+			payload:      map[string]any{"claim_code": "123456", "id_number": "1199080012345678"},
+			expectedCode: fiber.StatusNotFound,
+		},
+	}
+	// Initialize the assert object
+	a := assert.New(t)
+	for _, test := range tests {
+		reqBody, _ := json.Marshal(test.payload)
+		req := httptest.NewRequest("POST", "/prize-claim/"+test.claimId+"/verify", bytes.NewReader(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", token)
+
+		resp, _ := app.Test(req, -1)
+		a.Equal(test.expectedCode, resp.StatusCode, test.description)
+	}
+}
+
+func TestPrizeClaimLockout(t *testing.T) {
+	token := createTestAccessToken()
+	idNumber := fmt.Sprintf("11990800%08d", time.Now().UnixNano()%100000000)
+	phone := fmt.Sprintf("25078%07d", time.Now().UnixNano()%10000000)
+	var customerId, prizeId int
+	err := config.DB.QueryRow(ctx, `INSERT INTO customer (names,phone,phone_hash,province,district,locale,network_operator,id_number)
+	VALUES (pgp_sym_encrypt('MUGISHA Eric', 'secret'),pgp_sym_encrypt($1, 'secret')::bytea,digest($1, 'sha256')::bytea,5,3,'en','MTN',$2) returning id`, phone, idNumber).
+		Scan(&customerId)
+	if err == nil {
+		err = config.DB.QueryRow(ctx, `insert into prize (entry_id, prize_type_id, prize_value, code, rewarded) values (1, 1, 1000, 'wrsdsad', false) returning id`).Scan(&prizeId)
+	}
+	if err != nil {
+		t.Fatal("Error inserting prize data", err)
+	}
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		t.Fatal("Error starting transaction", err)
+	}
+	code, _, err := utils.CreatePrizeClaim(tx, prizeId, customerId, nil)
+	if err != nil {
+		tx.Rollback(ctx)
+		t.Fatal("Error creating prize claim", err)
+	}
+	tx.Commit(ctx)
+	var claimId int
+	config.DB.QueryRow(ctx, `select id from prize_claim where prize_id=$1`, prizeId).Scan(&claimId)
+	wrongCode := "000000"
+	if code == wrongCode {
+		wrongCode = "111111"
+	}
+	// Setup Fiber app
+	app := fiber.New()
+	app.Use(Authenticate)
+	// Define the routes
+	app.Post("/prize-claim/:claim_id/verify", VerifyPrizeClaim)
+	app.Post("/prize-claim/:claim_id/resend", ResendPrizeClaim)
+	// Initialize the assert object
+	a := assert.New(t)
+	send := func(route string, payload any) (int, string) {
+		reqBody, _ := json.Marshal(payload)
+		req := httptest.NewRequest("POST", route, bytes.NewReader(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", token)
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal("Error sending request", err)
+		}
+		data := map[string]interface{}{}
+		json.NewDecoder(resp.Body).Decode(&data)
+		message, _ := data["message"].(string)
+		return resp.StatusCode, message
+	}
+	verifyRoute := fmt.Sprintf("/prize-claim/%d/verify", claimId)
+	for i := 0; i < utils.ClaimMaxAttempts; i++ {
+		status, message := send(verifyRoute, map[string]any{"claim_code": wrongCode, "id_number": idNumber})
+		a.Equal(fiber.StatusNotAcceptable, status, "wrong code")
+		a.Equal("Invalid claim code", message, "wrong code")
+	}
+	status, message := send(verifyRoute, map[string]any{"claim_code": code, "id_number": idNumber})
+	a.Equal(fiber.StatusNotAcceptable, status, "locked claim")
+	a.Contains(message, "locked", "the right code is refused once the claim is locked")
+
+	status, _ = send(fmt.Sprintf("/prize-claim/%d/resend", claimId), nil)
+	a.Equal(fiber.StatusOK, status, "resend claim code")
+	var smsMessage string
+	config.DB.QueryRow(ctx, `select message from sms where customer_id=$1 and type='prize_claim' order by id desc limit 1`, customerId).Scan(&smsMessage)
+	newCode := regexp.MustCompile(`code is (\d{6})`).FindStringSubmatch(smsMessage)
+	if !a.Len(newCode, 2, "the new code is sent by sms") {
+		return
+	}
+	status, _ = send(verifyRoute, map[string]any{"claim_code": code, "id_number": idNumber})
+	a.Equal(fiber.StatusNotAcceptable, status, "the previous code is replaced")
+	status, message = send(verifyRoute, map[string]any{"claim_code": newCode[1], "id_number": idNumber})
+	a.Equal(fiber.StatusOK, status, "verify with the new code")
+	a.Contains(message, "verified", "verify with the new code")
+	status, _ = send(fmt.Sprintf("/prize-claim/%d/resend", claimId), nil)
+	a.Equal(fiber.StatusNotAcceptable, status, "a verified claim has no new code")
+}
+
+func TestQueueSMS(t *testing.T) {
+	token := createTestAccessToken()
+	// Setup Fiber app
+	app := fiber.New()
+	app.Use(Authenticate)
+	// Define the route
+	app.Get("/test-sms/:mno/:phone", TestSMS)
+	// Initialize the assert object
+	a := assert.New(t)
+	req := httptest.NewRequest("GET", "/test-sms/MTN/250785753712", nil)
+	resp, _ := app.Test(req, -1)
+	a.Equal(fiber.StatusUnauthorized, resp.StatusCode, "test sms needs a session")
+	req = httptest.NewRequest("GET", "/test-sms/MTN/250785753712", nil)
+	req.Header.Set("Authorization", token)
+	resp, _ = app.Test(req, -1)
+	a.Equal(fiber.StatusOK, resp.StatusCode, "sms queued")
+	body, _ := io.ReadAll(resp.Body)
+	var result map[string]any
+	json.Unmarshal(body, &result)
+	smsId, _ := result["sms_id"].(float64)
+	var status string
+	err := config.DB.QueryRow(ctx, `select status from sms where id=$1`, int(smsId)).Scan(&status)
+	a.Nil(err, "queued sms saved")
+	a.Equal("QUEUED", status, "sms waits for the dispatcher")
+}
+
+func TestSMSDeliveryReport(t *testing.T) {
+	viper.Set("sms.dlr_token", "test-dlr-token")
+	// Setup Fiber app
+	app := fiber.New()
+	// Define the route
+	app.Post("/sms/dlr", SMSDeliveryReport)
+	tests := []struct {
+		description  string
+		token        string
+		payload      map[string]any
+		expectedCode int
+	}{
+		{
+			description:  "invalid token",
+			token:        "wrong-token",
+			payload:      map[string]any{"message_id": "TEST_SMS_ID", "status": "DELIVRD"},
+			expectedCode: fiber.StatusUnauthorized,
+		},
+		{
+			description:  "missing status",
+			token:        "test-dlr-token",
+			payload:      map[string]any{"message_id": "TEST_SMS_ID"},
+			expectedCode: fiber.StatusBadRequest,
+		},
+		{
+			description:  "unknown message",
+			token:        "test-dlr-token",
+			payload:      map[string]any{"message_id": fmt.Sprintf("unknown-%d", time.Now().UnixMilli()), "status": "DELIVRD"},
+			expectedCode: fiber.StatusNotFound,
+		},
+	}
+	// Initialize the assert object
+	a := assert.New(t)
+	for _, test := range tests {
+		reqBody, _ := json.Marshal(test.payload)
+		req := httptest.NewRequest("POST", "/sms/dlr", bytes.NewReader(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-DLR-Token", test.token)
+
+		resp, _ := app.Test(req, -1)
+		a.Equal(test.expectedCode, resp.StatusCode, test.description)
+	}
+}
+
+func TestSMPPSender(t *testing.T) {
+	// local smsc simulator answering every submit_sm
+	server := smpptest.NewUnstartedServer()
+	server.Handler = func(c smpptest.Conn, p pdu.Body) {
+		if p.Header().ID != pdu.SubmitSMID {
+			return
+		}
+		resp := pdu.NewSubmitSMResp()
+		resp.Header().Seq = p.Header().Seq
+		resp.Fields().Set(pdufield.MessageID, fmt.Sprintf("SMPP-%d", p.Header().Seq))
+		c.Write(resp)
+	}
+	server.Start()
+	defer server.Close()
+	sender := utils.NewSMPPSender([]utils.SMPPBindConfig{{
+		Operator: "MTN",
+		Address:  server.Addr(),
+		User:     smpptest.DefaultUser,
+		Password: smpptest.DefaultPasswd,
+	}}, nil, config.ServiceName)
+	defer sender.Close()
+	a := assert.New(t)
+	for i := 0; i < 20 && !sender.Connected("MTN"); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	a.True(sender.Connected("MTN"), "bound to the simulator")
+	tests := []struct {
+		description string
+		phone       string
+		message     string
+		segments    int
+		expectErr   bool
+	}{
+		{
+			description: "short gsm message",
+			phone:       "0785753712",
+			message:     "Hello from BRALIRWA",
+			segments:    1,
+		},
+		{
+			description: "long ucs-2 message",
+			phone:       "250785753712",
+			message:     strings.Repeat("Murakoze cyane 😀 ", 10),
+			segments:    3,
+		},
+		{
+			description: "operator without bind",
+			phone:       "0725753712",
+			message:     "Hello from BRALIRWA",
+			segments:    1,
+			expectErr:   true,
+		},
+	}
+	for _, test := range tests {
+		a.Equal(test.segments, utils.SMSSegments(test.message), test.description)
+		messageIds, err := sender.Send(test.phone, test.message, "BRALIRWA")
+		if test.expectErr {
+			a.NotNil(err, test.description)
+			continue
+		}
+		a.Nil(err, test.description)
+		//one message id per part
+		a.Len(messageIds, test.segments, test.description)
+	}
+}
+
+func TestSendRoutedSMS(t *testing.T) {
+	a := assert.New(t)
+	routing := viper.New()
+	routing.Set("sms_routing.providers", map[string]any{
+		"primary": map[string]any{"type": "http", "url": "http://127.0.0.1:9091/api/v1/send-sms", "cost": 2},
+	})
+	routing.Set("sms_routing.routes", []map[string]any{
+		{"operator": "MTN", "types": []string{"prize_won"}, "providers": []string{"primary"}},
+	})
+	routing.Set("sms_routing.priorities", map[string]any{"prize_won": "high"})
+	a.Nil(utils.LoadSMSRouting(routing, config.ServiceName), "routing loaded")
+	defer utils.LoadSMSRouting(viper.GetViper(), config.ServiceName)
+	a.Equal(utils.SMSPriorityHigh, utils.SMSPriority("prize_won"), "priority of the type")
+	a.Equal(utils.SMSPriorityNormal, utils.SMSPriority("registration"), "default priority")
+	tests := []struct {
+		description     string
+		phone           string
+		message         string
+		expectedCredits int
+		expectErr       bool
+	}{
+		{
+			description:     "single segment",
+			phone:           "0785753712",
+			message:         "You won",
+			expectedCredits: 2,
+		},
+		{
+			description:     "long message costs each segment",
+			phone:           "0785753712",
+			message:         strings.Repeat("You won a prize. ", 20),
+			expectedCredits: 6,
+		},
+		{
+			description: "no route for the operator",
+			phone:       "0725753712",
+			message:     "You won",
+			expectErr:   true,
+		},
+	}
+	for _, test := range tests {
+		result, err := utils.SendRoutedSMS(test.phone, test.message, "BRALIRWA", "prize_won", utils.SMSPriorityHigh, config.ServiceName)
+		if test.expectErr {
+			a.NotNil(err, test.description)
+			continue
+		}
+		a.Nil(err, test.description)
+		a.Equal("primary", result.Provider, test.description)
+		a.Equal(test.expectedCredits, result.Credits, test.description)
+	}
+	//an invalid routing is rejected and the current one kept
+	routing.Set("sms_routing.routes", []map[string]any{{"providers": []string{"missing"}}})
+	a.NotNil(utils.LoadSMSRouting(routing, config.ServiceName), "unknown provider rejected")
+	_, err := utils.SendRoutedSMS("0785753712", "You won", "BRALIRWA", "prize_won", utils.SMSPriorityHigh, config.ServiceName)
+	a.Nil(err, "previous routing still used")
+}
+
+func TestPreviewSMSTemplate(t *testing.T) {
+	token := createTestAccessToken()
+	// Setup Fiber app
+	app := fiber.New()
+	app.Use(Authenticate)
+	// Define the route
+	app.Post("/sms-template/preview", PreviewSMSTemplate)
+	tests := []struct {
+		description      string
+		payload          map[string]any
+		expectedCode     int
+		expectedText     string
+		expectedSegments int
+	}{
+		{
+			description:      "body with data",
+			payload:          map[string]any{"body": "Dear {{.Name}}, you won {{.Amount}} RWF", "data": map[string]any{"Name": "KALISA", "Amount": 5000}},
+			expectedCode:     fiber.StatusOK,
+			expectedText:     "Dear KALISA, you won 5000 RWF",
+			expectedSegments: 1,
+		},
+		{
+			description:      "active template in the default locale",
+			payload:          map[string]any{"name": "prize_type.1", "lang": "fr", "data": map[string]any{"Name": "KALISA"}},
+			expectedCode:     fiber.StatusOK,
+			expectedText:     "Congratulation KALISA, you won a prize",
+			expectedSegments: 1,
+		},
+		{
+			description:  "unknown placeholder",
+			payload:      map[string]any{"body": "Dear {{.Unknown}}"},
+			expectedCode: fiber.StatusNotAcceptable,
+		},
+		{
+			description:  "placeholder the winner sms is not sent with",
+			payload:      map[string]any{"name": "prize_type.1", "body": "Dear {{.Name}}, your otp is {{.OTP}}"},
+			expectedCode: fiber.StatusNotAcceptable,
+		},
+		{
+			description:  "unknown template",
+			payload:      map[string]any{"name": "missing_template"},
+			expectedCode: fiber.StatusNotFound,
+		},
+		{
+			description:  "missing fields",
+			payload:      map[string]any{},
+			expectedCode: fiber.StatusBadRequest,
+		},
+	}
+	// Initialize the assert object
+	a := assert.New(t)
+	for _, test := range tests {
+		reqBody, _ := json.Marshal(test.payload)
+		req := httptest.NewRequest("POST", "/sms-template/preview", bytes.NewReader(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", token)
+
+		resp, _ := app.Test(req, -1)
+		a.Equal(test.expectedCode, resp.StatusCode, test.description)
+		if resp.StatusCode == fiber.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			var result map[string]any
+			json.Unmarshal(body, &result)
+			data, _ := result["data"].(map[string]any)
+			a.Equal(test.expectedText, data["text"], test.description)
+			a.Equal(float64(test.expectedSegments), data["segments"], test.description)
+		}
+	}
+}
+
+func TestSMSCampaignDryRun(t *testing.T) {
+	token := createTestAccessToken()
+	// Setup Fiber app
+	app := fiber.New()
+	app.Use(Authenticate)
+	// Define the route
+	app.Post("/sms-campaign/dry-run", SMSCampaignDryRun)
+	tests := []struct {
+		description  string
+		payload      map[string]any
+		expectedCode int
+	}{
+		{
+			description:  "all customers with preview",
+			payload:      map[string]any{"template_name": "campaign.unclaimed_prize"},
+			expectedCode: fiber.StatusOK,
+		},
+		{
+			description:  "segment filters",
+			payload:      map[string]any{"filters": map[string]any{"network_operators": []string{"MTN"}, "min_entries": 1, "winners": "not_won", "entry_start_date": "2024-01-01", "entry_end_date": "2024-12-31"}},
+			expectedCode: fiber.StatusOK,
+		},
+		{
+			description:  "invalid date range",
+			payload:      map[string]any{"filters": map[string]any{"registered_start_date": "2024-12-31", "registered_end_date": "2024-01-01"}},
+			expectedCode: fiber.StatusNotAcceptable,
+		},
+		{
+			description:  "invalid winners filter",
+			payload:      map[string]any{"filters": map[string]any{"winners": "everyone"}},
+			expectedCode: fiber.StatusBadRequest,
+		},
+		{
+			description:  "unknown template",
+			payload:      map[string]any{"template_name": "missing_template"},
+			expectedCode: fiber.StatusNotFound,
+		},
+	}
+	// Initialize the assert object
+	a := assert.New(t)
+	for _, test := range tests {
+		reqBody, _ := json.Marshal(test.payload)
+		req := httptest.NewRequest("POST", "/sms-campaign/dry-run", bytes.NewReader(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", token)
+
+		resp, _ := app.Test(req, -1)
+		a.Equal(test.expectedCode, resp.StatusCode, test.description)
+		if resp.StatusCode == fiber.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			var result map[string]any
+			json.Unmarshal(body, &result)
+			data, _ := result["data"].(map[string]any)
+			a.Contains(data, "recipients", test.description)
+			a.Contains(data, "opted_out", test.description)
+		}
+	}
+}
+
+func TestSMSInbound(t *testing.T) {
+	viper.Set("sms.mo_token", "test-mo-token")
+	// Setup Fiber app
+	app := fiber.New()
+	// Define the route
+	app.Post("/sms/mo", SMSInbound)
+	tests := []struct {
+		description     string
+		token           string
+		payload         map[string]any
+		expectedCode    int
+		expectedKeyword string
+		expectedOptOut  bool
+	}{
+		{
+			description:  "invalid token",
+			token:        "wrong-token",
+			payload:      map[string]any{"from": "250785753712", "message": "STOP"},
+			expectedCode: fiber.StatusUnauthorized,
+		},
+		{
+			description:  "missing message",
+			token:        "test-mo-token",
+			payload:      map[string]any{"from": "250785753712"},
+			expectedCode: fiber.StatusBadRequest,
+		},
+		{
+			description:     "stop keyword",
+			token:           "test-mo-token",
+			payload:         map[string]any{"from": "0785753712", "message": "stop", "message_id": "MO_1"},
+			expectedCode:    fiber.StatusOK,
+			expectedKeyword: "STOP",
+			expectedOptOut:  true,
+		},
+		{
+			description:     "help keyword keeps the preference",
+			token:           "test-mo-token",
+			payload:         map[string]any{"from": "+250785753712", "message": "Help"},
+			expectedCode:    fiber.StatusOK,
+			expectedKeyword: "HELP",
+			expectedOptOut:  true,
+		},
+		{
+			description:     "start keyword",
+			token:           "test-mo-token",
+			payload:         map[string]any{"from": "250785753712", "message": "START"},
+			expectedCode:    fiber.StatusOK,
+			expectedKeyword: "START",
+			expectedOptOut:  false,
+		},
+		{
+			description:     "not a keyword",
+			token:           "test-mo-token",
+			payload:         map[string]any{"from": "250785753712", "message": "hello"},
+			expectedCode:    fiber.StatusOK,
+			expectedKeyword: "",
+			expectedOptOut:  false,
+		},
+	}
+	// Initialize the assert object
+	a := assert.New(t)
+	for _, test := range tests {
+		reqBody, _ := json.Marshal(test.payload)
+		req := httptest.NewRequest("POST", "/sms/mo", bytes.NewReader(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-MO-Token", test.token)
+
+		resp, _ := app.Test(req, -1)
+		a.Equal(test.expectedCode, resp.StatusCode, test.description)
+		if resp.StatusCode == fiber.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			var result map[string]any
+			json.Unmarshal(body, &result)
+			a.Equal(test.expectedKeyword, result["keyword"], test.description)
+			var optOut bool
+			config.DB.QueryRow(ctx, `select sms_opt_out from customer where id=1`).Scan(&optOut)
+			a.Equal(test.expectedOptOut, optOut, test.description)
+		}
+	}
+}
+
+func TestChangeCodeBatchStatus(t *testing.T) {
+	token := createTestAccessToken()
+	var batchId int
+	err := config.DB.QueryRow(ctx, `INSERT INTO code_batch (reference, product, status) VALUES ($1, 'Fanta', 'ACTIVE') returning id`,
+		fmt.Sprintf("TEST-BATCH-%d", time.Now().UnixNano())).Scan(&batchId)
+	if err != nil {
+		t.Fatal("Error inserting code_batch data", err)
+	}
+	// Setup Fiber app
+	app := fiber.New()
+	app.Use(Authenticate)
+	// Define the route
+	app.Post("/code-batch/:batch_id/status", ChangeCodeBatchStatus)
+	tests := []struct {
+		description  string
+		batchId      int
+		payload      map[string]any
+		expectedCode int
+	}{
+		{
+			description:  "suspend active batch",
+			batchId:      batchId,
+			payload:      map[string]any{"status": "SUSPENDED", "reason": "bottling line audit"},
+			expectedCode: fiber.StatusOK,
+		},
+		{
+			description:  "activate suspended batch",
+			batchId:      batchId,
+			payload:      map[string]any{"status": "ACTIVE", "reason": "audit completed"},
+			expectedCode: fiber.StatusOK,
+		},
+		{
+			description:  "void batch",
+			batchId:      batchId,
+			payload:      map[string]any{"status": "VOIDED", "reason": "codes leaked"},
+			expectedCode: fiber.StatusOK,
+		},
+		{
+			description:  "voided batch is final",
+			batchId:      batchId,
+			payload:      map[string]any{"status": "ACTIVE", "reason": "mistake"},
+			expectedCode: fiber.StatusNotAcceptable,
+		},
+		{
+			description:  "invalid status",
+			batchId:      batchId,
+			payload:      map[string]any{"status": "DELETED", "reason": "mistake"},
+			expectedCode: fiber.StatusBadRequest,
+		},
+		{
+			description:  "unknown batch",
+			batchId:      999999,
+			payload:      map[string]any{"status": "SUSPENDED", "reason": "bottling line audit"},
+			expectedCode: fiber.StatusNotFound,
+		},
+	}
+	// Initialize the assert object
+	a := assert.New(t)
+	for _, test := range tests {
+		reqBody, _ := json.Marshal(test.payload)
+		req := httptest.NewRequest("POST", fmt.Sprintf("/code-batch/%d/status", test.batchId), bytes.NewReader(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", token)
+
+		resp, _ := app.Test(req, -1)
+		a.Equal(test.expectedCode, resp.StatusCode, test.description)
+	}
+}
+
+func TestReadImportCode(t *testing.T) {
+	legacy := utils.CodeFormat{Length: 10, CheckDigit: utils.CheckDigitNone}
+	luhn := utils.CodeFormat{Alphabet: utils.DefaultCodeAlphabet, Length: 10, CheckDigit: utils.CheckDigitLuhn}
+	damm := utils.CodeFormat{Alphabet: "0123456789", Length: 8, CheckDigit: utils.CheckDigitDamm}
+	tests := []struct {
+		description    string
+		line           int
+		columns        []string
+		xlsx           bool
+		format         utils.CodeFormat
+		expectedCode   string
+		expectedDetail string
+		expectedEmpty  bool
+	}{
+		{
+			description:  "valid code",
+			line:         1,
+			format:       legacy,
+			columns:      []string{" ab12cd34ef "},
+			expectedCode: "AB12CD34EF",
+		},
+		{
+			description:   "blank line",
+			line:          2,
+			format:        legacy,
+			columns:       []string{"   "},
+			expectedEmpty: true,
+		},
+		{
+			description:   "excel header",
+			line:          1,
+			format:        legacy,
+			columns:       []string{"code"},
+			xlsx:          true,
+			expectedEmpty: true,
+		},
+		{
+			description:    "invalid length",
+			line:           3,
+			format:         legacy,
+			columns:        []string{"AB12"},
+			expectedCode:   "AB12",
+			expectedDetail: "invalid code length, code should be 10 characters",
+		},
+		{
+			description:    "many codes in a row",
+			line:           4,
+			format:         legacy,
+			columns:        []string{"AB12CD34EF", "AB12CD34EG"},
+			xlsx:           true,
+			expectedCode:   "AB12CD34EF,AB12CD34EG",
+			expectedDetail: "each row should contain only one code",
+		},
+		{
+			description:  "valid luhn mod N code",
+			line:         5,
+			columns:      []string{"acdefghjk4"},
+			format:       luhn,
+			expectedCode: "ACDEFGHJK4",
+		},
+		{
+			description:    "mistyped luhn mod N code",
+			line:           6,
+			columns:        []string{"ACDEFGHJKA"},
+			format:         luhn,
+			expectedCode:   "ACDEFGHJKA",
+			expectedDetail: "invalid code, a character is not in the alphabet or the check character is wrong",
+		},
+		{
+			description:  "valid damm code",
+			line:         7,
+			columns:      []string{"05723415"},
+			format:       damm,
+			expectedCode: "05723415",
+		},
+		{
+			description:    "damm code with swapped digits",
+			line:           8,
+			columns:        []string{"07523415"},
+			format:         damm,
+			expectedCode:   "07523415",
+			expectedDetail: "invalid code, a character is not in the alphabet or the check character is wrong",
+		},
+	}
+	// Initialize the assert object
+	a := assert.New(t)
+	for _, test := range tests {
+		code, detail, empty := readImportCode(test.line, test.columns, test.xlsx, test.format)
+		a.Equal(test.expectedCode, code, test.description)
+		a.Equal(test.expectedDetail, detail, test.description)
+		a.Equal(test.expectedEmpty, empty, test.description)
+	}
+}
+
+func TestMatchAnyCodeFormat(t *testing.T) {
+	legacy := utils.CodeFormat{Length: utils.LegacyCodeLength, CheckDigit: utils.CheckDigitNone}
+	luhn := utils.CodeFormat{Alphabet: utils.DefaultCodeAlphabet, Length: 10, CheckDigit: utils.CheckDigitLuhn}
+	tests := []struct {
+		description string
+		code        string
+		formats     []utils.CodeFormat
+		expected    bool
+	}{
+		{
+			description: "legacy code",
+			code:        "AB12CD34EF",
+			formats:     []utils.CodeFormat{legacy},
+			expected:    true,
+		},
+		{
+			description: "legacy format checks the length",
+			code:        "AB12",
+			formats:     []utils.CodeFormat{legacy},
+			expected:    false,
+		},
+		{
+			description: "mistyped luhn mod N code with a legacy batch active",
+			code:        "ACDEFGHJK",
+			formats:     []utils.CodeFormat{luhn, legacy},
+			expected:    false,
+		},
+		{
+			description: "valid luhn mod N code",
+			code:        "ACDEFGHJK4",
+			formats:     []utils.CodeFormat{luhn},
+			expected:    true,
+		},
+	}
+	a := assert.New(t)
+	for _, test := range tests {
+		a.Equal(test.expected, utils.MatchAnyCodeFormat(test.code, test.formats), test.description)
+	}
+}
+
+func TestGenerateCodes(t *testing.T) {
+	tests := []struct {
+		description  string
+		body         map[string]interface{}
+		signingKey   string
+		expectedCode int
+	}{
+		{
+			description:  "alphabet with a repeated character",
+			body:         map[string]interface{}{"batch_reference": "GEN-TEST-1", "product": "Fanta", "quantity": 1000, "alphabet": "ABCA", "length": 10},
+			signingKey:   "signing-secret",
+			expectedCode: 406,
+		},
+		{
+			description:  "codes too short to be unguessable",
+			body:         map[string]interface{}{"batch_reference": "GEN-TEST-2", "product": "Fanta", "quantity": 1000, "length": 6},
+			signingKey:   "signing-secret",
+			expectedCode: 406,
+		},
+		{
+			description:  "too many codes for the code space",
+			body:         map[string]interface{}{"batch_reference": "GEN-TEST-3", "product": "Fanta", "quantity": 50000000, "length": 10},
+			signingKey:   "signing-secret",
+			expectedCode: 406,
+		},
+		{
+			description:  "missing signing key",
+			body:         map[string]interface{}{"batch_reference": "GEN-TEST-4", "product": "Fanta", "quantity": 1000, "length": 12},
+			expectedCode: 417,
+		},
+		{
+			description:  "invalid export format",
+			body:         map[string]interface{}{"batch_reference": "GEN-TEST-5", "product": "Fanta", "quantity": 1000, "export_format": "pdf"},
+			signingKey:   "signing-secret",
+			expectedCode: 400,
+		},
+	}
+	app := fiber.New()
+	app.Use(Authenticate)
+	app.Post("/code-generation", GenerateCodes)
+	token := createTestAccessToken()
+	// Initialize the assert object
+	a := assert.New(t)
+	for _, test := range tests {
+		viper.Set("code_generator.signing_key", test.signingKey)
+		body, _ := json.Marshal(test.body)
+		req := httptest.NewRequest("POST", "/code-generation", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, _ := app.Test(req, -1)
+		a.Equal(test.expectedCode, resp.StatusCode, test.description)
+	}
+	viper.Set("code_generator.signing_key", "")
+
+	format := utils.CodeFormat{Alphabet: utils.DefaultCodeAlphabet, Length: 10, CheckDigit: utils.CheckDigitLuhn}
+	a.Nil(format.Validate())
+	for i := 0; i < 100; i++ {
+		code, err := format.GenerateCode()
+		a.Nil(err)
+		a.Len(code, 10)
+		a.True(utils.ValidLuhnModN(code, format.Alphabet), code)
+		//a single mistyped character is caught by the check character
+		typo := []byte(code)
+		typo[i%9] = format.Alphabet[(strings.IndexByte(format.Alphabet, typo[i%9])+1)%len(format.Alphabet)]
+		a.False(utils.ValidLuhnModN(string(typo), format.Alphabet), string(typo))
+	}
+}
+
+func TestReviewCodeFraudFlag(t *testing.T) {
+	token := createTestAccessToken()
+	phone := fmt.Sprintf("25078%07d", time.Now().UnixNano()%10000000)
+	var flagId int
+	err := config.DB.QueryRow(ctx, `INSERT INTO code_fraud_flag (phone_hash, phone_masked, reason, invalid_attempts, lockouts)
+	VALUES (digest($1,'sha256'), $2, '3 lockouts for invalid codes', 15, 3) returning id`, phone, utils.MaskPhone(phone)).Scan(&flagId)
+	if err != nil {
+		t.Fatal("Error inserting code_fraud_flag data", err)
+	}
+	// Setup Fiber app
+	app := fiber.New()
+	app.Use(Authenticate)
+	// Define the route
+	app.Post("/code-fraud-flag/:flag_id/review", ReviewCodeFraudFlag)
+	tests := []struct {
+		description  string
+		flagId       int
+		payload      map[string]any
+		expectedCode int
+	}{
+		{
+			description:  "missing note",
+			flagId:       flagId,
+			payload:      map[string]any{"status": "CLEARED"},
+			expectedCode: fiber.StatusBadRequest,
+		},
+		{
+			description:  "confirm open flag",
+			flagId:       flagId,
+			payload:      map[string]any{"status": "CONFIRMED", "note": "scripted guessing from the same aggregator"},
+			expectedCode: fiber.StatusOK,
+		},
+		{
+			description:  "confirmed flag can not be confirmed again",
+			flagId:       flagId,
+			payload:      map[string]any{"status": "CONFIRMED", "note": "again"},
+			expectedCode: fiber.StatusNotAcceptable,
+		},
+		{
+			description:  "clear confirmed flag",
+			flagId:       flagId,
+			payload:      map[string]any{"status": "CLEARED", "note": "customer called, kid playing with the phone"},
+			expectedCode: fiber.StatusOK,
+		},
+		{
+			description:  "unknown flag",
+			flagId:       999999,
+			payload:      map[string]any{"status": "CLEARED", "note": "customer called"},
+			expectedCode: fiber.StatusNotFound,
+		},
+	}
+	// Initialize the assert object
+	a := assert.New(t)
+	for _, test := range tests {
+		reqBody, _ := json.Marshal(test.payload)
+		req := httptest.NewRequest("POST", fmt.Sprintf("/code-fraud-flag/%d/review", test.flagId), bytes.NewReader(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", token)
+
+		resp, _ := app.Test(req, -1)
+		a.Equal(test.expectedCode, resp.StatusCode, test.description)
+	}
+}
+
+func TestMomoNamesHash(t *testing.T) {
+	tests := []struct {
+		description string
+		names       string
+		other       string
+		expectSame  bool
+	}{
+		{
+			description: "case and spaces are ignored",
+			names:       "KALISA  Jean ",
+			other:       "kalisa jean",
+			expectSame:  true,
+		},
+		{
+			description: "different names",
+			names:       "KALISA Jean",
+			other:       "KALISA John",
+			expectSame:  false,
+		},
+	}
+	// Initialize the assert object
+	a := assert.New(t)
+	for _, test := range tests {
+		a.Equal(test.expectSame, bytes.Equal(utils.MomoNamesHash(test.names), utils.MomoNamesHash(test.other)), test.description)
+	}
+	a.Nil(utils.MomoNamesHash("   "), "blank name")
+}
+
+func TestReviewFraudCase(t *testing.T) {
+	token := createTestAccessToken()
+	phone := fmt.Sprintf("25072%07d", time.Now().UnixNano()%10000000)
+	var customerId, caseId int
+	err := config.DB.QueryRow(ctx, `INSERT INTO customer (names,phone,phone_hash,province,district,locale,network_operator,status)
+	VALUES (pgp_sym_encrypt('MUGISHA Eric', 'secret'),pgp_sym_encrypt($1, 'secret')::bytea,digest($1, 'sha256')::bytea,5,3,'en','MTN','REVIEW') returning id`, phone).
+		Scan(&customerId)
+	if err != nil {
+		t.Fatal("Error inserting customer data", err)
+	}
+	err = config.DB.QueryRow(ctx, `INSERT INTO fraud_case (customer_id, score, signals)
+	VALUES ($1, 70, '[{"rule":"entry_velocity","score":40,"detail":"25 entries within the last hour"},{"rule":"shared_momo_name","score":30,"detail":"MoMo name shared by 4 customers"}]')
+	returning id`, customerId).Scan(&caseId)
+	if err != nil {
+		t.Fatal("Error inserting fraud_case data", err)
+	}
+	// Setup Fiber app
+	app := fiber.New()
+	app.Use(Authenticate)
+	// Define the route
+	app.Post("/fraud-case/:case_id/review", ReviewFraudCase)
+	tests := []struct {
+		description    string
+		caseId         int
+		payload        map[string]any
+		expectedCode   int
+		expectedStatus string
+	}{
+		{
+			description:    "invalid status",
+			caseId:         caseId,
+			payload:        map[string]any{"status": "OPEN", "note": "reopen"},
+			expectedCode:   fiber.StatusBadRequest,
+			expectedStatus: "REVIEW",
+		},
+		{
+			description:    "confirm open case",
+			caseId:         caseId,
+			payload:        map[string]any{"status": "CONFIRMED", "note": "codes bought from a distributor"},
+			expectedCode:   fiber.StatusOK,
+			expectedStatus: "FRAUD",
+		},
+		{
+			description:    "clear confirmed case",
+			caseId:         caseId,
+			payload:        map[string]any{"status": "CLEARED", "note": "shop owner entering codes of his customers"},
+			expectedCode:   fiber.StatusOK,
+			expectedStatus: "OKAY",
+		},
+		{
+			description:    "cleared case is final",
+			caseId:         caseId,
+			payload:        map[string]any{"status": "CONFIRMED", "note": "mistake"},
+			expectedCode:   fiber.StatusNotAcceptable,
+			expectedStatus: "OKAY",
+		},
+	}
+	// Initialize the assert object
+	a := assert.New(t)
+	for _, test := range tests {
+		reqBody, _ := json.Marshal(test.payload)
+		req := httptest.NewRequest("POST", fmt.Sprintf("/fraud-case/%d/review", test.caseId), bytes.NewReader(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", token)
+
+		resp, _ := app.Test(req, -1)
+		a.Equal(test.expectedCode, resp.StatusCode, test.description)
+		var status string
+		config.DB.QueryRow(ctx, `select status from customer where id=$1`, customerId).Scan(&status)
+		a.Equal(test.expectedStatus, status, test.description)
+	}
+}
+
+func TestPrizeExclusion(t *testing.T) {
+	token := createTestAccessToken()
+	number := fmt.Sprintf("%07d", time.Now().UnixNano()%10000000)
+	phone := "25073" + number
+	var customerId int
+	err := config.DB.QueryRow(ctx, `INSERT INTO customer (names,phone,phone_hash,province,district,locale,network_operator)
+	VALUES (pgp_sym_encrypt('KAMANZI Jean', 'secret'),pgp_sym_encrypt($1, 'secret')::bytea,digest($1, 'sha256')::bytea,5,3,'en','MTN') returning id`, phone).
+		Scan(&customerId)
+	if err != nil {
+		t.Fatal("Error inserting customer data", err)
+	}
+	// Setup Fiber app
+	app := fiber.New()
+	app.Use(Authenticate)
+	// Define the routes
+	app.Post("/prize-exclusion", AddPrizeExclusion)
+	app.Post("/prize-exclusion/:exclusion_id/remove", RemovePrizeExclusion)
+	tests := []struct {
+		description   string
+		payload       map[string]any
+		expectedCode  int
+		expectedMatch bool
+	}{
+		{
+			description:   "invalid phone",
+			payload:       map[string]any{"exclusion_type": "PHONE", "value": "07312", "reason": "staff"},
+			expectedCode:  fiber.StatusNotAcceptable,
+			expectedMatch: false,
+		},
+		{
+			description:   "unknown type",
+			payload:       map[string]any{"exclusion_type": "EMAIL", "value": "staff@bralirwa.rw", "reason": "staff"},
+			expectedCode:  fiber.StatusBadRequest,
+			expectedMatch: false,
+		},
+		{
+			description:   "local phone format",
+			payload:       map[string]any{"exclusion_type": "PHONE", "value": "073 " + number, "reason": "marketing staff"},
+			expectedCode:  fiber.StatusCreated,
+			expectedMatch: true,
+		},
+		{
+			description:   "same phone with country code",
+			payload:       map[string]any{"exclusion_type": "PHONE", "value": "+" + phone, "reason": "marketing staff"},
+			expectedCode:  fiber.StatusConflict,
+			expectedMatch: true,
+		},
+	}
+	// Initialize the assert object
+	a := assert.New(t)
+	for _, test := range tests {
+		reqBody, _ := json.Marshal(test.payload)
+		req := httptest.NewRequest("POST", "/prize-exclusion", bytes.NewReader(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", token)
+
+		resp, _ := app.Test(req, -1)
+		a.Equal(test.expectedCode, resp.StatusCode, test.description)
+		hit, err := utils.MatchPrizeExclusion(config.DB, customerId)
+		a.Nil(err, test.description)
+		a.Equal(test.expectedMatch, hit != nil, test.description)
+	}
+	var exclusionId int
+	config.DB.QueryRow(ctx, `select id from prize_exclusion where value_hash = digest($1,'sha256') and status = 'ACTIVE'`, phone).Scan(&exclusionId)
+	for _, expectedCode := range []int{fiber.StatusOK, fiber.StatusNotFound} {
+		req := httptest.NewRequest("POST", fmt.Sprintf("/prize-exclusion/%d/remove", exclusionId), nil)
+		req.Header.Set("Authorization", token)
+		resp, _ := app.Test(req, -1)
+		a.Equal(expectedCode, resp.StatusCode, "remove exclusion")
+	}
+	hit, err := utils.MatchPrizeExclusion(config.DB, customerId)
+	a.Nil(err)
+	a.Nil(hit, "removed exclusion should not match")
+}
+
+func TestRequirePermission(t *testing.T) {
+	access_token := createTestAccessToken()
+	//an auditor token, it can read the logs but can not trigger a draw
+	auditor, err := utils.CreateSession(config.Redis, model.UserProfile{Id: 2, Email: "test@qonics.com", Status: "OKAY", Permissions: []string{"logs.view"}}, "0.0.0.0", "test")
+	if err != nil {
+		t.Fatal("Error creating auditor session", err)
+	}
+	auditorToken := auditor.AccessToken
+	// Setup Fiber app
+	app := fiber.New()
+	app.Use(Authenticate)
+	// Define the routes
+	handler := func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success"})
+	}
+	app.Get("/logs", RequirePermission("logs.view"), handler)
+	app.Post("/draw", RequirePermission("draws.trigger"), handler)
+	tests := []struct {
+		description  string
+		method       string
+		route        string
+		token        string
+		expectedCode int
+	}{
+		{
+			description:  "missing token",
+			method:       "GET",
+			route:        "/logs",
+			expectedCode: fiber.StatusUnauthorized,
+		},
+		{
+			description:  "auditor reads logs",
+			method:       "GET",
+			route:        "/logs",
+			token:        auditorToken,
+			expectedCode: fiber.StatusOK,
+		},
+		{
+			description:  "auditor triggers a draw",
+			method:       "POST",
+			route:        "/draw",
+			token:        auditorToken,
+			expectedCode: fiber.StatusUnauthorized,
+		},
+		{
+			description:  "admin triggers a draw",
+			method:       "POST",
+			route:        "/draw",
+			token:        access_token,
+			expectedCode: fiber.StatusOK,
+		},
+	}
+	// Initialize the assert object
+	a := assert.New(t)
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.route, nil)
+		if test.token != "" {
+			req.Header.Set("Authorization", test.token)
+		}
+		resp, _ := app.Test(req, -1)
+		a.Equal(test.expectedCode, resp.StatusCode, test.description)
+	}
+}
+
+func TestSaveRole(t *testing.T) {
+	access_token := createTestAccessToken()
+	// Setup Fiber app
+	app := fiber.New()
+	app.Use(Authenticate)
+	// Define the routes
+	app.Post("/role", SaveRole)
+	app.Post("/role/:role_id/delete", DeleteRole)
+	roleName := fmt.Sprintf("Payout clerk %d", time.Now().UnixNano()%100000)
+	tests := []struct {
+		description  string
+		payload      map[string]any
+		expectedCode int
+	}{
+		{
+			description:  "unknown permission",
+			payload:      map[string]any{"name": roleName, "permissions": []string{"transactions.view", "payouts.everything"}},
+			expectedCode: fiber.StatusNotAcceptable,
+		},
+		{
+			description:  "no permission",
+			payload:      map[string]any{"name": roleName, "permissions": []string{}},
+			expectedCode: fiber.StatusNotAcceptable,
+		},
+		{
+			description:  "new role",
+			payload:      map[string]any{"name": roleName, "permissions": []string{"transactions.view", "transactions.confirm", "transactions.view"}},
+			expectedCode: fiber.StatusOK,
+		},
+		{
+			description:  "duplicate name",
+			payload:      map[string]any{"name": roleName, "permissions": []string{"transactions.view"}},
+			expectedCode: fiber.StatusConflict,
+		},
+	}
+	// Initialize the assert object
+	a := assert.New(t)
+	for _, test := range tests {
+		reqBody, _ := json.Marshal(test.payload)
+		req := httptest.NewRequest("POST", "/role", bytes.NewReader(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", access_token)
+
+		resp, _ := app.Test(req, -1)
+		a.Equal(test.expectedCode, resp.StatusCode, test.description)
+	}
+	var roleId, permissions int
+	err := config.DB.QueryRow(ctx, `select r.id,(select count(*) from role_permissions rp where rp.role_id = r.id) from roles r where r.name=$1`, roleName).
+		Scan(&roleId, &permissions)
+	a.Nil(err)
+	a.Equal(2, permissions, "permissions of the new role")
+	//a role assigned to a user can not be deleted
+	_, err = config.DB.Exec(ctx, `insert into user_roles (user_id, role_id) values (2, $1)`, roleId)
+	a.Nil(err)
+	req := httptest.NewRequest("POST", fmt.Sprintf("/role/%d/delete", roleId), nil)
+	req.Header.Set("Authorization", access_token)
+	resp, _ := app.Test(req, -1)
+	a.Equal(fiber.StatusNotAcceptable, resp.StatusCode, "delete assigned role")
+	config.DB.Exec(ctx, `delete from user_roles where user_id = 2 and role_id = $1`, roleId)
+	req = httptest.NewRequest("POST", fmt.Sprintf("/role/%d/delete", roleId), nil)
+	req.Header.Set("Authorization", access_token)
+	resp, _ = app.Test(req, -1)
+	a.Equal(fiber.StatusOK, resp.StatusCode, "delete role")
+}
+func TestManageHigherPrivilegedUser(t *testing.T) {
+	//a user administrator without the other permissions of the admin test user
+	operator := model.UserProfile{Id: 2, Email: "test@qonics.com", Status: "OKAY", Permissions: []string{"users.view", "users.manage"}}
+	tokens, err := utils.CreateSession(config.Redis, operator, "0.0.0.0", "test")
+	if err != nil {
+		t.Fatal("Unable to create test session", err)
+	}
+	// Setup Fiber app
+	app := fiber.New()
+	app.Use(Authenticate)
+	app.Post("/user/:userId", EditUser)
+	app.Post("/user/:userId/2fa/reset", ResetUserTwoFactor)
+	app.Post("/user/:userId/unlock", UnlockUser)
+	tests := []struct {
+		description string
+		route       string
+		payload     map[string]any
+	}{
+		{
+			description: "change the phone of a user with more permissions",
+			route:       "/user/2",
+			payload:     map[string]any{"fname": "Test", "lname": "user", "phone": "250788000111", "email": "test@qonics.com", "department": 1, "roles": []int{1}},
+		},
+		{
+			description: "reset the second factor of a user with more permissions",
+			route:       "/user/2/2fa/reset",
+		},
+		{
+			description: "unlock a user with more permissions",
+			route:       "/user/2/unlock",
+		},
+	}
+	// Initialize the assert object
+	a := assert.New(t)
+	for _, test := range tests {
+		reqBody, _ := json.Marshal(test.payload)
+		req := httptest.NewRequest("POST", test.route, bytes.NewReader(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", tokens.AccessToken)
+		resp, _ := app.Test(req, -1)
+		a.Equal(fiber.StatusNotAcceptable, resp.StatusCode, test.description)
+	}
+}
+func TestSessions(t *testing.T) {
+	// Setup Fiber app
+	app := fiber.New()
+	app.Post("/login", LoginWithEmail)
+	app.Post("/refresh", RefreshSession)
+	app.Use(Authenticate)
+	app.Get("/sessions", GetSessions)
+	app.Post("/logout", Logout)
+	app.Post("/logout/all", LogoutEverywhere)
+	// Initialize the assert object
+	a := assert.New(t)
+	login := func() (string, string) {
+		status, data := sendTestRequest(t, app, "POST", "/login", "", map[string]string{"email": "test@qonics.com", "password": "P@as12.W0d"})
+		a.Equal(fiber.StatusOK, status, "login")
+		a.NotEmpty(data["refreshToken"], "login returns a refresh token")
+		accessToken, _ := data["accessToken"].(string)
+		refreshToken, _ := data["refreshToken"].(string)
+		return accessToken, refreshToken
+	}
+	accessToken, refreshToken := login()
+	otherToken, _ := login()
+
+	status, data := sendTestRequest(t, app, "GET", "/sessions", accessToken, nil)
+	a.Equal(fiber.StatusOK, status, "list sessions")
+	sessions, _ := data["data"].([]interface{})
+	a.GreaterOrEqual(len(sessions), 2, "both logins are listed")
+	current := 0
+	for _, session := range sessions {
+		if session.(map[string]interface{})["current"] == true {
+			current++
+		}
+	}
+	a.Equal(1, current, "the current session is marked")
+
+	status, data = sendTestRequest(t, app, "POST", "/refresh", "", map[string]string{"refresh_token": refreshToken})
+	a.Equal(fiber.StatusOK, status, "refresh session")
+	newAccessToken, _ := data["accessToken"].(string)
+	status, _ = sendTestRequest(t, app, "GET", "/sessions", accessToken, nil)
+	a.Equal(fiber.StatusUnauthorized, status, "the previous access token is no longer valid")
+	status, _ = sendTestRequest(t, app, "GET", "/sessions", newAccessToken, nil)
+	a.Equal(fiber.StatusOK, status, "the new access token is valid")
+
+	status, _ = sendTestRequest(t, app, "POST", "/refresh", "", map[string]string{"refresh_token": refreshToken})
+	a.Equal(fiber.StatusUnauthorized, status, "a refresh token can be used once")
+	status, _ = sendTestRequest(t, app, "GET", "/sessions", newAccessToken, nil)
+	a.Equal(fiber.StatusUnauthorized, status, "reusing a refresh token revokes the session")
+
+	status, _ = sendTestRequest(t, app, "POST", "/logout", otherToken, nil)
+	a.Equal(fiber.StatusOK, status, "logout")
+	status, _ = sendTestRequest(t, app, "GET", "/sessions", otherToken, nil)
+	a.Equal(fiber.StatusUnauthorized, status, "the token is revoked on logout")
+
+	accessToken, _ = login()
+	otherToken, _ = login()
+	status, _ = sendTestRequest(t, app, "POST", "/logout/all", accessToken, nil)
+	a.Equal(fiber.StatusOK, status, "logout everywhere")
+	status, _ = sendTestRequest(t, app, "GET", "/sessions", otherToken, nil)
+	a.Equal(fiber.StatusUnauthorized, status, "all sessions are revoked")
+}
+func TestStepUp(t *testing.T) {
+	access_token := createTestAccessToken()
+	// Setup Fiber app
+	app := fiber.New()
+	app.Use(Authenticate)
+	app.Post("/step-up", StepUp)
+	app.Post("/draw", RequireStepUp, func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success"})
+	})
+	tests := []struct {
+		description  string
+		route        string
+		payload      map[string]any
+		expectedCode int
+	}{
+		{
+			description:  "sensitive action without re-authentication",
+			route:        "/draw",
+			expectedCode: fiber.StatusUnauthorized,
+		},
+		{
+			description:  "missing password",
+			route:        "/step-up",
+			payload:      map[string]any{},
+			expectedCode: fiber.StatusBadRequest,
+		},
+		{
+			description:  "invalid password",
+			route:        "/step-up",
+			payload:      map[string]any{"password": "P@as12.W0s"},
+			expectedCode: fiber.StatusUnauthorized,
+		},
+		{
+			description:  "re-authenticated",
+			route:        "/step-up",
+			payload:      map[string]any{"password": "P@as12.W0d"},
+			expectedCode: fiber.StatusOK,
+		},
+		{
+			description:  "sensitive action after re-authentication",
+			route:        "/draw",
+			expectedCode: fiber.StatusOK,
+		},
+	}
+	// Initialize the assert object
+	a := assert.New(t)
+	for _, test := range tests {
+		reqBody, _ := json.Marshal(test.payload)
+		req := httptest.NewRequest("POST", test.route, bytes.NewReader(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", access_token)
+		resp, _ := app.Test(req, -1)
+		a.Equal(test.expectedCode, resp.StatusCode, test.description)
+	}
+}
+func TestTwoFactor(t *testing.T) {
+	access_token := createTestAccessToken()
+	//leave the test user without second factor for the other tests
+	defer config.DB.Exec(ctx, `update users set totp_secret=null,totp_enabled_at=null where id=2`)
+	// Setup Fiber app
+	app := fiber.New()
+	app.Post("/login", LoginWithEmail)
+	app.Post("/login/2fa", VerifyLoginTwoFactor)
+	app.Use(Authenticate)
+	app.Post("/2fa/enroll", EnrollTwoFactor)
+	app.Post("/2fa/enable", EnableTwoFactor)
+	// Initialize the assert object
+	a := assert.New(t)
+	status, data := sendTestRequest(t, app, "POST", "/2fa/enroll", access_token, nil)
+	a.Equal(fiber.StatusOK, status, "enroll")
+	a.Contains(data["otpauth_url"], "otpauth://totp/", "enroll returns the QR code uri")
+	secret, _ := data["secret"].(string)
+
+	status, _ = sendTestRequest(t, app, "POST", "/2fa/enable", access_token, map[string]string{"code": "000000"})
+	a.Equal(fiber.StatusUnauthorized, status, "invalid code")
+	code, _ := utils.TOTPCode(secret, utils.TOTPCounter(time.Now()))
+	status, data = sendTestRequest(t, app, "POST", "/2fa/enable", access_token, map[string]string{"code": code})
+	a.Equal(fiber.StatusOK, status, "enable")
+	recoveryCodes, _ := data["recovery_codes"].([]interface{})
+	a.Len(recoveryCodes, recoveryCodesCount, "recovery codes are returned")
+	status, _ = sendTestRequest(t, app, "POST", "/2fa/enroll", access_token, nil)
+	a.Equal(fiber.StatusOK, status, "enroll another authenticator")
+	status, data = sendTestRequest(t, app, "POST", "/2fa/enable", access_token, map[string]string{"code": code})
+	a.Equal(fiber.StatusUnauthorized, status, "replace the authenticator without step up")
+	a.Equal(true, data["step_up_required"], "replacing the authenticator asks for a step up")
+
+	status, data = sendTestRequest(t, app, "POST", "/login", "", map[string]string{"email": "test@qonics.com", "password": "P@as12.W0d"})
+	a.Equal(fiber.StatusOK, status, "login")
+	a.Equal(true, data["two_factor_required"], "login asks for the second factor")
+	a.Empty(data["accessToken"], "no session before the second factor")
+	challenge, _ := data["challenge"].(string)
+
+	status, _ = sendTestRequest(t, app, "POST", "/login/2fa", "", map[string]string{"challenge": challenge, "method": "totp", "code": code})
+	a.Equal(fiber.StatusUnauthorized, status, "a totp code is only accepted once")
+	status, data = sendTestRequest(t, app, "POST", "/login/2fa", "", map[string]string{"challenge": challenge, "method": "recovery", "code": recoveryCodes[0].(string)})
+	a.Equal(fiber.StatusOK, status, "login with a recovery code")
+	a.NotEmpty(data["accessToken"], "the session is opened")
+	status, _ = sendTestRequest(t, app, "POST", "/login/2fa", "", map[string]string{"challenge": challenge, "method": "recovery", "code": recoveryCodes[0].(string)})
+	a.Equal(fiber.StatusUnauthorized, status, "the challenge is used")
+}
+func TestLoginGuard(t *testing.T) {
+	access_token := createTestAccessToken()
+	//lock the account without waiting for the delays between failures
+	viper.Set("login_guard.delay_after", 100)
+	defer viper.Set("login_guard.delay_after", 0)
+	defer utils.ClearLoginGuard(config.Redis, "test@qonics.com")
+	// Setup Fiber app
+	app := fiber.New()
+	app.Post("/login", LoginWithEmail)
+	app.Use(Authenticate)
+	app.Get("/user/:userId/lockout", GetUserLockout)
+	app.Post("/user/:userId/unlock", UnlockUser)
+	// Initialize the assert object
+	a := assert.New(t)
+	maxAttempts := utils.GetLoginGuardSettings().MaxAccountAttempts
+	for attempt := 1; attempt < maxAttempts; attempt++ {
+		status, _ := sendTestRequest(t, app, "POST", "/login", "", map[string]string{"email": "test@qonics.com", "password": "wrong-password"})
+		a.Equal(fiber.StatusForbidden, status, "failed login before the lockout")
+	}
+	status, data := sendTestRequest(t, app, "POST", "/login", "", map[string]string{"email": "test@qonics.com", "password": "wrong-password"})
+	a.Equal(fiber.StatusTooManyRequests, status, "the account is locked after too many failures")
+	a.Equal(true, data["locked"], "lockout is reported")
+	status, _ = sendTestRequest(t, app, "POST", "/login", "", map[string]string{"email": "test@qonics.com", "password": "P@as12.W0d"})
+	a.Equal(fiber.StatusTooManyRequests, status, "a locked account can not login with the right password")
+
+	status, data = sendTestRequest(t, app, "GET", "/user/2/lockout", access_token, nil)
+	a.Equal(fiber.StatusOK, status, "get lockout")
+	a.Equal(true, data["data"].(map[string]interface{})["locked"], "the user is locked")
+	status, _ = sendTestRequest(t, app, "POST", "/user/2/unlock", access_token, nil)
+	a.Equal(fiber.StatusOK, status, "unlock user")
+	status, _ = sendTestRequest(t, app, "POST", "/user/2/unlock", access_token, nil)
+	a.Equal(fiber.StatusNotAcceptable, status, "the user is no longer locked")
+	status, _ = sendTestRequest(t, app, "POST", "/login", "", map[string]string{"email": "test@qonics.com", "password": "P@as12.W0d"})
+	a.Equal(fiber.StatusOK, status, "login after unlock")
+}
+func TestPasswordPolicy(t *testing.T) {
+	access_token := createTestAccessToken()
+	//restore the password of the test user for the other tests
+	defer config.DB.Exec(ctx, `UPDATE users SET password=crypt($1, gen_salt('bf')) WHERE id=$2`, "P@as12.W0d", 2)
+	// Setup Fiber app
+	app := fiber.New()
+	app.Use(Authenticate)
+	app.Post("/change_password", ChangePassword)
+	app.Use(RequirePasswordChange)
+	app.Get("/password_policy", GetPasswordPolicy)
+	// Initialize the assert object
+	a := assert.New(t)
+	status, _ := sendTestRequest(t, app, "GET", "/password_policy", access_token, nil)
+	a.Equal(fiber.StatusOK, status, "get password policy")
+
+	expired := time.Now().Add(-time.Minute)
+	for description, user := range map[string]model.UserProfile{
+		"forced password change":  {Id: 2, Email: "test@qonics.com", Status: "OKAY", ForceChangePassword: true},
+		"expired password change": {Id: 2, Email: "test@qonics.com", Status: "OKAY", PasswordExpiresAt: &expired},
+	} {
+		tokens, err := utils.CreateSession(config.Redis, user, "0.0.0.0", "test")
+		if err != nil {
+			t.Fatal("Unable to create test session", err)
+		}
+		status, data := sendTestRequest(t, app, "GET", "/password_policy", tokens.AccessToken, nil)
+		a.Equal(fiber.StatusForbidden, status, description)
+		a.Equal(true, data["password_change_required"], description)
+		status, _ = sendTestRequest(t, app, "POST", "/change_password", tokens.AccessToken, map[string]string{"current_password": "P@as12.W0d", "new_password": "N3w@Pass.1"})
+		a.Equal(fiber.StatusOK, status, description+": change password")
+		status, _ = sendTestRequest(t, app, "GET", "/password_policy", tokens.AccessToken, nil)
+		a.Equal(fiber.StatusOK, status, description+": the session is unblocked once changed")
+		status, _ = sendTestRequest(t, app, "POST", "/change_password", tokens.AccessToken, map[string]string{"current_password": "N3w@Pass.1", "new_password": "An0ther@Pw.2"})
+		a.Equal(fiber.StatusOK, status, description+": change password again")
+		status, _ = sendTestRequest(t, app, "POST", "/change_password", tokens.AccessToken, map[string]string{"current_password": "An0ther@Pw.2", "new_password": "N3w@Pass.1"})
+		a.Equal(fiber.StatusNotAcceptable, status, description+": a recent password can not be reused")
+		config.DB.Exec(ctx, `UPDATE users SET password=crypt($1, gen_salt('bf')) WHERE id=$2`, "P@as12.W0d", 2)
+		config.DB.Exec(ctx, `delete from user_password_history where user_id=2`)
+	}
+}
+func TestEmail(t *testing.T) {
+	access_token := createTestAccessToken()
+	//the emails are delivered to a local smtp sink
+	sink, err := utils.StartSMTPSink("127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unable to start smtp sink", err)
+	}
+	defer sink.Close()
+	host, port := sink.Addr()
+	viper.Set("email.transport", "smtp")
+	viper.Set("email.smtp.host", host)
+	viper.Set("email.smtp.port", port)
+	viper.Set("email.smtp.tls", "none")
+	// Setup Fiber app
+	app := fiber.New()
+	app.Use(Authenticate)
+	app.Get("/emails", GetEmails)
+	app.Post("/email/:email_id/resend", ResendEmail)
+	// Initialize the assert object
+	a := assert.New(t)
+
+	emailId, err := utils.QueueEmail(config.DB, utils.EmailMessage{To: "test@qonics.com", Subject: "Transactions export", Body: "<p>export</p>",
+		Attachments: []utils.EmailAttachment{{FileName: "transactions.xlsx", ContentType: "application/octet-stream", Content: []byte("excel data")}}}, "export")
+	a.Nil(err, "queue email")
+	status := ""
+	for status != "SENT" && utils.DispatchEmail(config.DB, config.ServiceName) > 0 {
+		config.DB.QueryRow(ctx, `select status from email where id=$1`, emailId).Scan(&status)
+	}
+	a.Equal("SENT", status, "the email is sent")
+	var attachments int
+	config.DB.QueryRow(ctx, `select count(*) from email_attachment where email_id=$1`, emailId).Scan(&attachments)
+	a.Equal(0, attachments, "the attachments are removed once sent")
+	received := false
+	for _, email := range sink.Emails() {
+		message, err := email.Message()
+		if err == nil && message.Header.Get("Subject") == "Transactions export" && email.To[0] == "test@qonics.com" {
+			received = true
+			a.Contains(message.Header.Get("Content-Type"), "multipart/mixed", "the attachment is sent")
+		}
+	}
+	a.True(received, "the email is received by the sink")
+
+	req := httptest.NewRequest("GET", "/emails?message_type=export", nil)
+	req.Header.Set("Authorization", access_token)
+	resp, _ := app.Test(req, -1)
+	a.Equal(fiber.StatusOK, resp.StatusCode, "list emails")
+	req = httptest.NewRequest("POST", fmt.Sprintf("/email/%d/resend", emailId), nil)
+	req.Header.Set("Authorization", access_token)
+	resp, _ = app.Test(req, -1)
+	a.Equal(fiber.StatusNotAcceptable, resp.StatusCode, "only failed emails can be resent")
+}
@@ -0,0 +1,210 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"shared-package/utils"
+	"strconv"
+	"strings"
+	"time"
+	"web-service/config"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/spf13/viper"
+)
+
+// loginGuardActions describe the scopes of the login guard in the lockout alert
+var loginGuardActions = map[string]string{
+	utils.LoginGuardLogin:          "failed logins",
+	utils.LoginGuardForgotPassword: "password reset requests",
+	utils.LoginGuardOTP:            "invalid OTPs",
+}
+
+// loginGuardResponse is returned while the account or the ip is delayed or locked out
+func loginGuardResponse(c *fiber.Ctx, err error, funcName string) error {
+	var guardErr *utils.LoginGuardError
+	if !errors.As(err, &guardErr) {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to process your request, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     funcName + ": Unable to check login guard, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	retryAfter := int(math.Ceil(guardErr.RetryAfter.Seconds()))
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfter))
+	message := "Too many attempts, please try again in " + formatWait(guardErr.RetryAfter)
+	if !guardErr.Locked {
+		message = "Please wait " + formatWait(guardErr.RetryAfter) + " before trying again"
+	}
+	c.Status(fiber.StatusTooManyRequests)
+	return c.JSON(fiber.Map{"status": fiber.StatusTooManyRequests, "message": message, "retry_after": retryAfter, "locked": guardErr.Locked})
+}
+
+// formatWait round a wait for the messages, e.g 15 minutes
+func formatWait(wait time.Duration) string {
+	if wait >= time.Hour {
+		return fmt.Sprintf("%d hour(s)", int(math.Ceil(wait.Hours())))
+	} else if wait >= time.Minute {
+		return fmt.Sprintf("%d minute(s)", int(math.Ceil(wait.Minutes())))
+	}
+	return fmt.Sprintf("%d second(s)", int(math.Ceil(wait.Seconds())))
+}
+
+// loginGuardFailure count a failed attempt on the account, when it locks the account the lockout is logged and the owner alerted.
+// it returns the error to respond with once the account is locked
+func loginGuardFailure(c *fiber.Ctx, scope string, email string) error {
+	lockout, err := utils.LoginGuardFailure(config.Redis, scope, email, c.IP())
+	if err != nil {
+		utils.LogMessage("critical", "loginGuardFailure: Unable to count failed attempt, error: "+err.Error(), config.ServiceName)
+		return nil
+	}
+	if lockout == nil {
+		return nil
+	}
+	notifyAccountLockout(c, email, lockout)
+	return &utils.LoginGuardError{Locked: true, RetryAfter: lockout.Duration}
+}
+
+// notifyAccountLockout record the lockout in the activity logs and alert the owner of the account by sms and email
+func notifyAccountLockout(c *fiber.Ctx, email string, lockout *utils.LoginLockout) {
+	var userId int
+	var fname, phone string
+	err := config.DB.QueryRow(ctx, `select id,fname,phone from users where email=$1`, strings.ToLower(email)).Scan(&userId, &fname, &phone)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			utils.LogMessage("critical", "notifyAccountLockout: Unable to get user data, error: "+err.Error(), config.ServiceName)
+		}
+		//unknown accounts are locked too, so a lockout does not reveal if an email exists
+		return
+	}
+	action := loginGuardActions[lockout.Scope]
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userId,
+			ActivityType: "accountLocked",
+			Description:  fmt.Sprintf("account locked for %s after too many %s", formatWait(lockout.Duration), action),
+			Status:       "failure",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"scope":    lockout.Scope,
+			"lockouts": lockout.Lockouts,
+			"duration": lockout.Duration.Seconds(),
+		},
+	)
+	data := map[string]any{"Name": fname, "Action": action, "Duration": formatWait(lockout.Duration)}
+	_, err = utils.QueueTemplateSMS(config.DB, "account_locked", utils.SMSTemplateDefaultLang(), data, phone, viper.GetString("SENDER_ID"), "account_locked", nil)
+	if err != nil {
+		utils.LogMessage("critical", fmt.Sprintf("notifyAccountLockout: Unable to queue lockout sms for user %d, error: %s", userId, err.Error()), config.ServiceName)
+	}
+	body, err := utils.GenerateHtmlTemplate("account_locked.html", map[string]any{"Name": fname, "Action": action,
+		"Duration": formatWait(lockout.Duration), "IPAddress": c.IP()})
+	if err == nil {
+		_, err = utils.QueueEmail(config.DB, utils.EmailMessage{To: email, Subject: "Your account has been locked", Body: body}, "account_locked")
+	}
+	if err != nil {
+		utils.LogMessage("critical", fmt.Sprintf("notifyAccountLockout: Unable to queue lockout email for user %d, error: %s", userId, err.Error()), config.ServiceName)
+	}
+}
+
+// GetUserLockout return the remaining lockout of a user per scope
+func GetUserLockout(c *fiber.Ctx) error {
+	userId, err := c.ParamsInt("userId")
+	if err != nil || userId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Invalid user id provided")
+	}
+	var email string
+	err = config.DB.QueryRow(ctx, `select email from users where id=$1`, userId).Scan(&email)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotFound, "User not found")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get user lockout failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetUserLockout: Unable to get user data, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	locked, err := utils.LoginGuardLocked(config.Redis, email)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get user lockout failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetUserLockout: Unable to get lockout, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	lockouts := map[string]time.Time{}
+	for scope, ttl := range locked {
+		lockouts[scope] = time.Now().Add(ttl)
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": fiber.Map{"locked": len(lockouts) > 0, "locked_until": lockouts}})
+}
+
+// UnlockUser remove the lockouts of a user and its failed attempts
+func UnlockUser(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	userId, err := c.ParamsInt("userId")
+	if err != nil || userId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Invalid user id provided")
+	}
+	var email, fname string
+	err = config.DB.QueryRow(ctx, `select email,fname from users where id=$1`, userId).Scan(&email, &fname)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotFound, "User not found")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to unlock user", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "UnlockUser: Unable to get user data, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	if err = checkManageableUser(userPayload, userId); err != nil {
+		if errors.Is(err, errUserNotManageable) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, err.Error())
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to unlock user", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "UnlockUser: Unable to check user permissions, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	locked, err := utils.LoginGuardLocked(config.Redis, email)
+	if err == nil && len(locked) == 0 {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Account of "+fname+" is not locked")
+	}
+	if err == nil {
+		err = utils.ClearLoginGuard(config.Redis, email)
+	}
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to unlock user", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "UnlockUser: Unable to clear lockout, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	scopes := []string{}
+	for scope := range locked {
+		scopes = append(scopes, scope)
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "unlockUser",
+			Description:  "unlocked user account of " + fname,
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"user_id": userId,
+			"scopes":  scopes,
+		},
+	)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Account of " + fname + " unlocked successfully"})
+}
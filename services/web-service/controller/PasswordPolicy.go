@@ -0,0 +1,160 @@
+package controller
+
+import (
+	"fmt"
+	"shared-package/utils"
+	"time"
+	"web-service/config"
+	"web-service/model"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+)
+
+// passwordPolicy is the password rules of a user, the strictest of its roles
+type passwordPolicy struct {
+	MinLength  int `json:"min_length"`
+	MaxAgeDays int `json:"max_age_days"` // 0 never expires
+	History    int `json:"history"`      // last passwords which can not be reused
+}
+
+// defaultPasswordPolicy is the password_policy config, used by the roles without their own policy
+func defaultPasswordPolicy() passwordPolicy {
+	policy := passwordPolicy{MinLength: 8, MaxAgeDays: 90, History: 5}
+	if viper.IsSet("password_policy.min_length") {
+		policy.MinLength = max(viper.GetInt("password_policy.min_length"), 8)
+	}
+	if viper.IsSet("password_policy.max_age_days") {
+		policy.MaxAgeDays = max(viper.GetInt("password_policy.max_age_days"), 0)
+	}
+	if viper.IsSet("password_policy.history") {
+		policy.History = max(viper.GetInt("password_policy.history"), 0)
+	}
+	return policy
+}
+
+// userPasswordPolicy combine the policies of the roles of the user: the longest length and history, the shortest expiry
+func userPasswordPolicy(userId int) (passwordPolicy, error) {
+	defaults := defaultPasswordPolicy()
+	rows, err := config.DB.Query(ctx, `select coalesce(r.password_min_length,$2),coalesce(r.password_max_age_days,$3),coalesce(r.password_history,$4)
+	from user_roles ur inner join roles r on r.id = ur.role_id where ur.user_id=$1`, userId, defaults.MinLength, defaults.MaxAgeDays, defaults.History)
+	if err != nil {
+		return defaults, err
+	}
+	defer rows.Close()
+	policy := passwordPolicy{}
+	roles := 0
+	for rows.Next() {
+		role := passwordPolicy{}
+		if err = rows.Scan(&role.MinLength, &role.MaxAgeDays, &role.History); err != nil {
+			return defaults, err
+		}
+		policy.MinLength = max(policy.MinLength, role.MinLength)
+		policy.History = max(policy.History, role.History)
+		if role.MaxAgeDays > 0 && (policy.MaxAgeDays == 0 || role.MaxAgeDays < policy.MaxAgeDays) {
+			policy.MaxAgeDays = role.MaxAgeDays
+		}
+		roles++
+	}
+	if err = rows.Err(); err != nil || roles == 0 {
+		return defaults, err
+	}
+	return policy, nil
+}
+
+// loadPasswordExpiry set when the password of the user expires, nothing when its policy has no expiry
+func loadPasswordExpiry(user *model.UserProfile) error {
+	policy, err := userPasswordPolicy(user.Id)
+	if err != nil {
+		return err
+	}
+	user.PasswordExpiresAt = nil
+	if policy.MaxAgeDays == 0 {
+		return nil
+	}
+	var changedAt time.Time
+	if err = config.DB.QueryRow(ctx, `select password_changed_at from users where id=$1`, user.Id).Scan(&changedAt); err != nil {
+		return err
+	}
+	expiresAt := changedAt.AddDate(0, 0, policy.MaxAgeDays)
+	user.PasswordExpiresAt = &expiresAt
+	return nil
+}
+
+// checkPasswordPolicy return why the new password of the user is refused, an empty text when it is accepted
+func checkPasswordPolicy(userId int, password string) (string, error) {
+	policy, err := userPasswordPolicy(userId)
+	if err != nil {
+		return "", err
+	}
+	if len(password) < policy.MinLength {
+		return fmt.Sprintf("Password must have at least %d characters", policy.MinLength), nil
+	}
+	var reused bool
+	err = config.DB.QueryRow(ctx, `select exists(select 1 from users where id=$1 and password = crypt($2, password))
+	or exists(select 1 from (select password_hash from user_password_history where user_id=$1 order by created_at desc, id desc limit $3) h
+	where h.password_hash = crypt($2, h.password_hash))`, userId, password, policy.History).Scan(&reused)
+	if err != nil {
+		return "", err
+	}
+	if reused {
+		return fmt.Sprintf("Password was used recently, please choose one different from your last %d passwords", max(policy.History, 1)), nil
+	}
+	return "", nil
+}
+
+// savePassword set the new password of the user, keep it in the history and clear the forced change
+func savePassword(userId int, password string) error {
+	policy, err := userPasswordPolicy(userId)
+	if err != nil {
+		return err
+	}
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, `with updated as (update users set password=crypt($2, gen_salt('bf')),force_change_password=false,password_changed_at=now()
+	where id=$1 returning password) insert into user_password_history (user_id,password_hash) select $1,password from updated`, userId, password)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `delete from user_password_history where user_id=$1 and id not in
+	(select id from user_password_history where user_id=$1 order by created_at desc, id desc limit $2)`, userId, policy.History)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// RequirePasswordChange reject the requests of a user who must change its password, forced on a new account or expired.
+// it is used on the route group after the routes allowed to change it
+func RequirePasswordChange(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	if userPayload == nil {
+		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, "unauthorized: You are not allowed to access this resource")
+	}
+	if userPayload.MustChangePassword() {
+		message := "Please change your password to continue"
+		if !userPayload.ForceChangePassword {
+			message = "Your password has expired, please change it to continue"
+		}
+		c.Status(fiber.StatusForbidden)
+		return c.JSON(fiber.Map{"status": fiber.StatusForbidden, "message": message, "password_change_required": true})
+	}
+	return c.Next()
+}
+
+// GetPasswordPolicy return the password policy of the current user
+func GetPasswordPolicy(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	policy, err := userPasswordPolicy(userPayload.Id)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get password policy failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetPasswordPolicy: Unable to get password policy, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": policy, "password_expires_at": userPayload.PasswordExpiresAt})
+}
@@ -0,0 +1,269 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"shared-package/utils"
+	"time"
+	"web-service/config"
+	"web-service/model"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+)
+
+func GetPrizeClaims(c *fiber.Ctx) error {
+	status := c.Query("status")
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 20)
+	if page < 1 {
+		page = 1
+	}
+	offSet := (page - 1) * limit
+	args := []interface{}{}
+	filter, ii := utils.BuildQueryFilter(
+		map[string]interface{}{
+			"pc.status": status,
+		},
+		&args,
+	)
+	globalArgs := args
+	claims := []model.PrizeClaim{}
+	rows, err := config.DB.Query(ctx,
+		fmt.Sprintf(`select pc.id,pc.prize_id,pt.name,p.code,c.id,pgp_sym_decrypt(c.names::bytea,$%[2]d),pgp_sym_decrypt(c.phone::bytea,$%[2]d),pc.transaction_id,
+		pc.status,pc.attempts,pc.channel,concat(u.fname,' ',u.lname),pc.expires_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',
+		pc.verified_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',pc.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali'
+		from prize_claim pc inner join prize p on p.id = pc.prize_id inner join prize_type pt on pt.id = p.prize_type_id
+		inner join customer c on c.id = pc.customer_id left join users u on u.id = pc.verified_by %[1]s order by pc.created_at desc limit $%[3]d offset $%[4]d`, filter, ii, ii+1, ii+2),
+		append(args, config.EncryptionKey, limit, offSet)...)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get prize claims failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetPrizeClaims: Unable to get prize claims, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer rows.Close()
+	for rows.Next() {
+		claim := model.PrizeClaim{}
+		var verifiedBy string
+		err = rows.Scan(&claim.Id, &claim.PrizeId, &claim.PrizeType, &claim.Code, &claim.Customer.Id, &claim.Customer.Names, &claim.Customer.Phone,
+			&claim.TransactionId, &claim.Status, &claim.Attempts, &claim.Channel, &verifiedBy, &claim.ExpiresAt, &claim.VerifiedAt, &claim.CreatedAt)
+		if err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get prize claims failed", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "GetPrizeClaims: Unable to read prize claim data, error: " + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+		if verifiedBy != " " {
+			claim.VerifiedBy = &verifiedBy
+		}
+		claims = append(claims, claim)
+	}
+	total := 0
+	err = config.DB.QueryRow(ctx, `select count(pc.id) from prize_claim pc `+filter, globalArgs...).Scan(&total)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get prize claims failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetPrizeClaims: Unable to count prize claims, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": claims,
+		"pagination": fiber.Map{"page": page, "limit": limit, "total": total}})
+}
+
+// VerifyPrizeClaim verify a claim at an agent, the agent checks the ID card of the winner
+func VerifyPrizeClaim(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	claimId, err := c.ParamsInt("claim_id")
+	if err != nil || claimId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid claim id provided")
+	}
+	type FormData struct {
+		ClaimCode string `json:"claim_code" binding:"required" validate:"required,len=6,numeric"`
+		IdNumber  string `json:"id_number" binding:"required" validate:"required,len=16,numeric"`
+	}
+	formData := FormData{}
+	if err := c.BodyParser(&formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+	customerId, err := utils.VerifyPrizeClaim(config.DB, claimId, formData.ClaimCode, formData.IdNumber, "AGENT", &userPayload.Id, true)
+	if err != nil {
+		switch {
+		case errors.Is(err, utils.ErrClaimNotFound):
+			return utils.JsonErrorResponse(c, fiber.StatusNotFound, "Prize claim not found")
+		case errors.Is(err, utils.ErrClaimInvalidCode):
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Invalid claim code")
+		case errors.Is(err, utils.ErrClaimIdMismatch):
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "National ID does not match the winner's ID")
+		case errors.Is(err, utils.ErrClaimExpired):
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Prize claim has expired")
+		case errors.Is(err, utils.ErrClaimLocked):
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Prize claim is locked, too many wrong attempts")
+		case errors.Is(err, utils.ErrClaimVerified):
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Prize claim is already verified")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to verify prize claim", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "VerifyPrizeClaim: Unable to verify prize claim, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "prize_claim",
+			Description:  "verified a prize claim at agent",
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"claim_id":    claimId,
+			"customer_id": customerId,
+		},
+	)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Prize claim verified, the transaction can now be approved"})
+}
+
+// ResendPrizeClaim send a new claim code to the winner, it unlocks a claim locked by too many wrong attempts
+func ResendPrizeClaim(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	claimId, err := c.ParamsInt("claim_id")
+	if err != nil || claimId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid claim id provided")
+	}
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to resend claim code", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ResendPrizeClaim: Unable to start transaction, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer tx.Rollback(ctx)
+	code, expiresAt, err := utils.ResendPrizeClaim(tx, claimId)
+	if err != nil {
+		switch {
+		case errors.Is(err, utils.ErrClaimNotFound):
+			return utils.JsonErrorResponse(c, fiber.StatusNotFound, "Prize claim not found")
+		case errors.Is(err, utils.ErrClaimExpired):
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Prize claim has expired")
+		case errors.Is(err, utils.ErrClaimVerified):
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Prize claim is already verified")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to resend claim code", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ResendPrizeClaim: Unable to reset claim code, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	var customerId int
+	var customerName, customerPhone, customerLocale, prizeType string
+	var value float64
+	err = tx.QueryRow(ctx, `select c.id,pgp_sym_decrypt(c.names::bytea,$2),pgp_sym_decrypt(c.phone::bytea,$2),coalesce(c.locale,''),pt.name,coalesce(p.prize_value,0)
+	from prize_claim pc inner join customer c on c.id = pc.customer_id inner join prize p on p.id = pc.prize_id inner join prize_type pt on pt.id = p.prize_type_id
+	where pc.id=$1`, claimId, config.EncryptionKey).Scan(&customerId, &customerName, &customerPhone, &customerLocale, &prizeType, &value)
+	if err == nil {
+		location, locationErr := time.LoadLocation(config.Timezone)
+		if locationErr != nil {
+			location = time.UTC
+		}
+		smsData := map[string]any{"Name": customerName, "Amount": int(value), "Code": code, "PrizeType": prizeType,
+			"ClaimDeadline": expiresAt.In(location).Format("02/01/2006 15:04")}
+		_, err = utils.QueueTemplateSMS(tx, "prize_claim", customerLocale, smsData, customerPhone, viper.GetString("SENDER_ID"), "prize_claim", &customerId)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to resend claim code", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ResendPrizeClaim: Unable to queue claim sms, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "prize_claim",
+			Description:  "resent a prize claim code",
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"claim_id":    claimId,
+			"customer_id": customerId,
+		},
+	)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "A new claim code has been sent to the winner"})
+}
+
+// ExpirePrizeClaims release prizes that were not claimed before the deadline so that they can be drawn again
+func ExpirePrizeClaims() {
+	rows, err := config.DB.Query(ctx, `select id from prize_claim where status='PENDING' and expires_at < now() limit 500`)
+	if err != nil {
+		utils.LogMessage(string(utils.CRITICAL), "ExpirePrizeClaims: Unable to fetch expired prize claims, error: "+err.Error(), config.ServiceName)
+	} else {
+		claimIds := []int{}
+		for rows.Next() {
+			var claimId int
+			if err = rows.Scan(&claimId); err == nil {
+				claimIds = append(claimIds, claimId)
+			}
+		}
+		rows.Close()
+		for _, claimId := range claimIds {
+			if err = expirePrizeClaim(claimId); err != nil {
+				utils.LogMessage(string(utils.CRITICAL), fmt.Sprintf("ExpirePrizeClaims: Unable to expire prize claim #%d, error: %s", claimId, err.Error()), config.ServiceName)
+			}
+		}
+	}
+	time.Sleep(60 * time.Second)
+	ExpirePrizeClaims()
+}
+
+func expirePrizeClaim(claimId int) error {
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			tx.Commit(ctx)
+		}
+	}()
+	var prizeId int
+	var transactionId *int
+	err = tx.QueryRow(ctx, `update prize_claim set status='EXPIRED' where id=$1 and status='PENDING' and expires_at < now() returning prize_id,transaction_id`, claimId).
+		Scan(&prizeId, &transactionId)
+	if err != nil {
+		return err
+	}
+	if transactionId != nil {
+		_, err = tx.Exec(ctx, `update transaction set status='EXPIRED' where id=$1 and status='WAITING'`, *transactionId)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(ctx, `update prize set status='EXPIRED' where id=$1`, prizeId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `update draw set status='closed',reason='unclaimed prize, released for redraw' where id=(select draw_id from prize where id=$1)`, prizeId)
+	if err != nil {
+		return err
+	}
+	utils.LogMessage("info", fmt.Sprintf("ExpirePrizeClaims: prize #%d was not claimed before the deadline, released for redraw", prizeId), config.ServiceName)
+	return nil
+}
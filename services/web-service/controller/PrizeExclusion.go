@@ -0,0 +1,278 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"shared-package/utils"
+	"strings"
+	"web-service/config"
+	"web-service/model"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/xuri/excelize/v2"
+)
+
+const prizeExclusionMaxFileSize = 1024 * 1024 * 5
+
+// prizeExclusionType map the type written by operators in the excel file, e.g "National ID", to an exclusion type
+func prizeExclusionType(value string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(strings.TrimSpace(value)), "_"))
+}
+
+// GetPrizeExclusions list the phones, national IDs and MoMo names excluded from prizes, values are masked
+func GetPrizeExclusions(c *fiber.Ctx) error {
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 20)
+	if page < 1 {
+		page = 1
+	}
+	offSet := (page - 1) * limit
+	args := []interface{}{}
+	filter, ii := utils.BuildQueryFilter(
+		map[string]interface{}{
+			"x.exclusion_type": c.Query("type"),
+			"x.status":         c.Query("status"),
+			"x.source":         c.Query("source"),
+		},
+		&args,
+	)
+	globalArgs := args
+	exclusions := []model.PrizeExclusion{}
+	rows, err := config.DB.Query(ctx, fmt.Sprintf(`select x.id,x.exclusion_type,x.value_masked,x.reason,x.source,x.status,nullif(concat(u.fname,' ',u.lname),' '),
+	x.removed_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',x.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali'
+	from prize_exclusion x left join users u on u.id = x.operator_id %s order by x.id desc limit $%d offset $%d`, filter, ii, ii+1), append(args, limit, offSet)...)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get prize exclusions failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetPrizeExclusions: Unable to get prize exclusions, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer rows.Close()
+	for rows.Next() {
+		exclusion := model.PrizeExclusion{}
+		err = rows.Scan(&exclusion.Id, &exclusion.ExclusionType, &exclusion.Value, &exclusion.Reason, &exclusion.Source, &exclusion.Status,
+			&exclusion.Operator, &exclusion.RemovedAt, &exclusion.CreatedAt)
+		if err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get prize exclusions failed", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "GetPrizeExclusions: Unable to read prize exclusion, error: " + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+		exclusions = append(exclusions, exclusion)
+	}
+	total := 0
+	err = config.DB.QueryRow(ctx, `select count(x.id) from prize_exclusion x `+filter, globalArgs...).Scan(&total)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get prize exclusions failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetPrizeExclusions: Unable to count prize exclusions, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": exclusions,
+		"pagination": fiber.Map{"page": page, "limit": limit, "total": total}})
+}
+
+// AddPrizeExclusion exclude a phone, national ID or MoMo name from draws and instant wins
+func AddPrizeExclusion(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	type FormData struct {
+		ExclusionType string `json:"exclusion_type" binding:"required" validate:"required,oneof=PHONE NATIONAL_ID MOMO_NAME"`
+		Value         string `json:"value" binding:"required" validate:"required,max=100"`
+		Reason        string `json:"reason" binding:"required" validate:"required,min=3,max=255"`
+	}
+	formData := FormData{}
+	if err := c.BodyParser(&formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+	valueHash, masked, err := utils.ExclusionValue(formData.ExclusionType, formData.Value)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, err.Error())
+	}
+	var exclusionId int
+	err = config.DB.QueryRow(ctx, `insert into prize_exclusion (exclusion_type,value_hash,value_masked,reason,operator_id) values ($1,$2,$3,$4,$5) returning id`,
+		formData.ExclusionType, valueHash, masked, formData.Reason, userPayload.Id).Scan(&exclusionId)
+	if err != nil {
+		if ok, _ := utils.IsErrDuplicate(err); ok {
+			return utils.JsonErrorResponse(c, fiber.StatusConflict, fmt.Sprintf("%s is already excluded", masked))
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to add prize exclusion, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "AddPrizeExclusion: Unable to insert prize exclusion, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "prize_exclusion",
+			Description:  fmt.Sprintf("excluded %s %s from prizes", formData.ExclusionType, masked),
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"exclusion_id": exclusionId,
+			"reason":       formData.Reason,
+		},
+	)
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"status": fiber.StatusCreated, "message": "Prize exclusion added", "data": fiber.Map{"id": exclusionId, "value": masked}})
+}
+
+// ImportPrizeExclusions add the exclusions of an excel file, columns are type, value and an optional reason.
+// the reason form value applies to rows without reason, values already excluded are skipped
+func ImportPrizeExclusions(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	file, err := c.FormFile("file")
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Please provide the exclusions file")
+	}
+	if strings.ToLower(filepath.Ext(file.Filename)) != ".xlsx" {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Exclusions file should be an excel (.xlsx) file")
+	}
+	if file.Size > prizeExclusionMaxFileSize {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Exclusions file size should not exceed 5MB")
+	}
+	defaultReason := strings.TrimSpace(c.FormValue("reason"))
+	content, err := file.Open()
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to read exclusions file", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ImportPrizeExclusions: Unable to open uploaded file, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer content.Close()
+	workbook, err := excelize.OpenReader(content)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Exclusions file is not a valid excel file")
+	}
+	defer workbook.Close()
+	rows, err := workbook.GetRows(workbook.GetSheetName(0))
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Unable to read the first sheet of the exclusions file")
+	}
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to import prize exclusions, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ImportPrizeExclusions: Unable to start transaction, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer tx.Rollback(ctx)
+	imported, duplicates := 0, 0
+	invalid := []fiber.Map{}
+	for i, row := range rows {
+		line := i + 1
+		columns := make([]string, 3)
+		for j := 0; j < len(row) && j < 3; j++ {
+			columns[j] = strings.TrimSpace(row[j])
+		}
+		if columns[0] == "" && columns[1] == "" {
+			continue
+		}
+		exclusionType := prizeExclusionType(columns[0])
+		if line == 1 && exclusionType == "TYPE" {
+			//header
+			continue
+		}
+		reason := columns[2]
+		if reason == "" {
+			reason = defaultReason
+		}
+		if len(reason) < 3 || len(reason) > 255 {
+			invalid = append(invalid, fiber.Map{"line": line, "detail": "reason should have between 3 and 255 characters"})
+			continue
+		}
+		valueHash, masked, err := utils.ExclusionValue(exclusionType, columns[1])
+		if err != nil {
+			invalid = append(invalid, fiber.Map{"line": line, "detail": err.Error()})
+			continue
+		}
+		result, err := tx.Exec(ctx, `insert into prize_exclusion (exclusion_type,value_hash,value_masked,reason,source,operator_id) values ($1,$2,$3,$4,'IMPORT',$5)
+		on conflict (exclusion_type,value_hash) where status = 'ACTIVE' do nothing`, exclusionType, valueHash, masked, reason, userPayload.Id)
+		if err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to import prize exclusions, system error", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     fmt.Sprintf("ImportPrizeExclusions: Unable to insert line %d, error: %s", line, err.Error()),
+				ServiceName: config.ServiceName,
+			})
+		}
+		if result.RowsAffected() == 0 {
+			duplicates++
+		} else {
+			imported++
+		}
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to import prize exclusions, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ImportPrizeExclusions: Unable to commit import, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "prize_exclusion",
+			Description:  fmt.Sprintf("imported %d prize exclusions from %s", imported, file.Filename),
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"imported":   imported,
+			"duplicates": duplicates,
+			"invalid":    len(invalid),
+		},
+	)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": fmt.Sprintf("%d prize exclusions imported", imported),
+		"data": fiber.Map{"imported": imported, "duplicates": duplicates, "invalid": invalid}})
+}
+
+// RemovePrizeExclusion stop excluding the value, the row is kept for the audit
+func RemovePrizeExclusion(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	exclusionId, err := c.ParamsInt("exclusion_id")
+	if err != nil || exclusionId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid exclusion id provided")
+	}
+	var exclusionType, masked string
+	err = config.DB.QueryRow(ctx, `update prize_exclusion set status='REMOVED', removed_by=$2, removed_at=now(), updated_at=now()
+	where id=$1 and status='ACTIVE' returning exclusion_type,value_masked`, exclusionId, userPayload.Id).Scan(&exclusionType, &masked)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotFound, "Active prize exclusion not found")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to remove prize exclusion, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "RemovePrizeExclusion: Unable to update prize exclusion, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "prize_exclusion",
+			Description:  fmt.Sprintf("removed %s %s from prize exclusions", exclusionType, masked),
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"exclusion_id": exclusionId,
+		},
+	)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Prize exclusion removed"})
+}
@@ -0,0 +1,348 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"shared-package/utils"
+	"slices"
+	"web-service/config"
+	"web-service/model"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// errRoleNotAssignable is returned when a role is unknown or grants a permission the operator does not have
+var errRoleNotAssignable = errors.New("role can not be assigned")
+
+// errRoleNotEditable is returned when a role grants a permission the operator does not have
+var errRoleNotEditable = errors.New("role can not be changed")
+
+// checkEditableRole lock the role and make sure the operator has every permission it grants today,
+// so a role can not be weakened (permissions, second factor, password policy) or deleted by someone who could not assign it
+func checkEditableRole(tx pgx.Tx, operator *model.UserProfile, roleId int) error {
+	var name string
+	err := tx.QueryRow(ctx, `select name from roles where id=$1 for update`, roleId).Scan(&name)
+	if err != nil {
+		return err
+	}
+	var permissions []string
+	err = tx.QueryRow(ctx, `select coalesce(array_agg(p.name),'{}') from role_permissions rp inner join permissions p on p.id = rp.permission_id
+	where rp.role_id=$1`, roleId).Scan(&permissions)
+	if err != nil {
+		return err
+	}
+	for _, permission := range permissions {
+		if !operator.HasPermission(permission) {
+			return fmt.Errorf("%w, %s grants %s which you don't have", errRoleNotEditable, name, permission)
+		}
+	}
+	return nil
+}
+
+// errUserNotManageable is returned when the target user has a permission the operator does not have
+var errUserNotManageable = errors.New("user can not be managed")
+
+// checkManageableUser make sure the user has no permission the operator lacks, so an operator can not change the account
+// (email, phone, second factor, lockout) of someone with more access and take it over
+func checkManageableUser(operator *model.UserProfile, userId int) error {
+	var permissions []string
+	err := config.DB.QueryRow(ctx, `select coalesce(array_agg(distinct p.name),'{}') from user_roles ur inner join role_permissions rp on rp.role_id = ur.role_id
+	inner join permissions p on p.id = rp.permission_id where ur.user_id=$1`, userId).Scan(&permissions)
+	if err != nil {
+		return err
+	}
+	for _, permission := range permissions {
+		if !operator.HasPermission(permission) {
+			return fmt.Errorf("%w, the user has %s which you don't have", errUserNotManageable, permission)
+		}
+	}
+	return nil
+}
+
+// loadUserAccess set the roles of the user and the permissions they grant
+func loadUserAccess(user *model.UserProfile) error {
+	user.Roles = []model.UserRole{}
+	user.Permissions = []string{}
+	rows, err := config.DB.Query(ctx, `select r.id,r.name from user_roles ur inner join roles r on r.id = ur.role_id where ur.user_id=$1 order by r.name`, user.Id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		role := model.UserRole{}
+		if err = rows.Scan(&role.Id, &role.Name); err != nil {
+			return err
+		}
+		user.Roles = append(user.Roles, role)
+	}
+	err = config.DB.QueryRow(ctx, `select coalesce(array_agg(distinct p.name),'{}') from user_roles ur inner join role_permissions rp on rp.role_id = ur.role_id
+	inner join permissions p on p.id = rp.permission_id where ur.user_id=$1`, user.Id).Scan(&user.Permissions)
+	if err != nil {
+		return err
+	}
+	//the password policy comes from the roles too
+	return loadPasswordExpiry(user)
+}
+
+// checkAssignableRoles make sure the roles exist and do not grant more than the permissions of the operator
+func checkAssignableRoles(operator *model.UserProfile, roleIds []int) error {
+	rows, err := config.DB.Query(ctx, `select r.id,r.name,coalesce(array_agg(p.name) filter (where p.name is not null),'{}') from roles r
+	left join role_permissions rp on rp.role_id = r.id left join permissions p on p.id = rp.permission_id where r.id = any($1) group by r.id`, roleIds)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	found := 0
+	for rows.Next() {
+		var roleId int
+		var name string
+		var permissions []string
+		if err = rows.Scan(&roleId, &name, &permissions); err != nil {
+			return err
+		}
+		for _, permission := range permissions {
+			if !operator.HasPermission(permission) {
+				return fmt.Errorf("%w, %s grants %s which you don't have", errRoleNotAssignable, name, permission)
+			}
+		}
+		found++
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if found != len(roleIds) {
+		return fmt.Errorf("%w, a provided role does not exist", errRoleNotAssignable)
+	}
+	return nil
+}
+
+// setUserRoles replace the roles of the user
+func setUserRoles(tx pgx.Tx, userId int, roleIds []int, operatorId int) error {
+	_, err := tx.Exec(ctx, `delete from user_roles where user_id=$1 and role_id <> all($2)`, userId, roleIds)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `insert into user_roles (user_id,role_id,operator_id) select $1,unnest($2::int[]),$3 on conflict do nothing`, userId, roleIds, operatorId)
+	return err
+}
+
+// GetPermissions list the permissions which can be granted to a role
+func GetPermissions(c *fiber.Ctx) error {
+	permissions := []model.Permission{}
+	rows, err := config.DB.Query(ctx, `select id,name,description from permissions order by name`)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get permissions failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetPermissions: Unable to get permissions, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer rows.Close()
+	for rows.Next() {
+		permission := model.Permission{}
+		if err = rows.Scan(&permission.Id, &permission.Name, &permission.Description); err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get permissions failed", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "GetPermissions: Unable to read permission, error: " + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+		permissions = append(permissions, permission)
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": permissions})
+}
+
+// GetRoles list the roles with their permissions and the number of users having them
+func GetRoles(c *fiber.Ctx) error {
+	roles := []model.Role{}
+	rows, err := config.DB.Query(ctx, `select r.id,r.name,r.description,r.require_two_factor,r.password_min_length,r.password_max_age_days,r.password_history,
+	coalesce((select array_agg(p.name order by p.name) from role_permissions rp inner join permissions p on p.id = rp.permission_id where rp.role_id = r.id),'{}'),
+	(select count(ur.user_id) from user_roles ur where ur.role_id = r.id),nullif(concat(u.fname,' ',u.lname),' '),
+	r.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali' from roles r left join users u on u.id = r.operator_id order by r.name`)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get roles failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetRoles: Unable to get roles, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer rows.Close()
+	for rows.Next() {
+		role := model.Role{}
+		err = rows.Scan(&role.Id, &role.Name, &role.Description, &role.RequireTwoFactor, &role.PasswordPolicy.MinLength, &role.PasswordPolicy.MaxAgeDays, &role.PasswordPolicy.History, &role.Permissions, &role.Users, &role.Operator, &role.CreatedAt)
+		if err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get roles failed", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "GetRoles: Unable to read role, error: " + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+		roles = append(roles, role)
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": roles})
+}
+
+// SaveRole create a role, or update it when the id is provided. its permissions are replaced by the provided ones
+// and an operator can only grant the permissions it has
+func SaveRole(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	type FormData struct {
+		Id               int                      `json:"id"`
+		Name             string                   `json:"name" binding:"required" validate:"required,min=3,max=60"`
+		Description      string                   `json:"description" validate:"max=255"`
+		RequireTwoFactor bool                     `json:"require_two_factor"` // users having the role must login with a second factor
+		PasswordPolicy   model.RolePasswordPolicy `json:"password_policy"`
+		Permissions      []string                 `json:"permissions" binding:"required" validate:"required,min=1,dive,required,max=60"`
+	}
+	formData := new(FormData)
+	if err := c.BodyParser(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Please provide all required data")
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Provided data are not valid")
+	}
+	slices.Sort(formData.Permissions)
+	formData.Permissions = slices.Compact(formData.Permissions)
+	for _, permission := range formData.Permissions {
+		if !userPayload.HasPermission(permission) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, fmt.Sprintf("You can not grant %s, you don't have it", permission))
+		}
+	}
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to save role, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "SaveRole: Unable to start transaction, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer tx.Rollback(ctx)
+	roleId := formData.Id
+	if formData.Id == 0 {
+		err = tx.QueryRow(ctx, `insert into roles (name,description,require_two_factor,password_min_length,password_max_age_days,password_history,operator_id)
+		values ($1,nullif($2,''),$3,$4,$5,$6,$7) returning id`,
+			formData.Name, formData.Description, formData.RequireTwoFactor, formData.PasswordPolicy.MinLength, formData.PasswordPolicy.MaxAgeDays,
+			formData.PasswordPolicy.History, userPayload.Id).Scan(&roleId)
+	} else {
+		err = checkEditableRole(tx, userPayload, formData.Id)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotFound, "Role not found")
+		} else if errors.Is(err, errRoleNotEditable) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, err.Error())
+		} else if err == nil {
+			err = tx.QueryRow(ctx, `update roles set name=$1,description=nullif($2,''),require_two_factor=$3,password_min_length=$4,password_max_age_days=$5,
+			password_history=$6,operator_id=$7,updated_at=now() where id=$8 returning id`,
+				formData.Name, formData.Description, formData.RequireTwoFactor, formData.PasswordPolicy.MinLength, formData.PasswordPolicy.MaxAgeDays,
+				formData.PasswordPolicy.History, userPayload.Id, formData.Id).Scan(&roleId)
+		}
+	}
+	if err != nil {
+		if ok, _ := utils.IsErrDuplicate(err); ok {
+			return utils.JsonErrorResponse(c, fiber.StatusConflict, "A role with the same name already exists")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to save role, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "SaveRole: Unable to save role, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	_, err = tx.Exec(ctx, `delete from role_permissions where role_id=$1`, roleId)
+	if err == nil {
+		var result pgconn.CommandTag
+		result, err = tx.Exec(ctx, `insert into role_permissions (role_id,permission_id) select $1,id from permissions where name = any($2)`,
+			roleId, formData.Permissions)
+		if err == nil && result.RowsAffected() != int64(len(formData.Permissions)) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "A provided permission does not exist")
+		}
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to save role, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "SaveRole: Unable to save role permissions, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "saveRole",
+			Description:  "saved role " + formData.Name,
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"role_id":            roleId,
+			"permissions":        formData.Permissions,
+			"require_two_factor": formData.RequireTwoFactor,
+			"password_policy":    formData.PasswordPolicy,
+		},
+	)
+	if formData.Id != 0 {
+		revokeRoleSessions(c, roleId, "permissions of role "+formData.Name+" changed")
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Role saved successfully", "id": roleId})
+}
+
+// DeleteRole delete a role which is not assigned to any user, the operator must have every permission of the role
+func DeleteRole(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	roleId, err := c.ParamsInt("role_id")
+	if err != nil || roleId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid role id provided")
+	}
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to delete role, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "DeleteRole: Unable to start transaction, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer tx.Rollback(ctx)
+	err = checkEditableRole(tx, userPayload, roleId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return utils.JsonErrorResponse(c, fiber.StatusNotFound, "Role not found")
+	} else if errors.Is(err, errRoleNotEditable) {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, err.Error())
+	}
+	var name string
+	if err == nil {
+		err = tx.QueryRow(ctx, `delete from roles r where r.id=$1 and not exists (select 1 from user_roles ur where ur.role_id = r.id) returning r.name`, roleId).
+			Scan(&name)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Role is assigned to users, remove it from them first")
+		}
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to delete role, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "DeleteRole: Unable to delete role, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "deleteRole",
+			Description:  "deleted role " + name,
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"role_id": roleId,
+		},
+	)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Role deleted successfully"})
+}
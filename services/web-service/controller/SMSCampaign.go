@@ -0,0 +1,598 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"shared-package/utils"
+	"strings"
+	"time"
+	"web-service/config"
+	"web-service/model"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/spf13/viper"
+)
+
+var errSMSCampaignStatus = errors.New("campaign can no longer be changed")
+var errSMSCampaignRender = errors.New("campaign template can not be rendered")
+
+func smsCampaignPerMinute() int {
+	perMinute := viper.GetInt("sms_campaign.per_minute")
+	if perMinute <= 0 {
+		perMinute = 600
+	}
+	return perMinute
+}
+
+// smsCampaignPageSize is the number of recipients queued per transaction when a campaign starts
+func smsCampaignPageSize() int {
+	pageSize := viper.GetInt("sms_campaign.page_size")
+	if pageSize <= 0 {
+		pageSize = 1000
+	}
+	return pageSize
+}
+
+// smsCampaignData is the data the campaign sms are rendered with
+func smsCampaignData(names string) map[string]any {
+	return map[string]any{"Name": names, "AppName": viper.GetString("ap_name")}
+}
+
+// smsCampaignTemplates return the body of the active versions of a template per lang
+func smsCampaignTemplates(db utils.DBConn, templateName string) (map[string]string, error) {
+	templates := map[string]string{}
+	rows, err := db.Query(ctx, `select lang,body from sms_template where name=$1 and status='ACTIVE'`, templateName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var lang, body string
+		if err = rows.Scan(&lang, &body); err != nil {
+			return nil, err
+		}
+		templates[lang] = body
+	}
+	return templates, rows.Err()
+}
+
+// validateSMSCampaignTemplates render every lang with the data used to send the campaign, it returns the message in the default lang
+func validateSMSCampaignTemplates(templates map[string]string) (string, error) {
+	if _, ok := templates[utils.SMSTemplateDefaultLang()]; !ok {
+		return "", utils.ErrSMSTemplateNotFound
+	}
+	data := smsCampaignData(fmt.Sprint(utils.SMSTemplateSampleData["Name"]))
+	preview := ""
+	for lang, body := range templates {
+		message, err := utils.ExecuteSMSTemplate(body, data)
+		if err != nil {
+			return "", fmt.Errorf("%s version: %w", lang, err)
+		}
+		if lang == utils.SMSTemplateDefaultLang() {
+			preview = message
+		}
+	}
+	return preview, nil
+}
+
+// renderSMSCampaignTemplate check a template can be sent by a campaign and return its preview
+func renderSMSCampaignTemplate(db utils.DBConn, templateName string) (string, error) {
+	templates, err := smsCampaignTemplates(db, templateName)
+	if err != nil {
+		return "", err
+	}
+	return validateSMSCampaignTemplates(templates)
+}
+
+// smsCampaignSegment build the condition selecting the customers (alias c) of the filters, values are appended to args
+func smsCampaignSegment(filters model.SMSCampaignFilters, args *[]interface{}) (string, error) {
+	conditions := []string{}
+	add := func(condition string, value interface{}) {
+		*args = append(*args, value)
+		conditions = append(conditions, strings.ReplaceAll(condition, "$?", fmt.Sprintf("$%d", len(*args))))
+	}
+	if len(filters.Provinces) > 0 {
+		add("c.province = any($?)", filters.Provinces)
+	}
+	if len(filters.Districts) > 0 {
+		add("c.district = any($?)", filters.Districts)
+	}
+	if len(filters.NetworkOperators) > 0 {
+		add("c.network_operator = any($?)", filters.NetworkOperators)
+	}
+	if len(filters.Locales) > 0 {
+		add("c.locale = any($?)", filters.Locales)
+	}
+	if err := utils.ValidateDateRanges(filters.RegisteredStartDate, &filters.RegisteredEndDate); err != nil {
+		return "", fmt.Errorf("registration dates: %w", err)
+	}
+	if filters.RegisteredStartDate != "" {
+		add("c.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali' >= $?", filters.RegisteredStartDate)
+	}
+	if filters.RegisteredEndDate != "" {
+		add("c.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali' < $?", filters.RegisteredEndDate)
+	}
+	//entries are counted in the entry date range
+	if err := utils.ValidateDateRanges(filters.EntryStartDate, &filters.EntryEndDate); err != nil {
+		return "", fmt.Errorf("entry dates: %w", err)
+	}
+	entryFilter := "e.customer_id = c.id"
+	if filters.EntryStartDate != "" {
+		*args = append(*args, filters.EntryStartDate)
+		entryFilter += fmt.Sprintf(" and e.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali' >= $%d", len(*args))
+	}
+	if filters.EntryEndDate != "" {
+		*args = append(*args, filters.EntryEndDate)
+		entryFilter += fmt.Sprintf(" and e.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali' < $%d", len(*args))
+	}
+	if filters.EntryStartDate != "" || filters.EntryEndDate != "" {
+		conditions = append(conditions, "exists (select 1 from entries e where "+entryFilter+")")
+	}
+	if filters.MinEntries != nil {
+		add("(select count(e.id) from entries e where "+entryFilter+") >= $?", *filters.MinEntries)
+	}
+	if filters.MaxEntries != nil {
+		add("(select count(e.id) from entries e where "+entryFilter+") <= $?", *filters.MaxEntries)
+	}
+	wonPrize := "exists (select 1 from prize p inner join entries e on e.id = p.entry_id where e.customer_id = c.id and coalesce(p.status,'OKAY') <> 'EXPIRED')"
+	switch filters.Winners {
+	case "won":
+		conditions = append(conditions, wonPrize)
+	case "not_won":
+		conditions = append(conditions, "not "+wonPrize)
+	case "unclaimed":
+		conditions = append(conditions, `(exists (select 1 from prize_claim pc where pc.customer_id = c.id and pc.status = 'PENDING' and pc.expires_at > now())
+		or exists (select 1 from fulfilment f where f.customer_id = c.id and f.status = 'WAITING_CLAIM'))`)
+	}
+	if len(conditions) == 0 {
+		return "true", nil
+	}
+	return strings.Join(conditions, " and "), nil
+}
+
+// SMSCampaignDryRun count the customers a campaign would reach, opted out customers are excluded
+func SMSCampaignDryRun(c *fiber.Ctx) error {
+	type FormData struct {
+		TemplateName string                   `json:"template_name" validate:"max=100"`
+		Filters      model.SMSCampaignFilters `json:"filters"`
+	}
+	formData := FormData{}
+	if err := c.BodyParser(&formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+	args := []interface{}{}
+	segment, err := smsCampaignSegment(formData.Filters, &args)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, err.Error())
+	}
+	type OperatorCount struct {
+		Operator   string `json:"network_operator"`
+		Recipients int    `json:"recipients"`
+		OptedOut   int    `json:"opted_out"`
+	}
+	operators := []OperatorCount{}
+	recipients, optedOut := 0, 0
+	rows, err := config.DB.Query(ctx, `select coalesce(c.network_operator,''),count(c.id) filter (where not c.sms_opt_out),count(c.id) filter (where c.sms_opt_out)
+	from customer c where `+segment+` group by 1 order by 1`, args...)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to count campaign recipients", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "SMSCampaignDryRun: Unable to count recipients, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer rows.Close()
+	for rows.Next() {
+		operator := OperatorCount{}
+		if err = rows.Scan(&operator.Operator, &operator.Recipients, &operator.OptedOut); err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to count campaign recipients", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "SMSCampaignDryRun: Unable to read recipients count, error: " + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+		recipients += operator.Recipients
+		optedOut += operator.OptedOut
+		operators = append(operators, operator)
+	}
+	result := fiber.Map{"recipients": recipients, "opted_out": optedOut, "operators": operators}
+	if formData.TemplateName != "" {
+		message, err := renderSMSCampaignTemplate(config.DB, formData.TemplateName)
+		if err != nil {
+			if errors.Is(err, utils.ErrSMSTemplateNotFound) {
+				return utils.JsonErrorResponse(c, fiber.StatusNotFound, "SMS template not found")
+			}
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Template is not valid, "+err.Error())
+		}
+		segments := utils.SMSSegments(message)
+		result["preview"] = message
+		result["segments"] = segments
+		result["estimated_sms"] = recipients * segments
+		result["estimated_minutes"] = int(math.Ceil(float64(recipients) / float64(smsCampaignPerMinute())))
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": result})
+}
+
+// CreateSMSCampaign schedule a campaign, recipients are selected when the campaign starts
+func CreateSMSCampaign(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	type FormData struct {
+		Name         string                   `json:"name" binding:"required" validate:"required,max=100"`
+		TemplateName string                   `json:"template_name" binding:"required" validate:"required,max=100"`
+		Filters      model.SMSCampaignFilters `json:"filters"`
+		ScheduledAt  *time.Time               `json:"scheduled_at"`
+		PerMinute    int                      `json:"per_minute" validate:"omitempty,min=1,max=100000"`
+	}
+	formData := FormData{}
+	if err := c.BodyParser(&formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+	if _, err := smsCampaignSegment(formData.Filters, &[]interface{}{}); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, err.Error())
+	}
+	if _, err := renderSMSCampaignTemplate(config.DB, formData.TemplateName); err != nil {
+		if errors.Is(err, utils.ErrSMSTemplateNotFound) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotFound, "SMS template not found")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Template is not valid, "+err.Error())
+	}
+	scheduledAt := time.Now()
+	if formData.ScheduledAt != nil {
+		if formData.ScheduledAt.Before(time.Now().Add(-time.Minute)) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Scheduled time is already passed")
+		}
+		scheduledAt = *formData.ScheduledAt
+	}
+	if formData.PerMinute == 0 {
+		formData.PerMinute = smsCampaignPerMinute()
+	}
+	filters, _ := json.Marshal(formData.Filters)
+	var campaignId int
+	err := config.DB.QueryRow(ctx, `insert into sms_campaign (name,template_name,filters,status,per_minute,scheduled_at,operator_id)
+	values ($1,$2,$3,'SCHEDULED',$4,$5,$6) returning id`, formData.Name, formData.TemplateName, filters, formData.PerMinute, scheduledAt.UTC(), userPayload.Id).
+		Scan(&campaignId)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to create sms campaign, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "CreateSMSCampaign: Unable to save sms campaign, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "sms_campaign",
+			Description:  "scheduled sms campaign " + formData.Name,
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"campaign_id":   campaignId,
+			"template_name": formData.TemplateName,
+			"filters":       formData.Filters,
+			"scheduled_at":  scheduledAt,
+		},
+	)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "SMS campaign scheduled", "campaign_id": campaignId})
+}
+
+func GetSMSCampaigns(c *fiber.Ctx) error {
+	status := c.Query("status")
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 20)
+	if page < 1 {
+		page = 1
+	}
+	offSet := (page - 1) * limit
+	args := []interface{}{}
+	filter, ii := utils.BuildQueryFilter(
+		map[string]interface{}{
+			"sc.status": status,
+		},
+		&args,
+	)
+	globalArgs := args
+	campaigns := []model.SMSCampaign{}
+	rows, err := config.DB.Query(ctx,
+		fmt.Sprintf(`select sc.id,sc.name,sc.template_name,sc.filters,sc.status,sc.per_minute,sc.recipient_count,sc.opted_out_count,sc.error_message,concat(u.fname,' ',u.lname),
+		sc.scheduled_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',sc.started_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',
+		sc.completed_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',sc.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',
+		count(s.id) filter (where s.status='QUEUED'),count(s.id) filter (where s.status in ('SENT','DELIVERED','EXPIRED','UNDELIVERABLE')),
+		count(s.id) filter (where s.status='DELIVERED'),count(s.id) filter (where s.status in ('EXPIRED','UNDELIVERABLE')),
+		count(s.id) filter (where s.status='FAILED'),count(s.id) filter (where s.status='CANCELLED'),count(s.id) filter (where s.status='SUPPRESSED'),coalesce(sum(s.credit_count),0)
+		from sms_campaign sc left join users u on u.id = sc.operator_id left join sms s on s.campaign_id = sc.id %s
+		group by sc.id,u.id order by sc.id desc limit $%d offset $%d`, filter, ii, ii+1),
+		append(args, limit, offSet)...)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get sms campaigns failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetSMSCampaigns: Unable to get sms campaigns, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer rows.Close()
+	for rows.Next() {
+		campaign := model.SMSCampaign{}
+		var operator string
+		err = rows.Scan(&campaign.Id, &campaign.Name, &campaign.TemplateName, &campaign.Filters, &campaign.Status, &campaign.PerMinute,
+			&campaign.RecipientCount, &campaign.OptedOutCount, &campaign.ErrorMessage, &operator, &campaign.ScheduledAt, &campaign.StartedAt, &campaign.CompletedAt, &campaign.CreatedAt,
+			&campaign.Stats.Queued, &campaign.Stats.Sent, &campaign.Stats.Delivered, &campaign.Stats.Undeliverable, &campaign.Stats.Failed,
+			&campaign.Stats.Cancelled, &campaign.Stats.Suppressed, &campaign.Stats.Credits)
+		if err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get sms campaigns failed", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "GetSMSCampaigns: Unable to read sms campaign, error: " + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+		if operator != " " {
+			campaign.Operator = &operator
+		}
+		if campaign.Stats.Sent > 0 {
+			campaign.Stats.DeliveryRate = math.Round(float64(campaign.Stats.Delivered)*10000/float64(campaign.Stats.Sent)) / 100
+		}
+		campaigns = append(campaigns, campaign)
+	}
+	total := 0
+	err = config.DB.QueryRow(ctx, `select count(sc.id) from sms_campaign sc `+filter, globalArgs...).Scan(&total)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get sms campaigns failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetSMSCampaigns: Unable to count sms campaigns, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": campaigns,
+		"pagination": fiber.Map{"page": page, "limit": limit, "total": total}})
+}
+
+// CancelSMSCampaign stop a scheduled or running campaign, sms not yet sent are cancelled
+func CancelSMSCampaign(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	campaignId, err := c.ParamsInt("campaign_id")
+	if err != nil || campaignId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid campaign id provided")
+	}
+	cancelled, err := cancelSMSCampaign(campaignId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotFound, "SMS campaign not found")
+		}
+		if errors.Is(err, errSMSCampaignStatus) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "SMS campaign is already completed or cancelled")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to cancel sms campaign, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "CancelSMSCampaign: Unable to cancel sms campaign, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "sms_campaign",
+			Description:  fmt.Sprintf("cancelled sms campaign #%d, %d sms not sent", campaignId, cancelled),
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		nil,
+	)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "SMS campaign cancelled", "cancelled_sms": cancelled})
+}
+
+func cancelSMSCampaign(campaignId int) (int, error) {
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+	var status string
+	err = tx.QueryRow(ctx, `select status from sms_campaign where id=$1 for update`, campaignId).Scan(&status)
+	if err != nil {
+		return 0, err
+	}
+	if status != "SCHEDULED" && status != "QUEUEING" && status != "SENDING" {
+		return 0, errSMSCampaignStatus
+	}
+	cmd, err := tx.Exec(ctx, `update sms set status='CANCELLED', error_message='campaign cancelled' where campaign_id=$1 and status='QUEUED'`, campaignId)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(ctx, `update sms_campaign set status='CANCELLED', completed_at=now() where id=$1`, campaignId)
+	if err != nil {
+		return 0, err
+	}
+	return int(cmd.RowsAffected()), tx.Commit(ctx)
+}
+
+// RunSMSCampaigns start the due campaigns and follow the running ones
+func RunSMSCampaigns() {
+	rows, err := config.DB.Query(ctx, `select id from sms_campaign where (status='SCHEDULED' and scheduled_at <= now()) or status='QUEUEING' order by scheduled_at`)
+	if err != nil {
+		utils.LogMessage(string(utils.CRITICAL), "RunSMSCampaigns: Unable to fetch due campaigns, error: "+err.Error(), config.ServiceName)
+	} else {
+		campaignIds := []int{}
+		for rows.Next() {
+			var campaignId int
+			if err = rows.Scan(&campaignId); err == nil {
+				campaignIds = append(campaignIds, campaignId)
+			}
+		}
+		rows.Close()
+		for _, campaignId := range campaignIds {
+			if err = startSMSCampaign(campaignId); err != nil {
+				utils.LogMessage(string(utils.CRITICAL), fmt.Sprintf("RunSMSCampaigns: Unable to start campaign #%d, error: %s", campaignId, err.Error()), config.ServiceName)
+			}
+		}
+	}
+	//customers who opted out while the campaign is running are not messaged
+	_, err = config.DB.Exec(ctx, `update sms s set status='SUPPRESSED', error_message='customer opted out' from customer c
+	where c.id = s.customer_id and c.sms_opt_out and s.campaign_id is not null and s.status='QUEUED'`)
+	if err != nil {
+		utils.LogMessage(string(utils.CRITICAL), "RunSMSCampaigns: Unable to cancel sms of opted out customers, error: "+err.Error(), config.ServiceName)
+	}
+	_, err = config.DB.Exec(ctx, `update sms_campaign sc set status='COMPLETED', completed_at=now()
+	where sc.status='SENDING' and not exists (select 1 from sms s where s.campaign_id = sc.id and s.status='QUEUED')`)
+	if err != nil {
+		utils.LogMessage(string(utils.CRITICAL), "RunSMSCampaigns: Unable to complete campaigns, error: "+err.Error(), config.ServiceName)
+	}
+	time.Sleep(30 * time.Second)
+	RunSMSCampaigns()
+}
+
+// startSMSCampaign queue the sms of every recipient page by page, next_attempt_at is spread to release per_minute sms each minute.
+// a campaign whose template can not be rendered is FAILED and the sms already queued are cancelled
+func startSMSCampaign(campaignId int) error {
+	for {
+		done, err := queueSMSCampaignPage(campaignId)
+		if err != nil {
+			if errors.Is(err, errSMSCampaignRender) {
+				if failErr := failSMSCampaign(campaignId, err.Error()); failErr != nil {
+					return failErr
+				}
+			}
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// queueSMSCampaignPage queue the sms of the next page of recipients, it resumes after the last customer queued so a campaign
+// interrupted while QUEUEING continues on the next run. done is true once every recipient is queued
+func queueSMSCampaignPage(campaignId int) (bool, error) {
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+	var templateName, status string
+	var perMinute int
+	filters := model.SMSCampaignFilters{}
+	err = tx.QueryRow(ctx, `select template_name,filters,per_minute,status from sms_campaign where id=$1 and status in ('SCHEDULED','QUEUEING') for update skip locked`, campaignId).
+		Scan(&templateName, &filters, &perMinute, &status)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			//queued by another instance or cancelled
+			return true, nil
+		}
+		return false, err
+	}
+	templates, err := smsCampaignTemplates(tx, templateName)
+	if err != nil {
+		return false, err
+	}
+	if status == "SCHEDULED" {
+		//the template may have changed since the campaign was scheduled
+		if _, err = validateSMSCampaignTemplates(templates); err != nil {
+			return false, fmt.Errorf("%w, %s", errSMSCampaignRender, err.Error())
+		}
+		_, err = tx.Exec(ctx, `update sms_campaign set status='QUEUEING', started_at=now() where id=$1`, campaignId)
+		if err != nil {
+			return false, err
+		}
+	}
+	var lastCustomerId int
+	var lastReleaseAt *time.Time
+	err = tx.QueryRow(ctx, `select coalesce(max(customer_id),0),max(next_attempt_at) from sms where campaign_id=$1`, campaignId).Scan(&lastCustomerId, &lastReleaseAt)
+	if err != nil {
+		return false, err
+	}
+	interval := time.Minute / time.Duration(perMinute)
+	startAt := time.Now().UTC()
+	if lastReleaseAt != nil && lastReleaseAt.Add(interval).After(startAt) {
+		startAt = lastReleaseAt.Add(interval)
+	}
+	args := []interface{}{}
+	segment, err := smsCampaignSegment(filters, &args)
+	if err != nil {
+		return false, err
+	}
+	pageSize := smsCampaignPageSize()
+	args = append(args, config.EncryptionKey, lastCustomerId, pageSize)
+	rows, err := tx.Query(ctx, fmt.Sprintf(`select c.id,pgp_sym_decrypt(c.phone::bytea,$%[1]d),pgp_sym_decrypt(c.names::bytea,$%[1]d),coalesce(c.locale,'')
+	from customer c where not c.sms_opt_out and %[2]s and c.id > $%[3]d order by c.id limit $%[4]d`, len(args)-2, segment, len(args)-1, len(args)), args...)
+	if err != nil {
+		return false, err
+	}
+	senderId := viper.GetString("SENDER_ID")
+	priority := utils.SMSPriority("campaign")
+	smsRows := [][]interface{}{}
+	for rows.Next() {
+		var customerId int
+		var phone, names, locale string
+		if err = rows.Scan(&customerId, &phone, &names, &locale); err != nil {
+			rows.Close()
+			return false, err
+		}
+		body, ok := templates[locale]
+		if !ok {
+			body = templates[utils.SMSTemplateDefaultLang()]
+		}
+		message, renderErr := utils.ExecuteSMSTemplate(body, smsCampaignData(names))
+		if renderErr != nil {
+			rows.Close()
+			return false, fmt.Errorf("%w, customer %d: %s", errSMSCampaignRender, customerId, renderErr.Error())
+		}
+		releaseAt := startAt.Add(time.Duration(len(smsRows)) * interval)
+		smsRows = append(smsRows, []interface{}{customerId, message, phone, "campaign", "QUEUED", senderId, utils.SMSOperator(phone), priority, "", 0, "", releaseAt, campaignId})
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return false, err
+	}
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"sms"},
+		[]string{"customer_id", "message", "phone", "type", "status", "sender_id", "network_operator", "priority", "message_id", "credit_count", "error_message", "next_attempt_at", "campaign_id"},
+		pgx.CopyFromRows(smsRows))
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(ctx, `update sms_campaign set recipient_count=recipient_count+$1 where id=$2`, len(smsRows), campaignId)
+	if err != nil {
+		return false, err
+	}
+	done := len(smsRows) < pageSize
+	if done {
+		args = args[:len(args)-3]
+		_, err = tx.Exec(ctx, fmt.Sprintf(`update sms_campaign set status='SENDING',
+		opted_out_count=(select count(c.id) from customer c where c.sms_opt_out and %s) where id=$%d`, segment, len(args)+1),
+			append(args, campaignId)...)
+		if err != nil {
+			return false, err
+		}
+	}
+	return done, tx.Commit(ctx)
+}
+
+// failSMSCampaign mark a campaign FAILED and cancel the sms it already queued
+func failSMSCampaign(campaignId int, reason string) error {
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, `update sms set status='CANCELLED', error_message='campaign failed' where campaign_id=$1 and status='QUEUED'`, campaignId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `update sms_campaign set status='FAILED', error_message=$2, completed_at=now() where id=$1 and status in ('SCHEDULED','QUEUEING')`,
+		campaignId, reason)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"crypto/subtle"
+	"errors"
+	"shared-package/utils"
+	"time"
+	"web-service/config"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+)
+
+// SMSDeliveryReport receive the delivery report (DLR) of a sent sms from the sms provider,
+// the provider authenticates with the token shared in sms.dlr_token (X-DLR-Token header or token query)
+func SMSDeliveryReport(c *fiber.Ctx) error {
+	token := c.Get("X-DLR-Token", c.Query("token"))
+	expectedToken := viper.GetString("sms.dlr_token")
+	if expectedToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expectedToken)) != 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, "Invalid delivery report token")
+	}
+	type FormData struct {
+		MessageId string `json:"message_id" query:"message_id" form:"message_id" validate:"required"`
+		Status    string `json:"status" query:"status" form:"status" validate:"required"`
+		ErrorCode string `json:"error_code" query:"error_code" form:"error_code"`
+		DoneAt    string `json:"done_at" query:"done_at" form:"done_at"`
+	}
+	formData := new(FormData)
+	if c.Method() == fiber.MethodGet {
+		if err := c.QueryParser(formData); err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+		}
+	} else if err := c.BodyParser(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Provided data are not valid")
+	}
+	report := utils.SMSDeliveryReport{
+		MessageId: formData.MessageId,
+		State:     formData.Status,
+		ErrorCode: formData.ErrorCode,
+	}
+	if formData.DoneAt != "" {
+		doneAt, err := time.Parse(time.RFC3339, formData.DoneAt)
+		if err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Invalid done_at, format: RFC3339")
+		}
+		doneAt = doneAt.UTC()
+		report.DoneAt = &doneAt
+	}
+	status, err := utils.SaveSMSDeliveryReport(config.DB, report)
+	if err != nil {
+		if errors.Is(err, utils.ErrSMSNotFound) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotFound, err.Error())
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to save delivery report", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "SMSDeliveryReport: Unable to save delivery report of " + formData.MessageId + ", error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "sms_status": status})
+}
+
+// SMSInbound receive a mobile originated sms from the sms provider and apply its keyword (STOP, START, HELP),
+// the provider authenticates with the token shared in sms.mo_token (X-MO-Token header or token query)
+func SMSInbound(c *fiber.Ctx) error {
+	token := c.Get("X-MO-Token", c.Query("token"))
+	expectedToken := viper.GetString("sms.mo_token")
+	if expectedToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expectedToken)) != 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, "Invalid inbound sms token")
+	}
+	type FormData struct {
+		From      string `json:"from" query:"from" form:"from" validate:"required,max=20"`
+		Message   string `json:"message" query:"message" form:"message" validate:"required,max=1000"`
+		MessageId string `json:"message_id" query:"message_id" form:"message_id" validate:"max=255"`
+	}
+	formData := new(FormData)
+	if c.Method() == fiber.MethodGet {
+		if err := c.QueryParser(formData); err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+		}
+	} else if err := c.BodyParser(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Provided data are not valid")
+	}
+	keyword, err := utils.HandleInboundSMS(config.DB, utils.InboundSMS{
+		Phone:     formData.From,
+		Message:   formData.Message,
+		MessageId: formData.MessageId,
+		Source:    "WEBHOOK",
+	})
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to save inbound sms", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "SMSInbound: Unable to handle inbound sms of " + formData.From + ", error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "keyword": keyword})
+}
@@ -0,0 +1,231 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"shared-package/utils"
+	"unicode/utf8"
+	"web-service/config"
+	"web-service/model"
+
+	"github.com/fiorix/go-smpp/smpp/pdu/pdutext"
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+// GetSMSTemplates list the active templates, all versions are listed when a name is given with versions=true
+func GetSMSTemplates(c *fiber.Ctx) error {
+	name := c.Query("name")
+	lang := c.Query("lang")
+	status := "ACTIVE"
+	if c.QueryBool("versions") && name != "" {
+		status = ""
+	}
+	args := []interface{}{}
+	filter, _ := utils.BuildQueryFilter(
+		map[string]interface{}{
+			"st.name":   name,
+			"st.lang":   lang,
+			"st.status": status,
+		},
+		&args,
+	)
+	templates := []model.SMSTemplate{}
+	rows, err := config.DB.Query(ctx,
+		`select st.id,st.name,st.lang,st.version,st.body,st.status,concat(u.fname,' ',u.lname),st.created_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali'
+		from sms_template st left join users u on u.id = st.operator_id`+filter+` order by st.name,st.lang,st.version desc`, args...)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get sms templates failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetSMSTemplates: Unable to get sms templates, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer rows.Close()
+	for rows.Next() {
+		template := model.SMSTemplate{}
+		var operator string
+		err = rows.Scan(&template.Id, &template.Name, &template.Lang, &template.Version, &template.Body, &template.Status, &operator, &template.CreatedAt)
+		if err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get sms templates failed", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "GetSMSTemplates: Unable to read sms template, error: " + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+		if operator != " " {
+			template.Operator = &operator
+		}
+		//estimate with the sample data, placeholders change the final length
+		if message, err := utils.ExecuteSMSTemplate(template.Body, utils.SMSTemplateSample(template.Name)); err == nil {
+			template.Segments = utils.SMSSegments(message)
+		}
+		templates = append(templates, template)
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": templates})
+}
+
+// SaveSMSTemplate save a new version of a template, the previous version is archived
+func SaveSMSTemplate(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	type FormData struct {
+		Name string `json:"name" binding:"required" validate:"required,max=100,regex=^[a-z0-9_.]*$"`
+		Lang string `json:"lang" binding:"required" validate:"required,oneof=en rw"`
+		Body string `json:"body" binding:"required" validate:"required,max=1000"`
+	}
+	formData := FormData{}
+	if err := c.BodyParser(&formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+	if _, err := utils.ExecuteSMSTemplate(formData.Body, utils.SMSTemplateSample(formData.Name)); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Template is not valid, "+err.Error())
+	}
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to save sms template, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "SaveSMSTemplate: Unable to begin transaction, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer tx.Rollback(ctx)
+	version, err := utils.SaveSMSTemplate(tx, formData.Name, formData.Lang, formData.Body, &userPayload.Id)
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to save sms template, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "SaveSMSTemplate: Unable to save sms template, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "sms_template",
+			Description:  fmt.Sprintf("saved sms template %s (%s), version %d", formData.Name, formData.Lang, version),
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		nil,
+	)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "SMS template saved", "version": version})
+}
+
+// ActivateSMSTemplate make an older version of a template active again
+func ActivateSMSTemplate(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	templateId, err := c.ParamsInt("template_id")
+	if err != nil || templateId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid template id provided")
+	}
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to activate sms template, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ActivateSMSTemplate: Unable to begin transaction, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer tx.Rollback(ctx)
+	var name, lang string
+	var version int
+	err = tx.QueryRow(ctx, `select name,lang,version from sms_template where id=$1`, templateId).Scan(&name, &lang, &version)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotFound, "SMS template not found")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to activate sms template, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ActivateSMSTemplate: Unable to get sms template, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	_, err = tx.Exec(ctx, `update sms_template set status='ARCHIVED' where name=$1 and lang=$2 and status='ACTIVE'`, name, lang)
+	if err == nil {
+		_, err = tx.Exec(ctx, `update sms_template set status='ACTIVE' where id=$1`, templateId)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to activate sms template, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ActivateSMSTemplate: Unable to activate sms template, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "sms_template",
+			Description:  fmt.Sprintf("activated sms template %s (%s), version %d", name, lang, version),
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		nil,
+	)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": fmt.Sprintf("Version %d of %s (%s) is now active", version, name, lang)})
+}
+
+// PreviewSMSTemplate render a template body, or the active template of a name, with the given or the sample data
+func PreviewSMSTemplate(c *fiber.Ctx) error {
+	var err error
+	type FormData struct {
+		Name string         `json:"name" validate:"required_without=Body,max=100"`
+		Lang string         `json:"lang" validate:"max=10"`
+		Body string         `json:"body" validate:"required_without=Name,max=1000"`
+		Data map[string]any `json:"data"`
+	}
+	formData := FormData{}
+	if err := c.BodyParser(&formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+	body := formData.Body
+	if body == "" {
+		lang := formData.Lang
+		if lang == "" {
+			lang = utils.SMSTemplateDefaultLang()
+		}
+		body, err = utils.GetSMSTemplate(config.DB, formData.Name, lang)
+		if err != nil {
+			if errors.Is(err, utils.ErrSMSTemplateNotFound) {
+				return utils.JsonErrorResponse(c, fiber.StatusNotFound, "SMS template not found")
+			}
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to preview sms template, system error", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "PreviewSMSTemplate: Unable to get sms template, error: " + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+	}
+	data := utils.SMSTemplateSample(formData.Name)
+	for key, value := range formData.Data {
+		data[key] = value
+	}
+	message, err := utils.ExecuteSMSTemplate(body, data)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Template is not valid, "+err.Error())
+	}
+	encoding := "GSM-7"
+	if utils.SMSText(message).Type() == pdutext.UCS2Type {
+		encoding = "UCS-2"
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": fiber.Map{
+		"text":       message,
+		"characters": utf8.RuneCountInString(message),
+		"encoding":   encoding,
+		"segments":   utils.SMSSegments(message),
+	}})
+}
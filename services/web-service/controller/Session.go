@@ -0,0 +1,262 @@
+package controller
+
+import (
+	"errors"
+	"shared-package/utils"
+	"slices"
+	"strconv"
+	"strings"
+	"web-service/config"
+	"web-service/model"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// revokeSessions end all sessions of the user, it is called when the account or its permissions change
+// so the user has to login again with its new access
+func revokeSessions(c *fiber.Ctx, userId int, reason string) {
+	revoked, err := utils.RevokeUserSessions(config.Redis, userId, "")
+	if err != nil {
+		utils.LogMessage("critical", "revokeSessions: Unable to revoke sessions of user "+strconv.Itoa(userId)+", error: "+err.Error(), config.ServiceName)
+		return
+	}
+	if revoked == 0 {
+		return
+	}
+	operatorId := userId
+	if userPayload := CurrentUser(c); userPayload != nil {
+		operatorId = userPayload.Id
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       operatorId,
+			ActivityType: "revokeSessions",
+			Description:  "revoked sessions, " + reason,
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"user_id":  userId,
+			"sessions": revoked,
+		},
+	)
+}
+
+// revokeRoleSessions end the sessions of all users having the role
+func revokeRoleSessions(c *fiber.Ctx, roleId int, reason string) {
+	rows, err := config.DB.Query(ctx, `select user_id from user_roles where role_id=$1`, roleId)
+	if err != nil {
+		utils.LogMessage("critical", "revokeRoleSessions: Unable to get users of role "+strconv.Itoa(roleId)+", error: "+err.Error(), config.ServiceName)
+		return
+	}
+	userIds := []int{}
+	for rows.Next() {
+		var userId int
+		if err = rows.Scan(&userId); err == nil {
+			userIds = append(userIds, userId)
+		}
+	}
+	rows.Close()
+	for _, userId := range userIds {
+		revokeSessions(c, userId, reason)
+	}
+}
+
+// RefreshSession exchange a refresh token for a new access and refresh token
+func RefreshSession(c *fiber.Ctx) error {
+	type FormData struct {
+		RefreshToken string `json:"refresh_token" binding:"required" validate:"required,max=100"`
+	}
+	formData := new(FormData)
+	if err := c.BodyParser(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Please provide all required data")
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Provided data are not valid")
+	}
+	session, tokens, err := utils.RefreshSession(config.Redis, formData.RefreshToken)
+	if err != nil {
+		if errors.Is(err, utils.ErrRefreshTokenReused) {
+			utils.RecordActivityLog(config.DB,
+				utils.ActivityLog{
+					UserID:       session.User.Id,
+					ActivityType: "refreshSession",
+					Description:  "refresh token reused, session revoked",
+					Status:       "failure",
+					IPAddress:    c.IP(),
+					UserAgent:    c.Get("User-Agent"),
+				},
+				config.ServiceName,
+				&map[string]interface{}{
+					"session_id": session.Id,
+				},
+			)
+			return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, err.Error())
+		} else if errors.Is(err, utils.ErrSessionNotFound) {
+			return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, "Refresh token not found or expired")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to refresh session, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "RefreshSession: Unable to refresh session, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Session refreshed", "accessToken": tokens.AccessToken,
+		"refreshToken": tokens.RefreshToken, "expiresIn": tokens.ExpiresIn})
+}
+
+// Logout end the current session
+func Logout(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	err := utils.RevokeSession(config.Redis, userPayload.Id, userPayload.SessionId)
+	if err != nil && !errors.Is(err, utils.ErrSessionNotFound) {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Logout failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "Logout: Unable to revoke session, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "logout",
+			Description:  "Self: logged out",
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"session_id": userPayload.SessionId,
+		},
+	)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Logged out successfully"})
+}
+
+// LogoutEverywhere end all sessions of the current user, the current one is kept when keep_current is set
+func LogoutEverywhere(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	exceptSessionId := ""
+	if c.QueryBool("keep_current") {
+		exceptSessionId = userPayload.SessionId
+	}
+	revoked, err := utils.RevokeUserSessions(config.Redis, userPayload.Id, exceptSessionId)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Logout failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "LogoutEverywhere: Unable to revoke sessions, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "logoutEverywhere",
+			Description:  "Self: logged out of all sessions",
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"sessions": revoked,
+		},
+	)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Logged out of " + strconv.Itoa(revoked) + " session(s)", "revoked": revoked})
+}
+
+// GetSessions list the active sessions of the current user, latest first
+func GetSessions(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	userSessions, err := utils.ListUserSessions(config.Redis, userPayload.Id)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get sessions failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetSessions: Unable to get sessions, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	sessions := []model.Session{}
+	for _, session := range userSessions {
+		sessions = append(sessions, model.Session{
+			Id:          session.Id,
+			IPAddress:   session.IPAddress,
+			UserAgent:   session.UserAgent,
+			CreatedAt:   session.CreatedAt,
+			RefreshedAt: session.RefreshedAt,
+			ExpiresAt:   session.ExpiresAt,
+			Current:     session.Id == userPayload.SessionId,
+		})
+	}
+	slices.SortFunc(sessions, func(a, b model.Session) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": sessions})
+}
+
+// RevokeSession end one of the sessions of the current user
+func RevokeSession(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	sessionId := strings.TrimSpace(c.Params("session_id"))
+	err := utils.RevokeSession(config.Redis, userPayload.Id, sessionId)
+	if err != nil {
+		if errors.Is(err, utils.ErrSessionNotFound) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotFound, "Session not found or expired")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to revoke session, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "RevokeSession: Unable to revoke session, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "revokeSession",
+			Description:  "Self: revoked a session",
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"session_id": sessionId,
+		},
+	)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Session revoked successfully"})
+}
+
+// RevokeUserSessions force the logout of a user from all its sessions
+func RevokeUserSessions(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	userId, err := c.ParamsInt("userId")
+	if err != nil || userId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Invalid user id provided")
+	}
+	revoked, err := utils.RevokeUserSessions(config.Redis, userId, "")
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to revoke sessions, system error", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "RevokeUserSessions: Unable to revoke sessions, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "revokeSessions",
+			Description:  "revoked sessions of user " + strconv.Itoa(userId),
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"user_id":  userId,
+			"sessions": revoked,
+		},
+	)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": strconv.Itoa(revoked) + " session(s) revoked", "revoked": revoked})
+}
@@ -0,0 +1,280 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"shared-package/utils"
+	"slices"
+	"strings"
+	"time"
+	"web-service/config"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var settlementEvidencePath = "/app/uploads/evidence"
+
+// SettleTransaction mark a transaction as paid outside the system (cash at a ceremony, bank transfer,...)
+func SettleTransaction(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	transactionId, err := c.ParamsInt("transaction_id")
+	if err != nil || transactionId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid transaction id provided")
+	}
+	type FormData struct {
+		Method    string `json:"method" form:"method" binding:"required" validate:"required,oneof=cash bank_transfer cheque in-person"`
+		Reference string `json:"reference" form:"reference" binding:"required" validate:"required,max=100"`
+		Note      string `json:"note" form:"note" validate:"max=500"`
+	}
+	formData := new(FormData)
+	if err := c.BodyParser(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Please provide all required data")
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Provided data are not valid")
+	}
+	invalidKeys := utils.ValidateStruct(formData, []string{}, []string{})
+	errorMessage := utils.ValidateStructText(invalidKeys)
+	if errorMessage != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, *errorMessage)
+	}
+	file, err := c.FormFile("evidence")
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Please provide the settlement evidence")
+	}
+	ext := strings.ToLower(filepath.Ext(file.Filename))
+	if !slices.Contains([]string{".pdf", ".jpg", ".jpeg", ".png"}, ext) {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Evidence should be a pdf or an image")
+	}
+	if file.Size > 1024*1024*10 {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Evidence size should not exceed 10MB")
+	}
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to settle transaction", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "SettleTransaction: Unable to start transaction, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	evidencePath := ""
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+			//the settlement is not saved, its evidence is not kept
+			if evidencePath != "" {
+				os.Remove(evidencePath)
+			}
+		} else {
+			tx.Commit(ctx)
+		}
+	}()
+	var status, phone, trxId, prizeCode string
+	var customerStatus *string
+	var dispatched bool
+	//the lock waits for DistributeMomoPrize to finish a payout in progress, it skips the row while it is being settled
+	err = tx.QueryRow(ctx, `select t.status,t.phone,t.trx_id,p.code,c.status,
+	exists(select 1 from transaction_records r where r.transaction_id = t.id and r.transaction_type='CREDIT' and r.status <> 'FAILED') from transaction t
+	INNER JOIN prize p on p.id = t.prize_id left join customer c on c.id = t.customer_id where t.id=$1 for update of t`, transactionId).
+		Scan(&status, &phone, &trxId, &prizeCode, &customerStatus, &dispatched)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Transaction data is invalid")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to settle transaction", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "SettleTransaction: Unable to get transaction data, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	//failed payouts and approved ones not sent to the network yet (a cash or bank payout) can be settled manually,
+	//they went through the approvals, the claim verification and the fraud checks. WAITING transactions have to be approved first
+	if status != "FAILED" && status != "PENDING" {
+		err = fmt.Errorf("invalid status %s", status)
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, fmt.Sprintf("Transaction with status %s can not be settled manually", status))
+	}
+	if status == "PENDING" && dispatched {
+		err = fmt.Errorf("transaction %d is already sent to the network", transactionId)
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Transaction is already sent to the network, it can be settled manually if it fails")
+	}
+	if customerStatus != nil && *customerStatus != "OKAY" {
+		err = errCustomerInReview
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "The winner is held by a fraud review, settlement is allowed once the fraud case is cleared")
+	}
+	err = os.MkdirAll(settlementEvidencePath, 0755)
+	if err == nil {
+		evidencePath = fmt.Sprintf("%s/%s_%d%s", settlementEvidencePath, trxId, time.Now().UnixMilli(), ext)
+		err = c.SaveFile(file, evidencePath)
+	}
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to save evidence file", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "SettleTransaction: Unable to save evidence file, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	var settlementId int
+	err = tx.QueryRow(ctx, `insert into transaction_settlement (transaction_id,settlement_type,method,reference,reason,evidence_path,operator_id,ip_address)
+	values ($1,'MANUAL',$2,$3,$4,$5,$6,$7) returning id`, transactionId, formData.Method, formData.Reference, formData.Note, evidencePath, userPayload.Id, c.IP()).
+		Scan(&settlementId)
+	if err == nil {
+		var result pgconn.CommandTag
+		result, err = tx.Exec(ctx, `update transaction set status='SETTLED', ref_no=$1, error_message=NULL where id=$2 and status=$3`, formData.Reference, transactionId, status)
+		if err == nil && result.RowsAffected() != 1 {
+			err = fmt.Errorf("transaction %d is no longer %s", transactionId, status)
+		}
+	}
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to settle transaction", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "SettleTransaction: Unable to save settlement, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "settleTransaction",
+			Description:  fmt.Sprintf("manual settlement of %s, TrxId: %s, Prize: %s, Method: %s, Reference: %s", phone, trxId, prizeCode, formData.Method, formData.Reference),
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"transaction_id":  transactionId,
+			"settlement_id":   settlementId,
+			"previous_status": status,
+			"status":          "SETTLED",
+		},
+	)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": fmt.Sprintf("Transaction of %s settled successfully", prizeCode), "settlement_id": settlementId})
+}
+
+// ReverseTransaction reverse a paid transaction (fraud,...) by recording a DEBIT transaction record
+func ReverseTransaction(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	transactionId, err := c.ParamsInt("transaction_id")
+	if err != nil || transactionId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid transaction id provided")
+	}
+	type FormData struct {
+		Reason    string `json:"reason" binding:"required" validate:"required,max=500"`
+		Reference string `json:"reference" validate:"max=100"`
+	}
+	formData := new(FormData)
+	if err := c.BodyParser(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Please provide all required data")
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Provided data are not valid")
+	}
+	invalidKeys := utils.ValidateStruct(formData, []string{}, []string{})
+	errorMessage := utils.ValidateStructText(invalidKeys)
+	if errorMessage != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, *errorMessage)
+	}
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to reverse transaction", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ReverseTransaction: Unable to start transaction, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			tx.Commit(ctx)
+		}
+	}()
+	var status, phone, mno, trxId, prizeCode string
+	var amount float64
+	err = tx.QueryRow(ctx, `select t.status,t.phone,t.mno,t.trx_id,t.amount,p.code from transaction t
+	INNER JOIN prize p on p.id = t.prize_id where t.id=$1 for update of t`, transactionId).Scan(&status, &phone, &mno, &trxId, &amount, &prizeCode)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Transaction data is invalid")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to reverse transaction", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ReverseTransaction: Unable to get transaction data, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	//only paid transactions can be reversed
+	if status != "SUCCESS" && status != "SETTLED" {
+		err = fmt.Errorf("invalid status %s", status)
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, fmt.Sprintf("Transaction with status %s can not be reversed", status))
+	}
+	var reference *string
+	if formData.Reference != "" {
+		reference = &formData.Reference
+	}
+	var recordId, settlementId int
+	reversalTrxId := trxId + "RV"
+	err = tx.QueryRow(ctx, `insert into transaction_records (transaction_id,trx_id,ref_no,amount,phone,transaction_type,mno,status)
+	values ($1,$2,$3,$4,$5,'DEBIT',$6,'SUCCESS') returning id`, transactionId, reversalTrxId, reference, amount, phone, mno).Scan(&recordId)
+	if err == nil {
+		err = tx.QueryRow(ctx, `insert into transaction_settlement (transaction_id,settlement_type,reference,reason,transaction_record_id,operator_id,ip_address)
+		values ($1,'REVERSAL',$2,$3,$4,$5,$6) returning id`, transactionId, reference, formData.Reason, recordId, userPayload.Id, c.IP()).Scan(&settlementId)
+	}
+	if err == nil {
+		_, err = tx.Exec(ctx, `update transaction set status='REVERSED' where id=$1`, transactionId)
+	}
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to reverse transaction", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ReverseTransaction: Unable to save reversal, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "reverseTransaction",
+			Description:  fmt.Sprintf("reverse transaction of %s, TrxId: %s, Prize: %s, Reason: %s", phone, trxId, prizeCode, formData.Reason),
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"transaction_id":        transactionId,
+			"transaction_record_id": recordId,
+			"settlement_id":         settlementId,
+			"previous_status":       status,
+			"status":                "REVERSED",
+		},
+	)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": fmt.Sprintf("Transaction of %s reversed successfully", prizeCode), "trx_id": reversalTrxId})
+}
+
+// GetSettlementEvidence download the evidence attached to a manual settlement
+func GetSettlementEvidence(c *fiber.Ctx) error {
+	settlementId, err := c.ParamsInt("settlement_id")
+	if err != nil || settlementId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Invalid settlement id provided")
+	}
+	var evidencePath *string
+	err = config.DB.QueryRow(ctx, `select evidence_path from transaction_settlement where id=$1`, settlementId).Scan(&evidencePath)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotFound, "Settlement not found")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to get settlement evidence", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetSettlementEvidence: Unable to get settlement data, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	if evidencePath == nil || *evidencePath == "" {
+		return utils.JsonErrorResponse(c, fiber.StatusNotFound, "Settlement has no evidence")
+	}
+	return c.Download(*evidencePath)
+}
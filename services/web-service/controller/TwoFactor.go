@@ -0,0 +1,711 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"shared-package/utils"
+	"strconv"
+	"time"
+	"web-service/config"
+	"web-service/model"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/spf13/viper"
+)
+
+// second factor methods, sms is the fallback of users enrolled with an authenticator
+const (
+	TwoFactorTOTP     = "totp"
+	TwoFactorRecovery = "recovery"
+	TwoFactorSMS      = "sms"
+)
+
+const recoveryCodesCount = 10
+const twoFactorMaxAttempts = 5
+
+var errInvalidSecondFactor = errors.New("invalid verification code")
+
+// twoFactorChallenge is kept between the password and the second factor of a login
+type twoFactorChallenge struct {
+	UserId   int    `json:"user_id"`
+	Email    string `json:"email"`  // failed codes count against the login guard of the account
+	Enroll   bool   `json:"enroll"` // a role of the user requires 2FA and it is not enrolled yet
+	Secret   string `json:"secret"` // secret being enrolled during the login
+	Attempts int    `json:"attempts"`
+}
+
+// twoFactorChallengeTTL is the time to provide the second factor after the password, two_factor.challenge_ttl in minutes
+func twoFactorChallengeTTL() time.Duration {
+	if ttl := viper.GetInt("two_factor.challenge_ttl"); ttl > 0 {
+		return time.Duration(ttl) * time.Minute
+	}
+	return 5 * time.Minute
+}
+
+// stepUpTTL is how long a re-authentication allows the sensitive actions of the session, two_factor.step_up_ttl in minutes
+func stepUpTTL() time.Duration {
+	if ttl := viper.GetInt("two_factor.step_up_ttl"); ttl > 0 {
+		return time.Duration(ttl) * time.Minute
+	}
+	return 5 * time.Minute
+}
+
+func twoFactorIssuer() string {
+	if issuer := viper.GetString("two_factor.issuer"); issuer != "" {
+		return issuer
+	}
+	return "BRALIRWA"
+}
+
+func twoFactorChallengeKey(token string) string {
+	return "2fa:challenge:" + utils.TokenHash(token)
+}
+func stepUpKey(sessionId string) string {
+	return "2fa:step_up:" + sessionId
+}
+
+// userTwoFactor return the decrypted secret of the user, if 2FA is enabled and if one of its roles requires it
+func userTwoFactor(userId int) (secret string, enabled bool, required bool, err error) {
+	err = config.DB.QueryRow(ctx, `select coalesce(pgp_sym_decrypt(u.totp_secret,$2),''),u.totp_enabled_at is not null,
+	exists(select 1 from user_roles ur inner join roles r on r.id = ur.role_id where ur.user_id = u.id and r.require_two_factor)
+	from users u where u.id=$1`, userId, config.EncryptionKey).Scan(&secret, &enabled, &required)
+	return secret, enabled, required, err
+}
+
+// saveRecoveryCodes replace the recovery codes of the user and return the new ones, they are only shown once
+func saveRecoveryCodes(tx pgx.Tx, userId int) ([]string, error) {
+	codes, err := utils.GenerateRecoveryCodes(recoveryCodesCount)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(ctx, `delete from user_recovery_code where user_id=$1`, userId)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(ctx, `insert into user_recovery_code (user_id,code_hash) select $1,digest(c,'sha256') from unnest($2::text[]) c`, userId, codes)
+	return codes, err
+}
+
+// enableTwoFactor save the confirmed secret of the user with new recovery codes
+func enableTwoFactor(userId int, secret string) ([]string, error) {
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, `update users set totp_secret=pgp_sym_encrypt($1,$2),totp_enabled_at=now() where id=$3`, secret, config.EncryptionKey, userId)
+	if err != nil {
+		return nil, err
+	}
+	codes, err := saveRecoveryCodes(tx, userId)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit(ctx)
+}
+
+// sendTwoFactorSMS send a one time code to the phone of the user, it is used when the authenticator is not at hand
+func sendTwoFactorSMS(userId int, purpose string) error {
+	//one sms per minute
+	if !config.Redis.SetNX(ctx, fmt.Sprintf("2fa:sms_sent:%s:%d", purpose, userId), 1, time.Minute).Val() {
+		return errors.New("a code has already been sent, please wait a minute before requesting a new one")
+	}
+	var fname, phone string
+	err := config.DB.QueryRow(ctx, `select fname,phone from users where id=$1`, userId).Scan(&fname, &phone)
+	if err != nil {
+		return err
+	}
+	otp, err := utils.GenerateOTP(6)
+	if err != nil {
+		return err
+	}
+	if utils.IsTestMode {
+		otp = "123456"
+	}
+	err = config.Redis.Set(ctx, fmt.Sprintf("2fa:sms:%s:%d", purpose, userId), utils.TokenHash(otp), twoFactorChallengeTTL()).Err()
+	if err != nil {
+		return err
+	}
+	_, err = utils.QueueTemplateSMS(config.DB, "two_factor_otp", utils.SMSTemplateDefaultLang(), map[string]any{"Name": fname, "OTP": otp},
+		phone, viper.GetString("SENDER_ID"), "two_factor_otp", nil)
+	return err
+}
+
+// verifySecondFactor check the code of the user with the given method, a totp code and a sms code are only accepted once
+func verifySecondFactor(userId int, secret string, method string, code string, purpose string) error {
+	switch method {
+	case TwoFactorTOTP:
+		step, ok := utils.ValidateTOTP(secret, code, time.Now())
+		if !ok {
+			return errInvalidSecondFactor
+		}
+		if !config.Redis.SetNX(ctx, fmt.Sprintf("2fa:totp_used:%d:%d", userId, step), 1, 2*time.Minute).Val() {
+			return errInvalidSecondFactor
+		}
+		return nil
+	case TwoFactorRecovery:
+		result, err := config.DB.Exec(ctx, `update user_recovery_code set used_at=now() where user_id=$1 and code_hash=digest($2,'sha256') and used_at is null`,
+			userId, utils.NormalizeRecoveryCode(code))
+		if err != nil {
+			return err
+		}
+		if result.RowsAffected() != 1 {
+			return errInvalidSecondFactor
+		}
+		return nil
+	case TwoFactorSMS:
+		key := fmt.Sprintf("2fa:sms:%s:%d", purpose, userId)
+		hash, err := config.Redis.Get(ctx, key).Result()
+		if err == redis.Nil || (err == nil && hash != utils.TokenHash(code)) {
+			return errInvalidSecondFactor
+		} else if err != nil {
+			return err
+		}
+		config.Redis.Del(ctx, key)
+		return nil
+	}
+	return errInvalidSecondFactor
+}
+
+// startTwoFactorChallenge return the challenge the login has to complete with the second factor
+func startTwoFactorChallenge(user model.UserProfile, enroll bool) (string, error) {
+	token, err := utils.RandomToken()
+	if err != nil {
+		return "", err
+	}
+	challenge, err := json.Marshal(twoFactorChallenge{UserId: user.Id, Email: user.Email, Enroll: enroll})
+	if err != nil {
+		return "", err
+	}
+	return token, config.Redis.Set(ctx, twoFactorChallengeKey(token), challenge, twoFactorChallengeTTL()).Err()
+}
+
+func getTwoFactorChallenge(token string) (*twoFactorChallenge, error) {
+	data, err := config.Redis.Get(ctx, twoFactorChallengeKey(token)).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	challenge := &twoFactorChallenge{}
+	return challenge, json.Unmarshal(data, challenge)
+}
+
+func saveTwoFactorChallenge(token string, challenge *twoFactorChallenge) error {
+	data, err := json.Marshal(challenge)
+	if err != nil {
+		return err
+	}
+	return config.Redis.Set(ctx, twoFactorChallengeKey(token), data, redis.KeepTTL).Err()
+}
+
+// challengeErrorResponse is returned when the challenge of a login is missing or expired
+func challengeErrorResponse(c *fiber.Ctx, err error, funcName string) error {
+	if err == redis.Nil {
+		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, "Login expired, please login again")
+	}
+	return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Login failed", utils.Logger{
+		LogLevel:    utils.CRITICAL,
+		Message:     funcName + ": Unable to get two factor challenge, error: " + err.Error(),
+		ServiceName: config.ServiceName,
+	})
+}
+
+// EnrollLoginTwoFactor return the secret to add in the authenticator, when a role of the user requires 2FA which is not enrolled yet
+func EnrollLoginTwoFactor(c *fiber.Ctx) error {
+	type FormData struct {
+		Challenge string `json:"challenge" binding:"required" validate:"required"`
+	}
+	formData := new(FormData)
+	if err := c.BodyParser(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Please provide all required data")
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Provided data are not valid")
+	}
+	challenge, err := getTwoFactorChallenge(formData.Challenge)
+	if err != nil {
+		return challengeErrorResponse(c, err, "EnrollLoginTwoFactor")
+	}
+	if !challenge.Enroll {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Two-factor authentication is already enabled")
+	}
+	var email string
+	if err = config.DB.QueryRow(ctx, `select email from users where id=$1`, challenge.UserId).Scan(&email); err == nil {
+		challenge.Secret, err = utils.GenerateTOTPSecret()
+	}
+	if err == nil {
+		err = saveTwoFactorChallenge(formData.Challenge, challenge)
+	}
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Two-factor enrollment failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "EnrollLoginTwoFactor: Unable to start enrollment, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Scan the QR code with your authenticator app then confirm with its code",
+		"secret": challenge.Secret, "otpauth_url": utils.TOTPUri(twoFactorIssuer(), email, challenge.Secret)})
+}
+
+// SendLoginTwoFactorSMS send the sms fallback code of a login
+func SendLoginTwoFactorSMS(c *fiber.Ctx) error {
+	type FormData struct {
+		Challenge string `json:"challenge" binding:"required" validate:"required"`
+	}
+	formData := new(FormData)
+	if err := c.BodyParser(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Please provide all required data")
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Provided data are not valid")
+	}
+	challenge, err := getTwoFactorChallenge(formData.Challenge)
+	if err != nil {
+		return challengeErrorResponse(c, err, "SendLoginTwoFactorSMS")
+	}
+	//the sms is a fallback, it does not replace the enrollment of the authenticator
+	if challenge.Enroll {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Please enroll an authenticator app first")
+	}
+	if err = sendTwoFactorSMS(challenge.UserId, "login"); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusTooManyRequests, err.Error())
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "A verification code has been sent to your phone"})
+}
+
+// VerifyLoginTwoFactor complete a login with the second factor and open the session
+func VerifyLoginTwoFactor(c *fiber.Ctx) error {
+	type FormData struct {
+		Challenge string `json:"challenge" binding:"required" validate:"required"`
+		Method    string `json:"method" binding:"required" validate:"required,oneof=totp recovery sms"`
+		Code      string `json:"code" binding:"required" validate:"required,max=20"`
+	}
+	formData := new(FormData)
+	if err := c.BodyParser(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Please provide all required data")
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Provided data are not valid")
+	}
+	challenge, err := getTwoFactorChallenge(formData.Challenge)
+	if err != nil {
+		return challengeErrorResponse(c, err, "VerifyLoginTwoFactor")
+	}
+	if err = utils.LoginGuardCheck(config.Redis, utils.LoginGuardLogin, challenge.Email, c.IP()); err != nil {
+		return loginGuardResponse(c, err, "VerifyLoginTwoFactor")
+	}
+	secret := challenge.Secret
+	if challenge.Enroll {
+		if secret == "" || formData.Method != TwoFactorTOTP {
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Please enroll an authenticator app first")
+		}
+	} else if secret, _, _, err = userTwoFactor(challenge.UserId); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Login failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "VerifyLoginTwoFactor: Unable to get two factor data, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	err = verifySecondFactor(challenge.UserId, secret, formData.Method, formData.Code, "login")
+	if err != nil {
+		if !errors.Is(err, errInvalidSecondFactor) {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Login failed", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "VerifyLoginTwoFactor: Unable to verify second factor, error: " + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+		challenge.Attempts++
+		if challenge.Attempts >= twoFactorMaxAttempts {
+			config.Redis.Del(ctx, twoFactorChallengeKey(formData.Challenge))
+		} else {
+			saveTwoFactorChallenge(formData.Challenge, challenge)
+		}
+		utils.RecordActivityLog(config.DB,
+			utils.ActivityLog{
+				UserID:       challenge.UserId,
+				ActivityType: "LoginWithEmail",
+				Description:  "Login failed, invalid " + formData.Method + " code",
+				Status:       "failure",
+				IPAddress:    c.IP(),
+				UserAgent:    c.Get("User-Agent"),
+			},
+			config.ServiceName,
+			&map[string]interface{}{
+				"attempts": challenge.Attempts,
+			},
+		)
+		if err = loginGuardFailure(c, utils.LoginGuardLogin, challenge.Email); err != nil {
+			config.Redis.Del(ctx, twoFactorChallengeKey(formData.Challenge))
+			return loginGuardResponse(c, err, "VerifyLoginTwoFactor")
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, "Invalid verification code")
+	}
+	config.Redis.Del(ctx, twoFactorChallengeKey(formData.Challenge))
+	var recoveryCodes []string
+	if challenge.Enroll {
+		recoveryCodes, err = enableTwoFactor(challenge.UserId, secret)
+		if err != nil {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Login failed", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "VerifyLoginTwoFactor: Unable to enable two factor, error: " + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+	}
+	UserProfile, err := loadLoginProfile(challenge.UserId)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Login failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "VerifyLoginTwoFactor: Unable to get user data, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	} else if UserProfile.Status != "OKAY" {
+		return utils.JsonErrorResponse(c, fiber.StatusForbidden, "Your account has been deactivated")
+	}
+	extra := fiber.Map{"two_factor_method": formData.Method}
+	if recoveryCodes != nil {
+		extra["recovery_codes"] = recoveryCodes
+	}
+	return completeLogin(c, UserProfile, extra)
+}
+
+// GetTwoFactor return the two-factor state of the current user
+func GetTwoFactor(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	var enabledAt *time.Time
+	var required bool
+	var recoveryCodes int
+	err := config.DB.QueryRow(ctx, `select u.totp_enabled_at AT TIME ZONE 'UTC' AT TIME ZONE 'Africa/Kigali',
+	exists(select 1 from user_roles ur inner join roles r on r.id = ur.role_id where ur.user_id = u.id and r.require_two_factor),
+	(select count(*) from user_recovery_code rc where rc.user_id = u.id and rc.used_at is null) from users u where u.id=$1`, userPayload.Id).
+		Scan(&enabledAt, &required, &recoveryCodes)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Get two-factor authentication failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "GetTwoFactor: Unable to get two factor data, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "success", "data": fiber.Map{"enabled": enabledAt != nil, "enabled_at": enabledAt,
+		"required": required, "recovery_codes": recoveryCodes}})
+}
+
+// EnrollTwoFactor start the enrollment of an authenticator app, it is enabled once confirmed with a code
+func EnrollTwoFactor(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	secret, err := utils.GenerateTOTPSecret()
+	if err == nil {
+		err = config.Redis.Set(ctx, "2fa:enroll:"+strconv.Itoa(userPayload.Id), secret, 10*time.Minute).Err()
+	}
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Two-factor enrollment failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "EnrollTwoFactor: Unable to start enrollment, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Scan the QR code with your authenticator app then confirm with its code",
+		"secret": secret, "otpauth_url": utils.TOTPUri(twoFactorIssuer(), userPayload.Email, secret)})
+}
+
+// EnableTwoFactor confirm the enrollment with a code of the authenticator,
+// replacing an enabled authenticator requires a recent step up like disabling it
+func EnableTwoFactor(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	_, enabled, _, err := userTwoFactor(userPayload.Id)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Two-factor enrollment failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "EnableTwoFactor: Unable to get two factor data, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	if enabled && !steppedUp(userPayload.SessionId) {
+		return stepUpRequiredResponse(c)
+	}
+	type FormData struct {
+		Code string `json:"code" binding:"required" validate:"required,len=6"`
+	}
+	formData := new(FormData)
+	if err := c.BodyParser(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Please provide all required data")
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Provided data are not valid")
+	}
+	enrollKey := "2fa:enroll:" + strconv.Itoa(userPayload.Id)
+	secret, err := config.Redis.Get(ctx, enrollKey).Result()
+	if err == redis.Nil {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Enrollment expired, please start again")
+	}
+	if err == nil {
+		err = verifySecondFactor(userPayload.Id, secret, TwoFactorTOTP, formData.Code, "enroll")
+		if errors.Is(err, errInvalidSecondFactor) {
+			return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, "Invalid verification code")
+		}
+	}
+	var recoveryCodes []string
+	if err == nil {
+		recoveryCodes, err = enableTwoFactor(userPayload.Id, secret)
+	}
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Two-factor enrollment failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "EnableTwoFactor: Unable to enable two factor, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	config.Redis.Del(ctx, enrollKey)
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "enableTwoFactor",
+			Description:  "Self: enabled two-factor authentication",
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		nil,
+	)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Two-factor authentication enabled, keep the recovery codes in a safe place",
+		"recovery_codes": recoveryCodes})
+}
+
+// DisableTwoFactor remove the authenticator of the current user, unless one of its roles requires it
+func DisableTwoFactor(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	_, enabled, required, err := userTwoFactor(userPayload.Id)
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Disable two-factor authentication failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "DisableTwoFactor: Unable to get two factor data, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	if !enabled {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Two-factor authentication is not enabled")
+	} else if required {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Two-factor authentication is required by your roles")
+	}
+	_, err = config.DB.Exec(ctx, `update users set totp_secret=null,totp_enabled_at=null where id=$1`, userPayload.Id)
+	if err == nil {
+		_, err = config.DB.Exec(ctx, `delete from user_recovery_code where user_id=$1`, userPayload.Id)
+	}
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Disable two-factor authentication failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "DisableTwoFactor: Unable to disable two factor, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "disableTwoFactor",
+			Description:  "Self: disabled two-factor authentication",
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		nil,
+	)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodes replace the recovery codes of the current user
+func RegenerateRecoveryCodes(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	_, enabled, _, err := userTwoFactor(userPayload.Id)
+	if err == nil && !enabled {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Two-factor authentication is not enabled")
+	}
+	var recoveryCodes []string
+	if err == nil {
+		var tx pgx.Tx
+		tx, err = config.DB.Begin(ctx)
+		if err == nil {
+			defer tx.Rollback(ctx)
+			recoveryCodes, err = saveRecoveryCodes(tx, userPayload.Id)
+		}
+		if err == nil {
+			err = tx.Commit(ctx)
+		}
+	}
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to generate recovery codes", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "RegenerateRecoveryCodes: Unable to save recovery codes, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "regenerateRecoveryCodes",
+			Description:  "Self: regenerated two-factor recovery codes",
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		nil,
+	)
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Recovery codes generated, the previous ones no longer work", "recovery_codes": recoveryCodes})
+}
+
+// ResetUserTwoFactor remove the authenticator of a user who lost it, the user enrolls again on its next login
+func ResetUserTwoFactor(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	userId, err := c.ParamsInt("userId")
+	if err != nil || userId < 1 {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Invalid user id provided")
+	}
+	if err = checkManageableUser(userPayload, userId); err != nil {
+		if errors.Is(err, errUserNotManageable) {
+			return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, err.Error())
+		}
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to reset two-factor authentication", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ResetUserTwoFactor: Unable to check user permissions, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	result, err := config.DB.Exec(ctx, `update users set totp_secret=null,totp_enabled_at=null where id=$1 and totp_enabled_at is not null`, userId)
+	if err == nil && result.RowsAffected() == 0 {
+		return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Two-factor authentication is not enabled for this user")
+	}
+	if err == nil {
+		_, err = config.DB.Exec(ctx, `delete from user_recovery_code where user_id=$1`, userId)
+	}
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Unable to reset two-factor authentication", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "ResetUserTwoFactor: Unable to reset two factor, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	utils.RecordActivityLog(config.DB,
+		utils.ActivityLog{
+			UserID:       userPayload.Id,
+			ActivityType: "resetTwoFactor",
+			Description:  "reset two-factor authentication of user " + strconv.Itoa(userId),
+			Status:       "success",
+			IPAddress:    c.IP(),
+			UserAgent:    c.Get("User-Agent"),
+		},
+		config.ServiceName,
+		&map[string]interface{}{
+			"user_id": userId,
+		},
+	)
+	revokeSessions(c, userId, "two-factor authentication reset")
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Two-factor authentication reset successfully"})
+}
+
+// SendStepUpSMS send the sms fallback code of a re-authentication
+func SendStepUpSMS(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	if err := sendTwoFactorSMS(userPayload.Id, "step_up"); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusTooManyRequests, err.Error())
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "A verification code has been sent to your phone"})
+}
+
+// StepUp re-authenticate the current user with its password and second factor, the session can then perform
+// the sensitive actions for a few minutes. users without 2FA only provide their password
+func StepUp(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	type FormData struct {
+		Password string `json:"password" binding:"required" validate:"required"`
+		Method   string `json:"method" validate:"omitempty,oneof=totp recovery sms"`
+		Code     string `json:"code" validate:"max=20"`
+	}
+	formData := new(FormData)
+	if err := c.BodyParser(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Please provide all required data")
+	}
+	if err := Validate.Struct(formData); err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusBadRequest, "Provided data are not valid")
+	}
+	attemptsKey := fmt.Sprintf("2fa:step_up_attempts:%d", userPayload.Id)
+	if attempts, _ := config.Redis.Get(ctx, attemptsKey).Int(); attempts >= twoFactorMaxAttempts {
+		return utils.JsonErrorResponse(c, fiber.StatusTooManyRequests, "Too many failed attempts, please try again later")
+	}
+	var userStatus string
+	err := config.DB.QueryRow(ctx, `select u.status from users u where id = $1 and password = crypt($2, password)`, userPayload.Id, formData.Password).
+		Scan(&userStatus)
+	if err == nil && userStatus == "OKAY" {
+		var secret string
+		var enabled bool
+		secret, enabled, _, err = userTwoFactor(userPayload.Id)
+		if err == nil && enabled {
+			if formData.Method == "" {
+				return utils.JsonErrorResponse(c, fiber.StatusNotAcceptable, "Please provide the code of your authenticator app")
+			}
+			err = verifySecondFactor(userPayload.Id, secret, formData.Method, formData.Code, "step_up")
+		}
+	} else if err == nil {
+		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, "Your account has been deactivated")
+	}
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) && !errors.Is(err, errInvalidSecondFactor) {
+			return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Re-authentication failed", utils.Logger{
+				LogLevel:    utils.CRITICAL,
+				Message:     "StepUp: Unable to verify user, error: " + err.Error(),
+				ServiceName: config.ServiceName,
+			})
+		}
+		config.Redis.Incr(ctx, attemptsKey)
+		config.Redis.Expire(ctx, attemptsKey, 15*time.Minute)
+		utils.RecordActivityLog(config.DB,
+			utils.ActivityLog{
+				UserID:       userPayload.Id,
+				ActivityType: "stepUp",
+				Description:  "Re-authentication failed, invalid credentials",
+				Status:       "failure",
+				IPAddress:    c.IP(),
+				UserAgent:    c.Get("User-Agent"),
+			},
+			config.ServiceName,
+			nil,
+		)
+		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, "Invalid credentials")
+	}
+	config.Redis.Del(ctx, attemptsKey)
+	err = config.Redis.Set(ctx, stepUpKey(userPayload.SessionId), formData.Method, stepUpTTL()).Err()
+	if err != nil {
+		return utils.JsonErrorResponse(c, fiber.StatusInternalServerError, "Re-authentication failed", utils.Logger{
+			LogLevel:    utils.CRITICAL,
+			Message:     "StepUp: Unable to save step up, error: " + err.Error(),
+			ServiceName: config.ServiceName,
+		})
+	}
+	return c.JSON(fiber.Map{"status": fiber.StatusOK, "message": "Re-authentication completed", "expiresIn": int(stepUpTTL().Seconds())})
+}
+
+// RequireStepUp reject a sensitive action unless the session re-authenticated recently, it is declared on the route
+func RequireStepUp(c *fiber.Ctx) error {
+	userPayload := CurrentUser(c)
+	if userPayload == nil {
+		return utils.JsonErrorResponse(c, fiber.StatusUnauthorized, "unauthorized: You are not allowed to access this resource")
+	}
+	if !steppedUp(userPayload.SessionId) {
+		return stepUpRequiredResponse(c)
+	}
+	return c.Next()
+}
+
+// steppedUp check if the session re-authenticated within the step up ttl
+func steppedUp(sessionId string) bool {
+	return config.Redis.Exists(ctx, stepUpKey(sessionId)).Val() > 0
+}
+
+func stepUpRequiredResponse(c *fiber.Ctx) error {
+	c.Status(fiber.StatusUnauthorized)
+	return c.JSON(fiber.Map{"status": fiber.StatusUnauthorized, "message": "Please confirm your identity to continue", "step_up_required": true})
+}
@@ -43,7 +43,6 @@ require (
 )
 
 require (
-	github.com/ajankovic/smpp v0.0.0-20191203230920-1db50388714e
 	github.com/andybalholm/brotli v1.0.5 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/davecgh/go-spew v1.1.2-0.20180830191138-d8f796af33cc // indirect
@@ -14,13 +14,14 @@ func main() {
 	config.InitializeConfig()
 	config.ConnectDb()
 	go controller.DistributeMomoPrize()
-	//initialize airtel smpp connection
-	// go func() {
-	// 	config.AirtelTX = config.InitializeSMPP(viper.GetString("smpp.airtel.address"), viper.GetString("smpp.airtel.user"), viper.GetString("smpp.airtel.password"), false)
-	// }()
-	// go func() {
-	// 	config.MTNTx = config.InitializeSMPP(viper.GetString("smpp.mtn.address"), viper.GetString("smpp.mtn.user"), viper.GetString("smpp.mtn.password"), false)
-	// }()
+	go controller.ExpirePrizeClaims()
+	go controller.RunSMSCampaigns()
+	go controller.RunCodeImportJobs()
+	go controller.RunCodeGenerationJobs()
+	go controller.RunFraudScoring()
+	utils.InitializeSMSTransport(config.DB, config.ServiceName)
+	go utils.RunSMSDispatcher(config.DB, config.Redis, config.ServiceName)
+	go utils.RunEmailDispatcher(config.DB, config.ServiceName)
 	defer config.DB.Close()
 	server := routes.InitRoutes()
 	server.Listen("0.0.0.0:9000")
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS transaction_approval (
+    id SERIAL PRIMARY KEY,
+    transaction_id INT NOT NULL REFERENCES transaction(id) ON DELETE RESTRICT,
+    user_id INT NOT NULL REFERENCES users(id),
+    department_id INT REFERENCES departments(id),
+    required_approvals INT NOT NULL DEFAULT 1, -- tier requirement at the time of approval
+    ip_address INET,
+    user_agent TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT unique_transaction_approver UNIQUE (transaction_id, user_id)
+);
+-- every approval step of a WAITING transaction, it moves to PENDING once the tier requirement is met
+CREATE INDEX idx_transaction_approval_transaction_id ON transaction_approval(transaction_id);
+CREATE INDEX idx_transaction_approval_user_id ON transaction_approval(user_id);
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS transaction_settlement (
+    id SERIAL PRIMARY KEY,
+    transaction_id INT NOT NULL REFERENCES transaction(id) ON DELETE RESTRICT,
+    settlement_type VARCHAR(50) NOT NULL, -- MANUAL, REVERSAL
+    method VARCHAR(50), -- cash, bank_transfer, cheque, momo (for reversal recovery)
+    reference VARCHAR(100),
+    reason TEXT,
+    evidence_path TEXT,
+    transaction_record_id INT REFERENCES transaction_records(id), -- DEBIT record of a reversal
+    operator_id INT REFERENCES users(id),
+    ip_address INET,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+-- transaction status: SETTLED (paid outside the system), REVERSED
+CREATE INDEX idx_transaction_settlement_transaction_id ON transaction_settlement(transaction_id);
+CREATE INDEX idx_transaction_settlement_reference ON transaction_settlement(reference);
+CREATE INDEX idx_transaction_records_transaction_type ON transaction_records(transaction_type);
@@ -0,0 +1,58 @@
+CREATE TABLE IF NOT EXISTS pickup_location (
+    id SERIAL PRIMARY KEY,
+    district_id INT NOT NULL REFERENCES district(id),
+    name VARCHAR(255) NOT NULL,
+    address TEXT,
+    contact_phone VARCHAR(20),
+    status VARCHAR(50) DEFAULT 'OKAY', -- OKAY, DISABLED
+    operator_id INT REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT unique_pickup_location_district_name UNIQUE (district_id, name)
+);
+CREATE INDEX idx_pickup_location_district_id ON pickup_location(district_id);
+
+-- fulfilment of non-momo prizes (cars, phones, crates,...)
+CREATE TABLE IF NOT EXISTS fulfilment (
+    id SERIAL PRIMARY KEY,
+    prize_id INT NOT NULL UNIQUE REFERENCES prize(id) ON DELETE RESTRICT,
+    customer_id INT NOT NULL REFERENCES customer(id),
+    status VARCHAR(50) NOT NULL DEFAULT 'WAITING_CLAIM', -- WAITING_CLAIM, CLAIMED, ID_VERIFIED, PICKUP_SCHEDULED, DELIVERED
+    pickup_location_id INT REFERENCES pickup_location(id),
+    pickup_date TIMESTAMP,
+    proof_path TEXT,
+    claimed_at TIMESTAMP,
+    verified_at TIMESTAMP,
+    delivered_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_fulfilment_customer_id ON fulfilment(customer_id);
+CREATE INDEX idx_fulfilment_status ON fulfilment(status);
+
+CREATE TABLE IF NOT EXISTS fulfilment_history (
+    id SERIAL PRIMARY KEY,
+    fulfilment_id INT NOT NULL REFERENCES fulfilment(id),
+    status VARCHAR(50) NOT NULL,
+    note TEXT,
+    operator_id INT REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_fulfilment_history_fulfilment_id ON fulfilment_history(fulfilment_id);
+
+CREATE TRIGGER update_pickup_location_updated_at
+BEFORE UPDATE ON pickup_location
+FOR EACH ROW
+EXECUTE FUNCTION update_updated_at_column();
+
+CREATE TRIGGER update_fulfilment_updated_at
+BEFORE UPDATE ON fulfilment
+FOR EACH ROW
+EXECUTE FUNCTION update_updated_at_column();
+
+-- track prizes won before fulfilment existed
+INSERT INTO fulfilment (prize_id, customer_id, status)
+SELECT p.id, e.customer_id, 'WAITING_CLAIM' FROM prize p
+INNER JOIN entries e ON e.id = p.entry_id
+INNER JOIN prize_type pt ON pt.id = p.prize_type_id
+WHERE pt.distribution_type <> 'momo';
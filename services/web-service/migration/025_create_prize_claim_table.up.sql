@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS prize_claim (
+    id SERIAL PRIMARY KEY,
+    prize_id INT NOT NULL UNIQUE REFERENCES prize(id) ON DELETE RESTRICT,
+    customer_id INT NOT NULL REFERENCES customer(id),
+    transaction_id INT REFERENCES transaction(id),
+    claim_code TEXT NOT NULL, -- bcrypt hash of the code sent by sms
+    status VARCHAR(50) NOT NULL DEFAULT 'PENDING', -- PENDING, VERIFIED, EXPIRED
+    attempts INT NOT NULL DEFAULT 0,
+    channel VARCHAR(20), -- USSD, AGENT
+    verified_by INT REFERENCES users(id),
+    expires_at TIMESTAMP NOT NULL,
+    verified_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_prize_claim_customer_id ON prize_claim(customer_id);
+CREATE INDEX idx_prize_claim_status_expires_at ON prize_claim(status, expires_at);
+
+CREATE TRIGGER update_prize_claim_updated_at
+BEFORE UPDATE ON prize_claim
+FOR EACH ROW
+EXECUTE FUNCTION update_updated_at_column();
+
+-- EXPIRED prizes (unclaimed) no longer take a place of their prize type and can be drawn again
+ALTER TABLE prize ADD COLUMN status VARCHAR(50) DEFAULT 'OKAY';
@@ -0,0 +1,8 @@
+-- sms outbox: messages are saved as QUEUED with the business change then sent by the dispatcher
+-- status: QUEUED, SENT, DELIVERED, FAILED
+ALTER TABLE sms ADD COLUMN sender_id VARCHAR(50);
+ALTER TABLE sms ADD COLUMN attempts INT NOT NULL DEFAULT 0;
+ALTER TABLE sms ADD COLUMN next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP;
+ALTER TABLE sms ADD COLUMN sent_at TIMESTAMP;
+ALTER TABLE sms ADD COLUMN delivered_at TIMESTAMP;
+CREATE INDEX idx_sms_status_next_attempt_at ON sms(status, next_attempt_at);
@@ -0,0 +1,8 @@
+-- delivery reports (DLR): status moves from SENT to DELIVERED, EXPIRED or UNDELIVERABLE
+-- delivered_at keeps the time the final state was reached on the SMSC (done date)
+ALTER TABLE sms ADD COLUMN network_operator VARCHAR(20);
+ALTER TABLE sms ADD COLUMN error_code VARCHAR(20);
+ALTER TABLE sms ADD COLUMN dlr_received_at TIMESTAMP;
+CREATE INDEX idx_sms_message_id ON sms(message_id);
+
+UPDATE sms SET network_operator = CASE WHEN phone ~ '^(\+?250|0)?7[23]' THEN 'AIRTEL' ELSE 'MTN' END WHERE phone IS NOT NULL;
@@ -0,0 +1,6 @@
+-- provider which accepted the sms (see sms_routing in config.yml), credit_count = segments x provider cost per segment
+-- priority: 0 low, 1 normal, 2 high, the dispatcher sends higher priorities first
+ALTER TABLE sms ADD COLUMN provider VARCHAR(50);
+ALTER TABLE sms ADD COLUMN priority SMALLINT NOT NULL DEFAULT 1;
+DROP INDEX IF EXISTS idx_sms_status_next_attempt_at;
+CREATE INDEX idx_sms_status_priority ON sms(status, priority DESC, next_attempt_at);
@@ -0,0 +1,33 @@
+-- named sms templates (text/template placeholders e.g {{.Name}}), one active version per name and locale
+-- saving a template adds a new version and archives the previous one, status: ACTIVE, ARCHIVED
+-- winner messages of a prize type are saved as prize_type.<prize_type_id> and replace prize_message
+CREATE TABLE IF NOT EXISTS sms_template (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    lang VARCHAR(10) NOT NULL,
+    version INT NOT NULL,
+    body TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'ACTIVE',
+    operator_id INT REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT unique_sms_template_version UNIQUE (name, lang, version)
+);
+CREATE UNIQUE INDEX unique_sms_template_active ON sms_template(name, lang) WHERE status = 'ACTIVE';
+
+INSERT INTO sms_template (name, lang, version, body, operator_id, created_at)
+SELECT 'prize_type.' || prize_type_id, lang, 1, message, operator_id, created_at FROM prize_message;
+DROP TABLE prize_message;
+
+INSERT INTO sms_template (name, lang, version, body) VALUES
+    ('account_password', 'en', 1, E'Your password is {{.Password}}, please change it after login\n\n{{.AppName}}'),
+    ('reset_password_otp', 'en', 1, 'Dear {{.Name}}, {{.OTP}} is the OTP for reseting your password. don''t share it with anyone.'),
+    ('prize_claim', 'en', 1, 'Your prize claim code is {{.Code}}. Confirm it on our USSD (Claim prize) or at an agent with your national ID before {{.ClaimDeadline}}.'),
+    ('upload_codes_success', 'en', 1, 'Codes uploaded successfully, total: {{.Total}}, time taken: {{.Duration}}'),
+    ('upload_codes_failed', 'en', 1, 'Codes uploaded failed, {{.Error}}'),
+    ('fulfilment_claimed', 'en', 1, 'Dear {{.Name}}, your claim for {{.PrizeType}} has been received. Please bring your national ID for verification.'),
+    ('fulfilment_id_verified', 'en', 1, 'Dear {{.Name}}, your identity has been verified for {{.PrizeType}}. You will be notified of the pickup date and location.'),
+    ('fulfilment_pickup', 'en', 1, 'Dear {{.Name}}, your {{.PrizeType}} will be ready for pickup at {{.Place}} on {{.PickupDate}}. Please come with your national ID.'),
+    ('fulfilment_delivered', 'en', 1, 'Dear {{.Name}}, your {{.PrizeType}} has been delivered. Thank you for participating.'),
+    ('no_prize', 'en', 1, 'Thank you for participating in the CocaCola lottery campaign. Although your code didn''t win an instant reward, you''ve been entered into a draw and stand a chance to win one of our big prizes of up to 5M RWF'),
+    ('no_prize', 'rw', 1, 'Mwakoze kwitabira gahunda ya Coca Cola Lottery. Ntabwo mubashije gutsindira igihembo cy''ako kanya ariko mufite amahirwe yo kuzatsindira igihembo nyamukuru cya 5M'),
+    ('test_sms', 'en', 1, 'Hey, this is a test message from {{.AppName}}');
@@ -0,0 +1,28 @@
+-- marketing sms campaigns sent to a segment of customers built from filters (see SMSCampaignFilters)
+-- status: SCHEDULED, SENDING, COMPLETED, CANCELLED
+CREATE TABLE IF NOT EXISTS sms_campaign (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    template_name VARCHAR(100) NOT NULL,
+    filters JSONB NOT NULL DEFAULT '{}',
+    status VARCHAR(20) NOT NULL DEFAULT 'SCHEDULED',
+    per_minute INT NOT NULL, -- throttle: sms released to the outbox per minute
+    scheduled_at TIMESTAMP NOT NULL,
+    started_at TIMESTAMP,
+    completed_at TIMESTAMP,
+    recipient_count INT NOT NULL DEFAULT 0,
+    opted_out_count INT NOT NULL DEFAULT 0,
+    operator_id INT REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_sms_campaign_status ON sms_campaign(status, scheduled_at);
+
+ALTER TABLE sms ADD COLUMN campaign_id INT REFERENCES sms_campaign(id);
+CREATE INDEX idx_sms_campaign_id ON sms(campaign_id);
+
+-- customers who do not want marketing sms, transactional sms (prize, claim, ...) are still sent
+ALTER TABLE customer ADD COLUMN sms_opt_out BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE customer ADD COLUMN sms_opt_out_at TIMESTAMP;
+
+INSERT INTO sms_template (name, lang, version, body) VALUES
+    ('campaign.unclaimed_prize', 'en', 1, 'Dear {{.Name}}, you have a prize waiting for you. Claim it before it expires.');
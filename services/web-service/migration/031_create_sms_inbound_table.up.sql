@@ -0,0 +1,36 @@
+-- mobile originated sms received on the short code (MO webhook or SMPP deliver_sm)
+-- keyword: STOP, START, HELP or empty when the message is not a keyword
+CREATE TABLE IF NOT EXISTS sms_inbound (
+    id SERIAL PRIMARY KEY,
+    phone VARCHAR(20) NOT NULL,
+    message TEXT NOT NULL,
+    keyword VARCHAR(20) NOT NULL DEFAULT '',
+    customer_id INT REFERENCES customer(id),
+    message_id VARCHAR(255) NOT NULL DEFAULT '',
+    source VARCHAR(20) NOT NULL, -- WEBHOOK, SMPP
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_sms_inbound_customer_id ON sms_inbound(customer_id);
+CREATE INDEX idx_sms_inbound_created_at ON sms_inbound(created_at);
+
+-- history of the sms preference of customers, kept as proof of consent
+-- source: KEYWORD (customer sms), ADMIN (override by an operator)
+CREATE TABLE IF NOT EXISTS customer_preference_log (
+    id SERIAL PRIMARY KEY,
+    customer_id INT NOT NULL REFERENCES customer(id),
+    sms_opt_out BOOLEAN NOT NULL,
+    source VARCHAR(20) NOT NULL,
+    reason VARCHAR(255) NOT NULL DEFAULT '',
+    operator_id INT REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_customer_preference_log_customer_id ON customer_preference_log(customer_id);
+CREATE INDEX idx_customer_sms_opt_out ON customer(sms_opt_out) WHERE sms_opt_out;
+
+INSERT INTO sms_template (name, lang, version, body) VALUES
+    ('keyword_stop', 'en', 1, 'You will no longer receive promotional messages from {{.AppName}}. Send START to subscribe again.'),
+    ('keyword_stop', 'rw', 1, 'Ntabwo muzongera kwakira ubutumwa bwamamaza bwa {{.AppName}}. Ohereza START kugira ngo mwongere mubwakire.'),
+    ('keyword_start', 'en', 1, 'You are subscribed again to messages from {{.AppName}}. Send STOP to unsubscribe.'),
+    ('keyword_start', 'rw', 1, 'Mwongeye kwiyandikisha ku butumwa bwa {{.AppName}}. Ohereza STOP kugira ngo mubuhagarike.'),
+    ('keyword_help', 'en', 1, '{{.AppName}}: send STOP to stop promotional messages, START to receive them again. Prize messages are always sent.'),
+    ('keyword_help', 'rw', 1, '{{.AppName}}: ohereza STOP guhagarika ubutumwa bwamamaza, START kongera kubwakira. Ubutumwa bw''ibihembo buzahora buboherezwa.');
@@ -0,0 +1,25 @@
+-- production batch of codes, every upload creates a batch
+-- status: UPLOADING, ACTIVE, SUSPENDED (codes rejected until re-activated), VOIDED (codes rejected for good), FAILED (upload failed)
+CREATE TABLE IF NOT EXISTS code_batch (
+    id SERIAL PRIMARY KEY,
+    reference VARCHAR(100) NOT NULL UNIQUE, -- production batch number
+    product VARCHAR(50) NOT NULL, -- Coca-Cola, Fanta, Primus, ...
+    bottling_line VARCHAR(50) NOT NULL DEFAULT '',
+    region VARCHAR(100) NOT NULL DEFAULT '', -- distribution region
+    production_date DATE,
+    status VARCHAR(20) NOT NULL DEFAULT 'UPLOADING',
+    status_reason VARCHAR(255) NOT NULL DEFAULT '',
+    file_name VARCHAR(255) NOT NULL DEFAULT '',
+    file_hash VARCHAR(64) NOT NULL DEFAULT '', -- sha256 of the uploaded file
+    uploaded_count INT NOT NULL DEFAULT 0,
+    uploaded_by INT REFERENCES users(id),
+    upload_ip VARCHAR(50) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_code_batch_product ON code_batch(product);
+CREATE INDEX idx_code_batch_status ON code_batch(status);
+
+-- codes uploaded before batches have no batch and stay valid
+ALTER TABLE codes ADD COLUMN batch_id INT REFERENCES code_batch(id);
+CREATE INDEX idx_codes_batch_id ON codes(batch_id);
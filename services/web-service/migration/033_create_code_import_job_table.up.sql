@@ -0,0 +1,41 @@
+-- background import of a codes file into a code batch, the file is read in chunks and processed_rows is saved
+-- with each chunk so an interrupted job resumes after the last imported chunk
+-- status: PENDING, RUNNING, COMPLETED, FAILED
+CREATE TABLE IF NOT EXISTS code_import_job (
+    id SERIAL PRIMARY KEY,
+    batch_id INT NOT NULL REFERENCES code_batch(id),
+    file_path VARCHAR(255) NOT NULL,
+    file_name VARCHAR(255) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'PENDING',
+    total_rows INT NOT NULL DEFAULT 0,
+    processed_rows INT NOT NULL DEFAULT 0,
+    imported_count INT NOT NULL DEFAULT 0,
+    duplicate_count INT NOT NULL DEFAULT 0,
+    invalid_count INT NOT NULL DEFAULT 0,
+    error_message VARCHAR(255) NOT NULL DEFAULT '',
+    operator_id INT REFERENCES users(id),
+    started_at TIMESTAMP,
+    completed_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_code_import_job_status ON code_import_job(status);
+
+-- rows rejected by an import, reason: INVALID or DUPLICATE
+CREATE TABLE IF NOT EXISTS code_import_error (
+    id BIGSERIAL PRIMARY KEY,
+    job_id INT NOT NULL REFERENCES code_import_job(id),
+    line_number INT NOT NULL,
+    reason VARCHAR(20) NOT NULL,
+    value VARCHAR(100) NOT NULL, -- masked for duplicates, the code is valid and must not leak
+    detail VARCHAR(255) NOT NULL DEFAULT ''
+);
+CREATE INDEX idx_code_import_error_job_id ON code_import_error(job_id, line_number);
+
+-- chunk of codes waiting to be merged into codes, emptied once the chunk is imported
+CREATE UNLOGGED TABLE IF NOT EXISTS code_import_staging (
+    job_id INT NOT NULL,
+    line_number INT NOT NULL,
+    code VARCHAR(50) NOT NULL
+);
+CREATE INDEX idx_code_import_staging_job_id ON code_import_staging(job_id);
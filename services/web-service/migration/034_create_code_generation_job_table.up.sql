@@ -0,0 +1,28 @@
+-- format of the codes of a batch, empty for uploaded batches whose format is unknown
+ALTER TABLE code_batch ADD COLUMN code_alphabet VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE code_batch ADD COLUMN code_length INT NOT NULL DEFAULT 0;
+ALTER TABLE code_batch ADD COLUMN check_digit VARCHAR(20) NOT NULL DEFAULT 'none';
+
+-- codes generated in the platform, they are inserted into the batch then exported to the printer file
+-- status: PENDING, RUNNING (generating), EXPORTING, COMPLETED, FAILED
+CREATE TABLE IF NOT EXISTS code_generation_job (
+    id SERIAL PRIMARY KEY,
+    batch_id INT NOT NULL REFERENCES code_batch(id),
+    quantity INT NOT NULL,
+    export_format VARCHAR(10) NOT NULL, -- csv, xlsx
+    status VARCHAR(20) NOT NULL DEFAULT 'PENDING',
+    generated_count INT NOT NULL DEFAULT 0,
+    collision_count INT NOT NULL DEFAULT 0,
+    export_path VARCHAR(255) NOT NULL DEFAULT '',
+    manifest JSONB,
+    error_message VARCHAR(255) NOT NULL DEFAULT '',
+    operator_id INT REFERENCES users(id),
+    started_at TIMESTAMP,
+    completed_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_code_generation_job_status ON code_generation_job(status);
+
+INSERT INTO sms_template (name, lang, version, body) VALUES
+    ('codes_generated', 'en', 1, 'Codes of batch {{.Reference}} generated, total: {{.Total}}, time taken: {{.Duration}}. The printer file is ready for download');
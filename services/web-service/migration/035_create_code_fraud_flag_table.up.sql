@@ -0,0 +1,23 @@
+-- status: OKAY or FRAUD, FRAUD customers can not enter codes on USSD
+ALTER TABLE customer ADD COLUMN status VARCHAR(20) NOT NULL DEFAULT 'OKAY';
+
+-- msisdns flagged by the USSD code guard after repeated lockouts for invalid codes
+-- status: OPEN (blocked, to review), CLEARED (unblocked), CONFIRMED (blocked)
+CREATE TABLE IF NOT EXISTS code_fraud_flag (
+    id SERIAL PRIMARY KEY,
+    customer_id INT REFERENCES customer(id) ON DELETE SET NULL, -- null when the msisdn is not registered
+    phone_hash BYTEA NOT NULL,
+    phone_masked VARCHAR(20) NOT NULL,
+    reason VARCHAR(255) NOT NULL,
+    invalid_attempts INT NOT NULL DEFAULT 0,
+    lockouts INT NOT NULL DEFAULT 0,
+    status VARCHAR(20) NOT NULL DEFAULT 'OPEN',
+    review_note VARCHAR(255),
+    reviewed_by INT REFERENCES users(id),
+    reviewed_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX unique_code_fraud_flag_open ON code_fraud_flag(phone_hash) WHERE status = 'OPEN';
+CREATE INDEX idx_code_fraud_flag_phone ON code_fraud_flag(phone_hash);
+CREATE INDEX idx_code_fraud_flag_status ON code_fraud_flag(status);
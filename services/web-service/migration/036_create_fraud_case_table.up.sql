@@ -0,0 +1,27 @@
+-- customer status REVIEW: a fraud case is open, draws skip the customer and instant win payouts wait for approval
+-- momo names are encrypted, customers sharing a MoMo name are matched on the hash of the normalized name
+ALTER TABLE customer ADD COLUMN momo_names_hash BYTEA;
+CREATE INDEX idx_customer_momo_names_hash ON customer(momo_names_hash);
+CREATE INDEX idx_customer_status ON customer(status);
+
+-- score of the fraud rules when the entry was saved
+ALTER TABLE entries ADD COLUMN fraud_score INT NOT NULL DEFAULT 0;
+CREATE INDEX idx_entries_customer_created ON entries(customer_id, created_at);
+
+-- customers whose fraud score reached fraud_rules.hold_score, signals are the rules which matched
+-- status: OPEN (customer in REVIEW), CLEARED (customer OKAY), CONFIRMED (customer FRAUD)
+CREATE TABLE IF NOT EXISTS fraud_case (
+    id SERIAL PRIMARY KEY,
+    customer_id INT NOT NULL REFERENCES customer(id) ON DELETE CASCADE,
+    entry_id INT REFERENCES entries(id) ON DELETE SET NULL,
+    score INT NOT NULL,
+    signals JSONB NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'OPEN',
+    review_note VARCHAR(255),
+    reviewed_by INT REFERENCES users(id),
+    reviewed_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX unique_fraud_case_open ON fraud_case(customer_id) WHERE status = 'OPEN';
+CREATE INDEX idx_fraud_case_status ON fraud_case(status);
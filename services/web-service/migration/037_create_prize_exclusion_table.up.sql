@@ -0,0 +1,19 @@
+-- people who can not win (staff, relatives, blacklist), values are hashed like customer.phone_hash
+-- exclusion_type: PHONE, NATIONAL_ID, MOMO_NAME
+-- status: ACTIVE, REMOVED
+CREATE TABLE IF NOT EXISTS prize_exclusion (
+    id SERIAL PRIMARY KEY,
+    exclusion_type VARCHAR(20) NOT NULL,
+    value_hash BYTEA NOT NULL,
+    value_masked VARCHAR(100) NOT NULL,
+    reason VARCHAR(255) NOT NULL,
+    source VARCHAR(20) NOT NULL DEFAULT 'MANUAL', -- MANUAL, IMPORT
+    status VARCHAR(20) NOT NULL DEFAULT 'ACTIVE',
+    operator_id INT REFERENCES users(id),
+    removed_by INT REFERENCES users(id),
+    removed_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX unique_prize_exclusion_active ON prize_exclusion(exclusion_type, value_hash) WHERE status = 'ACTIVE';
+CREATE INDEX idx_prize_exclusion_value_hash ON prize_exclusion(value_hash);
@@ -0,0 +1,90 @@
+-- permissions are declared on the routes, a user has the permissions of all its roles
+CREATE TABLE IF NOT EXISTS permissions (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(60) NOT NULL UNIQUE,
+    description VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO permissions (name, description) VALUES
+('prizes.view', 'View prize categories, prize types and their space'),
+('prizes.manage', 'Create prize categories and prize types'),
+('entries.view', 'View entries'),
+('customers.view', 'View customers, their entries and preferences'),
+('customers.manage', 'Update customer preferences'),
+('draws.view', 'View draws and prize distributions'),
+('draws.trigger', 'Start a prize draw'),
+('codes.view', 'View code batches, import and generation jobs'),
+('codes.add', 'Upload codes and resume import jobs'),
+('codes.generate', 'Generate codes'),
+('codes.export', 'Download generated codes for the printer'),
+('codes.manage', 'Change the status of a code batch'),
+('transactions.view', 'View transactions, pending approvals and settlement evidence'),
+('transactions.confirm', 'Approve payouts'),
+('transactions.settle', 'Settle and reverse payouts'),
+('transactions.resend', 'Resend failed payouts'),
+('fulfilments.view', 'View fulfilments, prize claims and pickup locations'),
+('fulfilments.manage', 'Claim, verify, schedule and deliver prizes, manage pickup locations'),
+('fraud.view', 'View fraud flags and fraud cases'),
+('fraud.review', 'Review fraud flags and fraud cases'),
+('exclusions.view', 'View the prize exclusion registry'),
+('exclusions.manage', 'Add, import and remove prize exclusions'),
+('sms.view', 'View sent SMS, SMS balance, templates and campaigns'),
+('sms.manage', 'Manage SMS templates and campaigns'),
+('reports.view', 'View overviews and metrics'),
+('users.view', 'View users'),
+('users.manage', 'Add and update users, change their status'),
+('roles.view', 'View roles and permissions'),
+('roles.manage', 'Create, update and delete roles'),
+('logs.view', 'View activity logs');
+
+CREATE TABLE IF NOT EXISTS roles (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(60) NOT NULL UNIQUE,
+    description VARCHAR(255),
+    operator_id INT REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+    role_id INT NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+    permission_id INT NOT NULL REFERENCES permissions(id) ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role_id INT NOT NULL REFERENCES roles(id),
+    operator_id INT REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, role_id)
+);
+CREATE INDEX idx_user_roles_role ON user_roles(role_id);
+
+-- the can_* flags become roles, Back office keeps what every user could do before (any valid session)
+INSERT INTO roles (name, description) VALUES
+('Viewer', 'Read only access, without activity logs'),
+('Back office', 'Operations open to every user before roles'),
+('Code manager', 'Formerly can_add_codes'),
+('Draw operator', 'Formerly can_trigger_draw'),
+('User administrator', 'Formerly can_add_user'),
+('Auditor', 'Formerly can_view_logs');
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT r.id, p.id FROM roles r INNER JOIN permissions p ON (
+    (r.name = 'Viewer' AND p.name LIKE '%.view' AND p.name <> 'logs.view')
+    OR (r.name = 'Back office' AND (p.name IN ('prizes.manage', 'customers.manage', 'transactions.confirm', 'transactions.settle', 'transactions.resend',
+        'fulfilments.manage', 'sms.manage') OR (p.name LIKE '%.view' AND p.name <> 'logs.view')))
+    OR (r.name = 'Code manager' AND p.name IN ('codes.add', 'codes.generate', 'codes.export', 'codes.manage'))
+    OR (r.name = 'Draw operator' AND p.name = 'draws.trigger')
+    OR (r.name = 'User administrator' AND p.name IN ('users.manage', 'roles.manage', 'fraud.review', 'exclusions.manage'))
+    OR (r.name = 'Auditor' AND p.name = 'logs.view')
+);
+INSERT INTO user_roles (user_id, role_id)
+SELECT u.id, r.id FROM users u INNER JOIN roles r ON (
+    r.name = 'Back office'
+    OR (r.name = 'Code manager' AND u.can_add_codes)
+    OR (r.name = 'Draw operator' AND u.can_trigger_draw)
+    OR (r.name = 'User administrator' AND u.can_add_user)
+    OR (r.name = 'Auditor' AND u.can_view_logs)
+);
+ALTER TABLE users DROP COLUMN can_add_codes, DROP COLUMN can_trigger_draw, DROP COLUMN can_add_user, DROP COLUMN can_view_logs;
@@ -0,0 +1,17 @@
+-- TOTP second factor, the secret is encrypted with the encryption key and only set once the enrollment is confirmed
+ALTER TABLE users ADD COLUMN totp_secret BYTEA, ADD COLUMN totp_enabled_at TIMESTAMP;
+-- users having a role which requires it must enroll before their session is opened
+ALTER TABLE roles ADD COLUMN require_two_factor BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- single use codes to sign in without the authenticator, they are replaced when regenerated
+CREATE TABLE IF NOT EXISTS user_recovery_code (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash BYTEA NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT unique_user_recovery_code UNIQUE (user_id, code_hash)
+);
+
+INSERT INTO sms_template (name, lang, version, body) VALUES
+    ('two_factor_otp', 'en', 1, 'Dear {{.Name}}, {{.OTP}} is your verification code. don''t share it with anyone.');
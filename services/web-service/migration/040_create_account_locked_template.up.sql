@@ -0,0 +1,2 @@
+INSERT INTO sms_template (name, lang, version, body) VALUES
+    ('account_locked', 'en', 1, 'Dear {{.Name}}, your account has been locked for {{.Duration}} after too many {{.Action}}. If it was not you, please contact your administrator.');
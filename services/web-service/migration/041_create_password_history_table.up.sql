@@ -0,0 +1,13 @@
+-- passwords expire from the time they are set, existing passwords start their period now
+ALTER TABLE users ADD COLUMN password_changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
+-- password policy of the role, null uses the password_policy config. a user with several roles gets the strictest one
+ALTER TABLE roles ADD COLUMN password_min_length INT, ADD COLUMN password_max_age_days INT, ADD COLUMN password_history INT;
+
+-- hashes of the passwords set by the user, the last ones can not be reused
+CREATE TABLE IF NOT EXISTS user_password_history (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    password_hash TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_user_password_history_user ON user_password_history (user_id, created_at DESC);
@@ -0,0 +1,40 @@
+-- outbox of the emails, the dispatcher sends the QUEUED ones and retries the failures like the sms
+CREATE TABLE IF NOT EXISTS email (
+    id SERIAL PRIMARY KEY,
+    recipient VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    body TEXT NOT NULL,
+    type VARCHAR(50), -- (verify_account_otp, account_locked, export)
+    status VARCHAR(50) NOT NULL, -- QUEUED, SENT, FAILED
+    attachments INT NOT NULL DEFAULT 0,
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    error_message VARCHAR(255),
+    message_id VARCHAR(255),
+    provider VARCHAR(50),
+    sent_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_email_status_next_attempt_at ON email(status, next_attempt_at);
+CREATE INDEX idx_email_type ON email(type);
+
+-- files sent with an email, removed once it is sent
+CREATE TABLE IF NOT EXISTS email_attachment (
+    id SERIAL PRIMARY KEY,
+    email_id INT NOT NULL REFERENCES email(id) ON DELETE CASCADE,
+    file_name VARCHAR(255) NOT NULL,
+    content_type VARCHAR(255) NOT NULL,
+    content BYTEA NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_email_attachment_email ON email_attachment(email_id);
+
+INSERT INTO permissions (name, description) VALUES
+('emails.view', 'View sent emails'),
+('emails.manage', 'Resend failed emails');
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT r.id, p.id FROM roles r INNER JOIN permissions p ON (
+    (r.name IN ('Viewer', 'Back office') AND p.name = 'emails.view')
+    OR (r.name = 'Back office' AND p.name = 'emails.manage')
+);
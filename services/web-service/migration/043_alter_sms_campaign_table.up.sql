@@ -0,0 +1,3 @@
+-- campaigns are queued page by page (QUEUEING) before SENDING, a campaign whose template can not be rendered is FAILED
+-- status: SCHEDULED, QUEUEING, SENDING, COMPLETED, CANCELLED, FAILED
+ALTER TABLE sms_campaign ADD COLUMN error_message TEXT;
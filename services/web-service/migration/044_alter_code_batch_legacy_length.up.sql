@@ -0,0 +1,3 @@
+-- legacy batches were saved with an unknown length, their codes are 10 characters
+UPDATE code_batch SET code_length = 10 WHERE code_length = 0;
+ALTER TABLE code_batch ALTER COLUMN code_length SET DEFAULT 10;
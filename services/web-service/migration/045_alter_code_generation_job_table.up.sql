@@ -0,0 +1,5 @@
+-- the printer file holds the codes in clear, it is deleted once downloaded (DOWNLOADED) or after code_generator.export_ttl hours (EXPIRED).
+-- the manifest stays in the manifest column
+-- status: PENDING, RUNNING (generating), EXPORTING, COMPLETED, DOWNLOADED, EXPIRED, FAILED
+ALTER TABLE code_generation_job ADD COLUMN downloaded_at TIMESTAMP;
+ALTER TABLE code_generation_job ADD COLUMN downloaded_by INT REFERENCES users(id);
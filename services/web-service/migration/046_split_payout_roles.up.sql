@@ -0,0 +1,18 @@
+-- payouts are no longer approved or settled with Back office, the role every user got when roles were introduced.
+-- Payout approver confirms and resends payouts, Finance also settles and reverses them and is given to the users of the
+-- finance department (payout_approval.finance_department, FINANCE by default) who approve the payouts above finance_limit
+INSERT INTO roles (name, description) VALUES
+('Payout approver', 'Approve and resend payouts'),
+('Finance', 'Approve, resend, settle and reverse payouts');
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT r.id, p.id FROM roles r INNER JOIN permissions p ON (
+    (r.name = 'Payout approver' AND p.name IN ('transactions.confirm', 'transactions.resend'))
+    OR (r.name = 'Finance' AND p.name IN ('transactions.confirm', 'transactions.resend', 'transactions.settle'))
+);
+DELETE FROM role_permissions rp USING roles r, permissions p
+WHERE rp.role_id = r.id AND rp.permission_id = p.id AND r.name = 'Back office'
+AND p.name IN ('transactions.confirm', 'transactions.settle', 'transactions.resend');
+UPDATE roles SET description = 'Day to day operations, payouts are approved with Payout approver or Finance', updated_at = now() WHERE name = 'Back office';
+INSERT INTO user_roles (user_id, role_id)
+SELECT u.id, r.id FROM users u INNER JOIN departments d ON d.id = u.department_id INNER JOIN roles r ON r.name = 'Finance'
+WHERE upper(d.title) = 'FINANCE' ON CONFLICT DO NOTHING;
@@ -0,0 +1,2 @@
+-- the Kinyarwanda no_prize template was seeded as sw, customers have the rw locale
+UPDATE sms_template SET lang = 'rw' WHERE name = 'no_prize' AND lang = 'sw';
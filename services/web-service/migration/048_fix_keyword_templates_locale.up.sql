@@ -0,0 +1,2 @@
+-- the Kinyarwanda STOP, START and HELP replies were seeded as sw, customers have the rw locale
+UPDATE sms_template SET lang = 'rw' WHERE name IN ('keyword_stop', 'keyword_start', 'keyword_help') AND lang = 'sw';
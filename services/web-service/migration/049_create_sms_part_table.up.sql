@@ -0,0 +1,13 @@
+-- parts of a long sms submitted through SMPP, every part gets its own message id and delivery report.
+-- sms.message_id keeps the id of the first part, the sms is DELIVERED once all its parts are
+CREATE TABLE IF NOT EXISTS sms_part (
+    id SERIAL PRIMARY KEY,
+    sms_id INT NOT NULL REFERENCES sms(id) ON DELETE CASCADE,
+    part SMALLINT NOT NULL,
+    message_id VARCHAR(255) NOT NULL,
+    status VARCHAR(50), -- DELIVERED, EXPIRED or UNDELIVERABLE once its report is received
+    dlr_received_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_sms_part_sms_id ON sms_part(sms_id);
+CREATE INDEX idx_sms_part_message_id ON sms_part(message_id);
@@ -7,6 +7,85 @@ type Code struct {
 	Code      string     `json:"code"`
 	PrizeType *PrizeType `json:"prize_type"`
 	// Redeemed  bool       `json:"redeemed"`
-	Status    string    `json:"status,omitempty"`
-	CreatedAt time.Time `json:"created_at"`
+	Status    string     `json:"status,omitempty"`
+	Batch     *CodeBatch `json:"batch,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type CodeBatchCounts struct {
+	Uploaded int `json:"uploaded"`
+	Used     int `json:"used"`
+	Won      int `json:"won"`
+}
+
+type CodeBatch struct {
+	Id             int              `json:"id"`
+	Reference      string           `json:"reference"`
+	Product        string           `json:"product"`
+	BottlingLine   string           `json:"bottling_line,omitempty"`
+	Region         string           `json:"region,omitempty"`
+	ProductionDate *time.Time       `json:"production_date,omitempty"`
+	Status         string           `json:"status,omitempty"`
+	StatusReason   string           `json:"status_reason,omitempty"`
+	FileName       string           `json:"file_name,omitempty"`
+	FileHash       string           `json:"file_hash,omitempty"`
+	CodeAlphabet   string           `json:"code_alphabet,omitempty"`
+	CodeLength     int              `json:"code_length,omitempty"`
+	CheckDigit     string           `json:"check_digit,omitempty"`
+	UploadedBy     *string          `json:"uploaded_by,omitempty"`
+	Counts         *CodeBatchCounts `json:"counts,omitempty"`
+	CreatedAt      *time.Time       `json:"created_at,omitempty"`
+}
+
+type CodeImportJob struct {
+	Id             int        `json:"id"`
+	BatchId        int        `json:"batch_id"`
+	BatchReference string     `json:"batch_reference"`
+	FileName       string     `json:"file_name"`
+	Status         string     `json:"status"`
+	TotalRows      int        `json:"total_rows"`
+	ProcessedRows  int        `json:"processed_rows"` // last line of the file imported
+	ImportedCount  int        `json:"imported_count"`
+	DuplicateCount int        `json:"duplicate_count"`
+	InvalidCount   int        `json:"invalid_count"`
+	Progress       float64    `json:"progress"` // percentage of rows done
+	ErrorMessage   string     `json:"error_message,omitempty"`
+	StartedAt      *time.Time `json:"started_at"`
+	CompletedAt    *time.Time `json:"completed_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// CodeExportManifest describe a printer file, Signature is the HMAC-SHA256 of the manifest without the signature
+type CodeExportManifest struct {
+	JobId          int       `json:"job_id"`
+	BatchId        int       `json:"batch_id"`
+	BatchReference string    `json:"batch_reference"`
+	Product        string    `json:"product"`
+	Quantity       int       `json:"quantity"`
+	Alphabet       string    `json:"alphabet"`
+	Length         int       `json:"length"`
+	CheckDigit     string    `json:"check_digit"`
+	FileName       string    `json:"file_name"`
+	FileSize       int64     `json:"file_size"`
+	SHA256         string    `json:"sha256"`
+	GeneratedAt    time.Time `json:"generated_at"`
+	Signature      string    `json:"signature,omitempty"`
+}
+
+type CodeGenerationJob struct {
+	Id             int                 `json:"id"`
+	BatchId        int                 `json:"batch_id"`
+	BatchReference string              `json:"batch_reference"`
+	Quantity       int                 `json:"quantity"`
+	ExportFormat   string              `json:"export_format"`
+	Status         string              `json:"status"`
+	GeneratedCount int                 `json:"generated_count"`
+	CollisionCount int                 `json:"collision_count"`
+	Progress       float64             `json:"progress"`
+	Manifest       *CodeExportManifest `json:"manifest"`
+	ErrorMessage   string              `json:"error_message,omitempty"`
+	StartedAt      *time.Time          `json:"started_at"`
+	CompletedAt    *time.Time          `json:"completed_at"`
+	DownloadedAt   *time.Time          `json:"downloaded_at"`
+	CreatedAt      time.Time           `json:"created_at"`
 }
@@ -3,14 +3,64 @@ package model
 import "time"
 
 type Customer struct {
-	Id              int       `json:"id"`
-	Names           string    `json:"names"`
-	MOMONames       *string   `json:"momo_names,omitempty"`
-	Phone           string    `json:"phone"`
-	NetworkOperator string    `json:"network_operator,omitempty"`
-	Locale          string    `json:"locale,omitempty"`
-	Province        Province  `json:"province,omitempty"`
-	District        District  `json:"district,omitempty"`
-	CreatedAt       time.Time `json:"created_at"`
-	UpdatedAt       time.Time `json:"-"`
+	Id              int        `json:"id"`
+	Names           string     `json:"names"`
+	MOMONames       *string    `json:"momo_names,omitempty"`
+	Phone           string     `json:"phone"`
+	NetworkOperator string     `json:"network_operator,omitempty"`
+	Locale          string     `json:"locale,omitempty"`
+	Province        Province   `json:"province,omitempty"`
+	District        District   `json:"district,omitempty"`
+	IdNumber        *string    `json:"id_number,omitempty"`
+	SMSOptOut       bool       `json:"sms_opt_out"`
+	SMSOptOutAt     *time.Time `json:"sms_opt_out_at,omitempty"`
+	Status          string     `json:"status,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"-"`
+}
+
+// CustomerPreferenceLog is a change of the sms preference of a customer
+type CustomerPreferenceLog struct {
+	Id        int       `json:"id"`
+	SMSOptOut bool      `json:"sms_opt_out"`
+	Source    string    `json:"source"`
+	Reason    string    `json:"reason"`
+	Operator  *string   `json:"operator"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CodeFraudFlag is a msisdn blocked by the USSD code guard, waiting for or after review
+type CodeFraudFlag struct {
+	Id              int        `json:"id"`
+	CustomerId      *int       `json:"customer_id"`
+	Phone           string     `json:"phone"`
+	Reason          string     `json:"reason"`
+	InvalidAttempts int        `json:"invalid_attempts"`
+	Lockouts        int        `json:"lockouts"`
+	Status          string     `json:"status"`
+	ReviewNote      *string    `json:"review_note"`
+	ReviewedBy      *string    `json:"reviewed_by"`
+	ReviewedAt      *time.Time `json:"reviewed_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// FraudCase is a customer held by the fraud rules, Signals are the rules which matched
+type FraudCase struct {
+	Id         int           `json:"id"`
+	CustomerId int           `json:"customer_id"`
+	EntryId    *int          `json:"entry_id"`
+	Score      int           `json:"score"`
+	Signals    []FraudSignal `json:"signals"`
+	Status     string        `json:"status"`
+	ReviewNote *string       `json:"review_note"`
+	ReviewedBy *string       `json:"reviewed_by"`
+	ReviewedAt *time.Time    `json:"reviewed_at"`
+	CreatedAt  time.Time     `json:"created_at"`
+}
+
+// FraudSignal is a fraud rule matched by the customer, see utils.FraudSignal
+type FraudSignal struct {
+	Rule   string `json:"rule"`
+	Score  int    `json:"score"`
+	Detail string `json:"detail"`
 }
@@ -0,0 +1,40 @@
+package model
+
+import "time"
+
+type PickupLocation struct {
+	Id           int       `json:"id"`
+	District     District  `json:"district"`
+	Name         string    `json:"name"`
+	Address      *string   `json:"address"`
+	ContactPhone *string   `json:"contact_phone"`
+	Status       string    `json:"status"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"-"`
+}
+
+type FulfilmentHistory struct {
+	Id        int       `json:"id"`
+	Status    string    `json:"status"`
+	Note      *string   `json:"note"`
+	Operator  *string   `json:"operator"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Fulfilment struct {
+	Id             int                 `json:"id"`
+	PrizeId        int                 `json:"prize_id"`
+	PrizeType      string              `json:"prize_type"`
+	Code           string              `json:"code"`
+	Customer       Customer            `json:"customer"`
+	Status         string              `json:"status"`
+	PickupLocation *PickupLocation     `json:"pickup_location,omitempty"`
+	PickupDate     *time.Time          `json:"pickup_date"`
+	HasProof       bool                `json:"has_proof"`
+	ClaimedAt      *time.Time          `json:"claimed_at"`
+	VerifiedAt     *time.Time          `json:"verified_at"`
+	DeliveredAt    *time.Time          `json:"delivered_at"`
+	History        []FulfilmentHistory `json:"history,omitempty"`
+	CreatedAt      time.Time           `json:"created_at"`
+	UpdatedAt      time.Time           `json:"updated_at"`
+}
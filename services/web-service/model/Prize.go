@@ -9,9 +9,12 @@ type PrizeCategory struct {
 	CreatedAt time.Time `json:"created_at,omitempty"`
 	UpdatedAt time.Time `json:"-"`
 }
+
+// PrizeMessage is the winner sms template of a prize type in one locale
 type PrizeMessage struct {
 	Lang    string `json:"lang" binding:"required" validate:"required,oneof=en rw"`
-	Message string `json:"message" binding:"required" validate:"required,min=10,max=255"`
+	Message string `json:"message" binding:"required" validate:"required,min=10,max=1000"`
+	Version int    `json:"version,omitempty"`
 }
 type PrizeType struct {
 	Id              int            `json:"id"`
@@ -0,0 +1,19 @@
+package model
+
+import "time"
+
+type PrizeClaim struct {
+	Id            int        `json:"id"`
+	PrizeId       int        `json:"prize_id"`
+	PrizeType     string     `json:"prize_type"`
+	Code          string     `json:"code"`
+	Customer      Customer   `json:"customer"`
+	TransactionId *int       `json:"transaction_id"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	Channel       *string    `json:"channel"`
+	VerifiedBy    *string    `json:"verified_by"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	VerifiedAt    *time.Time `json:"verified_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
@@ -0,0 +1,16 @@
+package model
+
+import "time"
+
+// PrizeExclusion is a phone, national ID or MoMo name which can not win, Value is masked
+type PrizeExclusion struct {
+	Id            int        `json:"id"`
+	ExclusionType string     `json:"exclusion_type"`
+	Value         string     `json:"value"`
+	Reason        string     `json:"reason"`
+	Source        string     `json:"source"`
+	Status        string     `json:"status"`
+	Operator      *string    `json:"operator"`
+	RemovedAt     *time.Time `json:"removed_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
@@ -0,0 +1,34 @@
+package model
+
+import "time"
+
+type Permission struct {
+	Id          int    `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type Role struct {
+	Id               int                `json:"id"`
+	Name             string             `json:"name"`
+	Description      *string            `json:"description"`
+	RequireTwoFactor bool               `json:"require_two_factor"`
+	PasswordPolicy   RolePasswordPolicy `json:"password_policy"`
+	Permissions      []string           `json:"permissions"`
+	Users            int                `json:"users"`
+	Operator         *string            `json:"operator"`
+	CreatedAt        time.Time          `json:"created_at"`
+}
+
+// RolePasswordPolicy is the password policy of a role, a nil value uses the password_policy config
+type RolePasswordPolicy struct {
+	MinLength  *int `json:"min_length" validate:"omitempty,min=8,max=50"`
+	MaxAgeDays *int `json:"max_age_days" validate:"omitempty,min=0,max=3650"` // 0 never expires
+	History    *int `json:"history" validate:"omitempty,min=0,max=24"`
+}
+
+// UserRole is a role assigned to a user
+type UserRole struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
@@ -0,0 +1,48 @@
+package model
+
+import "time"
+
+// SMSCampaignFilters select the customers of a campaign, empty filters match every customer
+type SMSCampaignFilters struct {
+	Provinces           []int    `json:"provinces,omitempty"`
+	Districts           []int    `json:"districts,omitempty"`
+	NetworkOperators    []string `json:"network_operators,omitempty" validate:"omitempty,dive,oneof=MTN AIRTEL"`
+	Locales             []string `json:"locales,omitempty" validate:"omitempty,dive,min=2,max=10"`
+	MinEntries          *int     `json:"min_entries,omitempty" validate:"omitempty,min=0"`
+	MaxEntries          *int     `json:"max_entries,omitempty" validate:"omitempty,min=0"`
+	Winners             string   `json:"winners,omitempty" validate:"omitempty,oneof=won not_won unclaimed"`
+	EntryStartDate      string   `json:"entry_start_date,omitempty"`
+	EntryEndDate        string   `json:"entry_end_date,omitempty"`
+	RegisteredStartDate string   `json:"registered_start_date,omitempty"`
+	RegisteredEndDate   string   `json:"registered_end_date,omitempty"`
+}
+
+type SMSCampaignStats struct {
+	Queued        int     `json:"queued"`
+	Sent          int     `json:"sent"`
+	Delivered     int     `json:"delivered"`
+	Undeliverable int     `json:"undeliverable"`
+	Failed        int     `json:"failed"`
+	Cancelled     int     `json:"cancelled"`
+	Suppressed    int     `json:"suppressed"` // customer opted out after the campaign started
+	Credits       int     `json:"credits"`
+	DeliveryRate  float64 `json:"delivery_rate"`
+}
+
+type SMSCampaign struct {
+	Id             int                `json:"id"`
+	Name           string             `json:"name"`
+	TemplateName   string             `json:"template_name"`
+	Filters        SMSCampaignFilters `json:"filters"`
+	Status         string             `json:"status"`
+	PerMinute      int                `json:"per_minute"`
+	RecipientCount int                `json:"recipient_count"`
+	OptedOutCount  int                `json:"opted_out_count"`
+	ErrorMessage   *string            `json:"error_message"`
+	Stats          SMSCampaignStats   `json:"stats"`
+	Operator       *string            `json:"operator"`
+	ScheduledAt    time.Time          `json:"scheduled_at"`
+	StartedAt      *time.Time         `json:"started_at"`
+	CompletedAt    *time.Time         `json:"completed_at"`
+	CreatedAt      time.Time          `json:"created_at"`
+}
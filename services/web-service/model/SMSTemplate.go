@@ -0,0 +1,15 @@
+package model
+
+import "time"
+
+type SMSTemplate struct {
+	Id        int       `json:"id"`
+	Name      string    `json:"name"`
+	Lang      string    `json:"lang"`
+	Version   int       `json:"version"`
+	Body      string    `json:"body"`
+	Status    string    `json:"status"`
+	Segments  int       `json:"segments"`
+	Operator  *string   `json:"operator"`
+	CreatedAt time.Time `json:"created_at"`
+}
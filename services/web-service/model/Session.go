@@ -0,0 +1,14 @@
+package model
+
+import "time"
+
+// Session is an active login of a user
+type Session struct {
+	Id          string    `json:"id"`
+	IPAddress   string    `json:"ip_address"`
+	UserAgent   string    `json:"user_agent"`
+	CreatedAt   time.Time `json:"created_at"`
+	RefreshedAt time.Time `json:"refreshed_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Current     bool      `json:"current"`
+}
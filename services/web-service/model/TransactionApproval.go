@@ -0,0 +1,21 @@
+package model
+
+import "time"
+
+type TransactionApproval struct {
+	Id            int       `json:"id"`
+	TransactionId int       `json:"transaction_id"`
+	UserId        int       `json:"user_id"`
+	Names         string    `json:"names"`
+	Department    string    `json:"department"`
+	IPAddress     string    `json:"ip_address"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type PendingApproval struct {
+	Transactions
+	RequiredApprovals int                   `json:"required_approvals"`
+	FinanceOnly       bool                  `json:"finance_only"`
+	CanApprove        bool                  `json:"can_approve"`
+	Approvals         []TransactionApproval `json:"approvals"`
+}
@@ -19,6 +19,9 @@ type Transactions struct {
 	Charges         int       `json:"charges"`
 	Status          string    `json:"status"`
 	PrizeType       string    `json:"prize_type"`
+	SettlementType  *string   `json:"settlement_type"`
+	SettlementRef   *string   `json:"settlement_reference"`
+	ReversalTrxId   *string   `json:"reversal_trx_id"`
 	CreatedAt       time.Time `json:"created_at"`
 	UpdatedAt       time.Time `json:"updated_at"`
 }
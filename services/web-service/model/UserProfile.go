@@ -1,6 +1,9 @@
 package model
 
-import "time"
+import (
+	"slices"
+	"time"
+)
 
 type UserProfile struct {
 	Id                  int        `json:"id"`
@@ -9,15 +12,25 @@ type UserProfile struct {
 	Lname               string     `json:"lastname"`
 	Phone               string     `json:"phone"`
 	Department          Department `json:"department"`
-	CanAddCodes         bool       `json:"can_add_codes"`
-	CanTriggerDraw      bool       `json:"can_trigger_draw"`
-	CanAddUser          bool       `json:"can_add_user"`
-	CanViewLogs         bool       `json:"can_view_logs"`
+	Roles               []UserRole `json:"roles"`
+	Permissions         []string   `json:"permissions,omitempty"`
 	EmailVerified       bool       `json:"email_verified"`
 	PhoneVerified       bool       `json:"phone_verified"`
 	ForceChangePassword bool       `json:"force_change_password"`
+	PasswordExpiresAt   *time.Time `json:"password_expires_at"`
 	AvatarUrl           string     `json:"avatar_url"`
 	Status              string     `json:"status"`
 	CreatedAt           time.Time  `json:"created_at"`
 	AccessToken         string     `json:"-"`
+	SessionId           string     `json:"-"`
+}
+
+// HasPermission tell if one of the roles of the user grants the permission
+func (u *UserProfile) HasPermission(permission string) bool {
+	return slices.Contains(u.Permissions, permission)
+}
+
+// MustChangePassword tell if the user has to change its password before anything else, forced or expired
+func (u *UserProfile) MustChangePassword() bool {
+	return u.ForceChangePassword || (u.PasswordExpiresAt != nil && time.Now().After(*u.PasswordExpiresAt))
 }
@@ -9,8 +9,12 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/recover"
 	html "github.com/gofiber/template/html/v2"
+	"github.com/spf13/viper"
 )
 
+// largest request body, the codes upload is checked against CodeImportMaxFileSize instead
+const bodyLimit = 100 * 1024 * 1024
+
 func InitRoutes() *fiber.App {
 
 	// v1 := r.Group("/api/v1/")
@@ -22,11 +26,22 @@ func InitRoutes() *fiber.App {
 		JSONEncoder:  json.Marshal,
 		JSONDecoder:  json.Unmarshal,
 		Views:        engine,
-		ReadTimeout:  time.Minute * 20,  // Increase read timeout (e.g., 5 minutes)
-		WriteTimeout: time.Minute * 20,  // Increase write timeout (e.g., 5 minutes)
-		BodyLimit:    100 * 1024 * 1024, // 50 MB limit
+		ReadTimeout:  time.Minute * 20, // Increase read timeout (e.g., 5 minutes)
+		WriteTimeout: time.Minute * 20, // Increase write timeout (e.g., 5 minutes)
+		BodyLimit:    bodyLimit,
+		//bodies past the BodyLimit are streamed instead of refused, LimitBody only lets them through on the codes upload
+		//where the multipart file is spilled to disk instead of being held in memory
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+		//behind a reverse proxy c.IP() (login guard ip limit, activity logs) is read from proxy.header,
+		//only when the request comes from one of proxy.trusted so clients can not pick their ip
+		ProxyHeader:             viper.GetString("proxy.header"),
+		EnableTrustedProxyCheck: true,
+		TrustedProxies:          viper.GetStringSlice("proxy.trusted"),
+		EnableIPValidation:      true,
 	})
 	app.Use(recover.New())
+	app.Use(controller.LimitBody(bodyLimit, "/api/v1/upload_codes"))
 	// app.Use(logger.New())
 	app.Use(cors.New())
 	app.Use(cors.New(cors.Config{
@@ -37,56 +52,136 @@ func InitRoutes() *fiber.App {
 	}))
 
 	v1 := app.Group("/api/v1/")
+	//public routes
 	v1.All("/service-status", func(c *fiber.Ctx) error {
 		return c.JSON(fiber.Map{"status": 200, "message": "This API service is running!"})
 	})
 	v1.Get("/", controller.Index)
 	v1.Post("/login", controller.LoginWithEmail)
-	v1.Get("/profile", controller.GetUserProfile)
-
-	v1.Get("/prize_categories", controller.GetPrizeCategory)
-	v1.Get("/prize_type/:prize_category?", controller.GetPrizeType)
-	v1.Get("/prizes", controller.GetPrizeType)
-	v1.Post("/prize_category", controller.CreatePrizeCategory)
-	v1.Post("/prize_type", controller.CreatePrizeType)
-	v1.Post("/user", controller.AddUser)
-	v1.Post("/user/:userId", controller.EditUser)
-	v1.Get("/users", controller.GetUsers)
-	v1.Get("/entries", controller.GetEntries)
-	v1.Get("/draws", controller.GetDraws)
-	v1.Get("/prize_distributions", controller.GetPrizes)
-	v1.Get("/customer/:customerId", controller.GetCustomer)
-	v1.Get("/entry/:entryId", controller.GetEntryData)
-	v1.Get("/customer_entry_history/:customerId", controller.GetUserProfile)
-	v1.Post("/upload_codes", controller.UploadCodes)
-	v1.Post("/change_password", controller.ChangePassword)
+	v1.Post("/refresh", controller.RefreshSession)
+	v1.Post("/login/2fa", controller.VerifyLoginTwoFactor)
+	v1.Post("/login/2fa/enroll", controller.EnrollLoginTwoFactor)
+	v1.Post("/login/2fa/sms", controller.SendLoginTwoFactorSMS)
 	v1.Post("/forgot_password", controller.ForgotPassword)
 	v1.Post("/set_password", controller.SetNewPassword)
 	v1.Post("/validate_otp", controller.ValidateOTP)
 	v1.Post("/verify_otp", controller.ValidateOTP)
 	v1.Get("/avatar/svg/:type/:avatar_number", controller.GetSVGAvatar)
-	v1.Get("/draws", controller.GetDraws)
-	v1.Post("/draw", controller.StartPrizeDraw)
+	//delivery reports and inbound messages are authenticated by the sms provider tokens
+	v1.Get("/sms/dlr", controller.SMSDeliveryReport)
+	v1.Post("/sms/dlr", controller.SMSDeliveryReport)
+	v1.Get("/sms/mo", controller.SMSInbound)
+	v1.Post("/sms/mo", controller.SMSInbound)
+
+	//public routes are registered above, every route below needs a valid session
+	v1.Use(controller.Authenticate)
+	v1.Get("/profile", controller.GetUserProfile)
+	v1.Post("/logout", controller.Logout)
+	v1.Post("/logout/all", controller.LogoutEverywhere)
+	v1.Get("/sessions", controller.GetSessions)
+	v1.Post("/session/:session_id/revoke", controller.RevokeSession)
+	v1.Post("/change_password", controller.ChangePassword)
+	v1.Get("/password_policy", controller.GetPasswordPolicy)
+	//a user who must change its password can only use the routes above
+	v1.Use(controller.RequirePasswordChange)
+	v1.Get("/2fa", controller.GetTwoFactor)
+	v1.Post("/2fa/enroll", controller.EnrollTwoFactor)
+	v1.Post("/2fa/enable", controller.EnableTwoFactor)
+	v1.Post("/2fa/disable", controller.RequireStepUp, controller.DisableTwoFactor)
+	v1.Post("/2fa/recovery-codes", controller.RequireStepUp, controller.RegenerateRecoveryCodes)
+	//sensitive actions need a recent re-authentication, see controller.RequireStepUp
+	v1.Post("/step-up", controller.StepUp)
+	v1.Post("/step-up/sms", controller.SendStepUpSMS)
+
+	v1.Get("/prize_categories", controller.RequirePermission("prizes.view"), controller.GetPrizeCategory)
+	v1.Get("/prize_type/:prize_category?", controller.RequirePermission("prizes.view"), controller.GetPrizeType)
+	v1.Get("/prizes", controller.RequirePermission("prizes.view"), controller.GetPrizeType)
+	v1.Post("/prize_category", controller.RequirePermission("prizes.manage"), controller.CreatePrizeCategory)
+	v1.Post("/prize_type", controller.RequirePermission("prizes.manage"), controller.CreatePrizeType)
+	v1.Post("/user", controller.RequirePermission("users.manage"), controller.AddUser)
+	v1.Post("/user/:userId", controller.RequirePermission("users.manage"), controller.EditUser)
+	v1.Post("/user/:userId/sessions/revoke", controller.RequirePermission("users.manage"), controller.RevokeUserSessions)
+	v1.Get("/user/:userId/lockout", controller.RequirePermission("users.view"), controller.GetUserLockout)
+	v1.Post("/user/:userId/unlock", controller.RequirePermission("users.manage"), controller.UnlockUser)
+	v1.Post("/user/:userId/2fa/reset", controller.RequirePermission("users.manage"), controller.RequireStepUp, controller.ResetUserTwoFactor)
+	v1.Get("/users", controller.RequirePermission("users.view"), controller.GetUsers)
+	v1.Get("/entries", controller.RequirePermission("entries.view"), controller.GetEntries)
+	v1.Get("/draws", controller.RequirePermission("draws.view"), controller.GetDraws)
+	v1.Get("/prize_distributions", controller.RequirePermission("draws.view"), controller.GetPrizes)
+	v1.Get("/customer/:customerId", controller.RequirePermission("customers.view"), controller.GetCustomer)
+	v1.Get("/customer/:customerId/preferences", controller.RequirePermission("customers.view"), controller.GetCustomerPreferences)
+	v1.Post("/customer/:customerId/preferences", controller.RequirePermission("customers.manage"), controller.UpdateCustomerPreferences)
+	v1.Get("/entry/:entryId", controller.RequirePermission("customers.view"), controller.GetEntryData)
+	v1.Get("/customer_entry_history/:customerId", controller.RequirePermission("customers.view"), controller.GetUserProfile)
+	v1.Post("/upload_codes", controller.RequirePermission("codes.add"), controller.RequireStepUp, controller.UploadCodes)
+	v1.Get("/code-batches", controller.RequirePermission("codes.view"), controller.GetCodeBatches)
+	v1.Post("/code-batch/:batch_id/status", controller.RequirePermission("codes.manage"), controller.ChangeCodeBatchStatus)
+	v1.Get("/code-import/:job_id", controller.RequirePermission("codes.view"), controller.GetCodeImportJob)
+	v1.Get("/code-import/:job_id/errors", controller.RequirePermission("codes.view"), controller.GetCodeImportErrors)
+	v1.Post("/code-import/:job_id/resume", controller.RequirePermission("codes.add"), controller.ResumeCodeImportJob)
+	v1.Get("/code-fraud-flags", controller.RequirePermission("fraud.view"), controller.GetCodeFraudFlags)
+	v1.Post("/code-fraud-flag/:flag_id/review", controller.RequirePermission("fraud.review"), controller.ReviewCodeFraudFlag)
+	v1.Get("/fraud-cases", controller.RequirePermission("fraud.view"), controller.GetFraudCases)
+	v1.Post("/fraud-case/:case_id/review", controller.RequirePermission("fraud.review"), controller.ReviewFraudCase)
+	v1.Get("/prize-exclusions", controller.RequirePermission("exclusions.view"), controller.GetPrizeExclusions)
+	v1.Post("/prize-exclusion", controller.RequirePermission("exclusions.manage"), controller.AddPrizeExclusion)
+	v1.Post("/prize-exclusion/import", controller.RequirePermission("exclusions.manage"), controller.ImportPrizeExclusions)
+	v1.Get("/permissions", controller.RequirePermission("roles.view"), controller.GetPermissions)
+	v1.Get("/roles", controller.RequirePermission("roles.view"), controller.GetRoles)
+	v1.Post("/role", controller.RequirePermission("roles.manage"), controller.RequireStepUp, controller.SaveRole)
+	v1.Post("/role/:role_id/delete", controller.RequirePermission("roles.manage"), controller.RequireStepUp, controller.DeleteRole)
+	v1.Post("/prize-exclusion/:exclusion_id/remove", controller.RequirePermission("exclusions.manage"), controller.RemovePrizeExclusion)
+	v1.Post("/code-generation", controller.RequirePermission("codes.generate"), controller.GenerateCodes)
+	v1.Get("/code-generation/:job_id", controller.RequirePermission("codes.view"), controller.GetCodeGenerationJob)
+	v1.Get("/code-generation/:job_id/export", controller.RequirePermission("codes.export"), controller.DownloadCodeExport)
+	v1.Get("/draws", controller.RequirePermission("draws.view"), controller.GetDraws)
+	v1.Post("/draw", controller.RequirePermission("draws.trigger"), controller.RequireStepUp, controller.StartPrizeDraw)
 	v1.Get("/distribution-type", controller.GetDistributionType)
 	v1.Get("/departments", controller.GetDepartments)
-	v1.Get("/sms_sent", controller.GetSMSSent)
-	v1.Get("/prize_overview", controller.GetPrizeOverview)
-	v1.Get("/code-overview", controller.GetCodeOverview)
-	v1.Get("/logs", controller.GetLogs)
-	v1.Get("/sms_balance", controller.GetSMSBalance)
-	v1.Post("/user_status/:userId", controller.ChangeUserStatus)
+	v1.Get("/sms_sent", controller.RequirePermission("sms.view"), controller.GetSMSSent)
+	v1.Get("/emails", controller.RequirePermission("emails.view"), controller.GetEmails)
+	v1.Post("/email/:email_id/resend", controller.RequirePermission("emails.manage"), controller.ResendEmail)
+	v1.Get("/prize_overview", controller.RequirePermission("reports.view"), controller.GetPrizeOverview)
+	v1.Get("/code-overview", controller.RequirePermission("reports.view"), controller.GetCodeOverview)
+	v1.Get("/logs", controller.RequirePermission("logs.view"), controller.GetLogs)
+	v1.Get("/sms_balance", controller.RequirePermission("sms.view"), controller.GetSMSBalance)
+	v1.Post("/user_status/:userId", controller.RequirePermission("users.manage"), controller.ChangeUserStatus)
 	v1.Get("/provinces", controller.GetProvinces)
-	v1.Get("/transactions", controller.GetTransactions)
-	v1.Get("/prize_type_space/:type_id", controller.GetPrizeTypeSpace)
-	v1.Post("/confirm-trx/:transaction_id", controller.ConfirmTransaction)
-	v1.Post("/confirm-bulk-trx", controller.ConfirmBulkTransaction)
-	v1.Post("/resend-bulk-trx", controller.ResendBulkTransaction)
-	v1.Post("/resend-trx/:transaction_id", controller.ResendTransaction)
-	v1.Get("/test-sms/:mno/:phone", controller.TestSMS)
-	v1.Get("/player-metrics", controller.PlayerMetrics)
-	v1.Get("/winner-metrics", controller.WinnerMetrics)
+	v1.Get("/transactions", controller.RequirePermission("transactions.view"), controller.GetTransactions)
+	v1.Get("/prize_type_space/:type_id", controller.RequirePermission("prizes.view"), controller.GetPrizeTypeSpace)
+	v1.Post("/confirm-trx/:transaction_id", controller.RequirePermission("transactions.confirm"), controller.RequireStepUp, controller.ConfirmTransaction)
+	v1.Post("/confirm-bulk-trx", controller.RequirePermission("transactions.confirm"), controller.RequireStepUp, controller.ConfirmBulkTransaction)
+	v1.Get("/pending-approvals", controller.RequirePermission("transactions.view"), controller.GetPendingApprovals)
+	v1.Post("/settle-trx/:transaction_id", controller.RequirePermission("transactions.settle"), controller.RequireStepUp, controller.SettleTransaction)
+	v1.Post("/reverse-trx/:transaction_id", controller.RequirePermission("transactions.settle"), controller.RequireStepUp, controller.ReverseTransaction)
+	v1.Get("/settlement-evidence/:settlement_id", controller.RequirePermission("transactions.view"), controller.GetSettlementEvidence)
+	v1.Get("/fulfilments", controller.RequirePermission("fulfilments.view"), controller.GetFulfilments)
+	v1.Get("/fulfilment/:fulfilment_id", controller.RequirePermission("fulfilments.view"), controller.GetFulfilment)
+	v1.Post("/fulfilment/:fulfilment_id/claim", controller.RequirePermission("fulfilments.manage"), controller.ClaimFulfilment)
+	v1.Post("/fulfilment/:fulfilment_id/verify-id", controller.RequirePermission("fulfilments.manage"), controller.VerifyFulfilmentId)
+	v1.Post("/fulfilment/:fulfilment_id/schedule", controller.RequirePermission("fulfilments.manage"), controller.ScheduleFulfilmentPickup)
+	v1.Post("/fulfilment/:fulfilment_id/deliver", controller.RequirePermission("fulfilments.manage"), controller.DeliverFulfilment)
+	v1.Get("/fulfilment/:fulfilment_id/proof", controller.RequirePermission("fulfilments.view"), controller.GetFulfilmentProof)
+	v1.Get("/pickup-locations", controller.RequirePermission("fulfilments.view"), controller.GetPickupLocations)
+	v1.Post("/pickup-location", controller.RequirePermission("fulfilments.manage"), controller.SavePickupLocation)
+	v1.Get("/prize-claims", controller.RequirePermission("fulfilments.view"), controller.GetPrizeClaims)
+	v1.Post("/prize-claim/:claim_id/verify", controller.RequirePermission("fulfilments.manage"), controller.VerifyPrizeClaim)
+	v1.Post("/prize-claim/:claim_id/resend", controller.RequirePermission("fulfilments.manage"), controller.ResendPrizeClaim)
+	v1.Post("/resend-bulk-trx", controller.RequirePermission("transactions.resend"), controller.RequireStepUp, controller.ResendBulkTransaction)
+	v1.Post("/resend-trx/:transaction_id", controller.RequirePermission("transactions.resend"), controller.RequireStepUp, controller.ResendTransaction)
+	v1.Get("/sms-templates", controller.RequirePermission("sms.view"), controller.GetSMSTemplates)
+	v1.Post("/sms-template", controller.RequirePermission("sms.manage"), controller.SaveSMSTemplate)
+	v1.Post("/sms-template/preview", controller.RequirePermission("sms.manage"), controller.PreviewSMSTemplate)
+	v1.Post("/sms-template/:template_id/activate", controller.RequirePermission("sms.manage"), controller.ActivateSMSTemplate)
+	v1.Get("/sms-campaigns", controller.RequirePermission("sms.view"), controller.GetSMSCampaigns)
+	v1.Post("/sms-campaign", controller.RequirePermission("sms.manage"), controller.CreateSMSCampaign)
+	v1.Post("/sms-campaign/dry-run", controller.RequirePermission("sms.manage"), controller.SMSCampaignDryRun)
+	v1.Post("/sms-campaign/:campaign_id/cancel", controller.RequirePermission("sms.manage"), controller.CancelSMSCampaign)
+	v1.Get("/test-sms/:mno/:phone", controller.RequirePermission("sms.manage"), controller.TestSMS)
+	v1.Get("/player-metrics", controller.RequirePermission("reports.view"), controller.PlayerMetrics)
+	v1.Get("/winner-metrics", controller.RequirePermission("reports.view"), controller.WinnerMetrics)
 
-	v2 := app.Group("/api/v2/")
-	v2.Get("/prize_overview", controller.GetPrizeOverviewV2)
+	v2 := app.Group("/api/v2/", controller.Authenticate, controller.RequirePasswordChange)
+	v2.Get("/prize_overview", controller.RequirePermission("reports.view"), controller.GetPrizeOverviewV2)
 	return app
 }
@@ -0,0 +1,73 @@
+package routes
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// publicRoutes can be called without a session, every other route must be rejected by the authentication middleware
+var publicRoutes = map[string]bool{
+	"/api/v1/service-status":                  true,
+	"/api/v1/":                                true,
+	"/api/v1/login":                           true,
+	"/api/v1/refresh":                         true,
+	"/api/v1/login/2fa":                       true,
+	"/api/v1/login/2fa/enroll":                true,
+	"/api/v1/login/2fa/sms":                   true,
+	"/api/v1/forgot_password":                 true,
+	"/api/v1/set_password":                    true,
+	"/api/v1/validate_otp":                    true,
+	"/api/v1/verify_otp":                      true,
+	"/api/v1/avatar/svg/:type/:avatar_number": true,
+	"/api/v1/sms/dlr":                         true,
+	"/api/v1/sms/mo":                          true,
+}
+
+var routeParams = regexp.MustCompile(`:\w+\??`)
+
+func TestRoutesAreProtected(t *testing.T) {
+	app := InitRoutes()
+	// Initialize the assert object
+	a := assert.New(t)
+	registered := map[string]bool{}
+	for _, route := range app.GetRoutes(true) {
+		registered[route.Path] = true
+		if publicRoutes[route.Path] {
+			continue
+		}
+		//no Authorization header, the request must stop at the authentication middleware
+		req := httptest.NewRequest(route.Method, routeParams.ReplaceAllString(route.Path, "1"), nil)
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("%s %s: %s", route.Method, route.Path, err.Error())
+		}
+		a.Equal(fiber.StatusUnauthorized, resp.StatusCode, "%s %s is neither public nor protected", route.Method, route.Path)
+	}
+	for path := range publicRoutes {
+		a.True(registered[path], "public route %s is not registered", path)
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	app := InitRoutes()
+	a := assert.New(t)
+	send := func(path string, length int64) int {
+		req := httptest.NewRequest(fiber.MethodPost, path, strings.NewReader("{}"))
+		req.ContentLength = length
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("%s: %s", path, err.Error())
+		}
+		return resp.StatusCode
+	}
+	var oversized int64 = bodyLimit + 1
+	a.Equal(fiber.StatusRequestEntityTooLarge, send("/api/v1/login", oversized))
+	a.Equal(fiber.StatusRequestEntityTooLarge, send("/api/v1/sms/mo", oversized))
+	//only the codes upload takes large bodies, it still needs a session
+	a.Equal(fiber.StatusUnauthorized, send("/api/v1/upload_codes", oversized))
+}